@@ -0,0 +1,577 @@
+package bisonbotkit
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/companyzero/bisonrelay/clientrpc/types"
+	"github.com/companyzero/bisonrelay/zkidentity"
+	"github.com/decred/dcrd/dcrutil/v4"
+	"github.com/decred/slog"
+	"github.com/vctt94/bisonbotkit/utils"
+)
+
+var (
+	// ErrInsufficientFunds is returned when a change would make the
+	// balance of a user negative.
+	ErrInsufficientFunds = errors.New("insufficient funds")
+
+	// ErrLiabilityCap is returned when a change would make the total
+	// owed to users exceed the maximum house liability.
+	ErrLiabilityCap = errors.New("maximum house liability reached")
+)
+
+// AccountTxKind is the kind of an account transaction.
+type AccountTxKind string
+
+const (
+	// AccountDeposit is a tip received from the user.
+	AccountDeposit AccountTxKind = "deposit"
+
+	// AccountWithdrawal is a tip sent to the user from their balance.
+	AccountWithdrawal AccountTxKind = "withdrawal"
+
+	// AccountReversal gives back the amount of a failed withdrawal, or
+	// deposits a tip whose refund failed.
+	AccountReversal AccountTxKind = "reversal"
+
+	// AccountGame is a change made by the bot's logic through Apply.
+	AccountGame AccountTxKind = "game"
+)
+
+// AccountsConfig configures the custodial accounts of a bot.
+type AccountsConfig struct {
+	// MaxLiability is the maximum total the bot may owe to users,
+	// counting balances and withdrawals in progress. Deposits that would
+	// exceed it are refunded and credits are refused with
+	// ErrLiabilityCap. Zero disables the cap.
+	MaxLiability dcrutil.Amount
+
+	// MinWithdrawal and MaxWithdrawal bound the amount of a withdrawal.
+	// A zero MaxWithdrawal disables the upper bound.
+	MinWithdrawal dcrutil.Amount
+	MaxWithdrawal dcrutil.Amount
+
+	// TipAttempts is the number of attempts of withdrawal and refund
+	// tips. It defaults to 3.
+	TipAttempts int32
+
+	Log slog.Logger
+}
+
+// AccountChange is a change to the balance of a user applied with Apply.
+// Negative amounts debit the user.
+type AccountChange struct {
+	UID    zkidentity.ShortID
+	Amount dcrutil.Amount
+}
+
+// AccountTx is a change to the balance of a user.
+type AccountTx struct {
+	ID   uint64        `json:"id"`
+	Time time.Time     `json:"time"`
+	UID  string        `json:"uid"`
+	Kind AccountTxKind `json:"kind"`
+
+	// Amount is the change to the balance, negative for debits, and
+	// Balance the balance after the change.
+	Amount  dcrutil.Amount `json:"amount"`
+	Balance dcrutil.Amount `json:"balance"`
+	Memo    string         `json:"memo,omitempty"`
+}
+
+// accountWithdrawal is a withdrawal, or the refund of a deposit, whose tip is
+// in progress.
+type accountWithdrawal struct {
+	UID       string         `json:"uid"`
+	Amount    dcrutil.Amount `json:"amount"`
+	PaymentID uint64         `json:"paymentid"`
+
+	// Refund is set for the refunds of deposits above the liability cap,
+	// which are not debited from a balance.
+	Refund bool `json:"refund,omitempty"`
+}
+
+// accountsState is the persisted state of the accounts.
+type accountsState struct {
+	NextTxID    uint64                    `json:"nexttxid"`
+	Balances    map[string]dcrutil.Amount `json:"balances"`
+	Withdrawals []*accountWithdrawal      `json:"withdrawals,omitempty"`
+	Txs         []*AccountTx              `json:"txs,omitempty"`
+
+	// DepositSeqs are the sequence IDs of the tips deposited, used to
+	// skip tips delivered again after a restart.
+	DepositSeqs appliedSeqs `json:"depositseqs"`
+}
+
+// Accounts holds custodial balances of users: tips received by the bot are
+// deposited in the balance of their sender, the bot's logic debits and
+// credits balances with Apply, and users withdraw their balance with the
+// withdraw command. It is enabled with Bot.SetAccounts.
+type Accounts struct {
+	cfg  AccountsConfig
+	log  slog.Logger
+	bot  *Bot
+	path string
+
+	mtx   sync.Mutex
+	state accountsState
+}
+
+// SetAccounts enables custodial accounts, stored in accounts.json inside the
+// data dir. Received tips not used to pay an invoice are deposited in the
+// balance of their sender and are not sent to TipReceivedChan. It must be
+// called before Run.
+func (b *Bot) SetAccounts(cfg AccountsConfig) (*Accounts, error) {
+	if cfg.MaxWithdrawal > 0 && cfg.MaxWithdrawal < cfg.MinWithdrawal {
+		return nil, errors.New("maximum withdrawal is lower than the minimum")
+	}
+	if cfg.TipAttempts <= 0 {
+		cfg.TipAttempts = defaultJobTipAttempts
+	}
+	log := cfg.Log
+	if log == nil {
+		log = slog.Disabled
+	}
+	a := &Accounts{
+		cfg:   cfg,
+		log:   log,
+		bot:   b,
+		path:  filepath.Join(b.cfg.DataDir, "accounts.json"),
+		state: accountsState{NextTxID: 1},
+	}
+	data, err := os.ReadFile(a.path)
+	switch {
+	case os.IsNotExist(err):
+	case err != nil:
+		return nil, err
+	default:
+		if err := json.Unmarshal(data, &a.state); err != nil {
+			return nil, fmt.Errorf("invalid accounts file: %w", err)
+		}
+	}
+	if a.state.Balances == nil {
+		a.state.Balances = make(map[string]dcrutil.Amount)
+	}
+	b.accounts = a
+	return a, nil
+}
+
+// Accounts returns the custodial accounts of the bot, if enabled.
+func (b *Bot) Accounts() *Accounts {
+	return b.accounts
+}
+
+// save writes the accounts to disk. It must be called with the mutex held.
+func (a *Accounts) save() error {
+	data, err := json.MarshalIndent(&a.state, "", "  ")
+	if err != nil {
+		return err
+	}
+	return utils.AtomicWriteFile(a.path, data, 0600)
+}
+
+// liability returns the total owed to users. It must be called with the
+// mutex held.
+func (a *Accounts) liability() dcrutil.Amount {
+	var total dcrutil.Amount
+	for _, bal := range a.state.Balances {
+		total += bal
+	}
+	for _, w := range a.state.Withdrawals {
+		if !w.Refund {
+			total += w.Amount
+		}
+	}
+	return total
+}
+
+// apply applies the changes atomically, recording a transaction for each
+// one. If saving fails, the changes are undone. It must be called with the
+// mutex held.
+func (a *Accounts) apply(kind AccountTxKind, memo string, changes []AccountChange) error {
+	var delta dcrutil.Amount
+	balances := make(map[string]dcrutil.Amount, len(changes))
+	for _, c := range changes {
+		uid := c.UID.String()
+		bal, ok := balances[uid]
+		if !ok {
+			bal = a.state.Balances[uid]
+		}
+		balances[uid] = bal + c.Amount
+		delta += c.Amount
+	}
+	for _, bal := range balances {
+		if bal < 0 {
+			return ErrInsufficientFunds
+		}
+	}
+	// Reversals give back amounts that were already owed, so they are not
+	// subject to the cap.
+	if delta > 0 && kind != AccountReversal && a.cfg.MaxLiability > 0 &&
+		a.liability()+delta > a.cfg.MaxLiability {
+		return ErrLiabilityCap
+	}
+
+	old := make(map[string]dcrutil.Amount, len(balances))
+	for uid := range balances {
+		old[uid] = a.state.Balances[uid]
+	}
+	nextID, nTxs := a.state.NextTxID, len(a.state.Txs)
+	now := time.Now()
+	running := make(map[string]dcrutil.Amount, len(old))
+	for uid, bal := range old {
+		running[uid] = bal
+	}
+	for _, c := range changes {
+		uid := c.UID.String()
+		running[uid] += c.Amount
+		a.state.Txs = append(a.state.Txs, &AccountTx{
+			ID:      a.state.NextTxID,
+			Time:    now,
+			UID:     uid,
+			Kind:    kind,
+			Amount:  c.Amount,
+			Balance: running[uid],
+			Memo:    memo,
+		})
+		a.state.NextTxID++
+	}
+	for uid, bal := range balances {
+		a.state.Balances[uid] = bal
+	}
+	if err := a.save(); err != nil {
+		for uid, bal := range old {
+			a.state.Balances[uid] = bal
+		}
+		a.state.NextTxID, a.state.Txs = nextID, a.state.Txs[:nTxs]
+		return err
+	}
+	return nil
+}
+
+// Apply atomically applies the changes to the balances of users: either
+// every change is applied or none is. It fails with ErrInsufficientFunds if
+// a balance would become negative and with ErrLiabilityCap if the changes
+// credit more than the house may owe.
+func (a *Accounts) Apply(memo string, changes ...AccountChange) error {
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+	return a.apply(AccountGame, memo, changes)
+}
+
+// Credit adds amt to the balance of the user.
+func (a *Accounts) Credit(uid zkidentity.ShortID, amt dcrutil.Amount, memo string) error {
+	return a.Apply(memo, AccountChange{UID: uid, Amount: amt})
+}
+
+// Debit removes amt from the balance of the user.
+func (a *Accounts) Debit(uid zkidentity.ShortID, amt dcrutil.Amount, memo string) error {
+	return a.Apply(memo, AccountChange{UID: uid, Amount: -amt})
+}
+
+// Balance returns the balance of the user.
+func (a *Accounts) Balance(uid zkidentity.ShortID) dcrutil.Amount {
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+	return a.state.Balances[uid.String()]
+}
+
+// Liability returns the total owed to users, counting balances and
+// withdrawals in progress.
+func (a *Accounts) Liability() dcrutil.Amount {
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+	return a.liability()
+}
+
+// History returns the most recent transactions of the user, oldest first. A
+// limit of zero returns all of them.
+func (a *Accounts) History(uid zkidentity.ShortID, limit int) []AccountTx {
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+	var res []AccountTx
+	id := uid.String()
+	for _, tx := range a.state.Txs {
+		if tx.UID == id {
+			res = append(res, *tx)
+		}
+	}
+	if limit > 0 && len(res) > limit {
+		res = res[len(res)-limit:]
+	}
+	return res
+}
+
+// deposit credits a received tip to the balance of its sender, refunding it
+// if the house cannot take more liability. It returns an error if the tip
+// could not be recorded, so it is delivered again.
+func (a *Accounts) deposit(ctx context.Context, tip *types.ReceivedTip) error {
+	var uid zkidentity.ShortID
+	if err := uid.FromBytes(tip.Uid); err != nil {
+		a.log.Warnf("Invalid tip sender %x: %v", tip.Uid, err)
+		return nil
+	}
+	amt := dcrutil.Amount(tip.AmountMatoms / 1000)
+
+	a.mtx.Lock()
+	if a.state.DepositSeqs.has(tip.SequenceId) {
+		a.mtx.Unlock()
+		return nil
+	}
+	oldSeqs := a.state.DepositSeqs
+	a.state.DepositSeqs = oldSeqs.add(tip.SequenceId)
+	memo := fmt.Sprintf("tip %d", tip.SequenceId)
+	err := a.apply(AccountDeposit, memo, []AccountChange{{UID: uid, Amount: amt}})
+	if err != nil {
+		a.state.DepositSeqs = oldSeqs
+		a.mtx.Unlock()
+		if errors.Is(err, ErrLiabilityCap) {
+			return a.refundDeposit(ctx, uid, amt, tip.SequenceId)
+		}
+		return fmt.Errorf("unable to deposit tip from %s: %w", uid, err)
+	}
+	bal := a.state.Balances[uid.String()]
+	a.mtx.Unlock()
+
+	a.log.Infof("Deposit of %s from %s", amt, uid)
+	a.bot.QueuePM(ctx, uid.String(), fmt.Sprintf("Deposited %s. Your balance is %s.", amt, bal))
+	return nil
+}
+
+// refundDeposit tips back a deposit above the liability cap. The tip is
+// recorded along with the sequence ID of the deposit before it is requested,
+// and its amount is deposited regardless of the cap if it fails.
+func (a *Accounts) refundDeposit(ctx context.Context, uid zkidentity.ShortID, amt dcrutil.Amount, seq uint64) error {
+	payment, err := a.bot.reserveTip(uid, amt, a.cfg.TipAttempts)
+	if err != nil {
+		return fmt.Errorf("unable to refund deposit of %s to %s: %w", amt, uid, err)
+	}
+
+	a.mtx.Lock()
+	w := &accountWithdrawal{UID: uid.String(), Amount: amt, PaymentID: payment.ID(), Refund: true}
+	oldSeqs, oldWithdrawals := a.state.DepositSeqs, a.state.Withdrawals
+	a.state.DepositSeqs = oldSeqs.add(seq)
+	a.state.Withdrawals = append(oldWithdrawals[:len(oldWithdrawals):len(oldWithdrawals)], w)
+	if err := a.save(); err != nil {
+		a.state.DepositSeqs, a.state.Withdrawals = oldSeqs, oldWithdrawals
+		a.mtx.Unlock()
+		a.bot.tipFailed(payment.ID(), err)
+		return fmt.Errorf("unable to save refund of deposit: %w", err)
+	}
+	a.mtx.Unlock()
+
+	a.log.Warnf("Refunding deposit of %s from %s: %v", amt, uid, ErrLiabilityCap)
+	a.bot.QueuePM(ctx, uid.String(), fmt.Sprintf("The bot cannot take "+
+		"deposits right now, your tip of %s is being refunded.", amt))
+	go a.watch(ctx, w, payment)
+	if err := a.bot.sendTip(ctx, payment); err != nil {
+		a.log.Warnf("Refund of %s to %s may not have been sent: %v", amt, uid, err)
+	}
+	return nil
+}
+
+// Withdraw sends amt from the balance of the user to them. The amount is
+// debited right away, along with the tip payment, and given back only once
+// the tip progress reports that the tip failed. If the tip request fails,
+// the payment is returned with the error: the tip may have been sent, so the
+// withdrawal stays in progress until a progress event resolves it.
+func (a *Accounts) Withdraw(ctx context.Context, uid zkidentity.ShortID, amt dcrutil.Amount) (*TipPayment, error) {
+	switch {
+	case amt <= 0:
+		return nil, UserErrorf("Withdrawal amount must be greater than zero.")
+	case amt < a.cfg.MinWithdrawal:
+		return nil, UserErrorf("The minimum withdrawal is %s.", a.cfg.MinWithdrawal)
+	case a.cfg.MaxWithdrawal > 0 && amt > a.cfg.MaxWithdrawal:
+		return nil, UserErrorf("The maximum withdrawal is %s.", a.cfg.MaxWithdrawal)
+	}
+	if a.Balance(uid) < amt {
+		return nil, ErrInsufficientFunds
+	}
+
+	payment, err := a.bot.reserveTip(uid, amt, a.cfg.TipAttempts)
+	if err != nil {
+		return nil, err
+	}
+	a.mtx.Lock()
+	w := &accountWithdrawal{UID: uid.String(), Amount: amt, PaymentID: payment.ID()}
+	old := a.state.Withdrawals
+	a.state.Withdrawals = append(old[:len(old):len(old)], w)
+	err = a.apply(AccountWithdrawal, "withdrawal", []AccountChange{{UID: uid, Amount: -amt}})
+	if err != nil {
+		a.state.Withdrawals = old
+		a.mtx.Unlock()
+		a.bot.tipFailed(payment.ID(), err)
+		return nil, err
+	}
+	a.mtx.Unlock()
+
+	go a.watch(ctx, w, payment)
+	if err := a.bot.sendTip(ctx, payment); err != nil {
+		a.log.Warnf("Withdrawal of %s to %s may not have been sent: %v", amt, uid, err)
+		return payment, err
+	}
+	return payment, nil
+}
+
+// reverse removes a withdrawal, giving back its amount if it failed. The
+// withdrawal is kept if the change cannot be saved. It must be called with
+// the mutex held.
+func (a *Accounts) reverse(w *accountWithdrawal, failure string) error {
+	idx := -1
+	for i, pw := range a.state.Withdrawals {
+		if pw == w {
+			idx = i
+			break
+		}
+	}
+	if idx < 0 {
+		return nil
+	}
+	old := a.state.Withdrawals
+	a.state.Withdrawals = append(old[:idx:idx], old[idx+1:]...)
+	var err error
+	if failure == "" {
+		err = a.save()
+	} else {
+		var uid zkidentity.ShortID
+		if err = uid.FromString(w.UID); err == nil {
+			memo := "failed withdrawal: " + failure
+			if w.Refund {
+				memo = "failed refund: " + failure
+			}
+			err = a.apply(AccountReversal, memo, []AccountChange{{UID: uid, Amount: w.Amount}})
+		}
+	}
+	if err != nil {
+		a.state.Withdrawals = old
+	}
+	return err
+}
+
+// watch waits for the tip of a withdrawal or refund, giving back its amount
+// if the tip fails.
+func (a *Accounts) watch(ctx context.Context, w *accountWithdrawal, payment *TipPayment) {
+	select {
+	case <-payment.Done():
+	case <-ctx.Done():
+		return
+	}
+	rec := payment.Status()
+	a.mtx.Lock()
+	failure := ""
+	if rec.Status == TipFailed {
+		failure = rec.Error
+		if failure == "" {
+			failure = "tip failed"
+		}
+	}
+	err := a.reverse(w, failure)
+	bal := a.state.Balances[w.UID]
+	a.mtx.Unlock()
+
+	what := "withdrawal"
+	if w.Refund {
+		what = "refund"
+	}
+	if err != nil {
+		// Kept in progress, so it is resolved again after a restart.
+		a.log.Errorf("Unable to record the outcome of the %s of %s to %s: %v",
+			what, w.Amount, w.UID, err)
+		return
+	}
+	switch {
+	case failure != "" && w.Refund:
+		a.log.Warnf("Refund of %s to %s failed: %s", w.Amount, w.UID, failure)
+		a.bot.QueuePM(ctx, w.UID, fmt.Sprintf("The refund of your tip of %s failed (%s). "+
+			"It was deposited in your balance, which is now %s.", w.Amount, failure, bal))
+	case failure != "":
+		a.log.Warnf("Withdrawal of %s to %s failed: %s", w.Amount, w.UID, failure)
+		a.bot.QueuePM(ctx, w.UID, fmt.Sprintf("Your withdrawal of %s failed (%s). "+
+			"The amount was returned to your balance, which is now %s.", w.Amount, failure, bal))
+	case w.Refund:
+		a.log.Infof("Refund of %s to %s completed", w.Amount, w.UID)
+	default:
+		a.log.Infof("Withdrawal of %s to %s completed", w.Amount, w.UID)
+		a.bot.QueuePM(ctx, w.UID, fmt.Sprintf("Your withdrawal of %s was sent.", w.Amount))
+	}
+}
+
+// run resumes watching the withdrawals and refunds in progress when the bot
+// starts, including those whose tip request had an unknown outcome.
+func (a *Accounts) run(ctx context.Context) error {
+	a.mtx.Lock()
+	withdrawals := append([]*accountWithdrawal(nil), a.state.Withdrawals...)
+	a.mtx.Unlock()
+	for _, w := range withdrawals {
+		if w.PaymentID == 0 {
+			// Recorded by an older version that requested the tip
+			// after debiting it, and stopped before the tip was
+			// requested.
+			a.mtx.Lock()
+			if err := a.reverse(w, "interrupted by a restart"); err != nil {
+				a.log.Errorf("Unable to give back withdrawal of %s to %s: %v",
+					w.Amount, w.UID, err)
+			}
+			a.mtx.Unlock()
+			continue
+		}
+		payment, ok := a.bot.TipPayment(w.PaymentID)
+		if !ok {
+			// The payment was dropped after being resolved long
+			// ago, so its outcome is no longer known.
+			a.log.Errorf("Tip %d of %s to %s not found, dropping it", w.PaymentID,
+				w.Amount, w.UID)
+			a.mtx.Lock()
+			if err := a.reverse(w, ""); err != nil {
+				a.log.Errorf("Unable to save withdrawals: %v", err)
+			}
+			a.mtx.Unlock()
+			continue
+		}
+		go a.watch(ctx, w, payment)
+	}
+	return nil
+}
+
+// RegisterCommands registers the balance and withdraw commands in the
+// router.
+func (a *Accounts) RegisterCommands(r *Router) error {
+	err := r.Register(Command{
+		Name:  "balance",
+		Help:  "Shows your balance",
+		Scope: ScopePM,
+		Handler: func(ctx context.Context, mc *MsgContext) error {
+			return mc.Replyf(ctx, "Your balance is %s.", a.Balance(mc.UID))
+		},
+	})
+	if err != nil {
+		return err
+	}
+	return r.Register(Command{
+		Name:  "withdraw",
+		Args:  []ArgSpec{{Name: "amount", Type: ArgAmount}},
+		Help:  "Sends the amount from your balance to you",
+		Scope: ScopePM,
+		Handler: func(ctx context.Context, mc *MsgContext) error {
+			amt := mc.Amount("amount")
+			payment, err := a.Withdraw(ctx, mc.UID, amt)
+			switch {
+			case errors.Is(err, ErrInsufficientFunds):
+				return mc.Replyf(ctx, "Your balance of %s is not enough.", a.Balance(mc.UID))
+			case err != nil && payment != nil:
+				return mc.Replyf(ctx, "Your withdrawal of %s is being processed, "+
+					"you will be told once it completes.", amt)
+			case err != nil:
+				return err
+			}
+			return mc.Replyf(ctx, "Sending %s to you...", amt)
+		},
+	})
+}
@@ -0,0 +1,276 @@
+package bisonbotkit
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/decred/dcrd/dcrutil/v4"
+)
+
+func newTestAccounts(t *testing.T, b *Bot, maxLiability dcrutil.Amount) *Accounts {
+	t.Helper()
+	a, err := b.SetAccounts(AccountsConfig{MaxLiability: maxLiability})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return a
+}
+
+func TestAccountsDeposit(t *testing.T) {
+	ctx := context.Background()
+	alice := testUID(1)
+	dir := t.TempDir()
+	b := newTestBot(t, dir, &fakePayments{})
+	a := newTestAccounts(t, b, 0)
+
+	tests := []struct {
+		name    string
+		seq     uint64
+		amt     dcrutil.Amount
+		wantBal dcrutil.Amount
+	}{
+		{"first", 3, 100, 100},
+		{"duplicate", 3, 100, 100},
+		{"older", 2, 100, 200},
+		{"older again", 2, 100, 200},
+		{"newer", 4, 50, 250},
+	}
+	for _, tc := range tests {
+		if err := a.deposit(ctx, testTip(alice, tc.seq, tc.amt)); err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		if bal := a.Balance(alice); bal != tc.wantBal {
+			t.Fatalf("%s: got balance %s, want %s", tc.name, bal, tc.wantBal)
+		}
+	}
+
+	// Balances and the last deposit survive a restart.
+	b = newTestBot(t, dir, &fakePayments{})
+	a = newTestAccounts(t, b, 0)
+	if err := a.deposit(ctx, testTip(alice, 4, 50)); err != nil {
+		t.Fatal(err)
+	}
+	if bal := a.Balance(alice); bal != 250 {
+		t.Fatalf("got balance %s after restart, want 250 atoms", bal)
+	}
+	if n := len(a.History(alice, 0)); n != 3 {
+		t.Fatalf("got %d transactions, want 3", n)
+	}
+
+	// Deposits that cannot be saved fail, and are applied once delivered
+	// again, even after a later deposit and a restart.
+	restore := breakSaves(t, a.path)
+	if err := a.deposit(ctx, testTip(alice, 5, 10)); err == nil {
+		t.Fatal("deposit did not fail")
+	}
+	if bal := a.Balance(alice); bal != 250 || a.state.DepositSeqs.has(5) {
+		t.Fatalf("failed deposit applied: %s", bal)
+	}
+	restore()
+	if err := a.deposit(ctx, testTip(alice, 6, 20)); err != nil {
+		t.Fatal(err)
+	}
+	b = newTestBot(t, dir, &fakePayments{})
+	a = newTestAccounts(t, b, 0)
+	for _, seq := range []uint64{5, 5, 6} {
+		if err := a.deposit(ctx, testTip(alice, seq, 10)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if bal := a.Balance(alice); bal != 280 {
+		t.Fatalf("got balance %s, want 280 atoms", bal)
+	}
+
+	// Tips without a sequence ID are always deposited.
+	for i := 0; i < 2; i++ {
+		if err := a.deposit(ctx, testTip(alice, 0, 10)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if bal := a.Balance(alice); bal != 300 || !a.state.DepositSeqs.has(6) {
+		t.Fatalf("got balance %s, want 300 atoms", bal)
+	}
+}
+
+func TestAccountsDepositRefund(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	alice := testUID(1)
+
+	tests := []struct {
+		name string
+
+		// breakPayments makes recording the refund tip fail, and
+		// completed is the outcome reported by the progress stream.
+		breakPayments bool
+		completed     bool
+
+		wantErr bool
+		wantBal dcrutil.Amount
+	}{
+		{name: "refunded", completed: true},
+		{name: "refund failed", wantBal: 100},
+		{name: "refund not recorded", breakPayments: true, wantErr: true},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			payments := &fakePayments{}
+			b := newTestBot(t, t.TempDir(), payments)
+			a := newTestAccounts(t, b, 50)
+			if tc.breakPayments {
+				defer breakSaves(t, b.tipPayments.path)()
+			}
+			err := a.deposit(ctx, testTip(alice, 1, 100))
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("unexpected error %v", err)
+			}
+			if tc.wantErr {
+				// Delivered again later, so the tip is not
+				// marked as deposited.
+				if a.state.DepositSeqs.has(1) || len(a.state.Withdrawals) != 0 {
+					t.Fatalf("failed refund recorded: %+v", a.state)
+				}
+				return
+			}
+			if !a.state.DepositSeqs.has(1) || payments.count() != 1 {
+				t.Fatalf("refund not requested: %d tips", payments.count())
+			}
+			if l := a.Liability(); l != 0 {
+				t.Fatalf("refund counted as liability: %s", l)
+			}
+			resolveTip(t, b, 1, alice, 100, tc.completed)
+			waitFor(t, "refund", func() bool {
+				a.mtx.Lock()
+				defer a.mtx.Unlock()
+				return len(a.state.Withdrawals) == 0
+			})
+			if bal := a.Balance(alice); bal != tc.wantBal {
+				t.Fatalf("got balance %s, want %s", bal, tc.wantBal)
+			}
+		})
+	}
+}
+
+func TestAccountsWithdraw(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	alice := testUID(1)
+
+	tests := []struct {
+		name string
+
+		// tipErr makes requesting the tip fail and completed is the
+		// outcome reported by the progress stream.
+		tipErr    error
+		completed bool
+
+		wantBal dcrutil.Amount
+	}{
+		{name: "completed", completed: true, wantBal: 60},
+		{name: "failed", wantBal: 100},
+		{name: "unknown then completed", tipErr: errors.New("conn lost"), completed: true, wantBal: 60},
+		{name: "unknown then failed", tipErr: errors.New("conn lost"), wantBal: 100},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			payments := &fakePayments{err: tc.tipErr}
+			b := newTestBot(t, t.TempDir(), payments)
+			a := newTestAccounts(t, b, 0)
+			if err := a.Credit(alice, 100, "test"); err != nil {
+				t.Fatal(err)
+			}
+
+			payment, err := a.Withdraw(ctx, alice, 40)
+			if !errors.Is(err, tc.tipErr) || payment == nil {
+				t.Fatalf("got payment %v and error %v", payment, err)
+			}
+			// Debited until the outcome of the tip is known, even
+			// if the request failed.
+			if bal := a.Balance(alice); bal != 60 {
+				t.Fatalf("got balance %s, want 60 atoms", bal)
+			}
+			if l := a.Liability(); l != 100 {
+				t.Fatalf("got liability %s, want 100 atoms", l)
+			}
+			if w := a.state.Withdrawals; len(w) != 1 || w[0].PaymentID != payment.ID() {
+				t.Fatalf("withdrawal not recorded with its payment: %+v", w)
+			}
+
+			resolveTip(t, b, 1, alice, 40, tc.completed)
+			waitFor(t, "withdrawal", func() bool {
+				a.mtx.Lock()
+				defer a.mtx.Unlock()
+				return len(a.state.Withdrawals) == 0
+			})
+			if bal := a.Balance(alice); bal != tc.wantBal {
+				t.Fatalf("got balance %s, want %s", bal, tc.wantBal)
+			}
+		})
+	}
+}
+
+func TestAccountsWithdrawErrors(t *testing.T) {
+	ctx := context.Background()
+	alice := testUID(1)
+	payments := &fakePayments{}
+	b := newTestBot(t, t.TempDir(), payments)
+	a := newTestAccounts(t, b, 0)
+	if err := a.Credit(alice, 100, "test"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := a.Withdraw(ctx, alice, 200); !errors.Is(err, ErrInsufficientFunds) {
+		t.Fatalf("got error %v, want %v", err, ErrInsufficientFunds)
+	}
+
+	// A withdrawal that cannot be saved is not sent.
+	restore := breakSaves(t, a.path)
+	if _, err := a.Withdraw(ctx, alice, 40); err == nil {
+		t.Fatal("Withdraw did not fail")
+	}
+	restore()
+	if bal := a.Balance(alice); bal != 100 || len(a.state.Withdrawals) != 0 {
+		t.Fatalf("failed withdrawal applied: %s, %+v", bal, a.state.Withdrawals)
+	}
+	if n := payments.count(); n != 0 {
+		t.Fatalf("got %d tips, want 0", n)
+	}
+	if n := len(b.PendingTipPayments()); n != 0 {
+		t.Fatalf("got %d pending tip payments, want 0", n)
+	}
+}
+
+func TestAccountsWithdrawRestart(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	alice := testUID(1)
+	dir := t.TempDir()
+	b := newTestBot(t, dir, &fakePayments{err: errors.New("conn lost")})
+	a := newTestAccounts(t, b, 0)
+	if err := a.Credit(alice, 100, "test"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := a.Withdraw(ctx, alice, 40); err == nil {
+		t.Fatal("Withdraw did not fail")
+	}
+
+	// The withdrawal is resumed after a restart and given back once its
+	// tip fails.
+	b = newTestBot(t, dir, &fakePayments{})
+	a = newTestAccounts(t, b, 0)
+	if err := a.run(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if bal := a.Balance(alice); bal != 60 {
+		t.Fatalf("got balance %s after restart, want 60 atoms", bal)
+	}
+	resolveTip(t, b, 1, alice, 40, false)
+	waitFor(t, "withdrawal", func() bool {
+		return a.Balance(alice) == 100
+	})
+	txs := a.History(alice, 0)
+	if last := txs[len(txs)-1]; last.Kind != AccountReversal || last.Amount != 40 {
+		t.Fatalf("unexpected last transaction %+v", last)
+	}
+}
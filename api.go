@@ -32,7 +32,13 @@ func (b *Bot) SendFile(ctx context.Context, uid, filename string) error {
 	return b.chatService.SendFile(ctx, &sfr, &types.SendFileResponse{})
 }
 
+// SendPM sends a PM to nick through the outbound queue, waiting until it is
+// sent. See QueuePM.
 func (b *Bot) SendPM(ctx context.Context, nick, msg string) error {
+	return b.QueuePM(ctx, nick, msg).Wait(ctx)
+}
+
+func (b *Bot) sendPM(ctx context.Context, nick, msg string) error {
 	req := &types.PMRequest{
 		User: nick,
 		Msg: &types.RMPrivateMessage{
@@ -43,7 +49,13 @@ func (b *Bot) SendPM(ctx context.Context, nick, msg string) error {
 	return b.chatService.PM(ctx, req, &res)
 }
 
+// SendGC sends a message to the GC through the outbound queue, waiting until
+// it is sent. See QueueGC.
 func (b *Bot) SendGC(ctx context.Context, gc, msg string) error {
+	return b.QueueGC(ctx, gc, msg).Wait(ctx)
+}
+
+func (b *Bot) sendGC(ctx context.Context, gc, msg string) error {
 	req := &types.GCMRequest{
 		Gc:  gc,
 		Msg: msg,
@@ -60,14 +72,83 @@ func (b *Bot) SubscribeToUserPosts(ctx context.Context, user zkidentity.ShortID)
 	return b.postService.SubscribeToPosts(ctx, &req, &rep)
 }
 
-func (b *Bot) PayTip(ctx context.Context, uid zkidentity.ShortID, tipAmt dcrutil.Amount, maxAttempts int32) error {
+// PayTip requests a tip to be sent to the user. The payment happens in the
+// background; the returned TipPayment resolves once the tip progress stream
+// reports it completed or failed. Pending payments are persisted, so their
+// outcome is tracked across restarts. When a ledger is attached, the tip is
+// also recorded in it.
+//
+// If the request fails after the payment was recorded, both the payment and
+// the error are returned: the tip may have been sent anyway, so the payment
+// is left in TipUnknown until a progress event resolves it.
+//
+// Progress events do not identify the tip they refer to, so they are matched
+// to payments by user and amount: the bot must be the only sender of tips on
+// its brclient, otherwise tips sent by other clients may resolve its
+// payments.
+func (b *Bot) PayTip(ctx context.Context, uid zkidentity.ShortID, tipAmt dcrutil.Amount, maxAttempts int32) (*TipPayment, error) {
+	payment, err := b.reserveTip(uid, tipAmt, maxAttempts)
+	if err != nil {
+		return nil, err
+	}
+	return payment, b.sendTip(ctx, payment)
+}
+
+// reserveTip records a pending tip payment (and its ledger entry) without
+// requesting it, so callers can persist the payment ID before the tip may be
+// sent. The tip is then requested with sendTip, or discarded with tipFailed.
+func (b *Bot) reserveTip(uid zkidentity.ShortID, tipAmt dcrutil.Amount, maxAttempts int32) (*TipPayment, error) {
+	var entryID uint64
+	if b.ledger != nil {
+		var err error
+		if entryID, err = b.ledger.recordSend(uid, tipAmt); err != nil {
+			return nil, fmt.Errorf("unable to record tip in ledger: %w", err)
+		}
+	}
+	payment, err := b.tipPayments.add(uid, tipAmt, maxAttempts, entryID)
+	if err != nil {
+		return nil, fmt.Errorf("unable to record tip payment: %w", err)
+	}
+	return payment, nil
+}
+
+// sendTip requests a tip reserved with reserveTip. If the request fails, the
+// payment is left in TipUnknown.
+func (b *Bot) sendTip(ctx context.Context, payment *TipPayment) error {
+	rec := payment.Status()
 	var rep types.TipUserResponse
 	req := types.TipUserRequest{
-		User:        uid.String(),
-		DcrAmount:   tipAmt.ToCoin(),
-		MaxAttempts: maxAttempts,
+		User:        rec.UID,
+		DcrAmount:   rec.Amount().ToCoin(),
+		MaxAttempts: rec.MaxAttempts,
+	}
+	err := b.paymentService.TipUser(ctx, &req, &rep)
+	if err != nil {
+		b.setTipStatus(payment.ID(), TipUnknown, err)
+		return err
+	}
+	return nil
+}
+
+// tipFailed records a reserved tip payment that will not be requested as
+// failed.
+func (b *Bot) tipFailed(id uint64, err error) {
+	b.setTipStatus(id, TipFailed, err)
+}
+
+// setTipStatus sets the status of a tip payment whose request did not go
+// through, in the payments table and the ledger.
+func (b *Bot) setTipStatus(id uint64, status TipStatus, err error) {
+	rec, serr := b.tipPayments.setStatus(id, status, err)
+	if serr != nil {
+		b.tipProgressLog.Errorf("Unable to record %s tip: %v", status, serr)
+		return
+	}
+	if b.ledger != nil && rec.LedgerID != 0 {
+		if err := b.ledger.updateSend(rec); err != nil {
+			b.tipProgressLog.Errorf("Unable to record %s tip in ledger: %v", status, err)
+		}
 	}
-	return b.paymentService.TipUser(ctx, &req, &rep)
 }
 
 func (b *Bot) MediateKX(ctx context.Context, mediator, target string) error {
@@ -79,19 +160,25 @@ func (b *Bot) MediateKX(ctx context.Context, mediator, target string) error {
 	return b.chatService.MediateKX(ctx, &mreq, &mres)
 }
 
+// AcceptGCInvite accepts the GC invite with the given decimal ID.
+//
+// Deprecated: use AcceptGCInviteByID.
 func (b *Bot) AcceptGCInvite(ctx context.Context, id string) error {
 	i, err := strconv.ParseUint(id, 10, 64)
 	if err != nil {
 		return err
 	}
-	var res types.AcceptGCInviteResponse
-	req := types.AcceptGCInviteRequest{
-		InviteId: i,
-	}
-	return b.gcService.AcceptGCInvite(ctx, &req, &res)
+	return b.AcceptGCInviteByID(ctx, i)
 }
 
+// InviteToGC invites the user (ID or nick) to the GC. When a moderator is
+// attached, users banned from the GC are refused with ErrBannedFromGC.
 func (b *Bot) InviteToGC(ctx context.Context, gc, id string) error {
+	if b.moderator != nil {
+		if err := b.moderator.checkInvite(ctx, gc, id); err != nil {
+			return err
+		}
+	}
 	var irep types.InviteToGCResponse
 	ireq := types.InviteToGCRequest{
 		Gc:   gc,
@@ -127,26 +214,60 @@ func (b *Bot) UserPublicIdentity(ctx context.Context, req *types.PublicIdentityR
 	return b.chatService.UserPublicIdentity(ctx, req, resp)
 }
 
+// AckTipProgress acknowledges the tip progress event sequenceId. The kit
+// acks the events itself once they are applied to the tip payments, so
+// calling it is only needed for events the kit could not record.
 func (b *Bot) AckTipProgress(ctx context.Context, sequenceId uint64) error {
-	var ackReq types.AckRequest
-	var ackRes types.AckResponse
-
-	ackReq.SequenceId = sequenceId
-	err := b.paymentService.AckTipProgress(ctx, &ackReq, &ackRes)
+	err := b.ack(ctx, StreamTipProgress, sequenceId)
 	if err != nil {
 		b.tipProgressLog.Errorf("Failed to acknowledge tip: %v", err)
 	}
 	return err
 }
 
+// AckTipReceived acknowledges the received tip sequenceId. See AckStream.
 func (b *Bot) AckTipReceived(ctx context.Context, sequenceId uint64) error {
-	var ackReq types.AckRequest
-	var ackRes types.AckResponse
-
-	ackReq.SequenceId = sequenceId
-	err := b.paymentService.AckTipReceived(ctx, &ackReq, &ackRes)
+	err := b.ack(ctx, StreamTipReceived, sequenceId)
 	if err != nil {
 		b.tipReceivedLog.Errorf("Failed to acknowledge tip: %v", err)
 	}
 	return err
 }
+
+// AckPM acknowledges the PM sequenceId. It only needs to be called for PMs
+// read from PMChan when the bot runs in manual ack mode. See AckStream.
+func (b *Bot) AckPM(ctx context.Context, sequenceId uint64) error {
+	return b.ack(ctx, StreamPM, sequenceId)
+}
+
+// AckGCM acknowledges the GC message sequenceId. It only needs to be called
+// for messages read from GCChan when the bot runs in manual ack mode. See
+// AckStream.
+func (b *Bot) AckGCM(ctx context.Context, sequenceId uint64) error {
+	return b.ack(ctx, StreamGCM, sequenceId)
+}
+
+// AckGCInvite acknowledges the GC invite sequenceId. It only needs to be
+// called when the bot runs in manual ack mode. See AckStream.
+func (b *Bot) AckGCInvite(ctx context.Context, sequenceId uint64) error {
+	return b.ack(ctx, StreamGCInvites, sequenceId)
+}
+
+// AckKX acknowledges the completed KX sequenceId. It only needs to be called
+// when the bot runs in manual ack mode. See AckStream.
+func (b *Bot) AckKX(ctx context.Context, sequenceId uint64) error {
+	return b.ack(ctx, StreamKX, sequenceId)
+}
+
+// AckPost acknowledges the received post sequenceId. It only needs to be
+// called when the bot runs in manual ack mode. See AckStream.
+func (b *Bot) AckPost(ctx context.Context, sequenceId uint64) error {
+	return b.ack(ctx, StreamPosts, sequenceId)
+}
+
+// AckPostStatus acknowledges the received post status update sequenceId. It
+// only needs to be called when the bot runs in manual ack mode. See
+// AckStream.
+func (b *Bot) AckPostStatus(ctx context.Context, sequenceId uint64) error {
+	return b.ack(ctx, StreamPostStatus, sequenceId)
+}
@@ -0,0 +1,208 @@
+// Package args parses the arguments of bot commands. The errors returned by
+// its functions are meant to be shown to the user as is.
+package args
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/companyzero/bisonrelay/zkidentity"
+	"github.com/decred/dcrd/dcrutil/v4"
+)
+
+// Token is a token of a command line. Start and End are the offsets of the
+// token in the original text, including any quotes.
+type Token struct {
+	Value string
+	Start int
+	End   int
+}
+
+// Tokenize splits s into whitespace separated tokens. Tokens that start with
+// a double or single quote extend to the matching closing quote, which
+// allows arguments with spaces. Inside double quotes, a backslash escapes the
+// next character. Quotes in the middle of a word, as in "don't", and quotes
+// that are never closed are kept as regular characters.
+func Tokenize(s string) []Token {
+	var tokens []Token
+	i := 0
+	for i < len(s) {
+		r := rune(s[i])
+		if unicode.IsSpace(r) {
+			i++
+			continue
+		}
+		start := i
+		if r == '"' || r == '\'' {
+			if value, end, ok := quoted(s, i); ok {
+				tokens = append(tokens, Token{Value: value, Start: start, End: end})
+				i = end
+				continue
+			}
+		}
+		for i < len(s) && !unicode.IsSpace(rune(s[i])) {
+			i++
+		}
+		tokens = append(tokens, Token{Value: s[start:i], Start: start, End: i})
+	}
+	return tokens
+}
+
+// quoted parses the quoted string that starts at s[i]. The closing quote must
+// be followed by a space or the end of s.
+func quoted(s string, i int) (string, int, bool) {
+	q := s[i]
+	var b strings.Builder
+	for j := i + 1; j < len(s); j++ {
+		c := s[j]
+		switch {
+		case c == '\\' && q == '"' && j+1 < len(s):
+			j++
+			b.WriteByte(s[j])
+		case c == q:
+			if j+1 < len(s) && !unicode.IsSpace(rune(s[j+1])) {
+				return "", 0, false
+			}
+			return b.String(), j + 1, true
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return "", 0, false
+}
+
+// Amount parses a positive DCR amount. Amounts are in DCR unless they end
+// with the "atoms" unit, as in "0.1", "0.1dcr", "0.1 DCR" or "1000atoms".
+func Amount(s string) (dcrutil.Amount, error) {
+	s = strings.ToLower(strings.TrimSpace(s))
+	isAtoms := false
+	switch {
+	case strings.HasSuffix(s, "atoms"):
+		s, isAtoms = strings.TrimSuffix(s, "atoms"), true
+	case strings.HasSuffix(s, "atom"):
+		s, isAtoms = strings.TrimSuffix(s, "atom"), true
+	case strings.HasSuffix(s, "dcr"):
+		s = strings.TrimSuffix(s, "dcr")
+	}
+	s = strings.TrimSpace(s)
+
+	var atoms int64
+	if isAtoms {
+		v, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			return 0, fmt.Errorf("%q is not a whole number of atoms", s)
+		}
+		atoms = v
+	} else {
+		v, err := parseDecimal(s, 8)
+		if err != nil {
+			return 0, err
+		}
+		atoms = v
+	}
+	if atoms <= 0 {
+		return 0, errors.New("amount must be greater than zero")
+	}
+	if atoms > dcrutil.MaxAmount {
+		return 0, errors.New("amount is too large")
+	}
+	return dcrutil.Amount(atoms), nil
+}
+
+// parseDecimal parses a non-negative decimal number with up to decimals
+// fractional digits into an integer scaled by 10^decimals, avoiding the
+// rounding of floats.
+func parseDecimal(s string, decimals int) (int64, error) {
+	invalid := fmt.Errorf("%q is not a valid amount", s)
+	whole, frac, _ := strings.Cut(s, ".")
+	if whole == "" && frac == "" {
+		return 0, invalid
+	}
+	if len(frac) > decimals {
+		return 0, fmt.Errorf("amounts can have at most %d decimal places", decimals)
+	}
+	for _, c := range whole + frac {
+		if c < '0' || c > '9' {
+			return 0, invalid
+		}
+	}
+	frac += strings.Repeat("0", decimals-len(frac))
+	var w int64
+	if whole != "" {
+		var err error
+		w, err = strconv.ParseInt(whole, 10, 64)
+		if err != nil || w > math.MaxInt64/int64(math.Pow10(decimals)) {
+			return 0, errors.New("amount is too large")
+		}
+	}
+	f, _ := strconv.ParseInt(frac, 10, 64)
+	return w*int64(math.Pow10(decimals)) + f, nil
+}
+
+// Duration parses a positive duration. Besides the units of
+// time.ParseDuration, it accepts "d" for days and "w" for weeks, as in
+// "1d12h" or "2w".
+func Duration(s string) (time.Duration, error) {
+	s = strings.ToLower(strings.TrimSpace(s))
+	var total time.Duration
+	rest := s
+	for _, unit := range []struct {
+		suffix string
+		d      time.Duration
+	}{{"w", 7 * 24 * time.Hour}, {"d", 24 * time.Hour}} {
+		i := strings.Index(rest, unit.suffix)
+		if i < 0 {
+			continue
+		}
+		n, err := strconv.Atoi(rest[:i])
+		if err != nil || n < 0 {
+			return 0, fmt.Errorf("%q is not a valid duration", s)
+		}
+		total += time.Duration(n) * unit.d
+		rest = rest[i+1:]
+	}
+	if rest != "" {
+		d, err := time.ParseDuration(rest)
+		if err != nil {
+			return 0, fmt.Errorf("%q is not a valid duration (use for example 30s, 10m, 2h or 1d)", s)
+		}
+		total += d
+	}
+	if total <= 0 {
+		return 0, errors.New("duration must be greater than zero")
+	}
+	return total, nil
+}
+
+// Enum returns the option that matches s, ignoring case.
+func Enum(s string, options []string) (string, error) {
+	for _, opt := range options {
+		if strings.EqualFold(opt, s) {
+			return opt, nil
+		}
+	}
+	return "", fmt.Errorf("%q is not one of %s", s, strings.Join(options, ", "))
+}
+
+// Int parses an integer.
+func Int(s string) (int64, error) {
+	v, err := strconv.ParseInt(strings.TrimSpace(s), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("%q is not a whole number", s)
+	}
+	return v, nil
+}
+
+// ShortID parses a hex encoded user ID.
+func ShortID(s string) (zkidentity.ShortID, error) {
+	var id zkidentity.ShortID
+	if err := id.FromString(strings.TrimSpace(s)); err != nil {
+		return id, fmt.Errorf("%q is not a valid user ID", s)
+	}
+	return id, nil
+}
@@ -0,0 +1,169 @@
+package args
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/decred/dcrd/dcrutil/v4"
+)
+
+func TestTokenize(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		want []Token
+	}{{
+		name: "empty",
+		in:   "   ",
+	}, {
+		name: "words",
+		in:   "  tip  bob 1 ",
+		want: []Token{{"tip", 2, 5}, {"bob", 7, 10}, {"1", 11, 12}},
+	}, {
+		name: "double quotes",
+		in:   `say "hello world" now`,
+		want: []Token{{"say", 0, 3}, {"hello world", 4, 17}, {"now", 18, 21}},
+	}, {
+		name: "single quotes",
+		in:   `say 'a "b" c'`,
+		want: []Token{{"say", 0, 3}, {`a "b" c`, 4, 13}},
+	}, {
+		name: "escape in double quotes",
+		in:   `"a \"b\" \\c"`,
+		want: []Token{{`a "b" \c`, 0, 13}},
+	}, {
+		name: "no escape in single quotes",
+		in:   `'a\b'`,
+		want: []Token{{`a\b`, 0, 5}},
+	}, {
+		name: "quote in word",
+		in:   "don't stop",
+		want: []Token{{"don't", 0, 5}, {"stop", 6, 10}},
+	}, {
+		name: "unclosed quote",
+		in:   `"open ended`,
+		want: []Token{{`"open`, 0, 5}, {"ended", 6, 11}},
+	}, {
+		name: "closing quote inside word",
+		in:   `"a"b c`,
+		want: []Token{{`"a"b`, 0, 4}, {"c", 5, 6}},
+	}, {
+		name: "empty quotes",
+		in:   `x "" y`,
+		want: []Token{{"x", 0, 1}, {"", 2, 4}, {"y", 5, 6}},
+	}}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			got := Tokenize(tc.in)
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Fatalf("got %+v, want %+v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestAmount(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    dcrutil.Amount
+		wantErr bool
+	}{
+		{in: "1", want: 1e8},
+		{in: "0.1", want: 1e7},
+		{in: ".5", want: 5e7},
+		{in: "2.", want: 2e8},
+		{in: "0.1dcr", want: 1e7},
+		{in: " 0.1 DCR ", want: 1e7},
+		{in: "0.00000001", want: 1},
+		{in: "1000atoms", want: 1000},
+		{in: "1 atom", want: 1},
+		{in: "21000000", want: 21e14},
+		{in: "0.000000001", wantErr: true},
+		{in: "0", wantErr: true},
+		{in: "0atoms", wantErr: true},
+		{in: "-1", wantErr: true},
+		{in: "1e3", wantErr: true},
+		{in: "1.5atoms", wantErr: true},
+		{in: ".", wantErr: true},
+		{in: "", wantErr: true},
+		{in: "21000001", wantErr: true},
+		{in: "99999999999999999999", wantErr: true},
+	}
+	for _, tc := range tests {
+		got, err := Amount(tc.in)
+		if (err != nil) != tc.wantErr {
+			t.Errorf("Amount(%q): unexpected error %v", tc.in, err)
+			continue
+		}
+		if got != tc.want {
+			t.Errorf("Amount(%q) = %d, want %d", tc.in, got, tc.want)
+		}
+	}
+}
+
+func TestDuration(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    time.Duration
+		wantErr bool
+	}{
+		{in: "30s", want: 30 * time.Second},
+		{in: "1h30m", want: 90 * time.Minute},
+		{in: "1d", want: 24 * time.Hour},
+		{in: "1d12h", want: 36 * time.Hour},
+		{in: "2w", want: 14 * 24 * time.Hour},
+		{in: "1w1d1h", want: 8*24*time.Hour + time.Hour},
+		{in: " 2D ", want: 48 * time.Hour},
+		{in: "0s", wantErr: true},
+		{in: "-1h", wantErr: true},
+		{in: "xd", wantErr: true},
+		{in: "5", wantErr: true},
+		{in: "", wantErr: true},
+	}
+	for _, tc := range tests {
+		got, err := Duration(tc.in)
+		if (err != nil) != tc.wantErr {
+			t.Errorf("Duration(%q): unexpected error %v", tc.in, err)
+			continue
+		}
+		if got != tc.want {
+			t.Errorf("Duration(%q) = %s, want %s", tc.in, got, tc.want)
+		}
+	}
+}
+
+func TestEnumInt(t *testing.T) {
+	opts := []string{"odd", "Even"}
+	enums := []struct {
+		in, want string
+		wantErr  bool
+	}{
+		{in: "odd", want: "odd"},
+		{in: "EVEN", want: "Even"},
+		{in: "none", wantErr: true},
+	}
+	for _, tc := range enums {
+		got, err := Enum(tc.in, opts)
+		if (err != nil) != tc.wantErr || got != tc.want {
+			t.Errorf("Enum(%q) = %q, %v, want %q", tc.in, got, err, tc.want)
+		}
+	}
+
+	ints := []struct {
+		in      string
+		want    int64
+		wantErr bool
+	}{
+		{in: "42", want: 42},
+		{in: " -7 ", want: -7},
+		{in: "1.5", wantErr: true},
+		{in: "abc", wantErr: true},
+	}
+	for _, tc := range ints {
+		got, err := Int(tc.in)
+		if (err != nil) != tc.wantErr || got != tc.want {
+			t.Errorf("Int(%q) = %d, %v, want %d", tc.in, got, err, tc.want)
+		}
+	}
+}
@@ -6,6 +6,7 @@ import (
 	"encoding/json"
 	"os"
 	"path/filepath"
+	"time"
 
 	"github.com/companyzero/bisonrelay/clientrpc/jsonrpc"
 	"github.com/companyzero/bisonrelay/clientrpc/types"
@@ -15,33 +16,60 @@ import (
 	"golang.org/x/sync/errgroup"
 )
 
+// Run connects to brclient and consumes the notification streams until ctx
+// is done or the connection to brclient fails for good, in which case the
+// error is returned.
 func (b *Bot) Run(ctx context.Context) error {
 	g, gctx := errgroup.WithContext(ctx)
 
-	if b.gcChan != nil {
+	g.Go(func() error {
+		return b.runRPCClient(gctx)
+	})
+
+	g.Go(func() error {
+		return b.outbound.run(gctx)
+	})
+
+	g.Go(func() error {
+		return b.runScheduler(gctx)
+	})
+
+	g.Go(func() error {
+		return b.runDialogTimeouts(gctx)
+	})
+
+	if b.gcChan != nil || b.router != nil {
 		g.Go(func() error {
 			return b.gcNtfns(gctx)
 		})
 	}
 
-	if b.inviteChan != nil {
+	if b.inviteChan != nil || b.invitePolicyActive() {
 		g.Go(func() error {
 			return b.inviteNtfns(gctx)
 		})
 	}
 
-	if b.pmChan != nil {
+	if b.pmChan != nil || b.router != nil || len(b.cfg.Invites.Approvers) > 0 ||
+		(b.onboarding != nil && len(b.onboarding.cfg.Steps) > 0) ||
+		b.dialogs.registered() {
 		g.Go(func() error {
 			return b.pmNtfns(gctx)
 		})
 	}
 
-	if b.kxChan != nil {
+	if b.kxChan != nil || b.onboarding != nil {
 		g.Go(func() error {
 			return b.kxNtfns(gctx)
 		})
 	}
 
+	if b.onboarding != nil && b.onboarding.gcGreetings() {
+		g.Go(func() error {
+			return b.membersAddedNtfns(gctx)
+		})
+	}
+
 	if b.postChan != nil {
 		g.Go(func() error {
 			return b.postNtfns(gctx)
@@ -54,13 +82,24 @@ func (b *Bot) Run(ctx context.Context) error {
 		})
 	}
 
-	if b.tipProgressChan != nil {
+	g.Go(func() error {
+		return b.tipProgress(gctx)
+	})
+
+	if b.paywall != nil {
 		g.Go(func() error {
-			return b.tipProgress(gctx)
+			return b.paywall.run(gctx)
 		})
 	}
 
-	if b.tipReceivedChan != nil {
+	if b.accounts != nil {
+		g.Go(func() error {
+			return b.accounts.run(gctx)
+		})
+	}
+
+	if b.tipReceivedChan != nil || b.ledger != nil || b.paywall != nil ||
+		b.accounts != nil {
 		g.Go(func() error {
 			return b.tipReceived(gctx)
 		})
@@ -82,10 +121,25 @@ func NewJSONRPCClient(cfg *config.BotConfig, log slog.Logger) (*jsonrpc.WSClient
 	)
 }
 
+// subsysLogger returns l if it is set, otherwise a logger for the given
+// subsystem from the backend.
+func subsysLogger(l slog.Logger, logBackend *logging.LogBackend, subsys string) slog.Logger {
+	if l != nil {
+		return l
+	}
+	return logBackend.Logger(subsys)
+}
+
 // NewBot creates a new Bot instance with the provided configuration and logging backend.
 // It initializes the RPC client and sets up chat and payment service clients.
-// Returns an error if the RPC client initialization fails.
+// The connection to brclient is only established once Run is called.
+// Returns an error if the config is invalid or the RPC client initialization
+// fails.
 func NewBot(cfg *config.BotConfig, logBackend *logging.LogBackend) (*Bot, error) {
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+
 	wsc, err := NewJSONRPCClient(cfg, logBackend.Logger("RPC"))
 	if err != nil {
 		return nil, err
@@ -104,48 +158,91 @@ func NewBot(cfg *config.BotConfig, logBackend *logging.LogBackend) (*Bot, error)
 		}
 	}
 
-	ctx, cancel := context.WithCancel(context.Background())
-	go func() {
-		// XXX - kill everything if websocket returns
-		err := wsc.Run(ctx)
-		brLog := logBackend.Logger("BR")
-		brLog.Errorf("websocket run ended: %v", err)
-		cancel()
-	}()
+	cursors, err := NewFileCursorStore(filepath.Join(cfg.DataDir, "cursors.json"))
+	if err != nil {
+		return nil, err
+	}
+
+	sched, err := newScheduler(filepath.Join(cfg.DataDir, "schedule.json"),
+		logBackend.Logger("SCHD"))
+	if err != nil {
+		return nil, err
+	}
+
+	invites, err := newInviteStore(filepath.Join(cfg.DataDir, "invites.json"))
+	if err != nil {
+		return nil, err
+	}
+
+	dialogs, err := newDialogs(filepath.Join(cfg.DataDir, "dialogs.json"),
+		logBackend.Logger("DLG"))
+	if err != nil {
+		return nil, err
+	}
+
+	tipPayments, err := newTipPayments(filepath.Join(cfg.DataDir, "tippayments.json"))
+	if err != nil {
+		return nil, err
+	}
+
+	conn := &rpcConn{wsc: wsc}
+	b := &Bot{
+		cfg:  cfg,
+		conn: conn,
 
-	return &Bot{
-		cfg: cfg,
-		wsc: wsc,
-		ctx: ctx,
+		log:        logBackend.Logger("BOT"),
+		logBackend: logBackend,
 
 		gcChan:     cfg.GCChan,
-		gcLog:      cfg.GCLog,
+		gcLog:      subsysLogger(cfg.GCLog, logBackend, "GC"),
 		inviteChan: cfg.InviteChan,
 
 		pmChan: cfg.PMChan,
-		pmLog:  cfg.PMLog,
+		pmLog:  subsysLogger(cfg.PMLog, logBackend, "PM"),
 
 		tipProgressChan: cfg.TipProgressChan,
-		tipProgressLog:  cfg.TipLog,
+		tipProgressLog:  subsysLogger(cfg.TipLog, logBackend, "TIP"),
 
-		tipReceivedLog:  cfg.TipReceivedLog,
+		tipReceivedLog:  subsysLogger(cfg.TipReceivedLog, logBackend, "TIPR"),
 		tipReceivedChan: cfg.TipReceivedChan,
 
 		kxChan: cfg.KXChan,
-		kxLog:  cfg.KXLog,
+		kxLog:  subsysLogger(cfg.KXLog, logBackend, "KX"),
 
 		postChan: cfg.PostChan,
-		postLog:  cfg.PostLog,
+		postLog:  subsysLogger(cfg.PostLog, logBackend, "POST"),
 
 		postStatusChan: cfg.PostStatusChan,
-		postStatusLog:  cfg.PostStatusLog,
-
-		wl:     wl,
-		wlFile: wlFile,
+		postStatusLog:  subsysLogger(cfg.PostStatusLog, logBackend, "PSTS"),
+
+		wl:        wl,
+		wlFile:    wlFile,
+		wlReplied: make(map[string]time.Time),
+
+		cursors:   cursors,
+		manualAck: cfg.AckMode == config.AckModeManual,
+		acked:     make(map[string]uint64),
+		breaker:   newCircuitBreaker(cfg.Reconnect),
+		streams:   make(map[string]streamAcker),
+
+		queues:        make(map[string]queueStatser),
+		queuePolicies: make(map[string]config.QueuePolicy),
+
+		outbound:  newOutboundQueue(cfg.Outbound, logBackend.Logger("OUTB")),
+		scheduler: sched,
+		invites:   invites,
+		dialogs:   dialogs,
+
+		tipPayments: tipPayments,
+		nicks:       make(map[string]string),
+
+		chatService:    types.NewChatServiceClient(conn),
+		gcService:      types.NewGCServiceClient(conn),
+		paymentService: types.NewPaymentsServiceClient(conn),
+		postService:    types.NewPostsServiceClient(conn),
+		versionService: types.NewVersionServiceClient(conn),
+	}
+	b.registerBuiltinStreams()
 
-		chatService:    types.NewChatServiceClient(wsc),
-		gcService:      types.NewGCServiceClient(wsc),
-		paymentService: types.NewPaymentsServiceClient(wsc),
-		postService:    types.NewPostsServiceClient(wsc),
-	}, nil
+	return b, nil
 }
@@ -0,0 +1,382 @@
+package bisonbotkit
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/companyzero/bisonrelay/clientrpc/types"
+	"github.com/companyzero/bisonrelay/zkidentity"
+	"github.com/vctt94/bisonbotkit/utils"
+)
+
+const (
+	// broadcastWindow is the maximum number of messages of a broadcast
+	// waiting in the outbound queue.
+	broadcastWindow = 50
+
+	// broadcastSaveInterval is how often the progress of a broadcast is
+	// persisted.
+	broadcastSaveInterval = time.Second
+)
+
+// BroadcastRequest describes a message to send to a set of users. The
+// recipients are the union of Users, the members of GC and, if Whitelisted
+// is set, every whitelisted user.
+type BroadcastRequest struct {
+	// ID identifies the broadcast in the data dir. A random ID is
+	// generated if it is empty.
+	ID string
+
+	// Message is a text/template executed for every recipient with a
+	// BroadcastRecipient as data, as in "Hello {{.Nick}}".
+	Message string
+
+	// Data holds extra values available to the template as .Data.
+	Data map[string]string
+
+	// Users are user IDs (or nicks) of recipients.
+	Users []string
+
+	// GC is the name or ID of a GC whose members are recipients.
+	GC string
+
+	// Whitelisted adds every whitelisted user to the recipients.
+	Whitelisted bool
+
+	// OnProgress, if set, is called after every message is sent or
+	// fails.
+	OnProgress func(BroadcastProgress)
+}
+
+// BroadcastRecipient is the data passed to the template of a broadcast.
+type BroadcastRecipient struct {
+	UID   string
+	Nick  string
+	Index int
+	Total int
+	Data  map[string]string
+}
+
+// BroadcastProgress reports the progress of a broadcast.
+type BroadcastProgress struct {
+	ID     string
+	Total  int
+	Sent   int
+	Failed int
+}
+
+// BroadcastResult is the summary of a broadcast.
+type BroadcastResult struct {
+	ID    string
+	Total int
+	Sent  int
+
+	// Failures maps the recipients that could not be sent the message to
+	// the error.
+	Failures map[string]string
+}
+
+// broadcastState is the persisted state of a broadcast.
+type broadcastState struct {
+	ID         string            `json:"id"`
+	Message    string            `json:"message"`
+	Data       map[string]string `json:"data,omitempty"`
+	Recipients []string          `json:"recipients"`
+	Created    time.Time         `json:"created"`
+	Finished   bool              `json:"finished"`
+
+	// Results maps the recipients that were handled to an empty string
+	// when the message was sent, or to the error when it failed.
+	Results map[string]string `json:"results"`
+}
+
+func (b *Bot) broadcastsDir() string {
+	return filepath.Join(b.cfg.DataDir, "broadcasts")
+}
+
+func (b *Bot) loadBroadcast(id string) (*broadcastState, error) {
+	data, err := os.ReadFile(filepath.Join(b.broadcastsDir(), id+".json"))
+	if err != nil {
+		return nil, err
+	}
+	var st broadcastState
+	if err := json.Unmarshal(data, &st); err != nil {
+		return nil, err
+	}
+	if st.Results == nil {
+		st.Results = make(map[string]string)
+	}
+	return &st, nil
+}
+
+func (b *Bot) saveBroadcast(st *broadcastState) error {
+	data, err := json.MarshalIndent(st, "", "  ")
+	if err != nil {
+		return err
+	}
+	return utils.AtomicWriteFile(filepath.Join(b.broadcastsDir(), st.ID+".json"), data, 0600)
+}
+
+// localID returns the ID of the bot's own client.
+func (b *Bot) localID(ctx context.Context) (string, error) {
+	var id types.PublicIdentity
+	if err := b.UserPublicIdentity(ctx, &types.PublicIdentityReq{}, &id); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(id.Identity), nil
+}
+
+// broadcastRecipients resolves the recipients of the request, without
+// duplicates and excluding the bot itself.
+func (b *Bot) broadcastRecipients(ctx context.Context, req *BroadcastRequest) ([]string, error) {
+	seen := make(map[string]bool)
+	var res []string
+	add := func(id string) {
+		if id != "" && !seen[id] {
+			seen[id] = true
+			res = append(res, id)
+		}
+	}
+
+	for _, u := range req.Users {
+		add(u)
+	}
+	if req.Whitelisted {
+		for _, e := range b.Whitelist() {
+			add(e.UID.String())
+		}
+	}
+	if req.GC != "" {
+		gc, err := b.GetGC(ctx, req.GC)
+		if err != nil {
+			return nil, fmt.Errorf("unable to get GC %q: %w", req.GC, err)
+		}
+		self, err := b.localID(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("unable to get local ID: %w", err)
+		}
+		seen[self] = true
+		for _, m := range gc.Members {
+			add(hex.EncodeToString(m))
+		}
+	}
+	return res, nil
+}
+
+// Broadcast sends a message to every recipient of the request with low
+// priority and returns a summary once every message was sent or failed. The
+// progress is stored in the data dir, so a broadcast interrupted by a
+// restart (or by ctx being done, or the bot stopping) can be completed with
+// ResumeBroadcast.
+func (b *Bot) Broadcast(ctx context.Context, req BroadcastRequest) (*BroadcastResult, error) {
+	tmpl, err := template.New("broadcast").Parse(req.Message)
+	if err != nil {
+		return nil, fmt.Errorf("invalid broadcast message template: %w", err)
+	}
+	if req.ID == "" {
+		rnd, err := utils.GenerateRandomString(8)
+		if err != nil {
+			return nil, err
+		}
+		req.ID = time.Now().Format("20060102-150405-") + rnd
+	}
+	if strings.ContainsAny(req.ID, `/\`) {
+		return nil, fmt.Errorf("invalid broadcast ID %q", req.ID)
+	}
+	if _, err := b.loadBroadcast(req.ID); err == nil {
+		return nil, fmt.Errorf("broadcast %q already exists", req.ID)
+	}
+
+	recipients, err := b.broadcastRecipients(ctx, &req)
+	if err != nil {
+		return nil, err
+	}
+	if len(recipients) == 0 {
+		return nil, errors.New("broadcast has no recipients")
+	}
+
+	st := &broadcastState{
+		ID:         req.ID,
+		Message:    req.Message,
+		Data:       req.Data,
+		Recipients: recipients,
+		Created:    time.Now(),
+		Results:    make(map[string]string),
+	}
+	if err := b.saveBroadcast(st); err != nil {
+		return nil, err
+	}
+	return b.runBroadcast(ctx, st, tmpl, req.OnProgress)
+}
+
+// ResumeBroadcast sends the message of an unfinished broadcast to the
+// recipients that were not handled yet.
+func (b *Bot) ResumeBroadcast(ctx context.Context, id string, onProgress func(BroadcastProgress)) (*BroadcastResult, error) {
+	st, err := b.loadBroadcast(id)
+	if err != nil {
+		return nil, err
+	}
+	tmpl, err := template.New("broadcast").Parse(st.Message)
+	if err != nil {
+		return nil, fmt.Errorf("invalid broadcast message template: %w", err)
+	}
+	return b.runBroadcast(ctx, st, tmpl, onProgress)
+}
+
+// UnfinishedBroadcasts returns the IDs of the broadcasts that were
+// interrupted before every recipient was handled.
+func (b *Bot) UnfinishedBroadcasts() ([]string, error) {
+	entries, err := os.ReadDir(b.broadcastsDir())
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var ids []string
+	for _, e := range entries {
+		id, ok := strings.CutSuffix(e.Name(), ".json")
+		if !ok {
+			continue
+		}
+		st, err := b.loadBroadcast(id)
+		if err != nil {
+			b.log.Warnf("Unable to load broadcast %s: %v", id, err)
+			continue
+		}
+		if !st.Finished {
+			ids = append(ids, id)
+		}
+	}
+	sort.Strings(ids)
+	return ids, nil
+}
+
+// recipientNick returns the nick of a recipient, which may already be a
+// nick.
+func (b *Bot) recipientNick(ctx context.Context, recipient string) string {
+	var uid zkidentity.ShortID
+	if uid.FromString(recipient) != nil {
+		return recipient
+	}
+	var res types.UserNickResponse
+	err := b.chatService.UserNick(ctx, &types.UserNickRequest{HexUid: recipient}, &res)
+	if err != nil {
+		return recipient
+	}
+	return res.Nick
+}
+
+func (st *broadcastState) result() *BroadcastResult {
+	res := &BroadcastResult{
+		ID:       st.ID,
+		Total:    len(st.Recipients),
+		Failures: make(map[string]string),
+	}
+	for r, errMsg := range st.Results {
+		if errMsg == "" {
+			res.Sent++
+		} else {
+			res.Failures[r] = errMsg
+		}
+	}
+	return res
+}
+
+// runBroadcast sends the message to the pending recipients of the
+// broadcast.
+func (b *Bot) runBroadcast(ctx context.Context, st *broadcastState, tmpl *template.Template, onProgress func(BroadcastProgress)) (*BroadcastResult, error) {
+	type inflight struct {
+		recipient string
+		d         *Delivery
+	}
+	var window []inflight
+	lastSave := time.Now()
+
+	// complete waits for the oldest queued message and records its
+	// result.
+	complete := func() error {
+		f := window[0]
+		window = window[1:]
+		err := f.d.Wait(ctx)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if errors.Is(err, ErrBotStopped) {
+			// Like when ctx is done, the recipient is left pending so
+			// that it is sent by ResumeBroadcast.
+			return err
+		}
+		st.Results[f.recipient] = ""
+		if err != nil {
+			st.Results[f.recipient] = err.Error()
+		}
+		if onProgress != nil {
+			res := st.result()
+			onProgress(BroadcastProgress{
+				ID:     st.ID,
+				Total:  res.Total,
+				Sent:   res.Sent,
+				Failed: len(res.Failures),
+			})
+		}
+		if time.Since(lastSave) >= broadcastSaveInterval {
+			lastSave = time.Now()
+			if err := b.saveBroadcast(st); err != nil {
+				b.log.Errorf("Unable to save broadcast %s: %v", st.ID, err)
+			}
+		}
+		return nil
+	}
+
+	var err error
+	for i, r := range st.Recipients {
+		if _, done := st.Results[r]; done {
+			continue
+		}
+		if len(window) >= broadcastWindow {
+			if err = complete(); err != nil {
+				break
+			}
+		}
+
+		var msg bytes.Buffer
+		data := BroadcastRecipient{
+			UID:   r,
+			Nick:  b.recipientNick(ctx, r),
+			Index: i,
+			Total: len(st.Recipients),
+			Data:  st.Data,
+		}
+		if err := tmpl.Execute(&msg, data); err != nil {
+			st.Results[r] = fmt.Sprintf("unable to execute template: %v", err)
+			continue
+		}
+		d := b.QueuePM(ctx, r, msg.String(), WithPriority(PriorityLow))
+		window = append(window, inflight{recipient: r, d: d})
+	}
+	for err == nil && len(window) > 0 {
+		err = complete()
+	}
+
+	st.Finished = err == nil
+	if saveErr := b.saveBroadcast(st); saveErr != nil && err == nil {
+		err = saveErr
+	}
+	res := st.result()
+	if err == nil {
+		b.log.Infof("Broadcast %s finished: %d of %d sent, %d failed",
+			st.ID, res.Sent, res.Total, len(res.Failures))
+	}
+	return res, err
+}
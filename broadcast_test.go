@@ -0,0 +1,53 @@
+package bisonbotkit
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func TestBroadcastBotStopped(t *testing.T) {
+	ctx := context.Background()
+	b := newTestBot(t, t.TempDir(), &fakePayments{})
+
+	// Messages of a stopped bot are left pending instead of failing.
+	b.outbound.stop()
+	res, err := b.Broadcast(ctx, BroadcastRequest{
+		ID:      "news",
+		Message: "hi {{.Nick}}",
+		Users:   []string{"alice", "bob"},
+	})
+	if !errors.Is(err, ErrBotStopped) {
+		t.Fatalf("got error %v, want %v", err, ErrBotStopped)
+	}
+	if res.Sent != 0 || len(res.Failures) != 0 {
+		t.Fatalf("unexpected result %+v", res)
+	}
+	ids, err := b.UnfinishedBroadcasts()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(ids, []string{"news"}) {
+		t.Fatalf("got unfinished broadcasts %v", ids)
+	}
+
+	// They are sent once the broadcast is resumed.
+	chat := runChat(t, b)
+	res, err = b.ResumeBroadcast(ctx, "news", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Sent != 2 || len(res.Failures) != 0 {
+		t.Fatalf("unexpected result %+v", res)
+	}
+	sent := chat.take()
+	sort.Strings(sent)
+	if want := []string{"hi alice", "hi bob"}; !reflect.DeepEqual(sent, want) {
+		t.Fatalf("sent %q, want %q", sent, want)
+	}
+	if ids, _ := b.UnfinishedBroadcasts(); len(ids) != 0 {
+		t.Fatalf("got unfinished broadcasts %v", ids)
+	}
+}
@@ -5,7 +5,9 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/decred/slog"
 
@@ -17,6 +19,158 @@ var (
 	defaultBRClientDir = utils.AppDataDir("brclient", false)
 )
 
+// Whitelist modes define how messages from users that are not in the bot's
+// whitelist are handled.
+const (
+	// WhitelistModeOff delivers messages from every user.
+	WhitelistModeOff = "off"
+
+	// WhitelistModeDrop silently drops messages from users that are not
+	// whitelisted.
+	WhitelistModeDrop = "drop"
+
+	// WhitelistModeReply drops messages from users that are not
+	// whitelisted and replies to their PMs with WhitelistReply, at most
+	// once an hour per user.
+	WhitelistModeReply = "reply"
+)
+
+// Ack modes define when messages received from brclient are acknowledged.
+// Acks are cumulative: acknowledging a message also acknowledges every
+// earlier message of the same stream.
+const (
+	// AckModeReceive acknowledges messages as soon as they are received,
+	// before they are handled.
+	AckModeReceive = "receive"
+
+	// AckModeManual acknowledges messages only after they are handled.
+	// Messages handled by a Router are acked once the handler returns
+	// without error. Messages sent to the bot channels must be acked by
+	// the application (Bot.AckPM, Bot.AckGCM, Bot.Envelope, etc). A
+	// message is only acked once every earlier message of its stream is,
+	// so a message that is never acked, or whose handling failed, holds
+	// back later ones until it is delivered again when the stream is
+	// reopened.
+	AckModeManual = "manual"
+)
+
+// ReconnectPolicy configures how the bot reopens notification streams that
+// failed. Zero values are replaced by the defaults described below.
+type ReconnectPolicy struct {
+	// InitialDelay is the delay before the first reconnection attempt
+	// (default 1s). It doubles after every consecutive failure.
+	InitialDelay time.Duration
+
+	// MaxDelay caps the delay between attempts (default 1m).
+	MaxDelay time.Duration
+
+	// Jitter is the fraction of each delay (0 to 1) that is randomized to
+	// avoid all streams reconnecting at once.
+	Jitter float64
+
+	// MaxAttempts is the number of consecutive failed attempts after
+	// which a stream gives up, causing Bot.Run to return. Zero retries
+	// forever.
+	MaxAttempts int
+
+	// BreakerThreshold is the number of consecutive failures, across all
+	// streams, after which the circuit breaker opens and every stream
+	// pauses for BreakerCooldown (default 5m). Zero disables the breaker.
+	BreakerThreshold int
+	BreakerCooldown  time.Duration
+}
+
+// Overflow policies define what happens when a message is received for a
+// stream whose delivery queue is full.
+const (
+	// OverflowBlock stops reading from the stream until the queue has
+	// room.
+	OverflowBlock = "block"
+
+	// OverflowDropOldest discards the oldest queued message to make room
+	// for the new one.
+	OverflowDropOldest = "dropoldest"
+
+	// OverflowDropNewest discards the new message.
+	OverflowDropNewest = "dropnewest"
+
+	// OverflowSpill writes messages that do not fit in the queue to a file
+	// in the data dir. Spilled messages are delivered in order once the
+	// consumer catches up, including after a restart.
+	OverflowSpill = "spill"
+)
+
+// QueuePolicy configures the bounded queue between a notification stream
+// and the code consuming its messages (the router and the bot channels).
+type QueuePolicy struct {
+	// Size is the number of messages held in memory (default 100).
+	Size int
+
+	// Overflow is one of the Overflow* constants. An empty value is the
+	// same as OverflowBlock.
+	Overflow string
+}
+
+// OutboundPolicy configures the queue through which the bot sends PMs and GC
+// messages. Zero values are replaced by the defaults described below.
+type OutboundPolicy struct {
+	// Rate is the maximum number of messages sent per second across all
+	// destinations, with bursts of up to Burst messages (default
+	// Rate, rounded up). Zero disables the limit.
+	Rate  float64
+	Burst int
+
+	// DestRate and DestBurst limit the messages sent to each user or GC
+	// in the same way. Zero disables the limit.
+	DestRate  float64
+	DestBurst int
+
+	// MaxRetries is the number of times a message that failed with a
+	// transient error (for example, because brclient was unreachable) is
+	// retried. The delay between retries starts at RetryDelay (default
+	// 1s) and doubles after each attempt.
+	MaxRetries int
+	RetryDelay time.Duration
+
+	// QueueSize is the maximum number of queued messages (default
+	// 10000). Messages queued while it is full fail immediately.
+	QueueSize int
+}
+
+// SplitPolicy configures how long outgoing messages are split into parts.
+type SplitPolicy struct {
+	// MaxLen is the maximum length in bytes of each part (default 8000).
+	// It is capped to the Bison Relay message size limit.
+	MaxLen int
+
+	// Number prefixes each part with its number, as in "(1/3)".
+	Number bool
+
+	// MaxParts is the number of parts above which a PM is sent as a text
+	// file (with SendFile) instead. Zero never sends PMs as files. GC
+	// messages are always split.
+	MaxParts int
+}
+
+// InvitePolicy configures which GC invites the bot accepts on its own.
+// Invites that are neither accepted nor sent for approval are delivered to
+// InviteChan.
+type InvitePolicy struct {
+	// AcceptWhitelisted accepts invites sent by whitelisted users.
+	AcceptWhitelisted bool
+
+	// AcceptGCs accepts invites to GCs with these names, from any user.
+	AcceptGCs []string
+
+	// Approvers are the IDs of users asked by PM to approve the invites
+	// that are not accepted automatically.
+	Approvers []string
+
+	// ApprovalTimeout is how long invites wait for approval (default
+	// 24h), unless they expire earlier.
+	ApprovalTimeout time.Duration
+}
+
 // BotConfig holds all configuration options for a Bison Relay bot
 type BotConfig struct {
 	DataDir string
@@ -51,6 +205,40 @@ type BotConfig struct {
 	RPCUser string
 	RPCPass string
 	Debug   string
+
+	// WhitelistMode is one of the WhitelistMode* constants. An empty
+	// value is the same as WhitelistModeOff.
+	WhitelistMode string
+	// WhitelistReply is sent to non-whitelisted users when WhitelistMode
+	// is WhitelistModeReply.
+	WhitelistReply string
+
+	// AckMode is one of the AckMode* constants. An empty value is the
+	// same as AckModeReceive. Tips are always acked by the application.
+	AckMode string
+
+	// Reconnect is the policy used to reopen failed notification streams.
+	Reconnect ReconnectPolicy
+
+	// RPCRecreateAfter, when set, makes the bot recreate its RPC client,
+	// re-reading the TLS certificates, after brclient has been
+	// unreachable for this long. Zero disables recreating the client.
+	RPCRecreateAfter time.Duration
+
+	// Queue is the delivery queue policy of every notification stream.
+	// It may be overridden per stream with Bot.SetQueuePolicy.
+	Queue QueuePolicy
+
+	// Outbound configures the rate limits and retries of sent PMs and
+	// GC messages.
+	Outbound OutboundPolicy
+
+	// Split configures how long PMs and GC messages are split.
+	Split SplitPolicy
+
+	// Invites configures the automatic acceptance of GC invites.
+	Invites InvitePolicy
+
 	// Logging-related fields
 	LogFile        string // Path to the log file
 	MaxLogFiles    int    // Maximum number of log files to keep
@@ -72,6 +260,32 @@ clientkeypath=%s
 rpcuser=%s
 rpcpass=%s
 debug=%s
+whitelistmode=%s
+whitelistreply=%s
+ackmode=%s
+reconnectinitialdelay=%s
+reconnectmaxdelay=%s
+reconnectjitter=%g
+reconnectmaxattempts=%d
+reconnectbreakerthreshold=%d
+reconnectbreakercooldown=%s
+rpcrecreateafter=%s
+queuesize=%d
+queueoverflow=%s
+sendrate=%g
+sendburst=%d
+senddestrate=%g
+senddestburst=%d
+sendmaxretries=%d
+sendretrydelay=%s
+sendqueuesize=%d
+splitmaxlen=%d
+splitnumber=%t
+splitmaxparts=%d
+inviteacceptwhitelisted=%t
+inviteacceptgcs=%s
+inviteapprovers=%s
+inviteapprovaltimeout=%s
 logfile=%s
 maxlogfiles=%d
 maxbufferlines=%d
@@ -84,6 +298,32 @@ maxbufferlines=%d
 		cfg.RPCUser,
 		cfg.RPCPass,
 		cfg.Debug,
+		cfg.WhitelistMode,
+		cfg.WhitelistReply,
+		cfg.AckMode,
+		cfg.Reconnect.InitialDelay,
+		cfg.Reconnect.MaxDelay,
+		cfg.Reconnect.Jitter,
+		cfg.Reconnect.MaxAttempts,
+		cfg.Reconnect.BreakerThreshold,
+		cfg.Reconnect.BreakerCooldown,
+		cfg.RPCRecreateAfter,
+		cfg.Queue.Size,
+		cfg.Queue.Overflow,
+		cfg.Outbound.Rate,
+		cfg.Outbound.Burst,
+		cfg.Outbound.DestRate,
+		cfg.Outbound.DestBurst,
+		cfg.Outbound.MaxRetries,
+		cfg.Outbound.RetryDelay,
+		cfg.Outbound.QueueSize,
+		cfg.Split.MaxLen,
+		cfg.Split.Number,
+		cfg.Split.MaxParts,
+		cfg.Invites.AcceptWhitelisted,
+		strings.Join(cfg.Invites.AcceptGCs, ","),
+		strings.Join(cfg.Invites.Approvers, ","),
+		cfg.Invites.ApprovalTimeout,
 		cfg.LogFile,
 		cfg.MaxLogFiles,
 		cfg.MaxBufferLines,
@@ -101,20 +341,21 @@ maxbufferlines=%d
 	return os.WriteFile(configPath, []byte(fullConfig), 0600)
 }
 
-// parseConfigFile parses the config file at the given path into a BotConfig struct.
-func parseConfigFile(configPath string) (*BotConfig, error) {
+// parseConfigFile parses the config file at the given path into a BotConfig
+// struct. Keys missing from the file keep the values of defaults. It fails if
+// a value cannot be parsed or is not valid.
+func parseConfigFile(configPath string, defaults *BotConfig) (*BotConfig, error) {
 	file, err := os.Open(configPath)
 	if err != nil {
 		return nil, err
 	}
 	defer file.Close()
 
-	cfg := &BotConfig{
-		ExtraConfig: make(map[string]string), // Initialize the map
-	}
+	cfg := defaults
+	cfg.ExtraConfig = make(map[string]string) // Initialize the map
 
 	scanner := bufio.NewScanner(file)
-	for scanner.Scan() {
+	for lineNo := 1; scanner.Scan(); lineNo++ {
 		line := scanner.Text()
 		parts := strings.SplitN(line, "=", 2)
 		if len(parts) != 2 {
@@ -143,15 +384,71 @@ func parseConfigFile(configPath string) (*BotConfig, error) {
 			cfg.RPCPass = value
 		case "debug":
 			cfg.Debug = value
+		case "whitelistmode":
+			cfg.WhitelistMode = value
+		case "whitelistreply":
+			cfg.WhitelistReply = value
+		case "ackmode":
+			cfg.AckMode = value
+		case "reconnectinitialdelay":
+			err = parseDuration(value, &cfg.Reconnect.InitialDelay)
+		case "reconnectmaxdelay":
+			err = parseDuration(value, &cfg.Reconnect.MaxDelay)
+		case "reconnectjitter":
+			err = parseFloat(value, &cfg.Reconnect.Jitter)
+		case "reconnectmaxattempts":
+			err = parseInt(value, &cfg.Reconnect.MaxAttempts)
+		case "reconnectbreakerthreshold":
+			err = parseInt(value, &cfg.Reconnect.BreakerThreshold)
+		case "reconnectbreakercooldown":
+			err = parseDuration(value, &cfg.Reconnect.BreakerCooldown)
+		case "rpcrecreateafter":
+			err = parseDuration(value, &cfg.RPCRecreateAfter)
+		case "queuesize":
+			err = parseInt(value, &cfg.Queue.Size)
+		case "queueoverflow":
+			cfg.Queue.Overflow = value
+		case "sendrate":
+			err = parseFloat(value, &cfg.Outbound.Rate)
+		case "sendburst":
+			err = parseInt(value, &cfg.Outbound.Burst)
+		case "senddestrate":
+			err = parseFloat(value, &cfg.Outbound.DestRate)
+		case "senddestburst":
+			err = parseInt(value, &cfg.Outbound.DestBurst)
+		case "sendmaxretries":
+			err = parseInt(value, &cfg.Outbound.MaxRetries)
+		case "sendretrydelay":
+			err = parseDuration(value, &cfg.Outbound.RetryDelay)
+		case "sendqueuesize":
+			err = parseInt(value, &cfg.Outbound.QueueSize)
+		case "splitmaxlen":
+			err = parseInt(value, &cfg.Split.MaxLen)
+		case "splitnumber":
+			cfg.Split.Number, err = strconv.ParseBool(value)
+		case "splitmaxparts":
+			err = parseInt(value, &cfg.Split.MaxParts)
+		case "inviteacceptwhitelisted":
+			cfg.Invites.AcceptWhitelisted, err = strconv.ParseBool(value)
+		case "inviteacceptgcs":
+			cfg.Invites.AcceptGCs = splitList(value)
+		case "inviteapprovers":
+			cfg.Invites.Approvers = splitList(value)
+		case "inviteapprovaltimeout":
+			err = parseDuration(value, &cfg.Invites.ApprovalTimeout)
 		case "logfile":
 			cfg.LogFile = value
 		case "maxlogfiles":
-			fmt.Sscanf(value, "%d", &cfg.MaxLogFiles)
+			err = parseInt(value, &cfg.MaxLogFiles)
 		case "maxbufferlines":
-			fmt.Sscanf(value, "%d", &cfg.MaxBufferLines)
+			err = parseInt(value, &cfg.MaxBufferLines)
 		default:
 			handled = false
 		}
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: invalid %s: %w", configPath,
+				lineNo, key, err)
+		}
 
 		// If this is not a known field, store it in the ExtraConfig map
 		if !handled {
@@ -162,11 +459,115 @@ func parseConfigFile(configPath string) (*BotConfig, error) {
 	if err := scanner.Err(); err != nil {
 		return nil, err
 	}
+	if err := cfg.Validate(); err != nil {
+		return nil, fmt.Errorf("%s: %w", configPath, err)
+	}
 
 	return cfg, nil
 }
 
+// parseInt parses a decimal integer config value into dst.
+func parseInt(value string, dst *int) error {
+	v, err := strconv.Atoi(value)
+	if err != nil {
+		return err
+	}
+	*dst = v
+	return nil
+}
+
+// parseFloat parses a decimal number config value into dst.
+func parseFloat(value string, dst *float64) error {
+	v, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return err
+	}
+	*dst = v
+	return nil
+}
+
+// parseDuration parses a duration config value such as "1m30s" into dst.
+func parseDuration(value string, dst *time.Duration) error {
+	v, err := time.ParseDuration(value)
+	if err != nil {
+		return err
+	}
+	*dst = v
+	return nil
+}
+
+// Validate checks that the config values that must be one of the constants
+// defined in this package are valid and that numeric values are not
+// negative.
+func (cfg *BotConfig) Validate() error {
+	switch cfg.WhitelistMode {
+	case "", WhitelistModeOff, WhitelistModeDrop, WhitelistModeReply:
+	default:
+		return fmt.Errorf("unknown whitelist mode %q", cfg.WhitelistMode)
+	}
+	switch cfg.AckMode {
+	case "", AckModeReceive, AckModeManual:
+	default:
+		return fmt.Errorf("unknown ack mode %q", cfg.AckMode)
+	}
+	switch cfg.Queue.Overflow {
+	case "", OverflowBlock, OverflowSpill:
+	case OverflowDropOldest, OverflowDropNewest:
+		// Dropped messages would be acked along with the next
+		// handled message, so they would be lost for good.
+		if cfg.AckMode == AckModeManual {
+			return fmt.Errorf("queue overflow policy %q cannot be "+
+				"used with ack mode %q", cfg.Queue.Overflow, cfg.AckMode)
+		}
+	default:
+		return fmt.Errorf("unknown queue overflow policy %q", cfg.Queue.Overflow)
+	}
+
+	nonNegative := []struct {
+		name  string
+		value float64
+	}{
+		{"reconnect initial delay", float64(cfg.Reconnect.InitialDelay)},
+		{"reconnect max delay", float64(cfg.Reconnect.MaxDelay)},
+		{"reconnect jitter", cfg.Reconnect.Jitter},
+		{"reconnect max attempts", float64(cfg.Reconnect.MaxAttempts)},
+		{"reconnect breaker threshold", float64(cfg.Reconnect.BreakerThreshold)},
+		{"reconnect breaker cooldown", float64(cfg.Reconnect.BreakerCooldown)},
+		{"RPC recreate delay", float64(cfg.RPCRecreateAfter)},
+		{"queue size", float64(cfg.Queue.Size)},
+		{"send rate", cfg.Outbound.Rate},
+		{"send burst", float64(cfg.Outbound.Burst)},
+		{"send dest rate", cfg.Outbound.DestRate},
+		{"send dest burst", float64(cfg.Outbound.DestBurst)},
+		{"send max retries", float64(cfg.Outbound.MaxRetries)},
+		{"send retry delay", float64(cfg.Outbound.RetryDelay)},
+		{"send queue size", float64(cfg.Outbound.QueueSize)},
+		{"split max length", float64(cfg.Split.MaxLen)},
+		{"split max parts", float64(cfg.Split.MaxParts)},
+		{"invite approval timeout", float64(cfg.Invites.ApprovalTimeout)},
+	}
+	for _, v := range nonNegative {
+		if v.value < 0 {
+			return fmt.Errorf("%s cannot be negative", v.name)
+		}
+	}
+	return nil
+}
+
+// splitList splits a comma separated list, skipping empty elements.
+func splitList(value string) []string {
+	var res []string
+	for _, v := range strings.Split(value, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			res = append(res, v)
+		}
+	}
+	return res
+}
+
 // LoadBotConfig attempts to load the bot config from the default locations.
+// A default config is written if the file does not exist. It fails if an
+// existing file holds invalid values.
 func LoadBotConfig(configPath string, fileName string) (*BotConfig, error) {
 	defaultConfigPath := utils.AppDataDir(fileName, false)
 	configPath = utils.CleanAndExpandPath(configPath)
@@ -182,14 +583,11 @@ func LoadBotConfig(configPath string, fileName string) (*BotConfig, error) {
 
 	fullPath := filepath.Join(configPath, fileName)
 	if _, err := os.Stat(fullPath); err == nil {
-		cfg, err := parseConfigFile(fullPath)
-		if err == nil {
-			return cfg, nil
-		}
+		return parseConfigFile(fullPath, defaultBotConfig(configPath))
 	}
 
-	// If we get here, either the file doesn't exist or couldn't be parsed
-	// Generate new credentials and create default config
+	// If we get here the file doesn't exist. Generate new credentials and
+	// create default config
 	rpcUser, err := utils.GenerateRandomString(8)
 	if err != nil {
 		return nil, err
@@ -199,25 +597,61 @@ func LoadBotConfig(configPath string, fileName string) (*BotConfig, error) {
 		return nil, err
 	}
 
-	cfg := &BotConfig{
+	cfg := defaultBotConfig(configPath)
+	cfg.RPCUser = rpcUser
+	cfg.RPCPass = rpcPass
+
+	// Write default config
+	if err := writeConfigFile(cfg, fullPath); err != nil {
+		return nil, fmt.Errorf("failed to write config file: %v", err)
+	}
+
+	return cfg, nil
+}
+
+// defaultBotConfig returns the config of a new bot whose data is stored in
+// configPath. Its values are also used for the keys missing from existing
+// config files.
+func defaultBotConfig(configPath string) *BotConfig {
+	return &BotConfig{
 		DataDir:        configPath,
 		RPCURL:         "wss://127.0.0.1:7676/ws",
 		ServerCertPath: filepath.Join(defaultBRClientDir, "rpc.cert"),
 		ClientCertPath: filepath.Join(defaultBRClientDir, "rpc-client.cert"),
 		ClientKeyPath:  filepath.Join(defaultBRClientDir, "rpc-client.key"),
-		RPCUser:        rpcUser,
-		RPCPass:        rpcPass,
 		Debug:          "info",
+		WhitelistMode:  WhitelistModeOff,
+		AckMode:        AckModeReceive,
+		Reconnect: ReconnectPolicy{
+			InitialDelay:    time.Second,
+			MaxDelay:        time.Minute,
+			Jitter:          0.2,
+			BreakerCooldown: 5 * time.Minute,
+		},
+		Queue: QueuePolicy{
+			Size:     100,
+			Overflow: OverflowBlock,
+		},
+		Outbound: OutboundPolicy{
+			Rate:       10,
+			Burst:      20,
+			DestRate:   1,
+			DestBurst:  5,
+			MaxRetries: 3,
+			RetryDelay: time.Second,
+			QueueSize:  10000,
+		},
+		Split: SplitPolicy{
+			MaxLen:   8000,
+			Number:   true,
+			MaxParts: 10,
+		},
+		Invites: InvitePolicy{
+			ApprovalTimeout: 24 * time.Hour,
+		},
 		LogFile:        filepath.Join(configPath, "logs", "chatbot.log"),
 		MaxLogFiles:    5,
 		MaxBufferLines: 1000,
 		ExtraConfig:    make(map[string]string), // Initialize the map for new configs
 	}
-
-	// Write default config
-	if err := writeConfigFile(cfg, fullPath); err != nil {
-		return nil, fmt.Errorf("failed to write config file: %v", err)
-	}
-
-	return cfg, nil
 }
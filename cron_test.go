@@ -0,0 +1,72 @@
+package bisonbotkit
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseCronErrors(t *testing.T) {
+	tests := []string{
+		"",
+		"* * * *",
+		"* * * * * *",
+		"60 * * * *",
+		"* 24 * * *",
+		"* * 0 * *",
+		"* * * 13 *",
+		"* * * * 8",
+		"5-1 * * * *",
+		"*/0 * * * *",
+		"a * * * *",
+		"1-x * * * *",
+		"@every 10ms",
+		"@every soon",
+		"@never",
+	}
+	for _, spec := range tests {
+		if _, err := parseCron(spec); err == nil {
+			t.Errorf("parseCron(%q) did not fail", spec)
+		}
+	}
+}
+
+func TestCronNext(t *testing.T) {
+	// 2024-01-10 was a Wednesday.
+	from := time.Date(2024, 1, 10, 10, 30, 15, 0, time.UTC)
+	tests := []struct {
+		spec string
+		want time.Time
+	}{
+		{"* * * * *", time.Date(2024, 1, 10, 10, 31, 0, 0, time.UTC)},
+		{"*/15 * * * *", time.Date(2024, 1, 10, 10, 45, 0, 0, time.UTC)},
+		{"0 * * * *", time.Date(2024, 1, 10, 11, 0, 0, 0, time.UTC)},
+		{"30 10 * * *", time.Date(2024, 1, 11, 10, 30, 0, 0, time.UTC)},
+		{"0 9-17/4 * * *", time.Date(2024, 1, 10, 13, 0, 0, 0, time.UTC)},
+		{"0 0,12 * * *", time.Date(2024, 1, 10, 12, 0, 0, 0, time.UTC)},
+		{"0 0 * * 0", time.Date(2024, 1, 14, 0, 0, 0, 0, time.UTC)},
+		{"0 0 * * 7", time.Date(2024, 1, 14, 0, 0, 0, 0, time.UTC)},
+		{"0 0 * * 1-5", time.Date(2024, 1, 11, 0, 0, 0, 0, time.UTC)},
+		{"0 0 31 * *", time.Date(2024, 1, 31, 0, 0, 0, 0, time.UTC)},
+		{"0 0 29 2 *", time.Date(2024, 2, 29, 0, 0, 0, 0, time.UTC)},
+		// Both day fields restricted: either one matches.
+		{"0 0 20 * 5", time.Date(2024, 1, 12, 0, 0, 0, 0, time.UTC)},
+		{"@hourly", time.Date(2024, 1, 10, 11, 0, 0, 0, time.UTC)},
+		{"@daily", time.Date(2024, 1, 11, 0, 0, 0, 0, time.UTC)},
+		{"@weekly", time.Date(2024, 1, 14, 0, 0, 0, 0, time.UTC)},
+		{"@monthly", time.Date(2024, 2, 1, 0, 0, 0, 0, time.UTC)},
+		{"@yearly", time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)},
+		{"@every 90s", from.Add(90 * time.Second)},
+		// Never happens.
+		{"0 0 31 2 *", time.Time{}},
+	}
+	for _, tc := range tests {
+		cs, err := parseCron(tc.spec)
+		if err != nil {
+			t.Errorf("parseCron(%q): %v", tc.spec, err)
+			continue
+		}
+		if got := cs.next(from); !got.Equal(tc.want) {
+			t.Errorf("next of %q = %s, want %s", tc.spec, got, tc.want)
+		}
+	}
+}
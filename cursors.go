@@ -0,0 +1,166 @@
+package bisonbotkit
+
+import (
+	"encoding/json"
+	"os"
+	"sync"
+
+	"github.com/decred/slog"
+	"github.com/vctt94/bisonbotkit/utils"
+)
+
+// Names of the notification streams, used as keys in a CursorStore.
+const (
+	StreamPM          = "pm"
+	StreamGCM         = "gcm"
+	StreamGCInvites   = "gcinvites"
+	StreamKX          = "kx"
+	StreamPosts       = "posts"
+	StreamPostStatus  = "poststatus"
+	StreamTipProgress = "tipprogress"
+	StreamTipReceived = "tipreceived"
+
+	StreamGCMembersAdded = "gcmembersadded"
+)
+
+// CursorStore persists the sequence ID of the last acknowledged message of
+// each notification stream, so that streams resume from where they stopped
+// after the bot restarts.
+type CursorStore interface {
+	// Cursor returns the last sequence ID recorded for the stream, or zero
+	// if there is none.
+	Cursor(stream string) (uint64, error)
+
+	// SetCursor records seq as the last handled sequence ID of the stream.
+	// It may be called concurrently and must ignore a seq lower than the
+	// one already recorded, so that the cursor never moves back.
+	SetCursor(stream string, seq uint64) error
+}
+
+// FileCursorStore is a CursorStore that keeps the cursors of all streams in a
+// JSON file. Cursors set while the file is being written are coalesced into a
+// single write.
+type FileCursorStore struct {
+	mtx     sync.Mutex
+	path    string
+	cursors map[string]uint64
+
+	// writing is set while a SetCursor call writes the file, and dirty
+	// when cursors changed since the file was last written.
+	writing bool
+	dirty   bool
+}
+
+// NewFileCursorStore creates a cursor store backed by the file at path,
+// loading any cursors previously stored in it.
+func NewFileCursorStore(path string) (*FileCursorStore, error) {
+	cursors := make(map[string]uint64)
+	data, err := os.ReadFile(path)
+	switch {
+	case os.IsNotExist(err):
+	case err != nil:
+		return nil, err
+	default:
+		if err := json.Unmarshal(data, &cursors); err != nil {
+			return nil, err
+		}
+	}
+
+	return &FileCursorStore{
+		path:    path,
+		cursors: cursors,
+	}, nil
+}
+
+// Cursor is part of the CursorStore interface.
+func (s *FileCursorStore) Cursor(stream string) (uint64, error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	return s.cursors[stream], nil
+}
+
+// SetCursor is part of the CursorStore interface. If another call is writing
+// the file, the cursor is left for that call to write and SetCursor returns
+// immediately.
+func (s *FileCursorStore) SetCursor(stream string, seq uint64) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	if seq <= s.cursors[stream] {
+		return nil
+	}
+	s.cursors[stream] = seq
+	s.dirty = true
+	if s.writing {
+		return nil
+	}
+
+	s.writing = true
+	defer func() { s.writing = false }()
+	for s.dirty {
+		s.dirty = false
+		data, err := json.Marshal(s.cursors)
+		if err != nil {
+			return err
+		}
+		s.mtx.Unlock()
+		err = utils.AtomicWriteFile(s.path, data, 0600)
+		s.mtx.Lock()
+		if err != nil {
+			// Leave the cursors to be written by the next call.
+			s.dirty = true
+			return err
+		}
+	}
+	return nil
+}
+
+// SetCursorStore replaces the store used to persist stream cursors. By
+// default cursors are stored in cursors.json inside the data dir. Setting a
+// nil store disables cursor persistence. It must be called before Run.
+func (b *Bot) SetCursorStore(cs CursorStore) {
+	b.cursors = cs
+}
+
+// streamCursor returns the sequence ID of the last acknowledged message of
+// the stream. Streams are (re)opened from this point.
+func (b *Bot) streamCursor(stream string, log slog.Logger) uint64 {
+	b.ackedMtx.Lock()
+	defer b.ackedMtx.Unlock()
+	if seq, ok := b.acked[stream]; ok {
+		return seq
+	}
+
+	var seq uint64
+	if b.cursors != nil {
+		var err error
+		seq, err = b.cursors.Cursor(stream)
+		if err != nil {
+			log.Errorf("Failed to load %s stream cursor: %v", stream, err)
+		} else if seq > 0 {
+			log.Debugf("Resuming %s stream from sequence id %d", stream, seq)
+		}
+	}
+	b.acked[stream] = seq
+	return seq
+}
+
+// setStreamCursor records seq as the last acknowledged message of the
+// stream.
+func (b *Bot) setStreamCursor(stream string, seq uint64, log slog.Logger) {
+	b.ackedMtx.Lock()
+	if seq <= b.acked[stream] {
+		b.ackedMtx.Unlock()
+		return
+	}
+	b.acked[stream] = seq
+	b.ackedMtx.Unlock()
+
+	// Concurrent acks may reach the store out of order, which it ignores.
+	if b.cursors == nil {
+		return
+	}
+	if err := b.cursors.SetCursor(stream, seq); err != nil {
+		log.Errorf("Failed to store %s stream cursor: %v", stream, err)
+	}
+}
@@ -0,0 +1,506 @@
+package bisonbotkit
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/companyzero/bisonrelay/clientrpc/types"
+	"github.com/companyzero/bisonrelay/zkidentity"
+	"github.com/decred/slog"
+	"github.com/vctt94/bisonbotkit/utils"
+)
+
+const (
+	defaultDialogTimeout = 5 * time.Minute
+	defaultDialogCancel  = "cancel"
+)
+
+// Reasons passed to Dialog.OnCancel.
+var (
+	// ErrDialogCanceled is the reason of dialogs canceled by the user or
+	// with CancelDialog.
+	ErrDialogCanceled = errors.New("dialog canceled")
+
+	// ErrDialogTimeout is the reason of dialogs whose answer did not
+	// arrive in time.
+	ErrDialogTimeout = errors.New("dialog timed out")
+)
+
+// DialogState is a state of a dialog, which asks the user a question and
+// moves to another state with the answer.
+type DialogState struct {
+	// Prompt is sent when the dialog enters the state. PromptFunc, if
+	// set, is used instead to build it from the dialog values.
+	Prompt     string
+	PromptFunc func(dc *DialogContext) string
+
+	// Options are the accepted answers, compared ignoring case. Any
+	// answer is accepted when it is empty.
+	Options []string
+
+	// Validate, if set, checks the answer and returns its normalized
+	// value. When it fails, the error is sent to the user and the prompt
+	// is repeated.
+	Validate func(dc *DialogContext, answer string) (string, error)
+
+	// Next returns the state the dialog moves to after the answer, which
+	// is already stored in dc.Values under the name of this state. An
+	// empty state ends the dialog. When Next is nil, the dialog ends
+	// after this state.
+	Next func(ctx context.Context, dc *DialogContext, answer string) (string, error)
+}
+
+// Dialog is a conversation with a user made of states. Each state prompts
+// the user and the next PM of the user is its answer.
+type Dialog struct {
+	Name   string
+	Start  string
+	States map[string]*DialogState
+
+	// Timeout is how long the answer of each state is awaited (default
+	// 5m).
+	Timeout time.Duration
+
+	// CancelWords are answers that cancel the dialog (default
+	// "cancel").
+	CancelWords []string
+
+	// OnDone is called when the dialog ends, with every answer in
+	// dc.Values. Its error is sent to the user.
+	OnDone func(ctx context.Context, dc *DialogContext) error
+
+	// OnCancel is called when the dialog is canceled or times out, with
+	// ErrDialogCanceled or ErrDialogTimeout. It defaults to telling the
+	// user.
+	OnCancel func(ctx context.Context, dc *DialogContext, reason error)
+}
+
+// DialogContext is the state of a running dialog.
+type DialogContext struct {
+	Bot  *Bot
+	UID  zkidentity.ShortID
+	Nick string
+
+	Dialog string
+	State  string
+
+	// Values holds the answers by state name, along with any value set
+	// by the dialog handlers. It is persisted, so it only holds strings.
+	Values map[string]string
+}
+
+// Reply sends a PM to the user of the dialog.
+func (dc *DialogContext) Reply(ctx context.Context, msg string) error {
+	return dc.Bot.SendPM(ctx, dc.UID.String(), msg)
+}
+
+// dialogRecord is the persisted state of a running dialog.
+type dialogRecord struct {
+	Dialog   string            `json:"dialog"`
+	State    string            `json:"state"`
+	Nick     string            `json:"nick,omitempty"`
+	Values   map[string]string `json:"values,omitempty"`
+	Started  time.Time         `json:"started"`
+	Deadline time.Time         `json:"-"`
+
+	// Remaining is how long the answer was still awaited when the record
+	// was saved. Deadline is restored from it on load, so that the time
+	// the bot was down does not count against the user.
+	Remaining time.Duration `json:"remaining"`
+
+	// seq changes on every transition, so that an answer and a timeout
+	// handled concurrently do not both apply.
+	seq uint64
+}
+
+// dialogs holds the registered dialogs and the running ones, persisted in a
+// JSON file.
+type dialogs struct {
+	path string
+	log  slog.Logger
+
+	// changed is signalled when a dialog starts or moves to a new state.
+	changed chan struct{}
+
+	mtx     sync.Mutex
+	defs    map[string]*Dialog
+	running map[string]*dialogRecord
+	seq     uint64
+}
+
+func newDialogs(path string, log slog.Logger) (*dialogs, error) {
+	d := &dialogs{
+		path:    path,
+		log:     log,
+		changed: make(chan struct{}, 1),
+		defs:    make(map[string]*Dialog),
+		running: make(map[string]*dialogRecord),
+	}
+	data, err := os.ReadFile(path)
+	switch {
+	case os.IsNotExist(err):
+	case err != nil:
+		return nil, err
+	default:
+		if err := json.Unmarshal(data, &d.running); err != nil {
+			return nil, err
+		}
+		now := time.Now()
+		for _, rec := range d.running {
+			rec.Deadline = now.Add(rec.Remaining)
+			d.seq++
+			rec.seq = d.seq
+		}
+	}
+	return d, nil
+}
+
+// save writes the running dialogs to disk. It must be called with the mutex
+// held.
+func (d *dialogs) save() {
+	now := time.Now()
+	running := make(map[string]dialogRecord, len(d.running))
+	for uid, rec := range d.running {
+		r := *rec
+		r.Remaining = rec.Deadline.Sub(now)
+		running[uid] = r
+	}
+	data, err := json.MarshalIndent(running, "", "  ")
+	if err == nil {
+		err = utils.AtomicWriteFile(d.path, data, 0600)
+	}
+	if err != nil {
+		d.log.Errorf("Unable to save dialogs: %v", err)
+	}
+}
+
+// registered returns true if any dialog is registered.
+func (d *dialogs) registered() bool {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	return len(d.defs) > 0
+}
+
+// RegisterDialog registers a dialog so that it can be started with
+// StartDialog. Dialogs that were running when the bot stopped continue once
+// their definition is registered again, so it must be called before Run.
+func (b *Bot) RegisterDialog(dlg *Dialog) error {
+	if dlg.Name == "" {
+		return errors.New("dialog has no name")
+	}
+	if _, ok := dlg.States[dlg.Start]; !ok {
+		return fmt.Errorf("dialog %q has no start state %q", dlg.Name, dlg.Start)
+	}
+	for name, st := range dlg.States {
+		if st.Prompt == "" && st.PromptFunc == nil {
+			return fmt.Errorf("state %q of dialog %q has no prompt", name, dlg.Name)
+		}
+	}
+	d := b.dialogs
+	d.mtx.Lock()
+	d.defs[dlg.Name] = dlg
+	d.mtx.Unlock()
+	return nil
+}
+
+func (dlg *Dialog) timeout() time.Duration {
+	if dlg.Timeout > 0 {
+		return dlg.Timeout
+	}
+	return defaultDialogTimeout
+}
+
+func (dlg *Dialog) isCancel(answer string) bool {
+	words := dlg.CancelWords
+	if len(words) == 0 {
+		words = []string{defaultDialogCancel}
+	}
+	for _, w := range words {
+		if strings.EqualFold(w, answer) {
+			return true
+		}
+	}
+	return false
+}
+
+// dialogContext returns the context of a running dialog.
+func (b *Bot) dialogContext(uid string, rec *dialogRecord) *DialogContext {
+	dc := &DialogContext{
+		Bot:    b,
+		Nick:   rec.Nick,
+		Dialog: rec.Dialog,
+		State:  rec.State,
+		Values: make(map[string]string, len(rec.Values)),
+	}
+	dc.UID.FromString(uid)
+	for k, v := range rec.Values {
+		dc.Values[k] = v
+	}
+	return dc
+}
+
+// prompt sends the prompt of the current state of a dialog.
+func (b *Bot) prompt(ctx context.Context, dlg *Dialog, dc *DialogContext) {
+	st := dlg.States[dc.State]
+	msg := st.Prompt
+	if st.PromptFunc != nil {
+		msg = st.PromptFunc(dc)
+	}
+	b.QueuePM(ctx, dc.UID.String(), msg)
+}
+
+// StartDialog starts the named dialog with the user, replacing any dialog
+// running with them, and sends the prompt of the start state. values are
+// the initial values of the dialog and may be nil.
+func (b *Bot) StartDialog(ctx context.Context, uid zkidentity.ShortID, nick, name string, values map[string]string) error {
+	d := b.dialogs
+	d.mtx.Lock()
+	dlg, ok := d.defs[name]
+	if !ok {
+		d.mtx.Unlock()
+		return fmt.Errorf("dialog %q is not registered", name)
+	}
+	now := time.Now()
+	rec := &dialogRecord{
+		Dialog:   name,
+		State:    dlg.Start,
+		Nick:     nick,
+		Values:   make(map[string]string, len(values)),
+		Started:  now,
+		Deadline: now.Add(dlg.timeout()),
+	}
+	for k, v := range values {
+		rec.Values[k] = v
+	}
+	d.seq++
+	rec.seq = d.seq
+	d.running[uid.String()] = rec
+	d.save()
+	dc := b.dialogContext(uid.String(), rec)
+	d.mtx.Unlock()
+
+	signal(d.changed)
+	b.prompt(ctx, dlg, dc)
+	return nil
+}
+
+// StartDialog starts the named dialog with the sender of the message.
+func (mc *MsgContext) StartDialog(ctx context.Context, name string, values map[string]string) error {
+	return mc.Bot.StartDialog(ctx, mc.UID, mc.Nick, name, values)
+}
+
+// ActiveDialog returns the name and state of the dialog running with the
+// user, if any.
+func (b *Bot) ActiveDialog(uid zkidentity.ShortID) (string, string, bool) {
+	d := b.dialogs
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	rec, ok := d.running[uid.String()]
+	if !ok {
+		return "", "", false
+	}
+	return rec.Dialog, rec.State, true
+}
+
+// CancelDialog cancels the dialog running with the user, if any.
+func (b *Bot) CancelDialog(ctx context.Context, uid zkidentity.ShortID) {
+	b.endDialog(ctx, uid.String(), 0, ErrDialogCanceled)
+}
+
+// endDialog removes the dialog running with the user and calls its OnCancel
+// handler. If seq is not zero, the dialog is only removed if it did not move
+// to another state.
+func (b *Bot) endDialog(ctx context.Context, uid string, seq uint64, reason error) {
+	d := b.dialogs
+	d.mtx.Lock()
+	rec, ok := d.running[uid]
+	if !ok || (seq != 0 && rec.seq != seq) {
+		d.mtx.Unlock()
+		return
+	}
+	delete(d.running, uid)
+	d.save()
+	dlg := d.defs[rec.Dialog]
+	dc := b.dialogContext(uid, rec)
+	d.mtx.Unlock()
+
+	switch {
+	case dlg != nil && dlg.OnCancel != nil:
+		dlg.OnCancel(ctx, dc, reason)
+	case errors.Is(reason, ErrDialogTimeout):
+		b.QueuePM(ctx, uid, "Timed out waiting for your answer.")
+	default:
+		b.QueuePM(ctx, uid, "Canceled.")
+	}
+}
+
+// handleDialogReply handles the PM of a user with a running dialog as the
+// answer to its current state. It returns false if the user has no running
+// dialog.
+func (b *Bot) handleDialogReply(ctx context.Context, pm *types.ReceivedPM) bool {
+	if pm.Msg == nil {
+		return false
+	}
+	uid := hex.EncodeToString(pm.Uid)
+	d := b.dialogs
+	d.mtx.Lock()
+	rec, ok := d.running[uid]
+	if !ok {
+		d.mtx.Unlock()
+		return false
+	}
+	dlg, ok := d.defs[rec.Dialog]
+	if !ok {
+		d.mtx.Unlock()
+		return false
+	}
+	seq := rec.seq
+	expired := time.Now().After(rec.Deadline)
+	dc := b.dialogContext(uid, rec)
+	if pm.Nick != "" {
+		dc.Nick = pm.Nick
+	}
+	d.mtx.Unlock()
+
+	if expired {
+		b.endDialog(ctx, uid, seq, ErrDialogTimeout)
+		return false
+	}
+
+	answer := strings.TrimSpace(pm.Msg.Message)
+	if dlg.isCancel(answer) {
+		b.endDialog(ctx, uid, seq, ErrDialogCanceled)
+		return true
+	}
+
+	st := dlg.States[dc.State]
+	if len(st.Options) > 0 {
+		valid := false
+		for _, opt := range st.Options {
+			if strings.EqualFold(opt, answer) {
+				answer = opt
+				valid = true
+				break
+			}
+		}
+		if !valid {
+			b.QueuePM(ctx, uid, "Please answer one of: "+strings.Join(st.Options, ", "))
+			return true
+		}
+	}
+	if st.Validate != nil {
+		v, err := st.Validate(dc, answer)
+		if err != nil {
+			b.QueuePM(ctx, uid, err.Error())
+			b.prompt(ctx, dlg, dc)
+			return true
+		}
+		answer = v
+	}
+
+	dc.Values[dc.State] = answer
+	next := ""
+	if st.Next != nil {
+		var err error
+		next, err = st.Next(ctx, dc, answer)
+		if err != nil {
+			b.QueuePM(ctx, uid, err.Error())
+			b.prompt(ctx, dlg, dc)
+			return true
+		}
+		if _, ok := dlg.States[next]; next != "" && !ok {
+			b.pmLog.Errorf("Dialog %s moved to unknown state %q", dlg.Name, next)
+			next = ""
+		}
+	}
+
+	d.mtx.Lock()
+	if rec, ok := d.running[uid]; !ok || rec.seq != seq {
+		// Canceled or restarted while handling the answer.
+		d.mtx.Unlock()
+		return true
+	}
+	if next == "" {
+		delete(d.running, uid)
+	} else {
+		d.seq++
+		d.running[uid] = &dialogRecord{
+			Dialog:   dlg.Name,
+			State:    next,
+			Nick:     dc.Nick,
+			Values:   dc.Values,
+			Started:  rec.Started,
+			Deadline: time.Now().Add(dlg.timeout()),
+			seq:      d.seq,
+		}
+	}
+	d.save()
+	d.mtx.Unlock()
+	signal(d.changed)
+
+	if next != "" {
+		dc.State = next
+		b.prompt(ctx, dlg, dc)
+		return true
+	}
+	if dlg.OnDone != nil {
+		if err := dlg.OnDone(ctx, dc); err != nil {
+			b.QueuePM(ctx, uid, err.Error())
+		}
+	}
+	return true
+}
+
+// runDialogTimeouts ends the dialogs whose answer did not arrive in time,
+// until ctx is done.
+func (b *Bot) runDialogTimeouts(ctx context.Context) error {
+	d := b.dialogs
+	for {
+		now := time.Now()
+		var next time.Time
+		type expired struct {
+			uid string
+			seq uint64
+		}
+		var ended []expired
+		d.mtx.Lock()
+		for uid, rec := range d.running {
+			if _, ok := d.defs[rec.Dialog]; !ok {
+				continue
+			}
+			if !now.Before(rec.Deadline) {
+				ended = append(ended, expired{uid, rec.seq})
+			} else if next.IsZero() || rec.Deadline.Before(next) {
+				next = rec.Deadline
+			}
+		}
+		d.mtx.Unlock()
+		for _, e := range ended {
+			b.endDialog(ctx, e.uid, e.seq, ErrDialogTimeout)
+		}
+
+		var timer <-chan time.Time
+		if !next.IsZero() {
+			timer = time.After(time.Until(next))
+		}
+		select {
+		case <-ctx.Done():
+			// Record the time left to answer at shutdown.
+			d.mtx.Lock()
+			if len(d.running) > 0 {
+				d.save()
+			}
+			d.mtx.Unlock()
+			return ctx.Err()
+		case <-d.changed:
+		case <-timer:
+		}
+	}
+}
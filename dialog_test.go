@@ -0,0 +1,47 @@
+package bisonbotkit
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/decred/slog"
+)
+
+func TestDialogDeadlineRestart(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "dialogs.json")
+	d, err := newDialogs(path, slog.Disabled)
+	if err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(time.Minute)
+	d.running["alice"] = &dialogRecord{Dialog: "signup", State: "name",
+		Started: time.Now(), Deadline: deadline}
+
+	// The time left to answer is saved at shutdown.
+	b := &Bot{dialogs: d}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		b.runDialogTimeouts(ctx)
+		close(done)
+	}()
+	cancel()
+	<-done
+
+	// The time the bot was down extends the deadline.
+	const downtime = 50 * time.Millisecond
+	time.Sleep(downtime)
+	d, err = newDialogs(path, slog.Disabled)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec, ok := d.running["alice"]
+	if !ok {
+		t.Fatal("dialog not loaded")
+	}
+	if got := rec.Deadline.Sub(deadline); got < downtime || got > time.Second {
+		t.Fatalf("deadline moved by %s, want about %s", got, downtime)
+	}
+}
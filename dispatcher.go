@@ -0,0 +1,196 @@
+package bisonbotkit
+
+import (
+	"context"
+	"encoding/hex"
+	"runtime/debug"
+	"sync"
+
+	"github.com/decred/slog"
+)
+
+const (
+	defaultDispatcherWorkers    = 8
+	defaultDispatcherMaxPending = 1000
+)
+
+// DispatcherConfig configures a Dispatcher. Zero values are replaced by the
+// defaults described below.
+type DispatcherConfig struct {
+	// Workers is the maximum number of handlers running concurrently
+	// (default 8).
+	Workers int
+
+	// MaxPending is the maximum number of submitted handlers that have
+	// not finished running (default 1000). Submit blocks once it is
+	// reached.
+	MaxPending int
+
+	// Log is used to log handler errors and panics. Defaults to a
+	// disabled logger.
+	Log slog.Logger
+
+	// OnPanic, if set, is called after a handler panics, with the key the
+	// handler was submitted with and the recovered value.
+	OnPanic func(key string, v interface{})
+}
+
+// dispatchJob is a handler submitted to a Dispatcher.
+type dispatchJob struct {
+	ctx context.Context
+	fn  func(context.Context) error
+}
+
+// Dispatcher runs handlers on a bounded pool of workers. Handlers submitted
+// with the same key (usually the sender's user ID) run one at a time, in the
+// order they were submitted, while handlers of different keys run
+// concurrently.
+type Dispatcher struct {
+	log     slog.Logger
+	onPanic func(key string, v interface{})
+
+	// workers and pending are semaphores bounding the running and the
+	// unfinished handlers.
+	workers chan struct{}
+	pending chan struct{}
+	wg      sync.WaitGroup
+
+	// queues holds the handlers waiting to run for each key. A key is
+	// present while a goroutine is draining its queue.
+	mtx    sync.Mutex
+	queues map[string][]dispatchJob
+}
+
+// NewDispatcher creates a new dispatcher.
+func NewDispatcher(cfg DispatcherConfig) *Dispatcher {
+	if cfg.Workers <= 0 {
+		cfg.Workers = defaultDispatcherWorkers
+	}
+	if cfg.MaxPending <= 0 {
+		cfg.MaxPending = defaultDispatcherMaxPending
+	}
+	if cfg.Log == nil {
+		cfg.Log = slog.Disabled
+	}
+	return &Dispatcher{
+		log:     cfg.Log,
+		onPanic: cfg.OnPanic,
+		workers: make(chan struct{}, cfg.Workers),
+		pending: make(chan struct{}, cfg.MaxPending),
+		queues:  make(map[string][]dispatchJob),
+	}
+}
+
+// Submit queues fn to run after every handler previously submitted with the
+// same key. fn is called with ctx. Submit blocks while MaxPending handlers
+// are unfinished, and returns an error only if ctx is done first.
+func (d *Dispatcher) Submit(ctx context.Context, key string, fn func(context.Context) error) error {
+	select {
+	case d.pending <- struct{}{}:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	d.mtx.Lock()
+	q, active := d.queues[key]
+	d.queues[key] = append(q, dispatchJob{ctx: ctx, fn: fn})
+	if !active {
+		d.wg.Add(1)
+		go d.runKey(key)
+	}
+	d.mtx.Unlock()
+	return nil
+}
+
+// Wait blocks until every submitted handler finished running.
+func (d *Dispatcher) Wait() {
+	d.wg.Wait()
+}
+
+// runKey runs the queued handlers of key until its queue is empty.
+func (d *Dispatcher) runKey(key string) {
+	defer d.wg.Done()
+	for {
+		d.mtx.Lock()
+		q := d.queues[key]
+		if len(q) == 0 {
+			delete(d.queues, key)
+			d.mtx.Unlock()
+			return
+		}
+		job := q[0]
+		q[0] = dispatchJob{}
+		d.queues[key] = q[1:]
+		d.mtx.Unlock()
+
+		// Wait for a free worker. The handler is skipped if its
+		// context is done in the meantime.
+		select {
+		case d.workers <- struct{}{}:
+			d.run(key, job)
+			<-d.workers
+		case <-job.ctx.Done():
+		}
+		<-d.pending
+	}
+}
+
+// run calls the handler, recovering from panics.
+func (d *Dispatcher) run(key string, job dispatchJob) {
+	defer func() {
+		v := recover()
+		if v == nil {
+			return
+		}
+		d.log.Errorf("Handler for %s panicked: %v\n%s", key, v, debug.Stack())
+		if d.onPanic != nil {
+			d.onPanic(key, v)
+		}
+	}()
+
+	if err := job.fn(job.ctx); err != nil {
+		d.log.Errorf("Handler for %s failed: %v", key, err)
+	}
+}
+
+// senderMsg is implemented by clientrpc messages sent by a user.
+type senderMsg[T any] interface {
+	*T
+	GetUid() []byte
+}
+
+// DispatchByUID reads messages from ch (for example the PMChan or GCChan
+// given to the bot, or the tip channels) until ctx is done or ch is closed,
+// and calls handle for each one through the dispatcher, keyed by the sender's
+// user ID. Messages of the same user are handled in order.
+func DispatchByUID[T any, PT senderMsg[T]](ctx context.Context, d *Dispatcher, ch <-chan T, handle func(context.Context, PT) error) error {
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case v, ok := <-ch:
+			if !ok {
+				return nil
+			}
+			msg := PT(&v)
+			err := d.Submit(ctx, hex.EncodeToString(msg.GetUid()), func(ctx context.Context) error {
+				return handle(ctx, msg)
+			})
+			if err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// SetDispatcher makes the bot run the router's handlers of PMs and GC
+// messages through d, keyed by the sender's user ID, so that a slow handler
+// only delays further messages of the same user. It must be called before
+// Run.
+//
+// In manual ack mode, messages handled out of order by the dispatcher are
+// only acked once every earlier message of the stream is handled, whichever
+// user sent it.
+func (b *Bot) SetDispatcher(d *Dispatcher) {
+	b.dispatcher = d
+}
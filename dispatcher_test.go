@@ -0,0 +1,181 @@
+package bisonbotkit
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestDispatcherOrder(t *testing.T) {
+	const keys, perKey = 4, 50
+	d := NewDispatcher(DispatcherConfig{Workers: 2})
+	ctx := context.Background()
+
+	// Handlers of the same key run one at a time, in order.
+	var mtx sync.Mutex
+	got := make(map[string][]int)
+	running := make(map[string]bool)
+	for i := 0; i < perKey; i++ {
+		for k := 0; k < keys; k++ {
+			key, i := fmt.Sprint(k), i
+			err := d.Submit(ctx, key, func(context.Context) error {
+				mtx.Lock()
+				if running[key] {
+					t.Errorf("handlers of %s ran concurrently", key)
+				}
+				running[key] = true
+				mtx.Unlock()
+				time.Sleep(time.Microsecond)
+				mtx.Lock()
+				running[key] = false
+				got[key] = append(got[key], i)
+				mtx.Unlock()
+				return nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	d.Wait()
+	for k := 0; k < keys; k++ {
+		seq := got[fmt.Sprint(k)]
+		if len(seq) != perKey {
+			t.Fatalf("key %d: ran %d handlers, want %d", k, len(seq), perKey)
+		}
+		for i, v := range seq {
+			if v != i {
+				t.Fatalf("key %d: handler %d ran in position %d", k, v, i)
+			}
+		}
+	}
+}
+
+func TestDispatcherBounds(t *testing.T) {
+	tests := []struct {
+		workers, maxPending int
+	}{
+		{1, 1},
+		{2, 4},
+		{3, 100},
+	}
+	for _, tc := range tests {
+		d := NewDispatcher(DispatcherConfig{Workers: tc.workers, MaxPending: tc.maxPending})
+		release := make(chan struct{})
+		var running, maxRunning int32
+		submit := func(ctx context.Context, key string) error {
+			return d.Submit(ctx, key, func(context.Context) error {
+				n := atomic.AddInt32(&running, 1)
+				for {
+					m := atomic.LoadInt32(&maxRunning)
+					if n <= m || atomic.CompareAndSwapInt32(&maxRunning, m, n) {
+						break
+					}
+				}
+				<-release
+				atomic.AddInt32(&running, -1)
+				return nil
+			})
+		}
+
+		// Submit blocks once MaxPending handlers are unfinished.
+		for i := 0; i < tc.maxPending; i++ {
+			if err := submit(context.Background(), fmt.Sprint(i)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+		if err := submit(ctx, "extra"); err == nil {
+			t.Fatalf("%+v: Submit did not block", tc)
+		}
+		cancel()
+
+		time.Sleep(20 * time.Millisecond)
+		close(release)
+		d.Wait()
+		want := tc.workers
+		if tc.maxPending < want {
+			want = tc.maxPending
+		}
+		if m := int(atomic.LoadInt32(&maxRunning)); m != want {
+			t.Fatalf("%+v: %d handlers ran concurrently, want %d", tc, m, want)
+		}
+	}
+}
+
+func TestDispatcherPanic(t *testing.T) {
+	var panicKey string
+	d := NewDispatcher(DispatcherConfig{OnPanic: func(key string, v interface{}) {
+		panicKey = key
+	}})
+	ctx := context.Background()
+	var ran bool
+	d.Submit(ctx, "alice", func(context.Context) error { panic("boom") })
+	d.Submit(ctx, "alice", func(context.Context) error { ran = true; return nil })
+	d.Wait()
+	if panicKey != "alice" || !ran {
+		t.Fatalf("panic not recovered: key %q, next handler ran %v", panicKey, ran)
+	}
+}
+
+func TestDispatcherAcks(t *testing.T) {
+	ctx := context.Background()
+	b, acks := newAckTestBot(t, StreamPM)
+	tracker := b.streams[StreamPM].tracker
+	d := NewDispatcher(DispatcherConfig{})
+
+	// handle submits the handler of msg seq from key, which waits for
+	// release, if not nil, and then acks or nacks the message.
+	handle := func(key string, seq uint64, release chan struct{}, ok bool) {
+		if !tracker.received(seq) {
+			t.Fatalf("msg %d not handled", seq)
+		}
+		d.Submit(ctx, key, func(context.Context) error {
+			if release != nil {
+				<-release
+			}
+			if !ok {
+				b.nack(StreamPM, seq)
+				return nil
+			}
+			return b.ack(ctx, StreamPM, seq)
+		})
+	}
+
+	// A slow handler of alice holds back the ack of a later message of
+	// bob handled first.
+	release := make(chan struct{})
+	handle("alice", 1, release, true)
+	handle("bob", 2, nil, true)
+	waitFor(t, "bob's handler", func() bool {
+		tracker.mtx.Lock()
+		defer tracker.mtx.Unlock()
+		return tracker.states[2] == ackHandled
+	})
+	if got := acks.last(); got != 0 {
+		t.Fatalf("acked up to %d before alice's msg was handled", got)
+	}
+	close(release)
+	d.Wait()
+	if got := acks.last(); got != 2 {
+		t.Fatalf("acked up to %d, want 2", got)
+	}
+
+	// A nacked message of alice holds back the acks of bob until it is
+	// delivered again and handled.
+	handle("alice", 3, nil, false)
+	handle("bob", 4, nil, true)
+	handle("bob", 5, nil, true)
+	d.Wait()
+	if got := acks.last(); got != 2 {
+		t.Fatalf("acked up to %d past a nacked msg", got)
+	}
+	handle("alice", 3, nil, true)
+	d.Wait()
+	if got := acks.last(); got != 5 {
+		t.Fatalf("acked up to %d, want 5", got)
+	}
+}
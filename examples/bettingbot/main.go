@@ -2,21 +2,20 @@ package main
 
 import (
 	"context"
+	"errors"
 	"flag"
 	"fmt"
-	"math/rand"
 	"os"
 	"os/signal"
 	"path/filepath"
-	"strconv"
-	"strings"
 	"syscall"
+	"time"
 
-	"github.com/companyzero/bisonrelay/clientrpc/types"
-	"github.com/companyzero/bisonrelay/zkidentity"
 	"github.com/decred/dcrd/dcrutil/v4"
+	"github.com/decred/slog"
 	kit "github.com/vctt94/bisonbotkit"
 	"github.com/vctt94/bisonbotkit/config"
+	"github.com/vctt94/bisonbotkit/fair"
 	"github.com/vctt94/bisonbotkit/logging"
 	"github.com/vctt94/bisonbotkit/utils"
 )
@@ -25,53 +24,71 @@ var (
 	flagAppRoot = flag.String("approot", "~/.bettingbot", "Path to application data directory")
 )
 
-// handlePM handles incoming PM commands.
-func handlePM(ctx context.Context, bot *kit.Bot, pm *types.ReceivedPM) {
-	tokens := strings.Fields(pm.Msg.Message)
-	if len(tokens) == 0 {
-		return
-	}
-
-	cmd := strings.ToLower(tokens[0])
-
-	// Expected usage: "bet <amount in DCR> <odd|even>"
-	if cmd == "bet" && len(tokens) == 3 {
-		// 1) Parse the bet amount
-		betFloat, err := strconv.ParseFloat(tokens[1], 64)
+// handleBet returns the handler of the "bet <amount> <odd|even>" command.
+// Bets are paid from the balance of the user, funded by tipping the bot, and
+// winnings are credited to it. Numbers are drawn from the provably fair
+// store, so users can verify them.
+func handleBet(accounts *kit.Accounts, rng *fair.Store) kit.HandlerFunc {
+	return func(ctx context.Context, mc *kit.MsgContext) error {
+		// 1) The amount and choice ("odd" or "even") are validated by
+		// the router.
+		betAmount := mc.Amount("amount")
+		choice := mc.Arg("choice")
+
+		// 2) Take the bet and credit the winnings (double the bet for
+		// demonstration) before drawing a number, so bets the user
+		// cannot pay or the house cannot cover are refused without
+		// drawing: the draw is never wasted. The dispatcher runs the
+		// commands of a user one at a time, so the winnings cannot be
+		// withdrawn before the bet is settled and the next nonce is
+		// the one of this bet.
+		commitment, err := rng.Commitment(mc.UID.String())
 		if err != nil {
-			bot.SendPM(ctx, pm.Nick, "Invalid bet amount. Please enter a valid number.")
-			return
+			return err
 		}
-
-		// Convert float to dcrutil.Amount
-		betAmount, err := dcrutil.NewAmount(betFloat)
-		if err != nil {
-			bot.SendPM(ctx, pm.Nick, "Invalid DCR amount. Please enter a valid number.")
-			return
-		}
-		if betAmount <= 0 {
-			bot.SendPM(ctx, pm.Nick, "Bet amount must be greater than 0.")
-			return
+		memo := fmt.Sprintf("bet #%d on %s", commitment.Nonce, choice)
+		payout := betAmount * 2
+		err = accounts.Apply(memo,
+			kit.AccountChange{UID: mc.UID, Amount: -betAmount},
+			kit.AccountChange{UID: mc.UID, Amount: payout})
+		switch {
+		case errors.Is(err, kit.ErrInsufficientFunds):
+			return mc.Replyf(ctx, "Your balance of %.8f DCR is not enough for this bet. "+
+				"Tip the bot to deposit funds.", accounts.Balance(mc.UID).ToCoin())
+		case errors.Is(err, kit.ErrLiabilityCap):
+			return mc.Reply(ctx, "The bot cannot cover this bet right now, please try a smaller amount.")
+		case err != nil:
+			return err
 		}
 
-		// 2) Parse the choice ("odd" or "even")
-		choice := strings.ToLower(tokens[2])
-		if choice != "odd" && choice != "even" {
-			bot.SendPM(ctx, pm.Nick, "Invalid choice. Please use 'odd' or 'even'.")
-			return
+		// 3) Draw a number between 1 and 100. If it cannot be drawn,
+		// the bet is canceled.
+		roll, err := rng.Roll(mc.UID.String(), 100)
+		if err != nil {
+			cancelErr := accounts.Apply(memo+" canceled",
+				kit.AccountChange{UID: mc.UID, Amount: betAmount - payout})
+			return errors.Join(err, cancelErr)
 		}
-
-		// 3) Generate a random number
-		randomNum := rand.Intn(100) + 1
+		randomNum := roll.Value + 1
 		isRandomEven := (randomNum%2 == 0)
 		userWon := false
 		if (choice == "even" && isRandomEven) || (choice == "odd" && !isRandomEven) {
 			userWon = true
 		}
 
-		// 4) Build result message
+		// 4) Lost bets take back the winnings.
+		if !userWon {
+			err := accounts.Apply(fmt.Sprintf("bet #%d lost", roll.Nonce),
+				kit.AccountChange{UID: mc.UID, Amount: -payout})
+			if err != nil {
+				return err
+			}
+		}
+
+		// 5) Build result message
 		resultMsg := fmt.Sprintf(
-			"You bet %.8f DCR on '%s'. Random number: %d (%s).",
+			"Bet #%d: you bet %.8f DCR on '%s'. Random number: %d (%s).",
+			roll.Nonce,
 			betAmount.ToCoin(),
 			choice,
 			randomNum,
@@ -82,30 +99,50 @@ func handlePM(ctx context.Context, bot *kit.Bot, pm *types.ReceivedPM) {
 				return "odd"
 			}(),
 		)
-
-		var uid zkidentity.ShortID
-		uid.FromBytes(pm.Uid)
-
-		// 5) Pay out if the user won
 		if userWon {
-			payout := betAmount * 2 // double the bet for demonstration
-			err := bot.PayTip(ctx, uid, payout, 3)
-			if err != nil {
-				fmt.Println("Error sending tip:", err)
-				bot.SendPM(ctx, pm.Nick,
-					resultMsg+" You won, but there was an error sending your tip: "+err.Error())
-				return
-			}
-			bot.SendPM(ctx, pm.Nick,
-				fmt.Sprintf("%s Congratulations! You won %.8f DCR!", resultMsg, payout.ToCoin()))
+			resultMsg += fmt.Sprintf(" Congratulations! You won %.8f DCR!", payout.ToCoin())
 		} else {
-			bot.SendPM(ctx, pm.Nick, resultMsg+" Sorry, you lost!")
+			resultMsg += " Sorry, you lost!"
 		}
+		return mc.Replyf(ctx, "%s Your balance is %.8f DCR.", resultMsg,
+			accounts.Balance(mc.UID).ToCoin())
+	}
+}
 
-	} else {
-		// Fallback or help message
-		bot.SendPM(ctx, pm.Nick, "Usage: bet <amount in DCR> <odd|even>")
+// newRouter creates the command router of the bot.
+func newRouter(accounts *kit.Accounts, rng *fair.Store, log slog.Logger) (*kit.Router, error) {
+	r := kit.NewRouter()
+
+	// Log commands and report failures (including panics) to the user
+	// instead of bringing the bot down.
+	r.Use(kit.LogCommands(log), kit.ReplyErrors(""),
+		kit.Timing(log, 10*time.Second), kit.Recover())
+	err := r.Register(kit.Command{
+		Name: "bet",
+		Args: []kit.ArgSpec{
+			{Name: "amount", Type: kit.ArgAmount},
+			{Name: "choice", Type: kit.ArgEnum, Options: []string{"odd", "even"}},
+		},
+		Help:    "Bet an amount in DCR on whether a random number is odd or even",
+		Scope:   kit.ScopePM,
+		Handler: handleBet(accounts, rng),
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err := accounts.RegisterCommands(r); err != nil {
+		return nil, err
 	}
+	if err := kit.RegisterFairCommands(r, rng); err != nil {
+		return nil, err
+	}
+
+	// Fallback or help message
+	r.NotFound(func(ctx context.Context, mc *kit.MsgContext) error {
+		return mc.Reply(ctx, "Tip the bot to deposit funds, then use: bet <amount in DCR> <odd|even>, "+
+			"balance, withdraw <amount in DCR>, seed, clientseed <seed>, rotate or verify <bet>")
+	})
+	return r, nil
 }
 
 func realMain() error {
@@ -139,20 +176,13 @@ func realMain() error {
 		return fmt.Errorf("failed to load config: %v", err)
 	}
 
-	// Create channels for handling PMs and tips
-	pmChan := make(chan types.ReceivedPM)
-	tipChan := make(chan types.ReceivedTip)
-	tipProgressChan := make(chan types.TipProgressEvent)
-
-	// Set up PM channel and log
-	cfg.PMChan = pmChan
+	// Set up PM log. PMs are handled by the router.
 	cfg.PMLog = logBackend.Logger("PM")
 
-	// Set up tip channels/logs
+	// Set up tip logs. Received tips are deposited in the accounts of
+	// their senders.
 	cfg.TipLog = logBackend.Logger("TIP")
-	cfg.TipProgressChan = tipProgressChan
 	cfg.TipReceivedLog = logBackend.Logger("TIP_RECEIVED")
-	cfg.TipReceivedChan = tipChan
 
 	// Create the bot
 	bot, err := kit.NewBot(cfg, logBackend)
@@ -160,6 +190,35 @@ func realMain() error {
 		return fmt.Errorf("failed to create bot: %v", err)
 	}
 
+	accounts, err := bot.SetAccounts(kit.AccountsConfig{
+		MaxLiability:  10 * dcrutil.AtomsPerCoin,
+		MinWithdrawal: dcrutil.AtomsPerCoin / 1000,
+		MaxWithdrawal: 5 * dcrutil.AtomsPerCoin,
+		Log:           logBackend.Logger("ACCT"),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to set up accounts: %v", err)
+	}
+
+	rng, err := fair.NewStore(filepath.Join(cfg.DataDir, "fair.json"))
+	if err != nil {
+		return fmt.Errorf("failed to open fair RNG store: %v", err)
+	}
+
+	router, err := newRouter(accounts, rng, logBackend.Logger("CMD"))
+	if err != nil {
+		return fmt.Errorf("failed to create router: %v", err)
+	}
+	bot.SetRouter(router)
+
+	// Handle commands of different users concurrently, so that a slow
+	// command of one user does not delay everyone else.
+	dispatcher := kit.NewDispatcher(kit.DispatcherConfig{
+		Workers: 8,
+		Log:     logBackend.Logger("DISP"),
+	})
+	bot.SetDispatcher(dispatcher)
+
 	// Set up context with cancellation
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
@@ -174,44 +233,6 @@ func realMain() error {
 		cancel()
 	}()
 
-	// Handle PMs
-	go func() {
-		for pm := range pmChan {
-			handlePM(ctx, bot, &pm)
-		}
-	}()
-
-	// Handle received tips
-	go func() {
-		for tip := range tipChan {
-			var userID zkidentity.ShortID
-			userID.FromBytes(tip.Uid)
-
-			log.Infof("Tip received: %.8f DCR from %s",
-				dcrutil.Amount(tip.AmountMatoms/1e3).ToCoin(),
-				userID.String())
-
-			bot.SendPM(ctx, userID.String(),
-				fmt.Sprintf("Thank you for the tip of %.8f DCR!",
-					dcrutil.Amount(tip.AmountMatoms/1e3).ToCoin()))
-
-			bot.AckTipReceived(ctx, tip.SequenceId)
-		}
-	}()
-
-	// Handle tip progress updates
-	go func() {
-		for progress := range tipProgressChan {
-			log.Infof("Tip progress event (sequence ID: %d)", progress.SequenceId)
-
-			// Acknowledge tip progress
-			err := bot.AckTipProgress(ctx, progress.SequenceId)
-			if err != nil {
-				log.Errorf("Failed to acknowledge tip progress: %v", err)
-			}
-		}
-	}()
-
 	// Run the bot
 	err = bot.Run(ctx)
 	log.Infof("Bot exited: %v", err)
@@ -57,17 +57,18 @@ func realMain() error {
 		return fmt.Errorf("failed to create bot: %v", err)
 	}
 
-	// Add a goroutine to handle PMs using our bidirectional channel
-	go func() {
-		for pm := range pmChan {
-			log.Infof("Received PM from %s: %s", pm.Nick, pm.Msg)
-		}
-	}()
-
 	// Set up context with cancellation
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
+	// Add a goroutine to handle PMs using our bidirectional channel. PMs
+	// of each user are logged in order.
+	dispatcher := kit.NewDispatcher(kit.DispatcherConfig{Log: log})
+	go kit.DispatchByUID(ctx, dispatcher, pmChan, func(ctx context.Context, pm *types.ReceivedPM) error {
+		log.Infof("Received PM from %s: %s", pm.Nick, pm.Msg.Message)
+		return nil
+	})
+
 	// Add input handling goroutine
 	go func() {
 		scanner := bufio.NewScanner(os.Stdin)
@@ -0,0 +1,109 @@
+package bisonbotkit
+
+import (
+	"context"
+	"errors"
+
+	"github.com/vctt94/bisonbotkit/fair"
+)
+
+// RegisterFairCommands registers the commands that let users audit the bets
+// made with a provably fair store: "seed" shows the commitments of their next
+// bets, "clientseed <seed>" changes their client seed, "rotate" reveals their
+// server seed and switches to the next one, and "verify <bet>" recomputes the
+// outcome of a past bet.
+func RegisterFairCommands(r *Router, s *fair.Store) error {
+	err := r.Register(Command{
+		Name:  "seed",
+		Help:  "Shows the seeds of your next bet",
+		Scope: ScopePM,
+		Handler: func(ctx context.Context, mc *MsgContext) error {
+			c, err := s.Commitment(mc.UID.String())
+			if err != nil {
+				return err
+			}
+			return mc.Replyf(ctx, "Server seed hash: %s\nNext server seed hash: %s\n"+
+				"Client seed: %s\nNext bet: #%d\n"+
+				"Use clientseed to choose your client seed and rotate to reveal "+
+				"the server seed and verify your bets.",
+				c.ServerHash, c.NextServerHash, c.ClientSeed, c.Nonce)
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	err = r.Register(Command{
+		Name:  "clientseed",
+		Args:  []ArgSpec{{Name: "seed"}},
+		Help:  "Sets the client seed of your next bets",
+		Scope: ScopePM,
+		Handler: func(ctx context.Context, mc *MsgContext) error {
+			c, err := s.SetClientSeed(mc.UID.String(), mc.Arg("seed"))
+			switch {
+			case errors.Is(err, fair.ErrInvalidClientSeed):
+				return UserErrorf("Client seeds must have 1 to 64 characters.")
+			case err != nil:
+				return err
+			}
+			return mc.Replyf(ctx, "Client seed: %s\nServer seed hash: %s",
+				c.ClientSeed, c.ServerHash)
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	err = r.Register(Command{
+		Name:  "rotate",
+		Help:  "Reveals your server seed and switches to the next one",
+		Scope: ScopePM,
+		Handler: func(ctx context.Context, mc *MsgContext) error {
+			revealed, c, err := s.Rotate(mc.UID.String())
+			if err != nil {
+				return err
+			}
+			return mc.Replyf(ctx, "Revealed server seed: %s (hash %s)\n"+
+				"Server seed hash: %s\nNext server seed hash: %s\nClient seed: %s",
+				revealed, fair.HashSeed(revealed), c.ServerHash, c.NextServerHash,
+				c.ClientSeed)
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	return r.Register(Command{
+		Name:  "verify",
+		Args:  []ArgSpec{{Name: "bet", Type: ArgInt}},
+		Help:  "Verifies the outcome of one of your bets",
+		Scope: ScopePM,
+		Handler: func(ctx context.Context, mc *MsgContext) error {
+			nonce := mc.Int("bet")
+			if nonce < 0 {
+				return UserErrorf("Invalid bet number.")
+			}
+			v, err := s.Verify(mc.UID.String(), uint64(nonce))
+			switch {
+			case errors.Is(err, fair.ErrUnknownBet):
+				return UserErrorf("Bet #%d not found.", nonce)
+			case errors.Is(err, fair.ErrNotRevealed):
+				return UserErrorf("The server seed of bet #%d is still in use, "+
+					"use rotate to reveal it first.", nonce)
+			case err != nil:
+				return err
+			}
+			result := "VALID"
+			if !v.Valid {
+				result = "INVALID"
+			}
+			return mc.Replyf(ctx, "Bet #%d: %s\nServer seed: %s\nServer seed hash: %s\n"+
+				"Client seed: %s\nOutcome: %d of [0, %d), recomputed: %d\n"+
+				"Outcome = first 8-byte chunk below the largest multiple of the range "+
+				"of HMAC-SHA256(server seed, \"clientseed:bet:round\") modulo the range, "+
+				"starting at round 0.",
+				v.Nonce, result, v.ServerSeed, v.ServerHash, v.ClientSeed,
+				v.Value, v.N, v.Recomputed)
+		},
+	})
+}
@@ -0,0 +1,378 @@
+// Package fair implements provably fair random numbers with a commit-reveal
+// scheme, for bots that run games of chance.
+//
+// Each user has a secret server seed whose SHA-256 hash is published before
+// any bet is made, a client seed chosen by the user and a nonce incremented
+// on every bet. The outcome of a bet is derived from the HMAC-SHA256 of the
+// client seed and nonce keyed by the server seed. The hash of the next server
+// seed is published in advance too, so rotating cannot pick a seed after
+// seeing the client seed. Once the server seed is rotated it is revealed, so
+// the user can check it matches the published hash and recompute every
+// outcome obtained with it.
+package fair
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/vctt94/bisonbotkit/utils"
+)
+
+// maxOutcomes is the number of outcomes kept per user for verification.
+const maxOutcomes = 1000
+
+// maxClientSeedLen is the maximum length of a client seed.
+const maxClientSeedLen = 64
+
+var (
+	// ErrUnknownBet is returned when verifying a bet that is not
+	// recorded.
+	ErrUnknownBet = errors.New("unknown bet")
+
+	// ErrNotRevealed is returned when verifying a bet whose server seed is
+	// still in use.
+	ErrNotRevealed = errors.New("server seed not revealed yet")
+
+	// ErrInvalidClientSeed is returned when setting an empty or too long
+	// client seed.
+	ErrInvalidClientSeed = errors.New("invalid client seed")
+)
+
+// NewSeed returns a random hex encoded seed of 32 bytes.
+func NewSeed() (string, error) {
+	var b [32]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b[:]), nil
+}
+
+// HashSeed returns the hex encoded SHA-256 hash of a server seed, which is
+// the commitment published before bets are made.
+func HashSeed(serverSeed string) string {
+	h := sha256.Sum256([]byte(serverSeed))
+	return hex.EncodeToString(h[:])
+}
+
+// Roll returns the outcome of a bet, a number in [0, n). It is uniformly
+// distributed: HMAC values that would bias the result are skipped.
+func Roll(serverSeed, clientSeed string, nonce, n uint64) uint64 {
+	if n == 0 {
+		return 0
+	}
+	// limit is the largest multiple of n representable in a uint64.
+	limit := math.MaxUint64 - math.MaxUint64%n
+	for round := uint64(0); ; round++ {
+		mac := hmac.New(sha256.New, []byte(serverSeed))
+		fmt.Fprintf(mac, "%s:%d:%d", clientSeed, nonce, round)
+		sum := mac.Sum(nil)
+		for i := 0; i+8 <= len(sum); i += 8 {
+			v := binary.BigEndian.Uint64(sum[i:])
+			if v < limit {
+				return v % n
+			}
+		}
+	}
+}
+
+// Commitment is what a user knows about their next bet before making it.
+// NextServerHash is the hash of the server seed used after the next
+// rotation.
+type Commitment struct {
+	ServerHash     string
+	NextServerHash string
+	ClientSeed     string
+	Nonce          uint64
+}
+
+// Outcome is the result of a bet.
+type Outcome struct {
+	ServerHash string    `json:"serverhash"`
+	ClientSeed string    `json:"clientseed"`
+	Nonce      uint64    `json:"nonce"`
+	N          uint64    `json:"n"`
+	Value      uint64    `json:"value"`
+	Time       time.Time `json:"time"`
+}
+
+// Verification is the check of a past bet against its revealed server seed.
+type Verification struct {
+	Outcome
+	ServerSeed string
+
+	// Recomputed is the outcome computed from the seeds, and Valid is
+	// set when it matches the recorded outcome and the server seed
+	// matches the published hash.
+	Recomputed uint64
+	Valid      bool
+}
+
+// userState is the persisted state of a user.
+type userState struct {
+	ServerSeed     string    `json:"serverseed"`
+	ServerHash     string    `json:"serverhash"`
+	NextServerSeed string    `json:"nextserverseed"`
+	NextServerHash string    `json:"nextserverhash"`
+	ClientSeed     string    `json:"clientseed"`
+	Nonce          uint64    `json:"nonce"`
+	Outcomes       []Outcome `json:"outcomes,omitempty"`
+
+	// Revealed maps the hashes of the rotated server seeds to the seeds.
+	// Seeds are kept while an outcome obtained with them is kept.
+	Revealed map[string]string `json:"revealed,omitempty"`
+}
+
+// prune drops the oldest outcomes beyond maxOutcomes and the revealed seeds
+// that no kept outcome was obtained with. Revealed is replaced rather than
+// modified, so a copy of the state taken before keeps its seeds.
+func (u *userState) prune() {
+	if len(u.Outcomes) > maxOutcomes {
+		u.Outcomes = u.Outcomes[len(u.Outcomes)-maxOutcomes:]
+	}
+	used := make(map[string]bool)
+	for _, out := range u.Outcomes {
+		used[out.ServerHash] = true
+	}
+	var revealed map[string]string
+	for hash, seed := range u.Revealed {
+		if !used[hash] {
+			continue
+		}
+		if revealed == nil {
+			revealed = make(map[string]string)
+		}
+		revealed[hash] = seed
+	}
+	u.Revealed = revealed
+}
+
+// Store keeps the seeds, nonces and past outcomes of every user, persisted in
+// a JSON file. Users are identified by an opaque string, usually their hex
+// user ID.
+type Store struct {
+	path string
+
+	mtx   sync.Mutex
+	users map[string]*userState
+}
+
+// NewStore creates a store backed by the file at path, loading the state
+// previously stored in it.
+func NewStore(path string) (*Store, error) {
+	s := &Store{path: path, users: make(map[string]*userState)}
+	data, err := os.ReadFile(path)
+	switch {
+	case os.IsNotExist(err):
+	case err != nil:
+		return nil, err
+	default:
+		if err := json.Unmarshal(data, &s.users); err != nil {
+			return nil, fmt.Errorf("invalid fair store file: %w", err)
+		}
+	}
+	return s, nil
+}
+
+// save writes the store to disk. It must be called with the mutex held.
+func (s *Store) save() error {
+	data, err := json.MarshalIndent(s.users, "", "  ")
+	if err != nil {
+		return err
+	}
+	return utils.AtomicWriteFile(s.path, data, 0600)
+}
+
+// newNextSeed commits to a new next server seed.
+func (u *userState) newNextSeed() error {
+	seed, err := NewSeed()
+	if err != nil {
+		return err
+	}
+	u.NextServerSeed = seed
+	u.NextServerHash = HashSeed(seed)
+	return nil
+}
+
+// user returns the state of the user, creating it if needed. It must be
+// called with the mutex held.
+func (s *Store) user(id string) (*userState, error) {
+	if u, ok := s.users[id]; ok {
+		if u.NextServerSeed != "" {
+			return u, nil
+		}
+		// Stored before next seeds were committed in advance.
+		old := *u
+		if err := u.newNextSeed(); err != nil {
+			return nil, err
+		}
+		if err := s.save(); err != nil {
+			*u = old
+			return nil, err
+		}
+		return u, nil
+	}
+	u := &userState{}
+	if err := u.newNextSeed(); err != nil {
+		return nil, err
+	}
+	u.ServerSeed, u.ServerHash = u.NextServerSeed, u.NextServerHash
+	if err := u.newNextSeed(); err != nil {
+		return nil, err
+	}
+	clientSeed, err := NewSeed()
+	if err != nil {
+		return nil, err
+	}
+	u.ClientSeed = clientSeed[:16]
+	s.users[id] = u
+	if err := s.save(); err != nil {
+		delete(s.users, id)
+		return nil, err
+	}
+	return u, nil
+}
+
+func (u *userState) commitment() Commitment {
+	return Commitment{
+		ServerHash:     u.ServerHash,
+		NextServerHash: u.NextServerHash,
+		ClientSeed:     u.ClientSeed,
+		Nonce:          u.Nonce,
+	}
+}
+
+// Commitment returns the server seed hash, client seed and nonce of the next
+// bet of the user, and the hash of the server seed that follows it.
+func (s *Store) Commitment(user string) (Commitment, error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	u, err := s.user(user)
+	if err != nil {
+		return Commitment{}, err
+	}
+	return u.commitment(), nil
+}
+
+// Roll makes a bet of the user, returning an outcome in [0, n).
+func (s *Store) Roll(user string, n uint64) (Outcome, error) {
+	if n == 0 {
+		return Outcome{}, errors.New("roll range must be greater than zero")
+	}
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	u, err := s.user(user)
+	if err != nil {
+		return Outcome{}, err
+	}
+	out := Outcome{
+		ServerHash: u.ServerHash,
+		ClientSeed: u.ClientSeed,
+		Nonce:      u.Nonce,
+		N:          n,
+		Value:      Roll(u.ServerSeed, u.ClientSeed, u.Nonce, n),
+		Time:       time.Now(),
+	}
+	old := *u
+	u.Nonce++
+	u.Outcomes = append(old.Outcomes[:len(old.Outcomes):len(old.Outcomes)], out)
+	if len(u.Outcomes) > maxOutcomes {
+		u.prune()
+	}
+	if err := s.save(); err != nil {
+		// The outcome must not be used if it could not be recorded.
+		*u = old
+		return Outcome{}, err
+	}
+	return out, nil
+}
+
+// SetClientSeed changes the client seed of the user's next bets. The server
+// seed is not rotated: it was committed before the client seed was chosen.
+func (s *Store) SetClientSeed(user, clientSeed string) (Commitment, error) {
+	clientSeed = strings.TrimSpace(clientSeed)
+	if clientSeed == "" || len(clientSeed) > maxClientSeedLen {
+		return Commitment{}, ErrInvalidClientSeed
+	}
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	u, err := s.user(user)
+	if err != nil {
+		return Commitment{}, err
+	}
+	old := u.ClientSeed
+	u.ClientSeed = clientSeed
+	if err := s.save(); err != nil {
+		u.ClientSeed = old
+		return Commitment{}, err
+	}
+	return u.commitment(), nil
+}
+
+// Rotate reveals the current server seed of the user, switches to the next
+// server seed, whose hash was already published, and commits to a new next
+// one. The client seed is kept. Nonces keep increasing across rotations, so
+// they identify the bets of a user.
+func (s *Store) Rotate(user string) (string, Commitment, error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	u, err := s.user(user)
+	if err != nil {
+		return "", Commitment{}, err
+	}
+	old := *u
+	u.ServerSeed, u.ServerHash = u.NextServerSeed, u.NextServerHash
+	if err := u.newNextSeed(); err != nil {
+		*u = old
+		return "", Commitment{}, err
+	}
+	u.Revealed = make(map[string]string, len(old.Revealed)+1)
+	for hash, seed := range old.Revealed {
+		u.Revealed[hash] = seed
+	}
+	u.Revealed[old.ServerHash] = old.ServerSeed
+	u.prune()
+	if err := s.save(); err != nil {
+		*u = old
+		return "", Commitment{}, err
+	}
+	return old.ServerSeed, u.commitment(), nil
+}
+
+// Verify checks the bet of the user with the given nonce. It fails with
+// ErrNotRevealed if the server seed of the bet was not rotated yet.
+func (s *Store) Verify(user string, nonce uint64) (Verification, error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	u, ok := s.users[user]
+	if !ok {
+		return Verification{}, ErrUnknownBet
+	}
+	for _, out := range u.Outcomes {
+		if out.Nonce != nonce {
+			continue
+		}
+		seed, ok := u.Revealed[out.ServerHash]
+		if !ok {
+			return Verification{Outcome: out}, ErrNotRevealed
+		}
+		v := Verification{
+			Outcome:    out,
+			ServerSeed: seed,
+			Recomputed: Roll(seed, out.ClientSeed, out.Nonce, out.N),
+		}
+		v.Valid = HashSeed(seed) == out.ServerHash && v.Recomputed == out.Value
+		return v, nil
+	}
+	return Verification{}, ErrUnknownBet
+}
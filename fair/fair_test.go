@@ -0,0 +1,261 @@
+package fair
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRoll(t *testing.T) {
+	tests := []struct {
+		server, client string
+		nonce, n       uint64
+	}{
+		{"server", "client", 0, 1},
+		{"server", "client", 0, 2},
+		{"server", "client", 1, 6},
+		{"server", "other", 1, 6},
+		{"seed", "client", 42, 100},
+		{"seed", "client", 42, 1 << 63},
+		{"seed", "client", 42, 1<<63 + 1},
+	}
+	for _, tc := range tests {
+		v := Roll(tc.server, tc.client, tc.nonce, tc.n)
+		if v >= tc.n {
+			t.Errorf("Roll(%q, %q, %d, %d) = %d, out of range", tc.server,
+				tc.client, tc.nonce, tc.n, v)
+		}
+		if again := Roll(tc.server, tc.client, tc.nonce, tc.n); again != v {
+			t.Errorf("Roll(%q, %q, %d, %d) is not deterministic: %d, %d",
+				tc.server, tc.client, tc.nonce, tc.n, v, again)
+		}
+	}
+	if v := Roll("server", "client", 0, 0); v != 0 {
+		t.Errorf("Roll with an empty range = %d, want 0", v)
+	}
+}
+
+func TestRollDistribution(t *testing.T) {
+	const n, rolls = 6, 60000
+	var counts [n]int
+	for i := uint64(0); i < rolls; i++ {
+		counts[Roll("server", "client", i, n)]++
+	}
+	for v, c := range counts {
+		if c < rolls/n*9/10 || c > rolls/n*11/10 {
+			t.Errorf("outcome %d drawn %d times out of %d", v, c, rolls)
+		}
+	}
+}
+
+func TestStoreRotateVerify(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "fair.json")
+	s, err := NewStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := s.Commitment("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.ServerHash == c.NextServerHash || c.ClientSeed == "" || c.Nonce != 0 {
+		t.Fatalf("unexpected commitment %+v", c)
+	}
+
+	var outs []Outcome
+	for i := 0; i < 3; i++ {
+		out, err := s.Roll("alice", 100)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if out.Nonce != uint64(i) || out.ServerHash != c.ServerHash {
+			t.Fatalf("unexpected outcome %+v", out)
+		}
+		outs = append(outs, out)
+	}
+	if _, err := s.Verify("alice", 0); !errors.Is(err, ErrNotRevealed) {
+		t.Fatalf("got error %v, want %v", err, ErrNotRevealed)
+	}
+
+	// Changing the client seed keeps the server seeds.
+	c2, err := s.SetClientSeed("alice", " my seed ")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c2.ClientSeed != "my seed" || c2.ServerHash != c.ServerHash ||
+		c2.NextServerHash != c.NextServerHash {
+		t.Fatalf("unexpected commitment %+v", c2)
+	}
+	out, err := s.Roll("alice", 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	outs = append(outs, out)
+
+	// Rotating reveals the seed and switches to the published next one.
+	revealed, c3, err := s.Rotate("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if HashSeed(revealed) != c.ServerHash || c3.ServerHash != c.NextServerHash ||
+		c3.NextServerHash == c3.ServerHash || c3.ClientSeed != "my seed" || c3.Nonce != 4 {
+		t.Fatalf("unexpected rotation: %s, %+v", revealed, c3)
+	}
+
+	// Verification survives a restart.
+	s, err = NewStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, out := range outs {
+		v, err := s.Verify("alice", out.Nonce)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !v.Valid || v.ServerSeed != revealed || v.Recomputed != out.Value ||
+			v.ClientSeed != out.ClientSeed {
+			t.Fatalf("bet %d not verified: %+v", out.Nonce, v)
+		}
+	}
+	if _, err := s.Verify("alice", 99); !errors.Is(err, ErrUnknownBet) {
+		t.Fatalf("got error %v, want %v", err, ErrUnknownBet)
+	}
+	if _, err := s.Verify("bob", 0); !errors.Is(err, ErrUnknownBet) {
+		t.Fatalf("got error %v, want %v", err, ErrUnknownBet)
+	}
+}
+
+func TestStoreClientSeed(t *testing.T) {
+	s, err := NewStore(filepath.Join(t.TempDir(), "fair.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		seed    string
+		wantErr bool
+	}{
+		{seed: "abc"},
+		{seed: strings.Repeat("x", maxClientSeedLen)},
+		{seed: "", wantErr: true},
+		{seed: "   ", wantErr: true},
+		{seed: strings.Repeat("x", maxClientSeedLen+1), wantErr: true},
+	}
+	for _, tc := range tests {
+		_, err := s.SetClientSeed("alice", tc.seed)
+		if tc.wantErr != errors.Is(err, ErrInvalidClientSeed) {
+			t.Errorf("SetClientSeed(%q): unexpected error %v", tc.seed, err)
+		}
+	}
+}
+
+func TestStoreTamperedSeed(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "fair.json")
+	s, err := NewStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err := s.Roll("alice", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := s.Rotate("alice"); err != nil {
+		t.Fatal(err)
+	}
+
+	// A revealed seed that does not match the published hash fails the
+	// verification.
+	s.users["alice"].Revealed[out.ServerHash] = "forged"
+	v, err := s.Verify("alice", out.Nonce)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v.Valid {
+		t.Fatal("forged seed verified")
+	}
+}
+
+func TestStoreLegacyState(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "fair.json")
+	seed := "legacy"
+	legacy := `{"alice": {"serverseed": "` + seed + `", "serverhash": "` + HashSeed(seed) +
+		`", "clientseed": "c", "nonce": 7}}`
+	if err := os.WriteFile(path, []byte(legacy), 0600); err != nil {
+		t.Fatal(err)
+	}
+	s, err := NewStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := s.Commitment("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.ServerHash != HashSeed(seed) || c.NextServerHash == "" || c.Nonce != 7 {
+		t.Fatalf("unexpected commitment %+v", c)
+	}
+	revealed, c2, err := s.Rotate("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if revealed != seed || c2.ServerHash != c.NextServerHash {
+		t.Fatalf("unexpected rotation: %s, %+v", revealed, c2)
+	}
+}
+
+func TestStorePrune(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "fair.json")
+	s, err := NewStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	first, err := s.Roll("alice", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		if _, _, err := s.Rotate("alice"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Seeds revealed without outcomes are not kept.
+	u := s.users["alice"]
+	if len(u.Revealed) != 1 || u.Revealed[first.ServerHash] == "" {
+		t.Fatalf("unexpected revealed seeds %v", u.Revealed)
+	}
+	for len(u.Outcomes) < maxOutcomes {
+		u.Outcomes = append(u.Outcomes, Outcome{ServerHash: u.ServerHash, Nonce: u.Nonce})
+		u.Nonce++
+	}
+
+	// A roll that cannot be saved keeps the oldest outcome and its seed.
+	os.Remove(path)
+	if err := os.MkdirAll(filepath.Join(path, "block"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Roll("alice", 10); err == nil {
+		t.Fatal("roll did not fail")
+	}
+	if len(u.Outcomes) != maxOutcomes || u.Outcomes[0] != first ||
+		u.Nonce != maxOutcomes || u.Revealed[first.ServerHash] == "" {
+		t.Fatalf("failed roll changed the state: %d outcomes, nonce %d",
+			len(u.Outcomes), u.Nonce)
+	}
+	if err := os.RemoveAll(path); err != nil {
+		t.Fatal(err)
+	}
+
+	// Once saved, it drops the oldest outcome along with its seed.
+	if _, err := s.Roll("alice", 10); err != nil {
+		t.Fatal(err)
+	}
+	if len(u.Outcomes) != maxOutcomes || u.Outcomes[0].Nonce != 1 || len(u.Revealed) != 0 {
+		t.Fatalf("not pruned: %d outcomes, %d revealed seeds", len(u.Outcomes),
+			len(u.Revealed))
+	}
+	if _, err := s.Verify("alice", first.Nonce); !errors.Is(err, ErrUnknownBet) {
+		t.Fatalf("got error %v, want %v", err, ErrUnknownBet)
+	}
+}
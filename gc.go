@@ -0,0 +1,124 @@
+package bisonbotkit
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"fmt"
+
+	"github.com/companyzero/bisonrelay/clientrpc/types"
+	"github.com/companyzero/bisonrelay/zkidentity"
+)
+
+// The clientrpc GCService only allows inviting, accepting invites, kicking
+// and reading GC definitions. Creating, parting and killing GCs and changing
+// their admins or owner are only available from the brclient UI, so they are
+// not wrapped here.
+
+// GCMember is a member of a GC.
+type GCMember struct {
+	UID  zkidentity.ShortID
+	Nick string
+
+	// Owner is set for the member that created the GC. The owner is also
+	// an admin.
+	Owner bool
+	Admin bool
+
+	// Self is set for the bot's own client.
+	Self bool
+}
+
+// GetGC returns the definition of the GC with the given name or hex ID.
+func (b *Bot) GetGC(ctx context.Context, gc string) (*types.RMGroupList, error) {
+	var res types.GetGCResponse
+	if err := b.gcService.GetGC(ctx, &types.GetGCRequest{Gc: gc}, &res); err != nil {
+		return nil, err
+	}
+	if res.Gc == nil {
+		return nil, fmt.Errorf("GC %q not found", gc)
+	}
+	return res.Gc, nil
+}
+
+// GCMembers returns the members of the GC with their nicks, in the order of
+// the GC definition (the owner first). The nick of users the bot has not
+// completed a KX with is empty.
+func (b *Bot) GCMembers(ctx context.Context, gc string) ([]GCMember, error) {
+	def, err := b.GetGC(ctx, gc)
+	if err != nil {
+		return nil, err
+	}
+	self, err := b.localID(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("unable to get local ID: %w", err)
+	}
+
+	members := make([]GCMember, 0, len(def.Members))
+	for i, id := range def.Members {
+		var m GCMember
+		if err := m.UID.FromBytes(id); err != nil {
+			return nil, fmt.Errorf("invalid member ID %x: %w", id, err)
+		}
+		m.Owner = i == 0
+		m.Admin = m.Owner || isExtraAdmin(def, id)
+		m.Self = hex.EncodeToString(id) == self
+		if !m.Self {
+			var res types.UserNickResponse
+			req := &types.UserNickRequest{HexUid: m.UID.String()}
+			if err := b.chatService.UserNick(ctx, req, &res); err == nil {
+				m.Nick = res.Nick
+				b.rememberNick(id, m.Nick)
+			}
+		}
+		members = append(members, m)
+	}
+	return members, nil
+}
+
+func isExtraAdmin(def *types.RMGroupList, id []byte) bool {
+	for _, admin := range def.ExtraAdmins {
+		if bytes.Equal(admin, id) {
+			return true
+		}
+	}
+	return false
+}
+
+// IsGCAdmin returns true if the user is the owner or an admin of the GC.
+func (b *Bot) IsGCAdmin(ctx context.Context, gc string, uid zkidentity.ShortID) (bool, error) {
+	def, err := b.GetGC(ctx, gc)
+	if err != nil {
+		return false, err
+	}
+	if len(def.Members) > 0 && bytes.Equal(def.Members[0], uid[:]) {
+		return true, nil
+	}
+	return isExtraAdmin(def, uid[:]), nil
+}
+
+// IsGCMember returns true if the user is a member of the GC.
+func (b *Bot) IsGCMember(ctx context.Context, gc string, uid zkidentity.ShortID) (bool, error) {
+	def, err := b.GetGC(ctx, gc)
+	if err != nil {
+		return false, err
+	}
+	for _, id := range def.Members {
+		if bytes.Equal(id, uid[:]) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// KickFromGC removes the user (ID or nick) from the GC, sending the optional
+// reason to the members. The bot must be an admin of the GC.
+func (b *Bot) KickFromGC(ctx context.Context, gc, user, reason string) error {
+	req := &types.KickFromGCRequest{
+		Gc:     gc,
+		User:   user,
+		Reason: reason,
+	}
+	var res types.KickFromGCResponse
+	return b.gcService.KickFromGC(ctx, req, &res)
+}
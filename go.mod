@@ -8,6 +8,7 @@ require (
 	github.com/decred/slog v1.2.0
 	github.com/jrick/logrotate v1.1.2
 	golang.org/x/sync v0.12.0
+	google.golang.org/protobuf v1.36.6
 )
 
 require (
@@ -27,6 +28,5 @@ require (
 	github.com/klauspost/cpuid/v2 v2.2.8 // indirect
 	golang.org/x/crypto v0.36.0 // indirect
 	golang.org/x/sys v0.31.0 // indirect
-	google.golang.org/protobuf v1.36.6 // indirect
 	lukechampine.com/blake3 v1.3.0 // indirect
 )
@@ -1,13 +1,13 @@
 package bisonbotkit
 
 import (
-	"context"
 	"sync"
+	"time"
 
-	"github.com/companyzero/bisonrelay/clientrpc/jsonrpc"
 	"github.com/companyzero/bisonrelay/clientrpc/types"
 	"github.com/decred/slog"
 	"github.com/vctt94/bisonbotkit/config"
+	"github.com/vctt94/bisonbotkit/logging"
 )
 
 // Bot represents a BisonRelay bot instance with configuration, RPC clients,
@@ -16,13 +16,22 @@ type Bot struct {
 	// Cfg holds the bot's configuration settings
 	cfg *config.BotConfig
 
-	wsc *jsonrpc.WSClient
-	ctx context.Context
+	// conn is the connection to brclient. Its websocket client is run and
+	// possibly recreated by Run.
+	conn *rpcConn
 
+	log        slog.Logger
+	logBackend *logging.LogBackend
+
+	// wl maps whitelisted user IDs to their expiry unix timestamp. See
+	// whitelist.go.
 	wl     map[string]int64
 	wlFile string
 	wlMtx  sync.Mutex
 
+	// wlReplied records when non-whitelisted users were last replied to.
+	wlReplied map[string]time.Time
+
 	gcLog      slog.Logger
 	gcChan     chan<- types.GCReceivedMsg
 	inviteChan chan<- types.ReceivedGCInvite
@@ -45,10 +54,61 @@ type Bot struct {
 	kxLog  slog.Logger
 	kxChan chan<- types.KXCompleted
 
+	router     *Router
+	dispatcher *Dispatcher
+	moderator  *Moderator
+	ledger     *Ledger
+	paywall    *Paywall
+	accounts   *Accounts
+
+	tipPayments *tipPayments
+	cursors     CursorStore
+
+	// manualAck is set when messages are only acked after being handled.
+	manualAck bool
+
+	// acked tracks the last acked sequence id of each stream.
+	ackedMtx sync.Mutex
+	acked    map[string]uint64
+
+	breaker            *circuitBreaker
+	streamStateHandler func(StreamEvent)
+
+	streamsMtx sync.Mutex
+	streams    map[string]streamAcker
+
+	// queues are the delivery queues of the running streams. See
+	// queue.go.
+	queuesMtx     sync.Mutex
+	queues        map[string]queueStatser
+	queuePolicies map[string]config.QueuePolicy
+
+	// invites holds the received invites and joined GCs. See invites.go.
+	invites *inviteStore
+
+	// nicks maps the lowercase nicks of users the bot received messages
+	// from to their hex IDs. See nicks.go.
+	nicksMtx sync.Mutex
+	nicks    map[string]string
+
+	// dialogs holds the registered and running dialogs. See dialog.go.
+	dialogs *dialogs
+
+	// onboarding greets and onboards new users. See onboarding.go.
+	onboarding *onboarding
+
+	// scheduler holds the scheduled jobs. See scheduler.go.
+	scheduler *scheduler
+
+	// outbound queues the PMs and GC messages sent by the bot. See
+	// outbound.go.
+	outbound *outboundQueue
+
 	chatService    types.ChatServiceClient
 	gcService      types.GCServiceClient
 	paymentService types.PaymentsServiceClient
 	postService    types.PostsServiceClient
+	versionService types.VersionServiceClient
 }
 
 type GCs []*types.ListGCsResponse_GCInfo
@@ -66,6 +126,19 @@ func (g GCs) Swap(a, b int) {
 	g[a], g[b] = g[b], g[a]
 }
 
+// SetRouter attaches a command router to the bot. PMs and GC messages that
+// match a registered command are handled by the router instead of being sent
+// to PMChan/GCChan. It must be called before Run.
+func (b *Bot) SetRouter(r *Router) {
+	b.router = r
+}
+
+// ClientConn returns the connection to brclient, which may be used to create
+// clientrpc service clients not wrapped by the bot.
+func (b *Bot) ClientConn() types.ClientConn {
+	return b.conn
+}
+
 func (b *Bot) Close() error {
-	return b.wsc.Close()
+	return b.conn.client().Close()
 }
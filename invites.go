@@ -0,0 +1,353 @@
+package bisonbotkit
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/companyzero/bisonrelay/clientrpc/types"
+	"github.com/companyzero/bisonrelay/zkidentity"
+	"github.com/vctt94/bisonbotkit/utils"
+)
+
+const defaultInviteApprovalTimeout = 24 * time.Hour
+
+// Reasons recorded for joined GCs.
+const (
+	JoinedWhitelisted = "whitelisted"
+	JoinedGCName      = "gcname"
+	JoinedApproved    = "approved"
+	JoinedManual      = "manual"
+)
+
+// GCInvite is a received GC invite that was not accepted yet.
+type GCInvite struct {
+	ID          uint64    `json:"id"`
+	GCID        string    `json:"gcid"`
+	GCName      string    `json:"gcname"`
+	Inviter     string    `json:"inviter"`
+	InviterNick string    `json:"inviternick,omitempty"`
+	Received    time.Time `json:"received"`
+
+	// Expires is when the invite can no longer be accepted. It is the
+	// zero time if the invite does not expire.
+	Expires time.Time `json:"expires,omitempty"`
+
+	// AwaitingApproval is set for invites sent to the approvers.
+	AwaitingApproval bool `json:"awaitingapproval,omitempty"`
+}
+
+// JoinedGC records a GC the bot joined by accepting an invite.
+type JoinedGC struct {
+	GCID        string    `json:"gcid"`
+	GCName      string    `json:"gcname"`
+	InviteID    uint64    `json:"inviteid"`
+	Inviter     string    `json:"inviter,omitempty"`
+	InviterNick string    `json:"inviternick,omitempty"`
+	Joined      time.Time `json:"joined"`
+
+	// Reason is one of the Joined* constants.
+	Reason string `json:"reason"`
+}
+
+// inviteStore keeps the received invites and joined GCs, persisted in a JSON
+// file.
+type inviteStore struct {
+	path string
+
+	mtx     sync.Mutex
+	pending map[uint64]*GCInvite
+	joined  []JoinedGC
+}
+
+type inviteStoreData struct {
+	Pending []*GCInvite `json:"pending"`
+	Joined  []JoinedGC  `json:"joined"`
+}
+
+func newInviteStore(path string) (*inviteStore, error) {
+	s := &inviteStore{
+		path:    path,
+		pending: make(map[uint64]*GCInvite),
+	}
+	data, err := os.ReadFile(path)
+	switch {
+	case os.IsNotExist(err):
+	case err != nil:
+		return nil, err
+	default:
+		var d inviteStoreData
+		if err := json.Unmarshal(data, &d); err != nil {
+			return nil, err
+		}
+		for _, inv := range d.Pending {
+			s.pending[inv.ID] = inv
+		}
+		s.joined = d.Joined
+	}
+	return s, nil
+}
+
+// save writes the store to disk. It must be called with the mutex held.
+func (s *inviteStore) save() error {
+	d := inviteStoreData{Joined: s.joined}
+	for _, inv := range s.pending {
+		d.Pending = append(d.Pending, inv)
+	}
+	sort.Slice(d.Pending, func(i, j int) bool { return d.Pending[i].ID < d.Pending[j].ID })
+	data, err := json.MarshalIndent(d, "", "  ")
+	if err != nil {
+		return err
+	}
+	return utils.AtomicWriteFile(s.path, data, 0600)
+}
+
+// prune removes the expired invites. It must be called with the mutex held.
+func (s *inviteStore) prune(now time.Time) {
+	for id, inv := range s.pending {
+		if !inv.Expires.IsZero() && now.After(inv.Expires) {
+			delete(s.pending, id)
+		}
+	}
+}
+
+// inviteApprovalTimeout returns how long invites wait for approval.
+func (b *Bot) inviteApprovalTimeout() time.Duration {
+	if t := b.cfg.Invites.ApprovalTimeout; t > 0 {
+		return t
+	}
+	return defaultInviteApprovalTimeout
+}
+
+// isInviteApprover returns true if the user may approve invites.
+func (b *Bot) isInviteApprover(uid string) bool {
+	for _, a := range b.cfg.Invites.Approvers {
+		if strings.EqualFold(a, uid) {
+			return true
+		}
+	}
+	return false
+}
+
+// invitePolicyActive returns true if the invite policy handles invites, in
+// which case the invites stream is consumed even without an InviteChan.
+func (b *Bot) invitePolicyActive() bool {
+	p := b.cfg.Invites
+	return p.AcceptWhitelisted || len(p.AcceptGCs) > 0 || len(p.Approvers) > 0
+}
+
+// deliverInvite applies the invite policy to a received invite. Invites that
+// are not accepted automatically are sent to the approvers or, if there are
+// none, to InviteChan.
+func (b *Bot) deliverInvite(ctx context.Context, ri *types.ReceivedGCInvite) {
+	now := time.Now()
+	inv := &GCInvite{
+		ID:          ri.InviteId,
+		Inviter:     hex.EncodeToString(ri.InviterUid),
+		InviterNick: ri.InviterNick,
+		Received:    now,
+	}
+	if ri.Invite != nil {
+		inv.GCID = hex.EncodeToString(ri.Invite.Id)
+		inv.GCName = ri.Invite.Name
+		if ri.Invite.Expires > 0 {
+			inv.Expires = time.Unix(ri.Invite.Expires, 0)
+		}
+	}
+
+	var inviter zkidentity.ShortID
+	validInviter := inviter.FromBytes(ri.InviterUid) == nil
+	p := b.cfg.Invites
+	reason := ""
+	for _, name := range p.AcceptGCs {
+		if strings.EqualFold(name, inv.GCName) {
+			reason = JoinedGCName
+		}
+	}
+	if reason == "" && p.AcceptWhitelisted && validInviter && b.IsWhitelisted(inviter) {
+		reason = JoinedWhitelisted
+	}
+
+	s := b.invites
+	s.mtx.Lock()
+	s.prune(now)
+	s.pending[inv.ID] = inv
+	if reason == "" && len(p.Approvers) > 0 {
+		inv.AwaitingApproval = true
+		expires := now.Add(b.inviteApprovalTimeout())
+		if inv.Expires.IsZero() || expires.Before(inv.Expires) {
+			inv.Expires = expires
+		}
+	}
+	if err := s.save(); err != nil {
+		b.gcLog.Errorf("Unable to save invites: %v", err)
+	}
+	s.mtx.Unlock()
+
+	switch {
+	case reason != "":
+		b.gcLog.Infof("Accepting invite %d from %s to %q (%s)", inv.ID,
+			inv.InviterNick, inv.GCName, reason)
+		if err := b.acceptInvite(ctx, inv.ID, reason); err != nil {
+			b.gcLog.Errorf("Unable to accept invite %d to %q: %v", inv.ID,
+				inv.GCName, err)
+		}
+		b.ackHandled(ctx, StreamGCInvites, ri.SequenceId)
+
+	case inv.AwaitingApproval:
+		msg := fmt.Sprintf("GC invite %d from %s (%s) to %q. Reply "+
+			"\"acceptinvite %d\" to join it or \"rejectinvite %d\" to "+
+			"ignore it.", inv.ID, inv.InviterNick, inv.Inviter, inv.GCName,
+			inv.ID, inv.ID)
+		for _, approver := range p.Approvers {
+			b.QueuePM(ctx, approver, msg, WithPriority(PriorityHigh))
+		}
+		b.ackHandled(ctx, StreamGCInvites, ri.SequenceId)
+
+	case b.inviteChan != nil:
+		b.inviteChan <- *ri
+
+	default:
+		b.gcLog.Infof("Ignoring invite %d from %s to %q", inv.ID,
+			inv.InviterNick, inv.GCName)
+		b.ackHandled(ctx, StreamGCInvites, ri.SequenceId)
+	}
+}
+
+// handleInviteReply handles the "acceptinvite <id>" and "rejectinvite <id>"
+// replies of approvers. It returns false for other PMs.
+func (b *Bot) handleInviteReply(ctx context.Context, pm *types.ReceivedPM) bool {
+	if len(b.cfg.Invites.Approvers) == 0 || pm.Msg == nil {
+		return false
+	}
+	fields := strings.Fields(strings.TrimPrefix(pm.Msg.Message, DefaultGCPrefix))
+	if len(fields) != 2 {
+		return false
+	}
+	cmd := strings.ToLower(fields[0])
+	if cmd != "acceptinvite" && cmd != "rejectinvite" {
+		return false
+	}
+	uid := hex.EncodeToString(pm.Uid)
+	if !b.isInviteApprover(uid) {
+		return false
+	}
+
+	reply := func(msg string) {
+		b.QueuePM(ctx, uid, msg, WithPriority(PriorityHigh))
+	}
+	id, err := strconv.ParseUint(fields[1], 10, 64)
+	if err != nil {
+		reply(fmt.Sprintf("Invalid invite ID %q.", fields[1]))
+		return true
+	}
+
+	s := b.invites
+	s.mtx.Lock()
+	s.prune(time.Now())
+	inv, ok := s.pending[id]
+	if ok && !inv.AwaitingApproval {
+		ok = false
+	}
+	if ok && cmd == "rejectinvite" {
+		delete(s.pending, id)
+		if err := s.save(); err != nil {
+			b.gcLog.Errorf("Unable to save invites: %v", err)
+		}
+	}
+	s.mtx.Unlock()
+
+	switch {
+	case !ok:
+		reply(fmt.Sprintf("Invite %d is not waiting for approval.", id))
+	case cmd == "rejectinvite":
+		b.gcLog.Infof("Invite %d to %q rejected by %s", id, inv.GCName, pm.Nick)
+		reply(fmt.Sprintf("Invite %d to %q rejected.", id, inv.GCName))
+	default:
+		b.gcLog.Infof("Invite %d to %q approved by %s", id, inv.GCName, pm.Nick)
+		if err := b.acceptInvite(ctx, id, JoinedApproved); err != nil {
+			reply(fmt.Sprintf("Unable to accept invite %d: %v", id, err))
+		} else {
+			reply(fmt.Sprintf("Joined %q.", inv.GCName))
+		}
+	}
+	return true
+}
+
+// acceptInvite accepts an invite and records the joined GC.
+func (b *Bot) acceptInvite(ctx context.Context, id uint64, reason string) error {
+	var res types.AcceptGCInviteResponse
+	req := types.AcceptGCInviteRequest{
+		InviteId: id,
+	}
+	if err := b.gcService.AcceptGCInvite(ctx, &req, &res); err != nil {
+		return err
+	}
+
+	s := b.invites
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	j := JoinedGC{InviteID: id, Joined: time.Now(), Reason: reason}
+	if inv, ok := s.pending[id]; ok {
+		j.GCID = inv.GCID
+		j.GCName = inv.GCName
+		j.Inviter = inv.Inviter
+		j.InviterNick = inv.InviterNick
+		delete(s.pending, id)
+	}
+	s.joined = append(s.joined, j)
+	if err := s.save(); err != nil {
+		b.gcLog.Errorf("Unable to save invites: %v", err)
+	}
+	return nil
+}
+
+// AcceptGCInviteByID accepts the GC invite with the given ID, as received in
+// ReceivedGCInvite.InviteId, and records the joined GC.
+func (b *Bot) AcceptGCInviteByID(ctx context.Context, id uint64) error {
+	return b.acceptInvite(ctx, id, JoinedManual)
+}
+
+// RejectGCInvite forgets a pending invite. Bison Relay does not notify the
+// inviter of rejected invites.
+func (b *Bot) RejectGCInvite(id uint64) error {
+	s := b.invites
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	if _, ok := s.pending[id]; !ok {
+		return fmt.Errorf("invite %d not found", id)
+	}
+	delete(s.pending, id)
+	return s.save()
+}
+
+// PendingInvites returns the received invites that were not accepted,
+// rejected or expired, oldest first.
+func (b *Bot) PendingInvites() []GCInvite {
+	s := b.invites
+	s.mtx.Lock()
+	s.prune(time.Now())
+	res := make([]GCInvite, 0, len(s.pending))
+	for _, inv := range s.pending {
+		res = append(res, *inv)
+	}
+	s.mtx.Unlock()
+	sort.Slice(res, func(i, j int) bool { return res[i].Received.Before(res[j].Received) })
+	return res
+}
+
+// JoinedGCs returns the GCs the bot joined by accepting invites, in the order
+// they were joined.
+func (b *Bot) JoinedGCs() []JoinedGC {
+	s := b.invites
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	return append([]JoinedGC(nil), s.joined...)
+}
@@ -0,0 +1,394 @@
+package bisonbotkit
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/companyzero/bisonrelay/clientrpc/types"
+	"github.com/companyzero/bisonrelay/zkidentity"
+	"github.com/decred/dcrd/dcrutil/v4"
+	"github.com/vctt94/bisonbotkit/utils"
+)
+
+// TipDirection is the direction of a tip recorded in the ledger.
+type TipDirection string
+
+const (
+	// TipIn is a tip received from a user.
+	TipIn TipDirection = "in"
+
+	// TipOut is a tip sent to a user with PayTip.
+	TipOut TipDirection = "out"
+)
+
+// TipStatus is the status of a tip recorded in the ledger.
+type TipStatus string
+
+const (
+	// TipPending is an outbound tip requested but not yet paid.
+	TipPending TipStatus = "pending"
+
+	// TipRetrying is an outbound tip whose last attempt failed and that
+	// will be attempted again.
+	TipRetrying TipStatus = "retrying"
+
+	// TipCompleted is a tip that was paid. Received tips are always
+	// completed.
+	TipCompleted TipStatus = "completed"
+
+	// TipFailed is an outbound tip that will not be attempted again.
+	TipFailed TipStatus = "failed"
+
+	// TipUnknown is an outbound tip whose request failed in a way that
+	// does not tell whether it was sent, such as a lost connection. It is
+	// resolved by the tip progress events of the tip, if any.
+	TipUnknown TipStatus = "unknown"
+)
+
+// LedgerEntry is a tip recorded in the ledger.
+type LedgerEntry struct {
+	ID        uint64       `json:"id"`
+	Direction TipDirection `json:"direction"`
+	UID       string       `json:"uid"`
+	Nick      string       `json:"nick,omitempty"`
+
+	// MAtoms is the amount of the tip in milli-atoms.
+	MAtoms int64     `json:"matoms"`
+	Status TipStatus `json:"status"`
+
+	// Attempts is the number of payment attempts of outbound tips and
+	// Error the error of the last failed attempt.
+	Attempts int32  `json:"attempts,omitempty"`
+	Error    string `json:"error,omitempty"`
+
+	// SequenceID is the sequence ID of the received tip notification.
+	SequenceID uint64 `json:"seq,omitempty"`
+
+	Created time.Time `json:"created"`
+	Updated time.Time `json:"updated"`
+}
+
+// Amount returns the amount of the tip, truncated to atoms.
+func (e LedgerEntry) Amount() dcrutil.Amount {
+	return dcrutil.Amount(e.MAtoms / 1000)
+}
+
+// Balance is the summary of the tips exchanged with a user.
+type Balance struct {
+	UID string
+
+	// Received is the total received from the user, Sent the total of the
+	// completed tips sent to them and Pending the total of the outbound
+	// tips not yet completed nor failed.
+	Received dcrutil.Amount
+	Sent     dcrutil.Amount
+	Pending  dcrutil.Amount
+}
+
+// Net returns the amount received from the user minus the amount sent or
+// being sent to them.
+func (b Balance) Net() dcrutil.Amount {
+	return b.Received - b.Sent - b.Pending
+}
+
+// LedgerTotals are the totals of the tips of a period.
+type LedgerTotals struct {
+	Received      dcrutil.Amount
+	Sent          dcrutil.Amount
+	Pending       dcrutil.Amount
+	Failed        dcrutil.Amount
+	ReceivedCount int
+	SentCount     int
+}
+
+// HistoryQuery filters the ledger history. Zero fields match every entry.
+type HistoryQuery struct {
+	UID       zkidentity.ShortID
+	Direction TipDirection
+	Status    TipStatus
+
+	// Since and Until bound the creation time of the entries, Until being
+	// exclusive.
+	Since time.Time
+	Until time.Time
+
+	// Limit returns only the most recent entries.
+	Limit int
+}
+
+// ledgerState is the persisted state of the ledger.
+type ledgerState struct {
+	NextID  uint64         `json:"nextid"`
+	Entries []*LedgerEntry `json:"entries"`
+
+	// ReceivedSeqs are the sequence IDs of the received tips recorded,
+	// used to skip tips delivered again after a restart.
+	ReceivedSeqs appliedSeqs `json:"receivedseqs"`
+}
+
+// Ledger records the tips received and sent by the bot, persisted in a JSON
+// file. It is attached to a bot with SetLedger, after which received tips and
+// the progress of tips sent with PayTip are recorded automatically.
+type Ledger struct {
+	path string
+
+	mtx   sync.Mutex
+	state ledgerState
+}
+
+// NewLedger creates a ledger backed by the file at path, loading the entries
+// previously stored in it.
+func NewLedger(path string) (*Ledger, error) {
+	l := &Ledger{path: path, state: ledgerState{NextID: 1}}
+	data, err := os.ReadFile(path)
+	switch {
+	case os.IsNotExist(err):
+	case err != nil:
+		return nil, err
+	default:
+		if err := json.Unmarshal(data, &l.state); err != nil {
+			return nil, fmt.Errorf("invalid ledger file: %w", err)
+		}
+	}
+	return l, nil
+}
+
+// SetLedger attaches a ledger to the bot. It must be called before Run.
+func (b *Bot) SetLedger(l *Ledger) {
+	b.ledger = l
+}
+
+// Ledger returns the ledger attached to the bot, if any.
+func (b *Bot) Ledger() *Ledger {
+	return b.ledger
+}
+
+// save writes st to disk and then makes it the state of the ledger, so
+// changes that could not be persisted are discarded. It must be called with
+// the mutex held.
+func (l *Ledger) save(st ledgerState) error {
+	data, err := json.MarshalIndent(&st, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := utils.AtomicWriteFile(l.path, data, 0600); err != nil {
+		return err
+	}
+	l.state = st
+	return nil
+}
+
+// add appends a new entry to the state.
+func (st *ledgerState) add(e *LedgerEntry) {
+	e.ID = st.NextID
+	st.NextID++
+	e.Created = time.Now()
+	e.Updated = e.Created
+	st.Entries = append(st.Entries, e)
+}
+
+// recordReceived records a received tip. It returns false if the tip was
+// already recorded.
+func (l *Ledger) recordReceived(tip *types.ReceivedTip) (bool, error) {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	if l.state.ReceivedSeqs.has(tip.SequenceId) {
+		return false, nil
+	}
+	st := l.state
+	st.add(&LedgerEntry{
+		Direction:  TipIn,
+		UID:        hex.EncodeToString(tip.Uid),
+		MAtoms:     tip.AmountMatoms,
+		Status:     TipCompleted,
+		SequenceID: tip.SequenceId,
+	})
+	st.ReceivedSeqs = st.ReceivedSeqs.add(tip.SequenceId)
+	if err := l.save(st); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// recordSend records an outbound tip about to be requested.
+func (l *Ledger) recordSend(uid zkidentity.ShortID, amt dcrutil.Amount) (uint64, error) {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	e := &LedgerEntry{
+		Direction: TipOut,
+		UID:       uid.String(),
+		MAtoms:    int64(amt) * 1000,
+		Status:    TipPending,
+	}
+	st := l.state
+	st.add(e)
+	if err := l.save(st); err != nil {
+		return 0, err
+	}
+	return e.ID, nil
+}
+
+// updateSend updates the outbound tip of a tip payment.
+func (l *Ledger) updateSend(rec TipPaymentRecord) error {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	for i, e := range l.state.Entries {
+		if e.ID != rec.LedgerID {
+			continue
+		}
+		upd := *e
+		if rec.Nick != "" {
+			upd.Nick = rec.Nick
+		}
+		upd.Status = rec.Status
+		upd.Attempts = rec.Attempts
+		upd.Error = rec.Error
+		upd.Updated = time.Now()
+		st := l.state
+		st.Entries = append([]*LedgerEntry(nil), st.Entries...)
+		st.Entries[i] = &upd
+		return l.save(st)
+	}
+	return nil
+}
+
+// Entry returns the entry with the given ID.
+func (l *Ledger) Entry(id uint64) (LedgerEntry, bool) {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	for _, e := range l.state.Entries {
+		if e.ID == id {
+			return *e, true
+		}
+	}
+	return LedgerEntry{}, false
+}
+
+// Balance returns the summary of the tips exchanged with the user.
+func (l *Ledger) Balance(uid zkidentity.ShortID) Balance {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	var mb matomsBalance
+	id := uid.String()
+	for _, e := range l.state.Entries {
+		if e.UID == id {
+			mb.add(e)
+		}
+	}
+	return mb.balance(id)
+}
+
+// Balances returns the balances of every user in the ledger, sorted by user
+// ID.
+func (l *Ledger) Balances() []Balance {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	byUser := make(map[string]*matomsBalance)
+	for _, e := range l.state.Entries {
+		mb, ok := byUser[e.UID]
+		if !ok {
+			mb = new(matomsBalance)
+			byUser[e.UID] = mb
+		}
+		mb.add(e)
+	}
+	res := make([]Balance, 0, len(byUser))
+	for uid, mb := range byUser {
+		res = append(res, mb.balance(uid))
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].UID < res[j].UID })
+	return res
+}
+
+// matomsBalance accumulates a balance in milli-atoms, so that amounts are
+// only truncated to atoms once.
+type matomsBalance struct {
+	received, sent, pending int64
+}
+
+func (mb *matomsBalance) add(e *LedgerEntry) {
+	switch {
+	case e.Direction == TipIn:
+		mb.received += e.MAtoms
+	case e.Status == TipCompleted:
+		mb.sent += e.MAtoms
+	case e.Status == TipPending || e.Status == TipRetrying || e.Status == TipUnknown:
+		mb.pending += e.MAtoms
+	}
+}
+
+func (mb *matomsBalance) balance(uid string) Balance {
+	return Balance{
+		UID:      uid,
+		Received: dcrutil.Amount(mb.received / 1000),
+		Sent:     dcrutil.Amount(mb.sent / 1000),
+		Pending:  dcrutil.Amount(mb.pending / 1000),
+	}
+}
+
+// match returns true if the entry matches the query filters (except Limit).
+func (q *HistoryQuery) match(e *LedgerEntry) bool {
+	switch {
+	case q.UID != (zkidentity.ShortID{}) && e.UID != q.UID.String():
+		return false
+	case q.Direction != "" && e.Direction != q.Direction:
+		return false
+	case q.Status != "" && e.Status != q.Status:
+		return false
+	case !q.Since.IsZero() && e.Created.Before(q.Since):
+		return false
+	case !q.Until.IsZero() && !e.Created.Before(q.Until):
+		return false
+	}
+	return true
+}
+
+// History returns the entries that match the query, oldest first.
+func (l *Ledger) History(q HistoryQuery) []LedgerEntry {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	var res []LedgerEntry
+	for _, e := range l.state.Entries {
+		if q.match(e) {
+			res = append(res, *e)
+		}
+	}
+	if q.Limit > 0 && len(res) > q.Limit {
+		res = res[len(res)-q.Limit:]
+	}
+	return res
+}
+
+// Totals returns the totals of the tips created between since and until
+// (exclusive). Zero times leave the period unbounded.
+func (l *Ledger) Totals(since, until time.Time) LedgerTotals {
+	q := HistoryQuery{Since: since, Until: until}
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	var res LedgerTotals
+	var mb matomsBalance
+	var failed int64
+	for _, e := range l.state.Entries {
+		if !q.match(e) {
+			continue
+		}
+		mb.add(e)
+		switch {
+		case e.Direction == TipIn:
+			res.ReceivedCount++
+		case e.Status == TipCompleted:
+			res.SentCount++
+		case e.Status == TipFailed:
+			failed += e.MAtoms
+		}
+	}
+	bal := mb.balance("")
+	res.Received, res.Sent, res.Pending = bal.Received, bal.Sent, bal.Pending
+	res.Failed = dcrutil.Amount(failed / 1000)
+	return res
+}
@@ -0,0 +1,184 @@
+package bisonbotkit
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/companyzero/bisonrelay/clientrpc/types"
+	"github.com/companyzero/bisonrelay/zkidentity"
+	"github.com/decred/dcrd/dcrutil/v4"
+)
+
+// breakSaves makes the files written to path fail to save, by putting a
+// non-empty directory in their place, until the returned function is called.
+func breakSaves(t *testing.T, path string) func() {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		t.Fatal(err)
+	}
+	os.Remove(path)
+	if err := os.MkdirAll(filepath.Join(path, "block"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	return func() {
+		t.Helper()
+		if err := os.RemoveAll(path); err != nil {
+			t.Fatal(err)
+		}
+		if data != nil {
+			if err := os.WriteFile(path, data, 0600); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+}
+
+func testUID(b byte) zkidentity.ShortID {
+	var id zkidentity.ShortID
+	id[0] = b
+	return id
+}
+
+func testTip(uid zkidentity.ShortID, seq uint64, amt dcrutil.Amount) *types.ReceivedTip {
+	return &types.ReceivedTip{Uid: uid[:], SequenceId: seq, AmountMatoms: int64(amt) * 1000}
+}
+
+func TestLedgerRecordReceived(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ledger.json")
+	l, err := NewLedger(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	alice, bob := testUID(1), testUID(2)
+
+	tests := []struct {
+		name string
+		tip  *types.ReceivedTip
+		want bool
+	}{
+		{"first", testTip(alice, 5, 100), true},
+		{"duplicate", testTip(alice, 5, 100), false},
+		{"older", testTip(bob, 3, 100), true},
+		{"older again", testTip(bob, 3, 100), false},
+		{"newer", testTip(bob, 6, 50), true},
+		{"no sequence", testTip(bob, 0, 10), true},
+		{"no sequence again", testTip(bob, 0, 10), true},
+	}
+	for _, tc := range tests {
+		got, err := l.recordReceived(tc.tip)
+		if err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		if got != tc.want {
+			t.Fatalf("%s: got %v, want %v", tc.name, got, tc.want)
+		}
+	}
+	if bal := l.Balance(alice); bal.Received != 100 {
+		t.Fatalf("alice received %s, want 100 atoms", bal.Received)
+	}
+	if bal := l.Balance(bob); bal.Received != 170 {
+		t.Fatalf("bob received %s, want 170 atoms", bal.Received)
+	}
+
+	// Tips delivered again after a restart are skipped.
+	l, err = NewLedger(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, seq := range []uint64{3, 5, 6} {
+		if ok, err := l.recordReceived(testTip(alice, seq, 100)); ok || err != nil {
+			t.Fatalf("tip %d recorded again after restart: %v, %v", seq, ok, err)
+		}
+	}
+	if n := len(l.History(HistoryQuery{})); n != 5 {
+		t.Fatalf("got %d entries after restart, want 5", n)
+	}
+}
+
+func TestLedgerSaveFailure(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ledger.json")
+	l, err := NewLedger(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	alice := testUID(1)
+	if _, err := l.recordReceived(testTip(alice, 1, 100)); err != nil {
+		t.Fatal(err)
+	}
+	sendID, err := l.recordSend(alice, 30)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	restore := breakSaves(t, path)
+	if ok, err := l.recordReceived(testTip(alice, 2, 100)); ok || err == nil {
+		t.Fatalf("recordReceived did not fail: %v, %v", ok, err)
+	}
+	if _, err := l.recordSend(alice, 10); err == nil {
+		t.Fatal("recordSend did not fail")
+	}
+	rec := TipPaymentRecord{LedgerID: sendID, Status: TipCompleted}
+	if err := l.updateSend(rec); err == nil {
+		t.Fatal("updateSend did not fail")
+	}
+	want := Balance{UID: alice.String(), Received: 100, Pending: 30}
+	if bal := l.Balance(alice); bal != want {
+		t.Fatalf("balance changed by failed saves: %+v", bal)
+	}
+	restore()
+
+	// The failed tip is recorded when it is delivered again, even after a
+	// later tip was recorded.
+	for _, seq := range []uint64{3, 2} {
+		if ok, err := l.recordReceived(testTip(alice, seq, 100)); !ok || err != nil {
+			t.Fatalf("tip %d not recorded after failure: %v, %v", seq, ok, err)
+		}
+	}
+	if err := l.updateSend(rec); err != nil {
+		t.Fatal(err)
+	}
+	want = Balance{UID: alice.String(), Received: 300, Sent: 30}
+	if bal := l.Balance(alice); bal != want {
+		t.Fatalf("got balance %+v, want %+v", bal, want)
+	}
+	e, ok := l.Entry(4)
+	if !ok || e.Direction != TipIn || e.SequenceID != 2 {
+		t.Fatalf("unexpected entry 4: %+v", e)
+	}
+}
+
+func TestLedgerBalanceStatuses(t *testing.T) {
+	alice := testUID(1)
+	tests := []struct {
+		status        TipStatus
+		sent, pending dcrutil.Amount
+		failed        dcrutil.Amount
+	}{
+		{status: TipPending, pending: 10},
+		{status: TipRetrying, pending: 10},
+		{status: TipUnknown, pending: 10},
+		{status: TipCompleted, sent: 10},
+		{status: TipFailed, failed: 10},
+	}
+	for _, tc := range tests {
+		l, err := NewLedger(filepath.Join(t.TempDir(), "ledger.json"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		id, err := l.recordSend(alice, 10)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := l.updateSend(TipPaymentRecord{LedgerID: id, Status: tc.status}); err != nil {
+			t.Fatal(err)
+		}
+		bal := l.Balance(alice)
+		totals := l.Totals(time.Time{}, time.Time{})
+		if bal.Sent != tc.sent || bal.Pending != tc.pending || totals.Failed != tc.failed {
+			t.Fatalf("%s: got balance %+v, totals %+v", tc.status, bal, totals)
+		}
+	}
+}
@@ -0,0 +1,168 @@
+package bisonbotkit
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"runtime/debug"
+	"time"
+
+	"github.com/decred/slog"
+)
+
+// DefaultErrorReply is the reply sent by ReplyErrors when no message is
+// given.
+const DefaultErrorReply = "Sorry, something went wrong while handling your command."
+
+// Middleware wraps a handler to add behavior around it.
+type Middleware func(HandlerFunc) HandlerFunc
+
+// PanicError is the error returned by handlers wrapped with Recover when they
+// panic.
+type PanicError struct {
+	Value interface{}
+	Stack []byte
+}
+
+func (e *PanicError) Error() string {
+	return fmt.Sprintf("panic: %v", e.Value)
+}
+
+// UserError is an error whose message is meant to be shown to the user, for
+// example to report invalid arguments. ReplyErrors sends its message as is.
+type UserError struct {
+	Msg string
+}
+
+func (e *UserError) Error() string {
+	return e.Msg
+}
+
+// UserErrorf returns a UserError with the formatted message.
+func UserErrorf(format string, args ...interface{}) error {
+	return &UserError{Msg: fmt.Sprintf(format, args...)}
+}
+
+// Use adds middlewares to the router. They wrap the handlers of every
+// command, including the NotFound handler, with the first middleware being
+// the outermost one. A typical chain is:
+//
+//	r.Use(LogCommands(log), ReplyErrors(""), Timing(log, 5*time.Second), Recover())
+func (r *Router) Use(mws ...Middleware) {
+	r.mtx.Lock()
+	r.middlewares = append(r.middlewares, mws...)
+	r.mtx.Unlock()
+}
+
+// wrap applies the router's middlewares to h.
+func (r *Router) wrap(h HandlerFunc) HandlerFunc {
+	r.mtx.Lock()
+	mws := r.middlewares
+	r.mtx.Unlock()
+	for i := len(mws) - 1; i >= 0; i-- {
+		h = mws[i](h)
+	}
+	return h
+}
+
+// Recover returns a middleware that recovers from panics in the handler and
+// returns them as a *PanicError.
+func Recover() Middleware {
+	return func(next HandlerFunc) HandlerFunc {
+		return func(ctx context.Context, mc *MsgContext) (err error) {
+			defer func() {
+				if v := recover(); v != nil {
+					err = &PanicError{Value: v, Stack: debug.Stack()}
+				}
+			}()
+			return next(ctx, mc)
+		}
+	}
+}
+
+// describe returns a description of the command invocation for logging.
+func (mc *MsgContext) describe() string {
+	cmd := mc.Cmd
+	if cmd == "" {
+		cmd = "unknown command"
+	}
+	if mc.IsGC() {
+		return fmt.Sprintf("%s from %s (%s) in %s", cmd, mc.Nick, mc.UID, mc.GC)
+	}
+	return fmt.Sprintf("%s from %s (%s)", cmd, mc.Nick, mc.UID)
+}
+
+// LogCommands returns a middleware that logs every command invocation at the
+// debug level and failed commands at the error level, including the stack of
+// recovered panics. log is usually a subsystem logger obtained from
+// logging.LogBackend.
+func LogCommands(log slog.Logger) Middleware {
+	return func(next HandlerFunc) HandlerFunc {
+		return func(ctx context.Context, mc *MsgContext) error {
+			log.Debugf("Handling %s", mc.describe())
+			err := next(ctx, mc)
+			var userErr *UserError
+			var panicErr *PanicError
+			switch {
+			case err == nil:
+			case errors.As(err, &userErr):
+				log.Debugf("Rejected %s: %v", mc.describe(), err)
+			case errors.As(err, &panicErr):
+				log.Errorf("Panic handling %s: %v\n%s", mc.describe(),
+					panicErr.Value, panicErr.Stack)
+			default:
+				log.Errorf("Failed to handle %s: %v", mc.describe(), err)
+			}
+			return err
+		}
+	}
+}
+
+// Timing returns a middleware that logs how long each command took at the
+// debug level, or at the warn level when it took longer than slow. A zero
+// slow disables the warnings.
+func Timing(log slog.Logger, slow time.Duration) Middleware {
+	return func(next HandlerFunc) HandlerFunc {
+		return func(ctx context.Context, mc *MsgContext) error {
+			start := time.Now()
+			err := next(ctx, mc)
+			d := time.Since(start)
+			if slow > 0 && d >= slow {
+				log.Warnf("Slow command %s took %s", mc.describe(), d)
+			} else {
+				log.Debugf("Command %s took %s", mc.describe(), d)
+			}
+			return err
+		}
+	}
+}
+
+// ReplyErrors returns a middleware that reports failed commands to the user.
+// The message of a UserError is replied where the command was sent from, after
+// which the command is considered handled. Other errors, including panics, are
+// reported privately to the sender with msg, or DefaultErrorReply if msg is
+// empty, and are still returned so that they are logged.
+func ReplyErrors(msg string) Middleware {
+	if msg == "" {
+		msg = DefaultErrorReply
+	}
+	return func(next HandlerFunc) HandlerFunc {
+		return func(ctx context.Context, mc *MsgContext) error {
+			err := next(ctx, mc)
+			if err == nil {
+				return nil
+			}
+			var userErr *UserError
+			if errors.As(err, &userErr) {
+				if replyErr := mc.Reply(ctx, userErr.Msg); replyErr != nil {
+					return fmt.Errorf("%w (unable to reply: %v)", err, replyErr)
+				}
+				return nil
+			}
+			if replyErr := mc.ReplyPM(ctx, msg); replyErr != nil {
+				return fmt.Errorf("%w (unable to reply: %v)", err, replyErr)
+			}
+			return err
+		}
+	}
+}
@@ -0,0 +1,845 @@
+package bisonbotkit
+
+import (
+	"bufio"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/companyzero/bisonrelay/clientrpc/types"
+	"github.com/companyzero/bisonrelay/zkidentity"
+	"github.com/decred/slog"
+	"github.com/vctt94/bisonbotkit/utils"
+)
+
+// ErrBannedFromGC is returned by InviteToGC for users banned from the GC by
+// the moderator.
+var ErrBannedFromGC = errors.New("user is banned from the GC")
+
+// ModAction is an action taken against a GC member that broke a rule.
+type ModAction string
+
+const (
+	// ModWarn sends the member a PM explaining the violation.
+	ModWarn ModAction = "warn"
+
+	// ModMute adds the member to the mute list for the mute duration.
+	// Messages of muted members are not handled by the bot and count as
+	// further violations.
+	ModMute ModAction = "mute"
+
+	// ModKick kicks the member from the GC.
+	ModKick ModAction = "kick"
+
+	// ModBan kicks the member and adds them to the ban list, which makes
+	// InviteToGC refuse to invite them and kicks them again if they post
+	// in the GC.
+	ModBan ModAction = "ban"
+)
+
+// ModerationRules configures the moderation of a GC. A zero limit disables
+// the corresponding check.
+type ModerationRules struct {
+	// Disabled turns off moderation in the GC.
+	Disabled bool `json:"disabled,omitempty"`
+
+	// FloodMessages is the maximum number of messages a member may send
+	// within FloodWindow.
+	FloodMessages int           `json:"floodmessages,omitempty"`
+	FloodWindow   time.Duration `json:"floodwindow,omitempty"`
+
+	// RepeatCount is the number of identical messages (ignoring case and
+	// spacing) within RepeatWindow that counts as a violation.
+	RepeatCount  int           `json:"repeatcount,omitempty"`
+	RepeatWindow time.Duration `json:"repeatwindow,omitempty"`
+
+	// BannedWords are words not allowed in messages, matched as whole
+	// words ignoring case.
+	BannedWords []string `json:"bannedwords,omitempty"`
+
+	// BannedPatterns are regular expressions not allowed to match
+	// messages.
+	BannedPatterns []string `json:"bannedpatterns,omitempty"`
+
+	// LinkLimit is the maximum number of links a member may post within
+	// LinkWindow.
+	LinkLimit  int           `json:"linklimit,omitempty"`
+	LinkWindow time.Duration `json:"linkwindow,omitempty"`
+
+	// Actions are the actions taken for the first, second, etc strike of
+	// a member. The last action is repeated for further strikes.
+	Actions []ModAction `json:"actions,omitempty"`
+
+	// StrikeWindow is how long strikes count towards the next action.
+	StrikeWindow time.Duration `json:"strikewindow,omitempty"`
+
+	// MuteFor is how long members stay muted.
+	MuteFor time.Duration `json:"mutefor,omitempty"`
+
+	// ExemptAdmins skips the GC owner and admins.
+	ExemptAdmins bool `json:"exemptadmins,omitempty"`
+}
+
+// DefaultModerationRules returns the rules used for GCs without specific
+// rules when the moderator config does not set any.
+func DefaultModerationRules() ModerationRules {
+	return ModerationRules{
+		FloodMessages: 5,
+		FloodWindow:   10 * time.Second,
+		RepeatCount:   3,
+		RepeatWindow:  time.Minute,
+		LinkLimit:     3,
+		LinkWindow:    time.Minute,
+		Actions:       []ModAction{ModWarn, ModMute, ModKick, ModBan},
+		StrikeWindow:  24 * time.Hour,
+		MuteFor:       10 * time.Minute,
+		ExemptAdmins:  true,
+	}
+}
+
+// ModerationEvent is an entry of the moderation audit log.
+type ModerationEvent struct {
+	Time   time.Time `json:"time"`
+	GC     string    `json:"gc"`
+	GCName string    `json:"gcname,omitempty"`
+	UID    string    `json:"uid"`
+	Nick   string    `json:"nick,omitempty"`
+
+	// Rule is the rule that was broken ("flood", "repeat", "word",
+	// "pattern", "links", "muted" or "banned"), or "manual" for actions
+	// requested through the Moderator methods.
+	Rule   string    `json:"rule"`
+	Detail string    `json:"detail,omitempty"`
+	Action ModAction `json:"action,omitempty"`
+
+	// Strikes is the number of strikes of the member, including this
+	// one.
+	Strikes int    `json:"strikes,omitempty"`
+	Error   string `json:"error,omitempty"`
+}
+
+// ModeratorConfig configures a Moderator.
+type ModeratorConfig struct {
+	// Dir is where the moderation state and audit log are stored,
+	// usually a directory inside the bot's data dir.
+	Dir string
+
+	// Defaults are the rules of GCs without specific rules. If nil,
+	// DefaultModerationRules is used.
+	Defaults *ModerationRules
+
+	Log slog.Logger
+
+	// OnAction, if set, is called for every audit log entry.
+	OnAction func(ModerationEvent)
+}
+
+// modBan is an entry of the ban list.
+type modBan struct {
+	Reason string    `json:"reason,omitempty"`
+	Time   time.Time `json:"time"`
+}
+
+// modGC is the persisted moderation state of a GC.
+type modGC struct {
+	Name    string                 `json:"name,omitempty"`
+	Rules   *ModerationRules       `json:"rules,omitempty"`
+	Strikes map[string][]time.Time `json:"strikes,omitempty"`
+	Mutes   map[string]time.Time   `json:"mutes,omitempty"`
+	Bans    map[string]modBan      `json:"bans,omitempty"`
+}
+
+// compiledRules are rules with their matchers compiled.
+type compiledRules struct {
+	ModerationRules
+	words    *regexp.Regexp
+	patterns []*regexp.Regexp
+}
+
+// memberActivity is the recent activity of a GC member used to detect floods,
+// repeats and link spam.
+type memberActivity struct {
+	msgs  []time.Time
+	texts []timedText
+	links []time.Time
+	last  time.Time
+}
+
+type timedText struct {
+	t    time.Time
+	text string
+}
+
+// linkRegexp matches links in messages.
+var linkRegexp = regexp.MustCompile(`(?i)\b(?:https?://|www\.)\S+`)
+
+// Moderator enforces moderation rules on the GCs the bot is in. It is
+// attached to a bot with SetModerator.
+type Moderator struct {
+	dir      string
+	log      slog.Logger
+	onAction func(ModerationEvent)
+	defaults *compiledRules
+	bot      *Bot
+
+	mtx       sync.Mutex
+	gcs       map[string]*modGC
+	compiled  map[string]*compiledRules
+	activity  map[string]*memberActivity
+	lastSweep time.Time
+
+	auditMtx sync.Mutex
+}
+
+// NewModerator creates a moderator, loading its state from cfg.Dir.
+func NewModerator(cfg ModeratorConfig) (*Moderator, error) {
+	defaults := DefaultModerationRules()
+	if cfg.Defaults != nil {
+		defaults = *cfg.Defaults
+	}
+	compiled, err := compileRules(defaults)
+	if err != nil {
+		return nil, fmt.Errorf("invalid default rules: %w", err)
+	}
+	log := cfg.Log
+	if log == nil {
+		log = slog.Disabled
+	}
+
+	m := &Moderator{
+		dir:      cfg.Dir,
+		log:      log,
+		onAction: cfg.OnAction,
+		defaults: compiled,
+		gcs:      make(map[string]*modGC),
+		compiled: make(map[string]*compiledRules),
+		activity: make(map[string]*memberActivity),
+	}
+	data, err := os.ReadFile(m.statePath())
+	switch {
+	case os.IsNotExist(err):
+	case err != nil:
+		return nil, err
+	default:
+		if err := json.Unmarshal(data, &m.gcs); err != nil {
+			return nil, err
+		}
+	}
+	for id, gc := range m.gcs {
+		if gc.Rules == nil {
+			continue
+		}
+		c, err := compileRules(*gc.Rules)
+		if err != nil {
+			return nil, fmt.Errorf("invalid rules of GC %s: %w", id, err)
+		}
+		m.compiled[id] = c
+	}
+	return m, nil
+}
+
+// SetModerator attaches a moderator to the bot. Every GC message is checked
+// by the moderator before being handed to the router or GCChan, and messages
+// that break a rule are dropped. It must be called before Run.
+func (b *Bot) SetModerator(m *Moderator) {
+	m.bot = b
+	b.moderator = m
+}
+
+func (m *Moderator) statePath() string {
+	return filepath.Join(m.dir, "moderation.json")
+}
+
+func (m *Moderator) auditPath() string {
+	return filepath.Join(m.dir, "audit.log")
+}
+
+// save persists the state. It must be called with the mutex held.
+func (m *Moderator) save() error {
+	data, err := json.MarshalIndent(m.gcs, "", "  ")
+	if err != nil {
+		return err
+	}
+	return utils.AtomicWriteFile(m.statePath(), data, 0600)
+}
+
+func compileRules(r ModerationRules) (*compiledRules, error) {
+	c := &compiledRules{ModerationRules: r}
+	if len(r.BannedWords) > 0 {
+		words := make([]string, 0, len(r.BannedWords))
+		for _, w := range r.BannedWords {
+			if w = strings.TrimSpace(w); w != "" {
+				words = append(words, regexp.QuoteMeta(w))
+			}
+		}
+		if len(words) > 0 {
+			// \b does not work for words that start or end with
+			// punctuation, such as "c++".
+			c.words = regexp.MustCompile(`(?i)(?:^|\W)(` + strings.Join(words, "|") + `)(?:\W|$)`)
+		}
+	}
+	for _, p := range r.BannedPatterns {
+		re, err := regexp.Compile(p)
+		if err != nil {
+			return nil, fmt.Errorf("invalid pattern %q: %w", p, err)
+		}
+		c.patterns = append(c.patterns, re)
+	}
+	for _, a := range r.Actions {
+		switch a {
+		case ModWarn, ModMute, ModKick, ModBan:
+		default:
+			return nil, fmt.Errorf("unknown action %q", a)
+		}
+	}
+	return c, nil
+}
+
+// gc returns the state of a GC, creating it if needed. It must be called with
+// the mutex held.
+func (m *Moderator) gc(id, name string) *modGC {
+	gc, ok := m.gcs[id]
+	if !ok {
+		gc = &modGC{}
+		m.gcs[id] = gc
+	}
+	if name != "" {
+		gc.Name = name
+	}
+	return gc
+}
+
+// rules returns the rules of a GC. It must be called with the mutex held.
+func (m *Moderator) rules(id string) *compiledRules {
+	if c, ok := m.compiled[id]; ok {
+		return c
+	}
+	return m.defaults
+}
+
+// resolveGC returns the ID and name of the GC with the given name or ID.
+func (m *Moderator) resolveGC(ctx context.Context, gc string) (string, string, error) {
+	def, err := m.bot.GetGC(ctx, gc)
+	if err != nil {
+		return "", "", err
+	}
+	return hex.EncodeToString(def.Id), def.Name, nil
+}
+
+// SetRules sets the rules of a GC. A nil rules resets the GC to the default
+// rules.
+func (m *Moderator) SetRules(ctx context.Context, gc string, rules *ModerationRules) error {
+	var c *compiledRules
+	if rules != nil {
+		var err error
+		if c, err = compileRules(*rules); err != nil {
+			return err
+		}
+	}
+	id, name, err := m.resolveGC(ctx, gc)
+	if err != nil {
+		return err
+	}
+
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	st := m.gc(id, name)
+	if rules == nil {
+		st.Rules = nil
+		delete(m.compiled, id)
+	} else {
+		r := *rules
+		st.Rules = &r
+		m.compiled[id] = c
+	}
+	return m.save()
+}
+
+// Rules returns the rules that apply to a GC.
+func (m *Moderator) Rules(ctx context.Context, gc string) (ModerationRules, error) {
+	id, _, err := m.resolveGC(ctx, gc)
+	if err != nil {
+		return ModerationRules{}, err
+	}
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	return m.rules(id).ModerationRules, nil
+}
+
+// Mute adds the user to the mute list of the GC for the given duration.
+func (m *Moderator) Mute(ctx context.Context, gc string, uid zkidentity.ShortID, d time.Duration) error {
+	id, name, err := m.resolveGC(ctx, gc)
+	if err != nil {
+		return err
+	}
+	m.mtx.Lock()
+	st := m.gc(id, name)
+	if st.Mutes == nil {
+		st.Mutes = make(map[string]time.Time)
+	}
+	st.Mutes[uid.String()] = time.Now().Add(d)
+	err = m.save()
+	m.mtx.Unlock()
+	m.audit(ModerationEvent{GC: id, GCName: name, UID: uid.String(),
+		Rule: "manual", Action: ModMute, Detail: d.String()})
+	return err
+}
+
+// Unmute removes the user from the mute list of the GC.
+func (m *Moderator) Unmute(ctx context.Context, gc string, uid zkidentity.ShortID) error {
+	id, name, err := m.resolveGC(ctx, gc)
+	if err != nil {
+		return err
+	}
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	delete(m.gc(id, name).Mutes, uid.String())
+	return m.save()
+}
+
+// Ban adds the user to the ban list of the GC and kicks them if they are a
+// member.
+func (m *Moderator) Ban(ctx context.Context, gc string, uid zkidentity.ShortID, reason string) error {
+	id, name, err := m.resolveGC(ctx, gc)
+	if err != nil {
+		return err
+	}
+	m.mtx.Lock()
+	m.addBan(m.gc(id, name), uid.String(), reason)
+	err = m.save()
+	m.mtx.Unlock()
+	if err != nil {
+		return err
+	}
+
+	ev := ModerationEvent{GC: id, GCName: name, UID: uid.String(),
+		Rule: "manual", Action: ModBan, Detail: reason}
+	member, err := m.bot.IsGCMember(ctx, id, uid)
+	if err == nil && member {
+		err = m.bot.KickFromGC(ctx, id, uid.String(), reason)
+	}
+	if err != nil {
+		ev.Error = err.Error()
+	}
+	m.audit(ev)
+	return err
+}
+
+// Unban removes the user from the ban list of the GC and clears their
+// strikes.
+func (m *Moderator) Unban(ctx context.Context, gc string, uid zkidentity.ShortID) error {
+	id, name, err := m.resolveGC(ctx, gc)
+	if err != nil {
+		return err
+	}
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	st := m.gc(id, name)
+	delete(st.Bans, uid.String())
+	delete(st.Strikes, uid.String())
+	return m.save()
+}
+
+// IsBanned returns true if the user is in the ban list of the GC with the
+// given ID.
+func (m *Moderator) IsBanned(gcID zkidentity.ShortID, uid zkidentity.ShortID) bool {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	gc, ok := m.gcs[gcID.String()]
+	if !ok {
+		return false
+	}
+	_, banned := gc.Bans[uid.String()]
+	return banned
+}
+
+// Banned returns the IDs of the users banned from the GC.
+func (m *Moderator) Banned(ctx context.Context, gc string) ([]string, error) {
+	id, _, err := m.resolveGC(ctx, gc)
+	if err != nil {
+		return nil, err
+	}
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	var res []string
+	if st, ok := m.gcs[id]; ok {
+		for uid := range st.Bans {
+			res = append(res, uid)
+		}
+	}
+	return res, nil
+}
+
+// addBan adds a user to the ban list. It must be called with the mutex held.
+func (m *Moderator) addBan(gc *modGC, uid, reason string) {
+	if gc.Bans == nil {
+		gc.Bans = make(map[string]modBan)
+	}
+	gc.Bans[uid] = modBan{Reason: reason, Time: time.Now()}
+	delete(gc.Mutes, uid)
+}
+
+// checkInvite returns ErrBannedFromGC if the user (an ID or nick) is banned
+// from the GC. Nicks are not resolved, so only invites by user ID are
+// checked.
+func (m *Moderator) checkInvite(ctx context.Context, gc, user string) error {
+	var uid zkidentity.ShortID
+	if uid.FromString(user) != nil {
+		return nil
+	}
+	m.mtx.Lock()
+	hasBans := false
+	for _, st := range m.gcs {
+		if len(st.Bans) > 0 {
+			hasBans = true
+			break
+		}
+	}
+	m.mtx.Unlock()
+	if !hasBans {
+		return nil
+	}
+
+	def, err := m.bot.GetGC(ctx, gc)
+	if err != nil {
+		return err
+	}
+	var gcID zkidentity.ShortID
+	if err := gcID.FromBytes(def.Id); err != nil {
+		return err
+	}
+	if m.IsBanned(gcID, uid) {
+		return ErrBannedFromGC
+	}
+	return nil
+}
+
+// normalizeText returns the text used to detect repeated messages.
+func normalizeText(s string) string {
+	return strings.ToLower(strings.Join(strings.Fields(s), " "))
+}
+
+// pruneTimes removes the times before cutoff.
+func pruneTimes(ts []time.Time, cutoff time.Time) []time.Time {
+	i := 0
+	for i < len(ts) && ts[i].Before(cutoff) {
+		i++
+	}
+	return ts[i:]
+}
+
+// maxWindow is the longest detection window of the rules.
+func (r *compiledRules) maxWindow() time.Duration {
+	w := r.FloodWindow
+	if r.RepeatWindow > w {
+		w = r.RepeatWindow
+	}
+	if r.LinkWindow > w {
+		w = r.LinkWindow
+	}
+	return w
+}
+
+// detect records a message in the member's activity and returns the rule it
+// breaks, if any. It must be called with the mutex held.
+func (m *Moderator) detect(r *compiledRules, key, msg string, now time.Time) (string, string) {
+	if r.words != nil {
+		if match := r.words.FindStringSubmatch(msg); match != nil {
+			return "word", fmt.Sprintf("banned word %q", match[1])
+		}
+	}
+	for _, re := range r.patterns {
+		if re.MatchString(msg) {
+			return "pattern", fmt.Sprintf("banned pattern %q", re.String())
+		}
+	}
+
+	act, ok := m.activity[key]
+	if !ok {
+		act = &memberActivity{}
+		m.activity[key] = act
+	}
+	act.last = now
+
+	var rule, detail string
+	if r.FloodMessages > 0 && r.FloodWindow > 0 {
+		act.msgs = append(pruneTimes(act.msgs, now.Add(-r.FloodWindow)), now)
+		if len(act.msgs) > r.FloodMessages {
+			rule = "flood"
+			detail = fmt.Sprintf("%d messages in %s", len(act.msgs), r.FloodWindow)
+		}
+	}
+	if r.RepeatCount > 0 && r.RepeatWindow > 0 {
+		cutoff := now.Add(-r.RepeatWindow)
+		texts := act.texts[:0]
+		for _, t := range act.texts {
+			if !t.t.Before(cutoff) {
+				texts = append(texts, t)
+			}
+		}
+		text := normalizeText(msg)
+		act.texts = append(texts, timedText{t: now, text: text})
+		n := 0
+		for _, t := range act.texts {
+			if t.text == text {
+				n++
+			}
+		}
+		if rule == "" && n >= r.RepeatCount {
+			rule = "repeat"
+			detail = fmt.Sprintf("same message %d times in %s", n, r.RepeatWindow)
+		}
+	}
+	if r.LinkLimit > 0 && r.LinkWindow > 0 {
+		act.links = pruneTimes(act.links, now.Add(-r.LinkWindow))
+		for range linkRegexp.FindAllString(msg, -1) {
+			act.links = append(act.links, now)
+		}
+		if rule == "" && len(act.links) > r.LinkLimit {
+			rule = "links"
+			detail = fmt.Sprintf("%d links in %s", len(act.links), r.LinkWindow)
+		}
+	}
+
+	// Start over after a violation, so that a single burst does not
+	// count as several strikes.
+	if rule != "" {
+		delete(m.activity, key)
+	}
+	return rule, detail
+}
+
+// sweep forgets the activity of members that have not posted recently. It
+// must be called with the mutex held.
+func (m *Moderator) sweep(now time.Time) {
+	if now.Sub(m.lastSweep) < time.Minute {
+		return
+	}
+	m.lastSweep = now
+	for key, act := range m.activity {
+		gcID, _, _ := strings.Cut(key, ":")
+		if now.Sub(act.last) > m.rules(gcID).maxWindow() {
+			delete(m.activity, key)
+		}
+	}
+}
+
+// strike records a strike for the member and returns the action to take. It
+// must be called with the mutex held.
+func (m *Moderator) strike(r *compiledRules, gc *modGC, uid string, now time.Time) (ModAction, int) {
+	if gc.Strikes == nil {
+		gc.Strikes = make(map[string][]time.Time)
+	}
+	strikes := gc.Strikes[uid]
+	if r.StrikeWindow > 0 {
+		strikes = pruneTimes(strikes, now.Add(-r.StrikeWindow))
+	}
+	strikes = append(strikes, now)
+	gc.Strikes[uid] = strikes
+
+	actions := r.Actions
+	if len(actions) == 0 {
+		actions = []ModAction{ModWarn}
+	}
+	n := len(strikes)
+	if n > len(actions) {
+		return actions[len(actions)-1], n
+	}
+	return actions[n-1], n
+}
+
+// check moderates a received GC message. It returns true if the message
+// broke a rule and must not be handled by the bot.
+func (m *Moderator) check(ctx context.Context, gcm *types.GCReceivedMsg) bool {
+	if gcm.Msg == nil {
+		return false
+	}
+	gcID := hex.EncodeToString(gcm.Msg.Id)
+	uid := hex.EncodeToString(gcm.Uid)
+	now := time.Now()
+
+	m.mtx.Lock()
+	r := m.rules(gcID)
+	if r.Disabled {
+		m.mtx.Unlock()
+		return false
+	}
+	m.sweep(now)
+	var rule, detail string
+	st, hasState := m.gcs[gcID]
+	if hasState {
+		if ban, banned := st.Bans[uid]; banned {
+			rule, detail = "banned", ban.Reason
+		} else if until, muted := st.Mutes[uid]; muted {
+			if now.Before(until) {
+				rule = "muted"
+				detail = fmt.Sprintf("muted until %s", until.Format(time.RFC3339))
+			} else {
+				delete(st.Mutes, uid)
+			}
+		}
+	}
+	if rule == "" {
+		rule, detail = m.detect(r, gcID+":"+uid, gcm.Msg.Message, now)
+	}
+	m.mtx.Unlock()
+	if rule == "" {
+		return false
+	}
+
+	if r.ExemptAdmins {
+		var id zkidentity.ShortID
+		if id.FromBytes(gcm.Uid) == nil {
+			admin, err := m.bot.IsGCAdmin(ctx, gcID, id)
+			if err != nil {
+				m.log.Warnf("Unable to check if %s is an admin of %s: %v",
+					gcm.Nick, gcm.GcAlias, err)
+			}
+			if admin {
+				return false
+			}
+		}
+	}
+
+	ev := ModerationEvent{
+		Time:   now,
+		GC:     gcID,
+		GCName: gcm.GcAlias,
+		UID:    uid,
+		Nick:   gcm.Nick,
+		Rule:   rule,
+		Detail: detail,
+	}
+
+	m.mtx.Lock()
+	gc := m.gc(gcID, gcm.GcAlias)
+	if rule == "banned" {
+		// Banned members that are somehow back in the GC are kicked
+		// again without further strikes.
+		ev.Action = ModKick
+	} else {
+		ev.Action, ev.Strikes = m.strike(r, gc, uid, now)
+	}
+	switch ev.Action {
+	case ModMute:
+		if gc.Mutes == nil {
+			gc.Mutes = make(map[string]time.Time)
+		}
+		gc.Mutes[uid] = now.Add(r.MuteFor)
+	case ModBan:
+		m.addBan(gc, uid, detail)
+	}
+	if err := m.save(); err != nil {
+		m.log.Errorf("Unable to save moderation state: %v", err)
+	}
+	m.mtx.Unlock()
+
+	if err := m.enforce(ctx, r, &ev); err != nil {
+		ev.Error = err.Error()
+	}
+	m.audit(ev)
+	return true
+}
+
+// enforce carries out the action of a moderation event.
+func (m *Moderator) enforce(ctx context.Context, r *compiledRules, ev *ModerationEvent) error {
+	reason := fmt.Sprintf("%s (%s)", ev.Rule, ev.Detail)
+	switch ev.Action {
+	case ModWarn:
+		msg := fmt.Sprintf("Warning: your message in %s broke the rules: %s. "+
+			"Further violations may get you muted or removed.", ev.GCName, reason)
+		m.bot.QueuePM(ctx, ev.UID, msg, WithPriority(PriorityHigh))
+	case ModMute:
+		msg := fmt.Sprintf("You were muted in %s for %s: %s. Messages sent "+
+			"while muted count as further violations.", ev.GCName, r.MuteFor, reason)
+		m.bot.QueuePM(ctx, ev.UID, msg, WithPriority(PriorityHigh))
+	case ModKick, ModBan:
+		return m.bot.KickFromGC(ctx, ev.GC, ev.UID, reason)
+	}
+	return nil
+}
+
+// audit appends an event to the audit log.
+func (m *Moderator) audit(ev ModerationEvent) {
+	if ev.Time.IsZero() {
+		ev.Time = time.Now()
+	}
+	if ev.Error != "" {
+		m.log.Errorf("Moderation %s of %s in %s failed: %s", ev.Action,
+			ev.UID, ev.GCName, ev.Error)
+	} else {
+		m.log.Infof("Moderation: %s %s (%s) in %s: %s %s", ev.Action,
+			ev.Nick, ev.UID, ev.GCName, ev.Rule, ev.Detail)
+	}
+
+	data, err := json.Marshal(ev)
+	if err == nil {
+		m.auditMtx.Lock()
+		err = appendLine(m.auditPath(), data)
+		m.auditMtx.Unlock()
+	}
+	if err != nil {
+		m.log.Errorf("Unable to write moderation audit log: %v", err)
+	}
+	if m.onAction != nil {
+		m.onAction(ev)
+	}
+}
+
+func appendLine(path string, data []byte) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(append(data, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// AuditLog returns the last limit entries of the audit log, oldest first. If
+// gc is not empty, only entries of the GC with that ID or name are returned.
+// A limit <= 0 returns every entry.
+func (m *Moderator) AuditLog(gc string, limit int) ([]ModerationEvent, error) {
+	m.auditMtx.Lock()
+	defer m.auditMtx.Unlock()
+
+	f, err := os.Open(m.auditPath())
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var res []ModerationEvent
+	sc := bufio.NewScanner(f)
+	sc.Buffer(nil, 1<<20)
+	for sc.Scan() {
+		var ev ModerationEvent
+		if err := json.Unmarshal(sc.Bytes(), &ev); err != nil {
+			continue
+		}
+		if gc != "" && ev.GC != gc && ev.GCName != gc {
+			continue
+		}
+		res = append(res, ev)
+		if limit > 0 && len(res) > limit {
+			res = res[1:]
+		}
+	}
+	return res, sc.Err()
+}
@@ -0,0 +1,42 @@
+package bisonbotkit
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"strings"
+
+	"github.com/companyzero/bisonrelay/zkidentity"
+	"github.com/vctt94/bisonbotkit/args"
+)
+
+// The clientrpc API has no call to look up a user by nick, so the bot keeps
+// the nicks of the users it receives messages from. Nicks are only known
+// after a PM, GC message or KX from the user since the bot started.
+
+// rememberNick records the nick of a user.
+func (b *Bot) rememberNick(uid []byte, nick string) {
+	if nick == "" || len(uid) != len(zkidentity.ShortID{}) {
+		return
+	}
+	b.nicksMtx.Lock()
+	b.nicks[strings.ToLower(nick)] = hex.EncodeToString(uid)
+	b.nicksMtx.Unlock()
+}
+
+// ResolveUser returns the ID of the user given by a hex user ID or by the
+// nick of a user the bot has received messages from.
+func (b *Bot) ResolveUser(ctx context.Context, user string) (zkidentity.ShortID, error) {
+	user = strings.TrimSpace(user)
+	if id, err := args.ShortID(user); err == nil {
+		return id, nil
+	}
+
+	b.nicksMtx.Lock()
+	hexID, ok := b.nicks[strings.ToLower(strings.TrimPrefix(user, "@"))]
+	b.nicksMtx.Unlock()
+	if !ok {
+		return zkidentity.ShortID{}, fmt.Errorf("unknown user %q", user)
+	}
+	return args.ShortID(hexID)
+}
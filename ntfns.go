@@ -2,302 +2,362 @@ package bisonbotkit
 
 import (
 	"context"
-	"errors"
-	"time"
+	"encoding/hex"
 
 	"github.com/companyzero/bisonrelay/clientrpc/types"
 )
 
-func (b *Bot) gcNtfns(ctx context.Context) error {
-	var ackRes types.AckResponse
-	var ackReq types.AckRequest
-	for {
-		// Keep requesting a new stream if the connection breaks.
-		streamReq := types.GCMStreamRequest{UnackedFrom: ackReq.SequenceId}
-		stream, err := b.chatService.GCMStream(ctx, &streamReq)
-		if errors.Is(err, context.Canceled) {
-			// Program is done.
-			return err
-		}
-		if err != nil {
-			b.gcLog.Errorf("failed to get GC stream: %v", err)
-			time.Sleep(time.Second) // Wait to try again.
-			continue
+// registerBuiltinStreams registers the ack functions of the notification
+// streams consumed by the bot.
+func (b *Bot) registerBuiltinStreams() {
+	ackFn := func(fn func(context.Context, *types.AckRequest, *types.AckResponse) error) func(context.Context, uint64) error {
+		return func(ctx context.Context, seq uint64) error {
+			ackReq := types.AckRequest{SequenceId: seq}
+			var ackRes types.AckResponse
+			return fn(ctx, &ackReq, &ackRes)
 		}
+	}
+	b.registerStream(StreamPM, ackFn(b.chatService.AckReceivedPM), b.pmLog)
+	b.registerStream(StreamGCM, ackFn(b.chatService.AckReceivedGCM), b.gcLog)
+	b.registerStream(StreamGCInvites, ackFn(b.gcService.AckReceivedGCInvites), b.gcLog)
+	b.registerStream(StreamKX, ackFn(b.chatService.AckKXCompleted), b.kxLog)
+	b.registerStream(StreamGCMembersAdded, ackFn(b.gcService.AckMembersAdded), b.gcLog)
+	b.registerStream(StreamPosts, ackFn(b.postService.AckReceivedPost), b.postLog)
+	b.registerStream(StreamPostStatus, ackFn(b.postService.AckReceivedPostStatus), b.postStatusLog)
+	b.registerStream(StreamTipProgress, ackFn(b.paymentService.AckTipProgress), b.tipProgressLog)
+	b.registerStream(StreamTipReceived, ackFn(b.paymentService.AckTipReceived), b.tipReceivedLog)
+}
 
-		b.gcLog.Info("Listening for GC msgs...")
-		for {
-			var pm types.GCReceivedMsg
-			err := stream.Recv(&pm)
-			if errors.Is(err, context.Canceled) {
-				// Program is done.
-				return err
-			}
-			if err != nil {
-				b.gcLog.Errorf("failed to receive from stream: %v", err)
-				break
-			}
-			ackReq.SequenceId = pm.SequenceId
-			err = b.chatService.AckReceivedGCM(ctx, &ackReq, &ackRes)
-			if err != nil {
-				b.gcLog.Errorf("failed to acknowledge received gc: %v", err)
-				break
-			}
-			b.gcChan <- pm
-		}
+// streamAckMode returns the ack mode of the bot's streams that are acked by
+// the kit.
+func (b *Bot) streamAckMode() StreamAckMode {
+	if b.manualAck {
+		return AckByHandler
 	}
+	return AckBeforeHandle
 }
 
-func (b *Bot) inviteNtfns(ctx context.Context) error {
-	var ackRes types.AckResponse
-	var ackReq types.AckRequest
-	for {
-		// Keep requesting a new stream if the connection breaks. Also
-		// request any messages received since the last one we acked.
-		streamReq := types.ReceivedGCInvitesRequest{UnackedFrom: ackReq.SequenceId}
-		stream, err := b.gcService.ReceivedGCInvites(ctx, &streamReq)
-		if errors.Is(err, context.Canceled) {
-			// Program is done.
-			return err
-		}
-		if err != nil {
-			b.gcLog.Warnf("Error while obtaining GC invite stream: %v", err)
-			time.Sleep(time.Second) // Wait to try again.
-			continue
-		}
+// ackHandled acknowledges a message consumed by the bot itself (for example,
+// handled by the router) when running in manual ack mode. In the default mode
+// messages are acked as soon as they are received.
+func (b *Bot) ackHandled(ctx context.Context, stream string, seq uint64) {
+	if !b.manualAck {
+		return
+	}
+	if err := b.ack(ctx, stream, seq); err != nil {
+		b.streamLog(stream).Errorf("failed to acknowledge handled msg: %v", err)
+	}
+}
 
-		b.gcLog.Info("Listening for GC invites...")
-		for {
-			var pm types.ReceivedGCInvite
-			err := stream.Recv(&pm)
-			if errors.Is(err, context.Canceled) {
-				// Program is done.
-				return err
-			}
-			if err != nil {
-				b.gcLog.Warnf("Error while receiving invite stream: %v", err)
-				break
-			}
-			ackReq.SequenceId = pm.SequenceId
-			if err = b.gcService.AckReceivedGCInvites(ctx, &ackReq, &ackRes); err != nil {
-				b.gcLog.Errorf("failed to acknowledge kx: %v", err)
-				break
-			}
-			b.inviteChan <- pm
-		}
+// ackOnPanic acks the message of the stream if the calling handler is
+// panicking, and panics again. Like failed commands, the message is not left
+// in flight holding back the acks of later messages, nor handled again on
+// every reconnect. It must be deferred.
+func (b *Bot) ackOnPanic(ctx context.Context, stream string, seq uint64) {
+	if v := recover(); v != nil {
+		b.ackHandled(ctx, stream, seq)
+		panic(v)
 	}
 }
 
-func (b *Bot) kxNtfns(ctx context.Context) error {
-	var ksr types.KXStreamRequest
-	var ackReq types.AckRequest
-	var ackRes types.AckResponse
-	for {
-		stream, err := b.chatService.KXStream(ctx, &ksr)
-		if errors.Is(err, context.Canceled) {
-			// Program is done.
-			return err
-		}
-		if err != nil {
-			b.kxLog.Warnf("Error while obtaining KX stream: %v", err)
-			time.Sleep(time.Second) // Wait to try again.
-			continue
-		}
-		b.kxLog.Info("Listening for kxs...")
-		for {
-			var pm types.KXCompleted
-			err := stream.Recv(&pm)
-			if errors.Is(err, context.Canceled) {
-				// Program is done.
-				return err
-			}
-			if err != nil {
-				b.kxLog.Warnf("Error while receiving stream: %v", err)
-				break
-			}
-			ksr.UnackedFrom = pm.SequenceId
-			ackReq.SequenceId = pm.SequenceId
-			if err = b.chatService.AckKXCompleted(ctx, &ackReq, &ackRes); err != nil {
-				b.kxLog.Errorf("failed to acknowledge kx: %v", err)
-				break
-			}
-			b.kxChan <- pm
-		}
+// deliverPM hands a received PM to the router, if one is attached, and to
+// PMChan if the router did not handle it, through the dispatcher if one is
+// set. PMs from senders rejected by the whitelist are dropped.
+func (b *Bot) deliverPM(ctx context.Context, pm *types.ReceivedPM) {
+	b.rememberNick(pm.Uid, pm.Nick)
+	if !b.senderAllowed(ctx, pm.Uid, true, b.pmLog) {
+		b.ackHandled(ctx, StreamPM, pm.SequenceId)
+		return
+	}
+	if b.dispatcher != nil {
+		b.dispatcher.Submit(ctx, hex.EncodeToString(pm.Uid), func(ctx context.Context) error {
+			defer b.ackOnPanic(ctx, StreamPM, pm.SequenceId)
+			b.routePM(ctx, pm)
+			return nil
+		})
+		return
 	}
+	b.routePM(ctx, pm)
 }
 
-func (b *Bot) pmNtfns(ctx context.Context) error {
-	var ackRes types.AckResponse
-	var ackReq types.AckRequest
-	for {
-		// Keep requesting a new stream if the connection breaks.
-		streamReq := types.PMStreamRequest{UnackedFrom: ackReq.SequenceId}
-		stream, err := b.chatService.PMStream(ctx, &streamReq)
-		if errors.Is(err, context.Canceled) {
-			// Program is done.
-			return err
-		}
+// routePM hands a PM to the router and to PMChan if the router did not
+// handle it. Replies of invite approvers, answers to dialogs and replies of
+// users being onboarded are handled by the bot.
+func (b *Bot) routePM(ctx context.Context, pm *types.ReceivedPM) {
+	if b.handleInviteReply(ctx, pm) {
+		b.ackHandled(ctx, StreamPM, pm.SequenceId)
+		return
+	}
+	// Prefixed commands are not answers, so users can still get help or
+	// use other commands in the middle of a dialog or the onboarding.
+	isCmd := b.router != nil && pm.Msg != nil && b.router.isPrefixedCommand(pm.Msg.Message)
+	if !isCmd && (b.handleDialogReply(ctx, pm) || b.handleOnboardingReply(ctx, pm)) {
+		b.ackHandled(ctx, StreamPM, pm.SequenceId)
+		return
+	}
+	if b.router != nil {
+		handled, err := b.router.HandlePM(ctx, b, pm)
 		if err != nil {
-			b.pmLog.Errorf("failed to get PM stream: %v", err)
-			time.Sleep(time.Second) // Wait to try again.
-			continue
+			b.pmLog.Errorf("failed to handle PM from %s: %v", pm.Nick, err)
 		}
-
-		b.pmLog.Info("Listening for private messages...")
-		for {
-			var pm types.ReceivedPM
-			err := stream.Recv(&pm)
-			if errors.Is(err, context.Canceled) {
-				// Program is done.
-				return err
-			}
-			if err != nil {
-				b.pmLog.Errorf("failed to receive from stream: %v", err)
-				break
-			}
-			ackReq.SequenceId = pm.SequenceId
-			err = b.chatService.AckReceivedPM(ctx, &ackReq, &ackRes)
-			if err != nil {
-				b.pmLog.Errorf("failed to acknowledge received gc: %v", err)
-				break
-			}
-			b.pmChan <- pm
+		if handled {
+			// Failed commands are acked too, once the error is logged
+			// (and replied to by the ReplyErrors middleware), so that
+			// they do not hold back the acks of later messages and are
+			// not run again on every reconnect.
+			b.ackHandled(ctx, StreamPM, pm.SequenceId)
+			return
 		}
 	}
+	if b.pmChan == nil {
+		b.ackHandled(ctx, StreamPM, pm.SequenceId)
+		return
+	}
+	b.pmChan <- *pm
 }
 
-func (b *Bot) postNtfns(ctx context.Context) error {
-	var psr types.PostsStreamRequest
-	var ackReq types.AckRequest
-	var ackRes types.AckResponse
-	for {
-		stream, err := b.postService.PostsStream(ctx, &psr)
-		if errors.Is(err, context.Canceled) {
-			// Program is done.
-			return err
-		}
-		if err != nil {
-			b.postLog.Errorf("failed to setup posts stream: %v", err)
-			time.Sleep(time.Second) // Wait to try again.
-			continue
-		}
-		b.postLog.Info("Listening for posts...")
-		for {
-			var pm types.ReceivedPost
-			err := stream.Recv(&pm)
-			if errors.Is(err, context.Canceled) {
-				// Program is done.
-				return err
-			}
-			if err != nil {
-				b.postLog.Errorf("failed to receive from stream: %v", err)
-				break
-			}
-			psr.UnackedFrom = pm.SequenceId
-			ackReq.SequenceId = pm.SequenceId
-			if err = b.postService.AckReceivedPost(ctx, &ackReq, &ackRes); err != nil {
-				b.postLog.Errorf("failed to acknowledge post: %v", err)
-				break
-			}
-			b.postChan <- pm
-		}
+// deliverGCM hands a received GC message to the router, if one is attached,
+// and to GCChan if the router did not handle it, through the dispatcher if one
+// is set. Messages from senders rejected by the whitelist or that break a
+// moderation rule are dropped.
+func (b *Bot) deliverGCM(ctx context.Context, gcm *types.GCReceivedMsg) {
+	b.rememberNick(gcm.Uid, gcm.Nick)
+	if !b.senderAllowed(ctx, gcm.Uid, false, b.gcLog) {
+		b.ackHandled(ctx, StreamGCM, gcm.SequenceId)
+		return
+	}
+	if b.moderator != nil && b.moderator.check(ctx, gcm) {
+		b.ackHandled(ctx, StreamGCM, gcm.SequenceId)
+		return
 	}
+	if b.dispatcher != nil {
+		b.dispatcher.Submit(ctx, hex.EncodeToString(gcm.Uid), func(ctx context.Context) error {
+			defer b.ackOnPanic(ctx, StreamGCM, gcm.SequenceId)
+			b.routeGCM(ctx, gcm)
+			return nil
+		})
+		return
+	}
+	b.routeGCM(ctx, gcm)
 }
 
-func (b *Bot) postStatusNtfns(ctx context.Context) error {
-	var psr types.PostsStatusStreamRequest
-	var ackReq types.AckRequest
-	var ackRes types.AckResponse
-	for {
-		stream, err := b.postService.PostsStatusStream(ctx, &psr)
-		if errors.Is(err, context.Canceled) {
-			// Program is done.
-			return err
-		}
+// routeGCM hands a GC message to the router and to GCChan if the router did
+// not handle it.
+func (b *Bot) routeGCM(ctx context.Context, gcm *types.GCReceivedMsg) {
+	if b.router != nil {
+		handled, err := b.router.HandleGC(ctx, b, gcm)
 		if err != nil {
-			b.postStatusLog.Warnf("Error while obtaining posts status stream: %v", err)
-			time.Sleep(time.Second) // Wait to try again.
-			continue
+			b.gcLog.Errorf("failed to handle GC msg from %s in %s: %v",
+				gcm.Nick, gcm.GcAlias, err)
 		}
-		b.postStatusLog.Info("Listening for comments...")
-		for {
-			var pm types.ReceivedPostStatus
-			err := stream.Recv(&pm)
-			if errors.Is(err, context.Canceled) {
-				// Program is done.
-				return err
-			}
-			if err != nil {
-				b.postStatusLog.Warnf("Error while receiving posts status stream: %v", err)
-				break
-			}
-			psr.UnackedFrom = pm.SequenceId
-			ackReq.SequenceId = pm.SequenceId
-			if err = b.postService.AckReceivedPostStatus(ctx, &ackReq, &ackRes); err != nil {
-				b.postStatusLog.Errorf("Failed to acknowledge post status: %v", err)
-				break
-			}
-			b.postStatusChan <- pm
+		if handled {
+			// Failed commands are acked too, like in routePM.
+			b.ackHandled(ctx, StreamGCM, gcm.SequenceId)
+			return
 		}
 	}
+	if b.gcChan == nil {
+		b.ackHandled(ctx, StreamGCM, gcm.SequenceId)
+		return
+	}
+	b.gcChan <- *gcm
+}
+
+func (b *Bot) gcNtfns(ctx context.Context) error {
+	return subscribeQueued(ctx, b, StreamConfig[types.GCReceivedMsg]{
+		Name: StreamGCM,
+		Log:  b.gcLog,
+		Open: func(ctx context.Context, unackedFrom uint64) (StreamClient[types.GCReceivedMsg], error) {
+			return b.chatService.GCMStream(ctx, &types.GCMStreamRequest{UnackedFrom: unackedFrom})
+		},
+		AckMode: b.streamAckMode(),
+	}, b.deliverGCM)
+}
+
+func (b *Bot) inviteNtfns(ctx context.Context) error {
+	return subscribeQueued(ctx, b, StreamConfig[types.ReceivedGCInvite]{
+		Name: StreamGCInvites,
+		Log:  b.gcLog,
+		Open: func(ctx context.Context, unackedFrom uint64) (StreamClient[types.ReceivedGCInvite], error) {
+			return b.gcService.ReceivedGCInvites(ctx, &types.ReceivedGCInvitesRequest{UnackedFrom: unackedFrom})
+		},
+		AckMode: b.streamAckMode(),
+	}, b.deliverInvite)
+}
+
+func (b *Bot) kxNtfns(ctx context.Context) error {
+	return subscribeQueued(ctx, b, StreamConfig[types.KXCompleted]{
+		Name: StreamKX,
+		Log:  b.kxLog,
+		Open: func(ctx context.Context, unackedFrom uint64) (StreamClient[types.KXCompleted], error) {
+			return b.chatService.KXStream(ctx, &types.KXStreamRequest{UnackedFrom: unackedFrom})
+		},
+		AckMode: b.streamAckMode(),
+	}, b.deliverKX)
+}
+
+// deliverKX greets the user of a completed KX when onboarding is enabled and
+// hands the KX to KXChan.
+func (b *Bot) deliverKX(ctx context.Context, kx *types.KXCompleted) {
+	b.rememberNick(kx.Uid, kx.Nick)
+	if b.onboarding != nil {
+		b.onboardKX(ctx, kx)
+	}
+	if b.kxChan != nil {
+		b.kxChan <- *kx
+		return
+	}
+	b.ackHandled(ctx, StreamKX, kx.SequenceId)
+}
+
+func (b *Bot) membersAddedNtfns(ctx context.Context) error {
+	return subscribeQueued(ctx, b, StreamConfig[types.GCMembersAddedEvent]{
+		Name: StreamGCMembersAdded,
+		Log:  b.gcLog,
+		Open: func(ctx context.Context, unackedFrom uint64) (StreamClient[types.GCMembersAddedEvent], error) {
+			return b.gcService.MembersAdded(ctx, &types.GCMembersAddedRequest{UnackedFrom: unackedFrom})
+		},
+		AckMode: b.streamAckMode(),
+	}, func(ctx context.Context, ev *types.GCMembersAddedEvent) {
+		b.greetGCMembers(ctx, ev)
+		b.ackHandled(ctx, StreamGCMembersAdded, ev.SequenceId)
+	})
 }
 
+func (b *Bot) pmNtfns(ctx context.Context) error {
+	return subscribeQueued(ctx, b, StreamConfig[types.ReceivedPM]{
+		Name: StreamPM,
+		Log:  b.pmLog,
+		Open: func(ctx context.Context, unackedFrom uint64) (StreamClient[types.ReceivedPM], error) {
+			return b.chatService.PMStream(ctx, &types.PMStreamRequest{UnackedFrom: unackedFrom})
+		},
+		AckMode: b.streamAckMode(),
+	}, b.deliverPM)
+}
+
+func (b *Bot) postNtfns(ctx context.Context) error {
+	return subscribeQueued(ctx, b, StreamConfig[types.ReceivedPost]{
+		Name: StreamPosts,
+		Log:  b.postLog,
+		Open: func(ctx context.Context, unackedFrom uint64) (StreamClient[types.ReceivedPost], error) {
+			return b.postService.PostsStream(ctx, &types.PostsStreamRequest{UnackedFrom: unackedFrom})
+		},
+		AckMode: b.streamAckMode(),
+	}, func(ctx context.Context, post *types.ReceivedPost) {
+		b.postChan <- *post
+	})
+}
+
+func (b *Bot) postStatusNtfns(ctx context.Context) error {
+	return subscribeQueued(ctx, b, StreamConfig[types.ReceivedPostStatus]{
+		Name: StreamPostStatus,
+		Log:  b.postStatusLog,
+		Open: func(ctx context.Context, unackedFrom uint64) (StreamClient[types.ReceivedPostStatus], error) {
+			return b.postService.PostsStatusStream(ctx, &types.PostsStatusStreamRequest{UnackedFrom: unackedFrom})
+		},
+		AckMode: b.streamAckMode(),
+	}, func(ctx context.Context, status *types.ReceivedPostStatus) {
+		b.postStatusChan <- *status
+	})
+}
+
+// tipProgress consumes the tip progress stream, which resolves the tips sent
+// with PayTip.
 func (b *Bot) tipProgress(ctx context.Context) error {
-	var tpr types.TipProgressRequest
-	for {
-		stream, err := b.paymentService.TipProgress(ctx, &tpr)
-		if errors.Is(err, context.Canceled) {
-			// Program is done.
-			return err
+	return subscribeQueued(ctx, b, StreamConfig[types.TipProgressEvent]{
+		Name: StreamTipProgress,
+		Log:  b.tipProgressLog,
+		Open: func(ctx context.Context, unackedFrom uint64) (StreamClient[types.TipProgressEvent], error) {
+			return b.paymentService.TipProgress(ctx, &types.TipProgressRequest{UnackedFrom: unackedFrom})
+		},
+		AckMode: AckByHandler,
+	}, b.deliverTipProgress)
+}
+
+// deliverTipProgress applies a progress event to the tip payments and the
+// ledger, acks it and hands it to TipProgressChan. Events that could not be
+// recorded are nacked, so they are delivered again when the stream is
+// reopened.
+func (b *Bot) deliverTipProgress(ctx context.Context, ev *types.TipProgressEvent) {
+	rec, err := b.tipPayments.progress(ev)
+	if err != nil {
+		b.tipProgressLog.Errorf("Unable to record tip progress: %v", err)
+		b.nack(StreamTipProgress, ev.SequenceId)
+	} else {
+		if rec != nil && b.ledger != nil && rec.LedgerID != 0 {
+			if err := b.ledger.updateSend(*rec); err != nil {
+				b.tipProgressLog.Errorf("Unable to record tip progress in ledger: %v", err)
+			}
 		}
-		if err != nil {
-			b.tipProgressLog.Warnf("Error while creating tip progress stream: %v", err)
-			time.Sleep(time.Second) // Wait to try again.
-			continue
+		if rec != nil && rec.Status == TipFailed {
+			b.tipProgressLog.Warnf("Tip %d of %s to %s failed: %s", rec.ID,
+				rec.Amount(), rec.UID, rec.Error)
 		}
-		b.tipProgressLog.Info("Listening for tip progress...")
-		for {
-			var pm types.TipProgressEvent
-			err := stream.Recv(&pm)
-			if errors.Is(err, context.Canceled) {
-				// Program is done.
-				return err
-			}
-			if err != nil {
-				b.tipProgressLog.Warnf("Error while receiving stream: %v", err)
-				break
-			}
-			b.tipProgressChan <- pm
+		if err := b.ack(ctx, StreamTipProgress, ev.SequenceId); err != nil {
+			b.tipProgressLog.Errorf("Failed to acknowledge tip progress: %v", err)
 		}
 	}
+	if b.tipProgressChan != nil {
+		b.tipProgressChan <- *ev
+	}
 }
 
+// tipReceived consumes the received tips stream. Tips are acked by the
+// application through AckTipReceived, or by the kit when only the ledger
+// consumes them.
 func (b *Bot) tipReceived(ctx context.Context) error {
-	var tpr types.TipStreamRequest
-	for {
-		stream, err := b.paymentService.TipStream(ctx, &tpr)
-		if errors.Is(err, context.Canceled) {
-			// Program is done.
-			return err
+	return subscribeQueued(ctx, b, StreamConfig[types.ReceivedTip]{
+		Name: StreamTipReceived,
+		Log:  b.tipReceivedLog,
+		Open: func(ctx context.Context, unackedFrom uint64) (StreamClient[types.ReceivedTip], error) {
+			return b.paymentService.TipStream(ctx, &types.TipStreamRequest{UnackedFrom: unackedFrom})
+		},
+		AckMode: AckByHandler,
+	}, b.deliverTip)
+}
+
+// deliverTip records a received tip in the ledger, applies it to the open
+// invoices of the sender or deposits it in their account, and hands the other
+// tips to TipReceivedChan. Tips that could not be recorded are nacked, so
+// they are delivered again when the stream is reopened.
+func (b *Bot) deliverTip(ctx context.Context, tip *types.ReceivedTip) {
+	if b.ledger != nil {
+		if _, err := b.ledger.recordReceived(tip); err != nil {
+			b.tipReceivedLog.Errorf("Unable to record received tip: %v", err)
+			b.nack(StreamTipReceived, tip.SequenceId)
+			return
 		}
+	}
+	if b.paywall != nil {
+		handled, err := b.paywall.handleTip(ctx, tip)
 		if err != nil {
-			b.tipReceivedLog.Warnf("Error while creating tip received stream: %v", err)
-			time.Sleep(time.Second) // Wait to try again.
-			continue
+			b.tipReceivedLog.Errorf("Unable to apply tip to invoice: %v", err)
+			b.nack(StreamTipReceived, tip.SequenceId)
+			return
 		}
-		b.tipReceivedLog.Info("Listening for tip received...")
-		for {
-			var tip types.ReceivedTip
-			err := stream.Recv(&tip)
-			if errors.Is(err, context.Canceled) {
-				// Program is done.
-				return err
-			}
-			if err != nil {
-				b.tipReceivedLog.Warnf("Error while receiving stream: %v", err)
-				break
+		if handled {
+			if err := b.ack(ctx, StreamTipReceived, tip.SequenceId); err != nil {
+				b.tipReceivedLog.Errorf("Failed to acknowledge tip: %v", err)
 			}
-			b.tipReceivedChan <- tip
+			return
 		}
 	}
+	if b.accounts != nil {
+		if err := b.accounts.deposit(ctx, tip); err != nil {
+			b.tipReceivedLog.Errorf("Unable to deposit tip: %v", err)
+			b.nack(StreamTipReceived, tip.SequenceId)
+			return
+		}
+		if err := b.ack(ctx, StreamTipReceived, tip.SequenceId); err != nil {
+			b.tipReceivedLog.Errorf("Failed to acknowledge tip: %v", err)
+		}
+		return
+	}
+	if b.tipReceivedChan != nil {
+		b.tipReceivedChan <- *tip
+		return
+	}
+	if err := b.ack(ctx, StreamTipReceived, tip.SequenceId); err != nil {
+		b.tipReceivedLog.Errorf("Failed to acknowledge tip: %v", err)
+	}
 }
@@ -0,0 +1,106 @@
+package bisonbotkit
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+
+	"github.com/companyzero/bisonrelay/clientrpc/types"
+	"github.com/decred/slog"
+)
+
+func TestRouteAcks(t *testing.T) {
+	ctx := context.Background()
+	alice := testUID(1)
+	r := NewRouter()
+	for _, cmd := range []Command{
+		{Name: "ok", Handler: func(context.Context, *MsgContext) error { return nil }},
+		{Name: "fail", Handler: func(context.Context, *MsgContext) error { return errors.New("boom") }},
+	} {
+		if err := r.Register(cmd); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// In manual ack mode, messages are acked whether the router handles
+	// them, fails handling them or ignores them, so that they never hold
+	// back the acks of later messages.
+	tests := []struct {
+		name string
+		gc   bool
+		msg  string
+	}{
+		{"pm command", false, "ok"},
+		{"pm failed command", false, "fail"},
+		{"pm not routed", false, "hello"},
+		{"gc command", true, "!ok"},
+		{"gc failed command", true, "!fail"},
+		{"gc chat", true, "hello"},
+	}
+	for i, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			stream := StreamPM
+			if tc.gc {
+				stream = StreamGCM
+			}
+			b, acks := newAckTestBot(t, stream)
+			b.router = r
+			seq := uint64(i + 1)
+			b.streams[stream].tracker.received(seq)
+			if tc.gc {
+				b.routeGCM(ctx, &types.GCReceivedMsg{Uid: alice[:], GcAlias: "gc",
+					SequenceId: seq, Msg: &types.RMGroupMessage{Message: tc.msg}})
+			} else {
+				b.routePM(ctx, &types.ReceivedPM{Uid: alice[:], SequenceId: seq,
+					Msg: &types.RMPrivateMessage{Message: tc.msg}})
+			}
+			if got := acks.last(); got != seq {
+				t.Fatalf("acked up to %d, want %d", got, seq)
+			}
+		})
+	}
+}
+
+func TestDeliverTipLedgerFailure(t *testing.T) {
+	ctx := context.Background()
+	b, acks := newAckTestBot(t, StreamTipReceived)
+	b.tipReceivedLog = slog.Disabled
+	tips := make(chan types.ReceivedTip, 1)
+	b.tipReceivedChan = tips
+	path := filepath.Join(b.cfg.DataDir, "ledger.json")
+	l, err := NewLedger(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.SetLedger(l)
+	tracker := b.streams[StreamTipReceived].tracker
+	alice := testUID(1)
+
+	// A tip that could not be recorded is nacked instead of being handed
+	// to TipReceivedChan.
+	restore := breakSaves(t, path)
+	tracker.received(5)
+	b.deliverTip(ctx, testTip(alice, 5, 100))
+	if len(tips) != 0 || acks.last() != 0 {
+		t.Fatalf("unrecorded tip delivered: %d queued, acked up to %d",
+			len(tips), acks.last())
+	}
+	restore()
+
+	// It is delivered once it is recorded, after a later tip.
+	for _, seq := range []uint64{6, 5} {
+		tracker.received(seq)
+		b.deliverTip(ctx, testTip(alice, seq, 100))
+		if got := (<-tips).SequenceId; got != seq {
+			t.Fatalf("got tip %d, want %d", got, seq)
+		}
+		b.ack(ctx, StreamTipReceived, seq)
+	}
+	if got := acks.last(); got != 6 {
+		t.Fatalf("acked up to %d, want 6", got)
+	}
+	if bal := l.Balance(alice); bal.Received != 200 {
+		t.Fatalf("alice received %s, want 200 atoms", bal.Received)
+	}
+}
@@ -0,0 +1,373 @@
+package bisonbotkit
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/companyzero/bisonrelay/clientrpc/types"
+	"github.com/companyzero/bisonrelay/zkidentity"
+	"github.com/vctt94/bisonbotkit/utils"
+)
+
+// OnboardingStep is a question asked to new users during onboarding.
+type OnboardingStep struct {
+	// Name is the key of the answer in the onboarding record.
+	Name string
+
+	// Prompt is the message that asks the question.
+	Prompt string
+
+	// Options are the accepted answers, compared ignoring case. Any
+	// answer is accepted when it is empty.
+	Options []string
+
+	// Invalid is sent when the answer is not one of the options, before
+	// the prompt is repeated. It defaults to a message listing the
+	// options.
+	Invalid string
+}
+
+// OnboardingConfig configures the greetings and onboarding of new users.
+// Messages are text/templates executed with a WelcomeData.
+type OnboardingConfig struct {
+	// WelcomePM is sent to users after a KX with them completes.
+	WelcomePM string
+
+	// GCWelcome is sent to the GCs administered by the bot when members
+	// are added to them. GCWelcomes overrides it for the GCs with the
+	// given names; an empty value disables the greeting in that GC.
+	GCWelcome  string
+	GCWelcomes map[string]string
+
+	// Steps are asked in order after the welcome PM, each answer being
+	// the next PM of the user. Onboarding is skipped for users that
+	// already completed it.
+	Steps []OnboardingStep
+
+	// Done is sent once every step is answered.
+	Done string
+
+	// OnComplete, if set, is called when a user completes the
+	// onboarding.
+	OnComplete func(ctx context.Context, rec OnboardingRecord)
+}
+
+// WelcomeData is the data of onboarding message templates.
+type WelcomeData struct {
+	UID  string
+	Nick string
+
+	// GC is the name of the GC for GC greetings.
+	GC string
+}
+
+// OnboardingRecord is the onboarding progress of a user.
+type OnboardingRecord struct {
+	UID     string            `json:"uid"`
+	Nick    string            `json:"nick,omitempty"`
+	Step    int               `json:"step"`
+	Answers map[string]string `json:"answers,omitempty"`
+	Started time.Time         `json:"started"`
+
+	// Completed is the zero time while the onboarding is in progress.
+	Completed time.Time `json:"completed,omitempty"`
+}
+
+// onboarding sends the greetings and runs the onboarding steps. Records
+// are persisted in a JSON file.
+type onboarding struct {
+	cfg        OnboardingConfig
+	welcomePM  *template.Template
+	gcWelcome  *template.Template
+	gcWelcomes map[string]*template.Template
+	done       *template.Template
+	path       string
+
+	mtx     sync.Mutex
+	records map[string]*OnboardingRecord
+}
+
+// parseTemplate parses a message template, returning nil for empty ones.
+func parseTemplate(name, text string) (*template.Template, error) {
+	if text == "" {
+		return nil, nil
+	}
+	t, err := template.New(name).Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s template: %w", name, err)
+	}
+	return t, nil
+}
+
+// executeTemplate executes a message template, returning an empty string for
+// nil templates.
+func executeTemplate(t *template.Template, data interface{}) (string, error) {
+	if t == nil {
+		return "", nil
+	}
+	var b bytes.Buffer
+	if err := t.Execute(&b, data); err != nil {
+		return "", err
+	}
+	return b.String(), nil
+}
+
+// SetOnboarding enables greeting and onboarding new users. Onboarding
+// records are stored in onboarding.json inside the data dir. It must be
+// called before Run.
+func (b *Bot) SetOnboarding(cfg OnboardingConfig) error {
+	o := &onboarding{
+		cfg:        cfg,
+		gcWelcomes: make(map[string]*template.Template),
+		path:       filepath.Join(b.cfg.DataDir, "onboarding.json"),
+		records:    make(map[string]*OnboardingRecord),
+	}
+	var err error
+	if o.welcomePM, err = parseTemplate("welcome PM", cfg.WelcomePM); err != nil {
+		return err
+	}
+	if o.gcWelcome, err = parseTemplate("GC welcome", cfg.GCWelcome); err != nil {
+		return err
+	}
+	for gc, text := range cfg.GCWelcomes {
+		t, err := parseTemplate("GC welcome", text)
+		if err != nil {
+			return err
+		}
+		o.gcWelcomes[strings.ToLower(gc)] = t
+	}
+	if o.done, err = parseTemplate("onboarding done", cfg.Done); err != nil {
+		return err
+	}
+	for _, step := range cfg.Steps {
+		if step.Name == "" || step.Prompt == "" {
+			return fmt.Errorf("onboarding steps require a name and a prompt")
+		}
+	}
+
+	data, err := os.ReadFile(o.path)
+	switch {
+	case os.IsNotExist(err):
+	case err != nil:
+		return err
+	default:
+		if err := json.Unmarshal(data, &o.records); err != nil {
+			return err
+		}
+	}
+	b.onboarding = o
+	return nil
+}
+
+// save writes the records to disk. It must be called with the mutex held.
+func (o *onboarding) save() error {
+	data, err := json.MarshalIndent(o.records, "", "  ")
+	if err != nil {
+		return err
+	}
+	return utils.AtomicWriteFile(o.path, data, 0600)
+}
+
+// gcGreetings returns true if members added to GCs must be greeted.
+func (o *onboarding) gcGreetings() bool {
+	return o.gcWelcome != nil || len(o.gcWelcomes) > 0
+}
+
+// OnboardingRecord returns the onboarding record of the user.
+func (b *Bot) OnboardingRecord(uid zkidentity.ShortID) (OnboardingRecord, bool) {
+	o := b.onboarding
+	if o == nil {
+		return OnboardingRecord{}, false
+	}
+	o.mtx.Lock()
+	defer o.mtx.Unlock()
+	rec, ok := o.records[uid.String()]
+	if !ok {
+		return OnboardingRecord{}, false
+	}
+	res := *rec
+	res.Answers = make(map[string]string, len(rec.Answers))
+	for k, v := range rec.Answers {
+		res.Answers[k] = v
+	}
+	return res, true
+}
+
+// Onboarded returns true if the user completed the onboarding.
+func (b *Bot) Onboarded(uid zkidentity.ShortID) bool {
+	rec, ok := b.OnboardingRecord(uid)
+	return ok && !rec.Completed.IsZero()
+}
+
+// StartOnboarding (re)starts the onboarding steps of the user, discarding
+// previous answers.
+func (b *Bot) StartOnboarding(ctx context.Context, uid zkidentity.ShortID, nick string) error {
+	o := b.onboarding
+	if o == nil || len(o.cfg.Steps) == 0 {
+		return fmt.Errorf("onboarding has no steps")
+	}
+	o.mtx.Lock()
+	o.records[uid.String()] = &OnboardingRecord{
+		UID:     uid.String(),
+		Nick:    nick,
+		Answers: make(map[string]string),
+		Started: time.Now(),
+	}
+	err := o.save()
+	o.mtx.Unlock()
+	if err != nil {
+		return err
+	}
+	b.QueuePM(ctx, uid.String(), o.cfg.Steps[0].Prompt)
+	return nil
+}
+
+// onboardKX greets a user after a KX and starts their onboarding.
+func (b *Bot) onboardKX(ctx context.Context, kx *types.KXCompleted) {
+	o := b.onboarding
+	var uid zkidentity.ShortID
+	if err := uid.FromBytes(kx.Uid); err != nil {
+		b.kxLog.Warnf("Invalid KX user ID: %v", err)
+		return
+	}
+
+	data := WelcomeData{UID: uid.String(), Nick: kx.Nick}
+	msg, err := executeTemplate(o.welcomePM, data)
+	if err != nil {
+		b.kxLog.Errorf("Unable to execute welcome template: %v", err)
+	} else if msg != "" {
+		b.QueuePM(ctx, uid.String(), msg)
+	}
+
+	if len(o.cfg.Steps) == 0 || b.Onboarded(uid) {
+		return
+	}
+	if err := b.StartOnboarding(ctx, uid, kx.Nick); err != nil {
+		b.kxLog.Errorf("Unable to start onboarding of %s: %v", kx.Nick, err)
+	}
+}
+
+// handleOnboardingReply records the PM of a user that is being onboarded as
+// the answer to the current step. It returns false if the user is not being
+// onboarded.
+func (b *Bot) handleOnboardingReply(ctx context.Context, pm *types.ReceivedPM) bool {
+	o := b.onboarding
+	if o == nil || len(o.cfg.Steps) == 0 || pm.Msg == nil {
+		return false
+	}
+	uid := hex.EncodeToString(pm.Uid)
+
+	o.mtx.Lock()
+	rec, ok := o.records[uid]
+	if !ok || !rec.Completed.IsZero() || rec.Step >= len(o.cfg.Steps) {
+		o.mtx.Unlock()
+		return false
+	}
+	step := o.cfg.Steps[rec.Step]
+	answer := strings.TrimSpace(pm.Msg.Message)
+	valid := len(step.Options) == 0
+	for _, opt := range step.Options {
+		if strings.EqualFold(opt, answer) {
+			answer = opt
+			valid = true
+			break
+		}
+	}
+	if !valid {
+		o.mtx.Unlock()
+		invalid := step.Invalid
+		if invalid == "" {
+			invalid = "Please answer one of: " + strings.Join(step.Options, ", ")
+		}
+		b.QueuePM(ctx, uid, invalid+"\n\n"+step.Prompt)
+		return true
+	}
+
+	if rec.Answers == nil {
+		rec.Answers = make(map[string]string)
+	}
+	rec.Answers[step.Name] = answer
+	rec.Step++
+	completed := rec.Step == len(o.cfg.Steps)
+	if completed {
+		rec.Completed = time.Now()
+	}
+	res := *rec
+	if err := o.save(); err != nil {
+		b.pmLog.Errorf("Unable to save onboarding records: %v", err)
+	}
+	o.mtx.Unlock()
+
+	if !completed {
+		b.QueuePM(ctx, uid, o.cfg.Steps[res.Step].Prompt)
+		return true
+	}
+	b.pmLog.Infof("User %s completed the onboarding", pm.Nick)
+	msg, err := executeTemplate(o.done, WelcomeData{UID: uid, Nick: pm.Nick})
+	if err != nil {
+		b.pmLog.Errorf("Unable to execute onboarding done template: %v", err)
+	} else if msg != "" {
+		b.QueuePM(ctx, uid, msg)
+	}
+	if o.cfg.OnComplete != nil {
+		o.cfg.OnComplete(ctx, res)
+	}
+	return true
+}
+
+// greetGCMembers welcomes the members added to a GC administered by the bot.
+func (b *Bot) greetGCMembers(ctx context.Context, ev *types.GCMembersAddedEvent) {
+	o := b.onboarding
+	tmpl := o.gcWelcome
+	if t, ok := o.gcWelcomes[strings.ToLower(ev.GcName)]; ok {
+		tmpl = t
+	}
+	if tmpl == nil {
+		return
+	}
+
+	self, err := b.localID(ctx)
+	if err != nil {
+		b.gcLog.Errorf("Unable to get local ID: %v", err)
+		return
+	}
+	var selfID zkidentity.ShortID
+	if err := selfID.FromString(self); err != nil {
+		b.gcLog.Errorf("Invalid local ID: %v", err)
+		return
+	}
+	gc := hex.EncodeToString(ev.Gc)
+	admin, err := b.IsGCAdmin(ctx, gc, selfID)
+	if err != nil {
+		b.gcLog.Errorf("Unable to check admins of %s: %v", ev.GcName, err)
+		return
+	}
+	if !admin {
+		return
+	}
+
+	for _, u := range ev.Users {
+		uid := hex.EncodeToString(u.Uid)
+		if uid == self {
+			continue
+		}
+		data := WelcomeData{UID: uid, Nick: u.Nick, GC: ev.GcName}
+		msg, err := executeTemplate(tmpl, data)
+		if err != nil {
+			b.gcLog.Errorf("Unable to execute GC welcome template: %v", err)
+			return
+		}
+		if msg != "" {
+			b.QueueGC(ctx, gc, msg)
+		}
+	}
+}
@@ -0,0 +1,467 @@
+package bisonbotkit
+
+import (
+	"context"
+	"errors"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/companyzero/bisonrelay/clientrpc/jsonrpc"
+	"github.com/decred/slog"
+	"github.com/vctt94/bisonbotkit/config"
+)
+
+const (
+	defaultOutboundRetryDelay = time.Second
+	defaultOutboundQueueSize  = 10000
+)
+
+var (
+	// ErrOutboundFull is the error of messages queued while the outbound
+	// queue is full.
+	ErrOutboundFull = errors.New("outbound queue is full")
+
+	// ErrBotStopped is the error of messages that were still queued when
+	// Run returned, or that were queued after it returned and before it
+	// was called again.
+	ErrBotStopped = errors.New("bot stopped")
+)
+
+// Priority is the priority of a queued outgoing message. Messages of higher
+// priority are sent first.
+type Priority int
+
+const (
+	// PriorityNormal is the priority of SendPM, SendGC and replies to
+	// commands.
+	PriorityNormal Priority = iota
+
+	// PriorityHigh is meant for messages that must not wait behind bulk
+	// sends, such as replies to admins.
+	PriorityHigh
+
+	// PriorityLow is meant for bulk sends, such as broadcasts.
+	PriorityLow
+)
+
+// lanes lists the priorities in the order their messages are sent.
+var lanes = [...]Priority{PriorityHigh, PriorityNormal, PriorityLow}
+
+// Delivery tracks a message queued with QueuePM or QueueGC.
+type Delivery struct {
+	done chan struct{}
+	err  error
+}
+
+// Done returns a channel closed once the message is sent or failed.
+func (d *Delivery) Done() <-chan struct{} {
+	return d.done
+}
+
+// Err returns the error of a failed message. It returns nil until Done is
+// closed.
+func (d *Delivery) Err() error {
+	select {
+	case <-d.done:
+		return d.err
+	default:
+		return nil
+	}
+}
+
+// Wait blocks until the message is sent or failed and returns its error, or
+// until ctx is done.
+func (d *Delivery) Wait(ctx context.Context) error {
+	select {
+	case <-d.done:
+		return d.err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// SendOption is an option of a queued message.
+type SendOption func(*outMsg)
+
+// WithPriority sets the priority of the message.
+func WithPriority(p Priority) SendOption {
+	return func(m *outMsg) {
+		m.prio = p
+	}
+}
+
+// OnFailure sets a function called, from a separate goroutine, if the message
+// fails to be sent.
+func OnFailure(fn func(error)) SendOption {
+	return func(m *outMsg) {
+		m.onFailure = fn
+	}
+}
+
+// outGroup is the group of parts of a split message. err is set once a part
+// fails, after which the remaining parts are not sent.
+type outGroup struct {
+	err error
+}
+
+// outMsg is a queued outgoing message.
+type outMsg struct {
+	ctx       context.Context
+	dest      string
+	send      func(context.Context) error
+	prio      Priority
+	onFailure func(error)
+	delivery  *Delivery
+	group     *outGroup
+
+	attempts  int
+	notBefore time.Time
+	finished  bool
+}
+
+// tokenBucket is a token bucket rate limiter. A zero rate means unlimited.
+type tokenBucket struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate float64, burst int, now time.Time) *tokenBucket {
+	b := float64(burst)
+	if b <= 0 {
+		b = math.Max(1, math.Ceil(rate))
+	}
+	return &tokenBucket{rate: rate, burst: b, tokens: b, last: now}
+}
+
+func (tb *tokenBucket) refill(now time.Time) {
+	tb.tokens = math.Min(tb.burst, tb.tokens+now.Sub(tb.last).Seconds()*tb.rate)
+	tb.last = now
+}
+
+// wait returns how long until a token is available.
+func (tb *tokenBucket) wait(now time.Time) time.Duration {
+	if tb.rate <= 0 {
+		return 0
+	}
+	tb.refill(now)
+	if tb.tokens >= 1 {
+		return 0
+	}
+	return time.Duration((1 - tb.tokens) / tb.rate * float64(time.Second))
+}
+
+// take consumes a token.
+func (tb *tokenBucket) take(now time.Time) {
+	if tb.rate <= 0 {
+		return
+	}
+	tb.refill(now)
+	tb.tokens--
+}
+
+// full returns true if the bucket is full, in which case it does not need to
+// be kept around.
+func (tb *tokenBucket) full(now time.Time) bool {
+	if tb.rate <= 0 {
+		return true
+	}
+	tb.refill(now)
+	return tb.tokens >= tb.burst
+}
+
+// outboundQueue holds the messages waiting to be sent, by priority.
+type outboundQueue struct {
+	policy config.OutboundPolicy
+	log    slog.Logger
+
+	// notify is signalled when a message is queued.
+	notify chan struct{}
+
+	mtx     sync.Mutex
+	lanes   map[Priority][]*outMsg
+	count   int
+	global  *tokenBucket
+	dests   map[string]*tokenBucket
+	stopped bool
+}
+
+func newOutboundQueue(policy config.OutboundPolicy, log slog.Logger) *outboundQueue {
+	if policy.RetryDelay <= 0 {
+		policy.RetryDelay = defaultOutboundRetryDelay
+	}
+	if policy.QueueSize <= 0 {
+		policy.QueueSize = defaultOutboundQueueSize
+	}
+	return &outboundQueue{
+		policy: policy,
+		log:    log,
+		notify: make(chan struct{}, 1),
+		lanes:  make(map[Priority][]*outMsg),
+		global: newTokenBucket(policy.Rate, policy.Burst, time.Now()),
+		dests:  make(map[string]*tokenBucket),
+	}
+}
+
+// finish completes the delivery of m. It must be called with the mutex
+// held.
+func (q *outboundQueue) finish(m *outMsg, err error) {
+	m.finished = true
+	q.count--
+	if err != nil && m.group != nil && m.group.err == nil {
+		m.group.err = err
+	}
+	m.delivery.err = err
+	close(m.delivery.done)
+	if err != nil && m.onFailure != nil {
+		go m.onFailure(err)
+	}
+}
+
+// push queues a message.
+func (q *outboundQueue) push(m *outMsg) {
+	q.mtx.Lock()
+	defer q.mtx.Unlock()
+	switch {
+	case q.stopped:
+		q.count++
+		q.finish(m, ErrBotStopped)
+	case q.count >= q.policy.QueueSize:
+		q.count++
+		q.finish(m, ErrOutboundFull)
+	default:
+		q.count++
+		q.lanes[m.prio] = append(q.lanes[m.prio], m)
+		signal(q.notify)
+	}
+}
+
+// destBucket returns the rate limiter of a destination. It must be called
+// with the mutex held.
+func (q *outboundQueue) destBucket(dest string, now time.Time) *tokenBucket {
+	tb, ok := q.dests[dest]
+	if !ok {
+		tb = newTokenBucket(q.policy.DestRate, q.policy.DestBurst, now)
+		q.dests[dest] = tb
+	}
+	return tb
+}
+
+// next returns the next message that may be sent now or, if there is none,
+// how long until one may be sent (or zero if the queue is empty). Only the
+// first queued message of each destination is considered, so messages to the
+// same destination and of the same priority are sent in order.
+func (q *outboundQueue) next(now time.Time) (*outMsg, time.Duration) {
+	q.mtx.Lock()
+	defer q.mtx.Unlock()
+
+	var wait time.Duration
+	seen := make(map[string]bool)
+	for _, prio := range lanes {
+		lane := q.lanes[prio][:0]
+		for _, m := range q.lanes[prio] {
+			switch {
+			case m.finished:
+			case m.group != nil && m.group.err != nil:
+				// An earlier part of the message failed.
+				q.finish(m, m.group.err)
+			case m.ctx.Err() != nil:
+				q.finish(m, m.ctx.Err())
+			}
+			if !m.finished {
+				lane = append(lane, m)
+			}
+		}
+		q.lanes[prio] = lane
+
+		for _, m := range lane {
+			if seen[m.dest] {
+				continue
+			}
+			seen[m.dest] = true
+
+			w := q.destBucket(m.dest, now).wait(now)
+			if nb := m.notBefore.Sub(now); nb > w {
+				w = nb
+			}
+			if w <= 0 {
+				if gw := q.global.wait(now); gw > 0 {
+					return nil, gw
+				}
+				q.global.take(now)
+				q.destBucket(m.dest, now).take(now)
+				return m, 0
+			}
+			if wait == 0 || w < wait {
+				wait = w
+			}
+		}
+	}
+
+	// Forget the rate limiters that are back to full.
+	for dest, tb := range q.dests {
+		if !seen[dest] && tb.full(now) {
+			delete(q.dests, dest)
+		}
+	}
+	return nil, wait
+}
+
+// sent records the result of sending m.
+func (q *outboundQueue) sent(m *outMsg, err error) {
+	q.mtx.Lock()
+	defer q.mtx.Unlock()
+
+	var rpcErr *jsonrpc.Error
+	transient := err != nil && m.ctx.Err() == nil && !errors.As(err, &rpcErr)
+	if transient && m.attempts < q.policy.MaxRetries {
+		m.attempts++
+		delay := q.policy.RetryDelay << (m.attempts - 1)
+		m.notBefore = time.Now().Add(delay)
+		q.log.Warnf("Failed to send msg to %s (retrying in %s): %v",
+			m.dest, delay, err)
+		return
+	}
+	if err != nil {
+		q.log.Errorf("Failed to send msg to %s: %v", m.dest, err)
+	}
+	q.finish(m, err)
+}
+
+// stop fails every queued message and makes new messages fail.
+func (q *outboundQueue) stop() {
+	q.mtx.Lock()
+	defer q.mtx.Unlock()
+	q.stopped = true
+	for prio, lane := range q.lanes {
+		for _, m := range lane {
+			if !m.finished {
+				q.finish(m, ErrBotStopped)
+			}
+		}
+		delete(q.lanes, prio)
+	}
+}
+
+// start makes the queue accept messages again after it was stopped.
+func (q *outboundQueue) start() {
+	q.mtx.Lock()
+	q.stopped = false
+	q.mtx.Unlock()
+}
+
+// run sends the queued messages until ctx is done. Messages queued before run
+// is called wait for it, and the queue may be run again after it returns.
+func (q *outboundQueue) run(ctx context.Context) error {
+	q.start()
+	defer q.stop()
+	for {
+		m, wait := q.next(time.Now())
+		if m != nil {
+			q.sent(m, m.send(m.ctx))
+			continue
+		}
+
+		var timer <-chan time.Time
+		if wait > 0 {
+			timer = time.After(wait)
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-q.notify:
+		case <-timer:
+		}
+	}
+}
+
+// queueSend queues the parts of a message, each one sent with one of the send
+// functions. ctx limits how long the message may wait in the queue and is used
+// to send it. The returned delivery completes once every part is sent or one
+// of them fails, in which case the remaining parts are dropped.
+func (b *Bot) queueSend(ctx context.Context, dest string, sends []func(context.Context) error, opts []SendOption) *Delivery {
+	tmpl := outMsg{dest: dest}
+	for _, opt := range opts {
+		opt(&tmpl)
+	}
+
+	newMsg := func(ctx context.Context, send func(context.Context) error) *outMsg {
+		m := tmpl
+		m.ctx = ctx
+		m.send = send
+		m.delivery = &Delivery{done: make(chan struct{})}
+		return &m
+	}
+	if len(sends) == 1 {
+		m := newMsg(ctx, sends[0])
+		b.outbound.push(m)
+		return m.delivery
+	}
+
+	partsCtx, cancel := context.WithCancel(ctx)
+	group := &outGroup{}
+	parts := make([]*Delivery, len(sends))
+	for i, send := range sends {
+		m := newMsg(partsCtx, send)
+		m.onFailure = nil
+		m.group = group
+		b.outbound.push(m)
+		parts[i] = m.delivery
+	}
+	d := &Delivery{done: make(chan struct{})}
+	go func() {
+		defer cancel()
+		for _, part := range parts {
+			<-part.Done()
+			if err := part.Err(); err != nil {
+				d.err = err
+				break
+			}
+		}
+		close(d.done)
+		if d.err != nil && tmpl.onFailure != nil {
+			tmpl.onFailure(d.err)
+		}
+	}()
+	return d
+}
+
+// QueuePM queues a PM to be sent to nick, subject to the outbound rate limits,
+// and returns immediately. Long messages are split according to the split
+// policy, or sent as a text file if they have too many parts. The message is
+// dropped if ctx is done before it is sent.
+func (b *Bot) QueuePM(ctx context.Context, nick, msg string, opts ...SendOption) *Delivery {
+	parts := b.splitMessage(msg)
+	if max := b.cfg.Split.MaxParts; max > 0 && len(parts) > max {
+		send := func(ctx context.Context) error {
+			return b.sendAsFile(ctx, nick, msg)
+		}
+		return b.queueSend(ctx, "pm:"+nick, []func(context.Context) error{send}, opts)
+	}
+
+	sends := make([]func(context.Context) error, len(parts))
+	for i, part := range parts {
+		part := part
+		sends[i] = func(ctx context.Context) error {
+			return b.sendPM(ctx, nick, part)
+		}
+	}
+	return b.queueSend(ctx, "pm:"+nick, sends, opts)
+}
+
+// QueueGC queues a message to be sent to the GC, subject to the outbound rate
+// limits, and returns immediately. Long messages are split according to the
+// split policy. The message is dropped if ctx is done before it is sent.
+func (b *Bot) QueueGC(ctx context.Context, gc, msg string, opts ...SendOption) *Delivery {
+	parts := b.splitMessage(msg)
+	sends := make([]func(context.Context) error, len(parts))
+	for i, part := range parts {
+		part := part
+		sends[i] = func(ctx context.Context) error {
+			return b.sendGC(ctx, gc, part)
+		}
+	}
+	return b.queueSend(ctx, "gc:"+gc, sends, opts)
+}
@@ -0,0 +1,92 @@
+package bisonbotkit
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTokenBucket(t *testing.T) {
+	start := time.Unix(1700000000, 0)
+	type step struct {
+		at       time.Duration
+		take     bool
+		wantWait time.Duration
+	}
+	tests := []struct {
+		name  string
+		rate  float64
+		burst int
+		steps []step
+	}{{
+		name: "unlimited",
+		rate: 0,
+		steps: []step{
+			{at: 0, take: true}, {at: 0, take: true}, {at: 0, take: true},
+			{at: 0, wantWait: 0},
+		},
+	}, {
+		name:  "burst then rate",
+		rate:  2,
+		burst: 3,
+		steps: []step{
+			{at: 0, take: true}, {at: 0, take: true}, {at: 0, take: true},
+			{at: 0, wantWait: 500 * time.Millisecond},
+			{at: 250 * time.Millisecond, wantWait: 250 * time.Millisecond},
+			{at: 500 * time.Millisecond, take: true},
+			{at: 500 * time.Millisecond, wantWait: 500 * time.Millisecond},
+		},
+	}, {
+		name:  "refill capped at burst",
+		rate:  1,
+		burst: 2,
+		steps: []step{
+			{at: 0, take: true}, {at: 0, take: true},
+			{at: time.Hour, take: true}, {at: time.Hour, take: true},
+			{at: time.Hour, wantWait: time.Second},
+		},
+	}, {
+		name: "default burst",
+		rate: 0.5,
+		steps: []step{
+			{at: 0, take: true},
+			{at: 0, wantWait: 2 * time.Second},
+			{at: time.Second, wantWait: time.Second},
+		},
+	}}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			tb := newTokenBucket(tc.rate, tc.burst, start)
+			for i, s := range tc.steps {
+				now := start.Add(s.at)
+				if s.take {
+					if w := tb.wait(now); w != 0 {
+						t.Fatalf("step %d: token not available, wait %s", i, w)
+					}
+					tb.take(now)
+					continue
+				}
+				if w := tb.wait(now); w != s.wantWait {
+					t.Fatalf("step %d: got wait %s, want %s", i, w, s.wantWait)
+				}
+			}
+		})
+	}
+}
+
+func TestTokenBucketFull(t *testing.T) {
+	start := time.Unix(1700000000, 0)
+	tb := newTokenBucket(1, 2, start)
+	if !tb.full(start) {
+		t.Fatal("new bucket is not full")
+	}
+	tb.take(start)
+	if tb.full(start.Add(500 * time.Millisecond)) {
+		t.Fatal("bucket full before refilling")
+	}
+	if !tb.full(start.Add(time.Second)) {
+		t.Fatal("bucket not full after refilling")
+	}
+	if !newTokenBucket(0, 0, start).full(start) {
+		t.Fatal("unlimited bucket is not full")
+	}
+}
@@ -0,0 +1,727 @@
+package bisonbotkit
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/companyzero/bisonrelay/clientrpc/types"
+	"github.com/companyzero/bisonrelay/zkidentity"
+	"github.com/decred/dcrd/dcrutil/v4"
+	"github.com/decred/slog"
+	"github.com/vctt94/bisonbotkit/utils"
+)
+
+// defaultInvoiceExpiry is how long invoices stay open when the paywall config
+// does not set it.
+const defaultInvoiceExpiry = 15 * time.Minute
+
+// ErrInvoiceClosed is returned when canceling an invoice that is no longer
+// open.
+var ErrInvoiceClosed = errors.New("invoice is not open")
+
+// InvoiceStatus is the status of an invoice.
+type InvoiceStatus string
+
+const (
+	InvoiceOpen     InvoiceStatus = "open"
+	InvoicePaid     InvoiceStatus = "paid"
+	InvoiceExpired  InvoiceStatus = "expired"
+	InvoiceCanceled InvoiceStatus = "canceled"
+)
+
+// RemainderPolicy is what the paywall does with the amount paid in excess of
+// an invoice and with the partial payment of an invoice that expires or is
+// canceled.
+type RemainderPolicy string
+
+const (
+	// RemainderCredit keeps the amount as credit of the user, which pays
+	// their next invoices.
+	RemainderCredit RemainderPolicy = "credit"
+
+	// RemainderRefund tips the amount back to the user.
+	RemainderRefund RemainderPolicy = "refund"
+)
+
+// Invoice is a payment requested from a user. Invoices are paid by tipping
+// the bot: tips are applied to the oldest open invoice of the user.
+type Invoice struct {
+	ID   uint64 `json:"id"`
+	UID  string `json:"uid"`
+	Nick string `json:"nick,omitempty"`
+	Memo string `json:"memo,omitempty"`
+
+	// MAtoms is the amount of the invoice and PaidMAtoms the amount paid
+	// so far (including credit), in milli-atoms.
+	MAtoms     int64 `json:"matoms"`
+	PaidMAtoms int64 `json:"paidmatoms,omitempty"`
+
+	// TipSeqs are the sequence IDs of the tips that paid the invoice.
+	TipSeqs []uint64 `json:"tipseqs,omitempty"`
+
+	// RemainderMAtoms is the amount credited or refunded when the invoice
+	// was closed.
+	RemainderMAtoms int64 `json:"remaindermatoms,omitempty"`
+
+	Status  InvoiceStatus `json:"status"`
+	Created time.Time     `json:"created"`
+	Expires time.Time     `json:"expires"`
+	Closed  time.Time     `json:"closed,omitempty"`
+
+	// Gated is set for invoices issued by Require, whose handler is lost
+	// if the bot restarts before they are paid.
+	Gated bool `json:"gated,omitempty"`
+}
+
+// Amount returns the amount of the invoice.
+func (inv Invoice) Amount() dcrutil.Amount {
+	return dcrutil.Amount(inv.MAtoms / 1000)
+}
+
+// Due returns the amount still to be paid.
+func (inv Invoice) Due() dcrutil.Amount {
+	if inv.PaidMAtoms >= inv.MAtoms {
+		return 0
+	}
+	return dcrutil.Amount((inv.MAtoms - inv.PaidMAtoms + 999) / 1000)
+}
+
+// PaywallConfig configures a Paywall.
+type PaywallConfig struct {
+	// Path is the file where invoices and credits are stored, usually
+	// inside the bot's data dir.
+	Path string
+
+	// Expiry is how long invoices stay open. It defaults to 15 minutes.
+	Expiry time.Duration
+
+	// Remainder is the policy for overpayments and partial payments of
+	// invoices that do not get paid. It defaults to RemainderCredit.
+	Remainder RemainderPolicy
+
+	Log slog.Logger
+
+	// OnPaid and OnExpired, if set, are called for every invoice that is
+	// paid or expires.
+	OnPaid    func(ctx context.Context, inv Invoice)
+	OnExpired func(ctx context.Context, inv Invoice)
+}
+
+// paywallRefund is a remainder being tipped back to a user. PaymentID is
+// zero until the tip is requested.
+type paywallRefund struct {
+	Invoice   uint64 `json:"invoice"`
+	UID       string `json:"uid"`
+	MAtoms    int64  `json:"matoms"`
+	PaymentID uint64 `json:"paymentid,omitempty"`
+}
+
+// Amount returns the amount of the refund, truncated to atoms.
+func (r paywallRefund) Amount() dcrutil.Amount {
+	return dcrutil.Amount(r.MAtoms / 1000)
+}
+
+// paywallState is the persisted state of the paywall.
+type paywallState struct {
+	NextID   uint64           `json:"nextid"`
+	Invoices []*Invoice       `json:"invoices"`
+	Credits  map[string]int64 `json:"credits,omitempty"`
+
+	// Refunds are the refunds not completed yet.
+	Refunds []*paywallRefund `json:"refunds,omitempty"`
+}
+
+// clone returns a copy of the state that can be changed without affecting
+// s. Invoices and refunds are shared, so they must be replaced by copies
+// before being changed.
+func (s *paywallState) clone() paywallState {
+	c := *s
+	c.Invoices = append([]*Invoice(nil), s.Invoices...)
+	c.Refunds = append([]*paywallRefund(nil), s.Refunds...)
+	c.Credits = make(map[string]int64, len(s.Credits))
+	for uid, m := range s.Credits {
+		c.Credits[uid] = m
+	}
+	return c
+}
+
+// editInvoice replaces the i-th invoice with a copy and returns it.
+func (s *paywallState) editInvoice(i int) *Invoice {
+	inv := *s.Invoices[i]
+	inv.TipSeqs = append([]uint64(nil), inv.TipSeqs...)
+	s.Invoices[i] = &inv
+	return &inv
+}
+
+// refundIndex returns the index of the refund of the invoice, or -1.
+func (s *paywallState) refundIndex(invoice uint64) int {
+	for i, r := range s.Refunds {
+		if r.Invoice == invoice {
+			return i
+		}
+	}
+	return -1
+}
+
+// removeRefund removes the refund of the invoice.
+func (s *paywallState) removeRefund(invoice uint64) {
+	if i := s.refundIndex(invoice); i >= 0 {
+		s.Refunds = append(s.Refunds[:i:i], s.Refunds[i+1:]...)
+	}
+}
+
+// Paywall issues invoices to users and runs the handlers of paid commands
+// once their invoice is paid. It is attached to a bot with SetPaywall.
+type Paywall struct {
+	cfg PaywallConfig
+	log slog.Logger
+	bot *Bot
+
+	mtx      sync.Mutex
+	state    paywallState
+	handlers map[uint64]func(context.Context, Invoice)
+
+	// changed is signalled when an invoice is issued, so the expiry timer
+	// is recomputed.
+	changed chan struct{}
+}
+
+// NewPaywall creates a paywall, loading the invoices and credits stored in
+// the config path.
+func NewPaywall(cfg PaywallConfig) (*Paywall, error) {
+	if cfg.Path == "" {
+		return nil, errors.New("paywall path is required")
+	}
+	if cfg.Expiry <= 0 {
+		cfg.Expiry = defaultInvoiceExpiry
+	}
+	switch cfg.Remainder {
+	case "":
+		cfg.Remainder = RemainderCredit
+	case RemainderCredit, RemainderRefund:
+	default:
+		return nil, fmt.Errorf("unknown remainder policy %q", cfg.Remainder)
+	}
+	log := cfg.Log
+	if log == nil {
+		log = slog.Disabled
+	}
+
+	p := &Paywall{
+		cfg:      cfg,
+		log:      log,
+		state:    paywallState{NextID: 1},
+		handlers: make(map[uint64]func(context.Context, Invoice)),
+		changed:  make(chan struct{}, 1),
+	}
+	data, err := os.ReadFile(cfg.Path)
+	switch {
+	case os.IsNotExist(err):
+	case err != nil:
+		return nil, err
+	default:
+		if err := json.Unmarshal(data, &p.state); err != nil {
+			return nil, fmt.Errorf("invalid paywall file: %w", err)
+		}
+	}
+	if p.state.Credits == nil {
+		p.state.Credits = make(map[string]int64)
+	}
+	return p, nil
+}
+
+// SetPaywall attaches a paywall to the bot. Received tips are applied to the
+// open invoices of their senders; tips that pay an invoice are acked by the
+// kit and not sent to TipReceivedChan. It must be called before Run.
+func (b *Bot) SetPaywall(p *Paywall) {
+	p.bot = b
+	b.paywall = p
+}
+
+// save writes st to disk and then makes it the state of the paywall, so
+// changes that could not be persisted are discarded. It must be called with
+// the mutex held.
+func (p *Paywall) save(st paywallState) error {
+	data, err := json.MarshalIndent(&st, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := utils.AtomicWriteFile(p.cfg.Path, data, 0600); err != nil {
+		return err
+	}
+	p.state = st
+	return nil
+}
+
+// closeInvoice closes the invoice of st with the given status, applying the
+// remainder policy to the amount paid beyond the invoice (or to everything
+// paid if it was not paid). It returns the refund added to st, if any.
+func (p *Paywall) closeInvoice(st *paywallState, inv *Invoice, status InvoiceStatus) *paywallRefund {
+	inv.Status = status
+	inv.Closed = time.Now()
+	remainder := inv.PaidMAtoms
+	if status == InvoicePaid {
+		remainder -= inv.MAtoms
+	}
+	if remainder <= 0 {
+		return nil
+	}
+	inv.RemainderMAtoms = remainder
+	if p.cfg.Remainder == RemainderRefund && remainder >= 1000 {
+		r := &paywallRefund{Invoice: inv.ID, UID: inv.UID, MAtoms: remainder}
+		st.Refunds = append(st.Refunds, r)
+		return r
+	}
+	st.Credits[inv.UID] += remainder
+	return nil
+}
+
+// remainderNote describes what was done with the remainder of an invoice.
+func (p *Paywall) remainderNote(inv Invoice) string {
+	if inv.RemainderMAtoms <= 0 {
+		return ""
+	}
+	amt := dcrutil.Amount(inv.RemainderMAtoms / 1000)
+	if p.cfg.Remainder == RemainderRefund && inv.RemainderMAtoms >= 1000 {
+		return fmt.Sprintf(" %s is being refunded to you.", amt)
+	}
+	return fmt.Sprintf(" %s was added to your credit.", amt)
+}
+
+// refund tips a refund back to the user and waits for the tip. The tip
+// payment is recorded in the refund before it is requested, so it is not
+// sent twice if the bot restarts. Refunds that cannot be sent are added to
+// the credit of the user.
+func (p *Paywall) refund(ctx context.Context, r *paywallRefund) {
+	if r == nil {
+		return
+	}
+	var uid zkidentity.ShortID
+	if err := uid.FromString(r.UID); err != nil {
+		p.log.Errorf("Invalid user ID of invoice %d: %v", r.Invoice, err)
+		return
+	}
+	payment, err := p.bot.reserveTip(uid, r.Amount(), defaultJobTipAttempts)
+	if err != nil {
+		p.log.Errorf("Unable to refund %s of invoice %d to %s: %v", r.Amount(),
+			r.Invoice, r.UID, err)
+		p.refundFailed(ctx, *r)
+		return
+	}
+
+	p.mtx.Lock()
+	st := p.state.clone()
+	if i := st.refundIndex(r.Invoice); i >= 0 {
+		upd := *st.Refunds[i]
+		upd.PaymentID = payment.ID()
+		st.Refunds[i] = &upd
+		err = p.save(st)
+	}
+	p.mtx.Unlock()
+	if err != nil {
+		// Not requested, so it is attempted again after a restart.
+		p.log.Errorf("Unable to save refund of invoice %d: %v", r.Invoice, err)
+		p.bot.tipFailed(payment.ID(), err)
+		return
+	}
+
+	if err := p.bot.sendTip(ctx, payment); err != nil {
+		p.log.Warnf("Refund of %s of invoice %d to %s may not have been sent: %v",
+			r.Amount(), r.Invoice, r.UID, err)
+	}
+	go p.watchRefund(ctx, *r, payment)
+}
+
+// watchRefund waits for the tip of a refund, adding its amount to the credit
+// of the user if the tip fails.
+func (p *Paywall) watchRefund(ctx context.Context, r paywallRefund, payment *TipPayment) {
+	select {
+	case <-payment.Done():
+	case <-ctx.Done():
+		return
+	}
+	if err := payment.Err(); err != nil {
+		p.log.Warnf("Refund of %s of invoice %d to %s failed: %v", r.Amount(),
+			r.Invoice, r.UID, err)
+		p.refundFailed(ctx, r)
+		return
+	}
+	p.mtx.Lock()
+	st := p.state.clone()
+	st.removeRefund(r.Invoice)
+	if err := p.save(st); err != nil {
+		p.log.Errorf("Unable to save refund of invoice %d: %v", r.Invoice, err)
+	}
+	p.mtx.Unlock()
+}
+
+// refundFailed moves the amount of a refund that could not be sent to the
+// credit of the user.
+func (p *Paywall) refundFailed(ctx context.Context, r paywallRefund) {
+	p.mtx.Lock()
+	if p.state.refundIndex(r.Invoice) < 0 {
+		p.mtx.Unlock()
+		return
+	}
+	st := p.state.clone()
+	st.removeRefund(r.Invoice)
+	st.Credits[r.UID] += r.MAtoms
+	err := p.save(st)
+	p.mtx.Unlock()
+	if err != nil {
+		// The refund is kept, so it is credited once the bot restarts.
+		p.log.Errorf("Unable to credit failed refund of invoice %d: %v", r.Invoice, err)
+		return
+	}
+	p.bot.QueuePM(ctx, r.UID, fmt.Sprintf("The refund of %s for invoice #%d failed, "+
+		"so it was added to your credit.", r.Amount(), r.Invoice))
+}
+
+// resumeRefunds requests or watches again the refunds in progress when the
+// bot starts.
+func (p *Paywall) resumeRefunds(ctx context.Context) {
+	p.mtx.Lock()
+	refunds := append([]*paywallRefund(nil), p.state.Refunds...)
+	p.mtx.Unlock()
+	for _, r := range refunds {
+		if r.PaymentID == 0 {
+			go p.refund(ctx, r)
+			continue
+		}
+		payment, ok := p.bot.TipPayment(r.PaymentID)
+		if !ok {
+			// The outcome of the tip is no longer known.
+			p.log.Errorf("Tip %d of refund of invoice %d to %s not found",
+				r.PaymentID, r.Invoice, r.UID)
+			p.mtx.Lock()
+			st := p.state.clone()
+			st.removeRefund(r.Invoice)
+			if err := p.save(st); err != nil {
+				p.log.Errorf("Unable to save refund of invoice %d: %v", r.Invoice, err)
+			}
+			p.mtx.Unlock()
+			continue
+		}
+		go p.watchRefund(ctx, *r, payment)
+	}
+}
+
+// issue creates an invoice, paying it with the credit of the user when
+// possible. Invoices not fully paid by credit are sent to the user and onPaid
+// is called once they are paid.
+func (p *Paywall) issue(ctx context.Context, uid zkidentity.ShortID, nick string, amt dcrutil.Amount,
+	memo string, gated bool, onPaid func(context.Context, Invoice)) (Invoice, error) {
+
+	if amt <= 0 {
+		return Invoice{}, errors.New("invoice amount must be greater than zero")
+	}
+	now := time.Now()
+	inv := &Invoice{
+		UID:     uid.String(),
+		Nick:    nick,
+		Memo:    memo,
+		MAtoms:  int64(amt) * 1000,
+		Status:  InvoiceOpen,
+		Created: now,
+		Expires: now.Add(p.cfg.Expiry),
+		Gated:   gated,
+	}
+
+	p.mtx.Lock()
+	st := p.state.clone()
+	inv.ID = st.NextID
+	st.NextID++
+	credit := st.Credits[inv.UID]
+	if credit > inv.MAtoms {
+		credit = inv.MAtoms
+	}
+	if credit > 0 {
+		inv.PaidMAtoms = credit
+		st.Credits[inv.UID] -= credit
+		if st.Credits[inv.UID] == 0 {
+			delete(st.Credits, inv.UID)
+		}
+	}
+	paid := inv.PaidMAtoms >= inv.MAtoms
+	if paid {
+		p.closeInvoice(&st, inv, InvoicePaid)
+	}
+	st.Invoices = append(st.Invoices, inv)
+	err := p.save(st)
+	if err == nil && !paid && onPaid != nil {
+		p.handlers[inv.ID] = onPaid
+	}
+	res := *inv
+	p.mtx.Unlock()
+	if err != nil {
+		return Invoice{}, err
+	}
+
+	if paid {
+		p.log.Infof("Invoice %d of %s paid with credit", res.ID, nick)
+		if p.cfg.OnPaid != nil {
+			p.cfg.OnPaid(ctx, res)
+		}
+		return res, nil
+	}
+
+	signal(p.changed)
+	msg := fmt.Sprintf("Invoice #%d: %s\nAmount: %s", res.ID, memo, res.Amount())
+	if res.PaidMAtoms > 0 {
+		msg += fmt.Sprintf(" (%s paid with your credit)", dcrutil.Amount(res.PaidMAtoms/1000))
+	}
+	msg += fmt.Sprintf("\nSend a tip of %s to pay it before %s.", res.Due(),
+		res.Expires.UTC().Format("15:04 MST"))
+	p.bot.QueuePM(ctx, res.UID, msg)
+	return res, nil
+}
+
+// RequestPayment issues an invoice of amt to the user and sends it to them in
+// a PM. onPaid, if set, is called once the invoice is paid. Invoices are paid
+// with the credit of the user first, in which case onPaid is called before
+// returning and no PM is sent.
+func (p *Paywall) RequestPayment(ctx context.Context, uid zkidentity.ShortID, nick string,
+	amt dcrutil.Amount, memo string, onPaid func(context.Context, Invoice)) (Invoice, error) {
+
+	inv, err := p.issue(ctx, uid, nick, amt, memo, false, onPaid)
+	if err == nil && inv.Status == InvoicePaid && onPaid != nil {
+		onPaid(ctx, inv)
+	}
+	return inv, err
+}
+
+// Require returns a middleware that charges amt for running the handler. The
+// handler runs right away when the credit of the user covers the amount;
+// otherwise the user is sent an invoice and the handler runs once it is paid.
+func (p *Paywall) Require(amt dcrutil.Amount, memo string) Middleware {
+	return func(next HandlerFunc) HandlerFunc {
+		return func(ctx context.Context, mc *MsgContext) error {
+			inv, err := p.issue(ctx, mc.UID, mc.Nick, amt, memo, true,
+				func(ctx context.Context, inv Invoice) {
+					if err := next(ctx, mc); err != nil {
+						p.log.Errorf("Paid command %q of %s (invoice %d) failed: %v",
+							mc.Cmd, mc.Nick, inv.ID, err)
+					}
+				})
+			if err != nil {
+				return err
+			}
+			if inv.Status == InvoicePaid {
+				return next(ctx, mc)
+			}
+			return nil
+		}
+	}
+}
+
+// handleTip applies a received tip to the oldest open invoice of the sender.
+// It returns false if the sender has no open invoice, and an error if the
+// payment could not be recorded.
+func (p *Paywall) handleTip(ctx context.Context, tip *types.ReceivedTip) (bool, error) {
+	uid := hex.EncodeToString(tip.Uid)
+	now := time.Now()
+
+	p.mtx.Lock()
+	idx := -1
+	for i, inv := range p.state.Invoices {
+		if inv.UID != uid {
+			continue
+		}
+		for _, seq := range inv.TipSeqs {
+			if seq == tip.SequenceId && seq != 0 {
+				// Tip delivered again after a restart.
+				p.mtx.Unlock()
+				return true, nil
+			}
+		}
+		if idx < 0 && inv.Status == InvoiceOpen && now.Before(inv.Expires) {
+			idx = i
+		}
+	}
+	if idx < 0 {
+		p.mtx.Unlock()
+		return false, nil
+	}
+	st := p.state.clone()
+	inv := st.editInvoice(idx)
+	inv.PaidMAtoms += tip.AmountMatoms
+	inv.TipSeqs = append(inv.TipSeqs, tip.SequenceId)
+	paid := inv.PaidMAtoms >= inv.MAtoms
+	var refund *paywallRefund
+	var handler func(context.Context, Invoice)
+	restarted := false
+	if paid {
+		handler = p.handlers[inv.ID]
+		if handler == nil && inv.Gated {
+			// The command that issued the invoice was lost in
+			// a restart, so credit the whole payment.
+			restarted = true
+			st.Credits[inv.UID] += inv.MAtoms
+		}
+		refund = p.closeInvoice(&st, inv, InvoicePaid)
+	}
+	if err := p.save(st); err != nil {
+		p.mtx.Unlock()
+		return false, err
+	}
+	if paid {
+		delete(p.handlers, inv.ID)
+	}
+	res := *inv
+	p.mtx.Unlock()
+
+	if !paid {
+		p.bot.QueuePM(ctx, uid, fmt.Sprintf("Received %s for invoice #%d. Send %s more to pay it.",
+			dcrutil.Amount(tip.AmountMatoms/1000), res.ID, res.Due()))
+		return true, nil
+	}
+
+	p.log.Infof("Invoice %d of %s paid", res.ID, res.Nick)
+	p.refund(ctx, refund)
+	msg := fmt.Sprintf("Invoice #%d paid, thank you!", res.ID)
+	if restarted {
+		msg += " The bot restarted before the payment arrived, so the amount was " +
+			"added to your credit: please run the command again."
+	}
+	p.bot.QueuePM(ctx, uid, msg+p.remainderNote(res))
+	if p.cfg.OnPaid != nil {
+		p.cfg.OnPaid(ctx, res)
+	}
+	if handler != nil {
+		go handler(ctx, res)
+	}
+	return true, nil
+}
+
+// Cancel cancels an open invoice, applying the remainder policy to the
+// amount already paid.
+func (p *Paywall) Cancel(ctx context.Context, id uint64) error {
+	p.mtx.Lock()
+	idx := -1
+	for i, inv := range p.state.Invoices {
+		if inv.ID == id {
+			idx = i
+			break
+		}
+	}
+	if idx < 0 || p.state.Invoices[idx].Status != InvoiceOpen {
+		p.mtx.Unlock()
+		return ErrInvoiceClosed
+	}
+	st := p.state.clone()
+	inv := st.editInvoice(idx)
+	refund := p.closeInvoice(&st, inv, InvoiceCanceled)
+	if err := p.save(st); err != nil {
+		p.mtx.Unlock()
+		return err
+	}
+	delete(p.handlers, id)
+	res := *inv
+	p.mtx.Unlock()
+
+	p.refund(ctx, refund)
+	if res.RemainderMAtoms > 0 {
+		p.bot.QueuePM(ctx, res.UID, fmt.Sprintf("Invoice #%d was canceled.%s",
+			res.ID, p.remainderNote(res)))
+	}
+	return nil
+}
+
+// run expires the open invoices when their time is up. It also resumes the
+// refunds in progress when the bot starts.
+func (p *Paywall) run(ctx context.Context) error {
+	p.resumeRefunds(ctx)
+	for {
+		now := time.Now()
+		var next time.Time
+		var expired []Invoice
+		var refunds []*paywallRefund
+		p.mtx.Lock()
+		st := p.state.clone()
+		for i, inv := range st.Invoices {
+			if inv.Status != InvoiceOpen {
+				continue
+			}
+			if now.Before(inv.Expires) {
+				if next.IsZero() || inv.Expires.Before(next) {
+					next = inv.Expires
+				}
+				continue
+			}
+			inv = st.editInvoice(i)
+			refunds = append(refunds, p.closeInvoice(&st, inv, InvoiceExpired))
+			expired = append(expired, *inv)
+		}
+		if len(expired) > 0 {
+			if err := p.save(st); err != nil {
+				p.log.Errorf("Unable to save paywall state: %v", err)
+				expired, refunds = nil, nil
+				next = now.Add(time.Minute)
+			}
+			for _, inv := range expired {
+				delete(p.handlers, inv.ID)
+			}
+		}
+		p.mtx.Unlock()
+
+		for i, inv := range expired {
+			p.log.Debugf("Invoice %d of %s expired", inv.ID, inv.Nick)
+			p.refund(ctx, refunds[i])
+			p.bot.QueuePM(ctx, inv.UID, fmt.Sprintf("Invoice #%d (%s) expired.%s",
+				inv.ID, inv.Memo, p.remainderNote(inv)))
+			if p.cfg.OnExpired != nil {
+				p.cfg.OnExpired(ctx, inv)
+			}
+		}
+
+		var timer <-chan time.Time
+		if !next.IsZero() {
+			timer = time.After(time.Until(next))
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-p.changed:
+		case <-timer:
+		}
+	}
+}
+
+// Invoice returns the invoice with the given ID.
+func (p *Paywall) Invoice(id uint64) (Invoice, bool) {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	for _, inv := range p.state.Invoices {
+		if inv.ID == id {
+			return *inv, true
+		}
+	}
+	return Invoice{}, false
+}
+
+// OpenInvoices returns the open invoices of the user, oldest first.
+func (p *Paywall) OpenInvoices(uid zkidentity.ShortID) []Invoice {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	var res []Invoice
+	id := uid.String()
+	for _, inv := range p.state.Invoices {
+		if inv.UID == id && inv.Status == InvoiceOpen {
+			res = append(res, *inv)
+		}
+	}
+	return res
+}
+
+// Credit returns the credit of the user.
+func (p *Paywall) Credit(uid zkidentity.ShortID) dcrutil.Amount {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	return dcrutil.Amount(p.state.Credits[uid.String()] / 1000)
+}
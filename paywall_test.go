@@ -0,0 +1,300 @@
+package bisonbotkit
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/companyzero/bisonrelay/clientrpc/types"
+	"github.com/companyzero/bisonrelay/zkidentity"
+	"github.com/decred/dcrd/dcrutil/v4"
+	"github.com/decred/slog"
+	"github.com/vctt94/bisonbotkit/config"
+)
+
+// fakePayments records the tips requested by the bot, failing them with err
+// if set.
+type fakePayments struct {
+	types.PaymentsServiceClient
+
+	mtx  sync.Mutex
+	tips []*types.TipUserRequest
+	err  error
+}
+
+func (f *fakePayments) TipUser(_ context.Context, req *types.TipUserRequest, _ *types.TipUserResponse) error {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	f.tips = append(f.tips, req)
+	return f.err
+}
+
+func (f *fakePayments) setErr(err error) {
+	f.mtx.Lock()
+	f.err = err
+	f.mtx.Unlock()
+}
+
+func (f *fakePayments) count() int {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	return len(f.tips)
+}
+
+// newTestBot returns a bot that stores its data in dir and sends tips to
+// payments. It is not connected, so PMs are only queued.
+func newTestBot(t *testing.T, dir string, payments *fakePayments) *Bot {
+	t.Helper()
+	tp, err := newTipPayments(filepath.Join(dir, "tippayments.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &Bot{
+		cfg:            &config.BotConfig{DataDir: dir},
+		log:            slog.Disabled,
+		pmLog:          slog.Disabled,
+		tipProgressLog: slog.Disabled,
+		tipReceivedLog: slog.Disabled,
+		outbound:       newOutboundQueue(config.OutboundPolicy{}, slog.Disabled),
+		tipPayments:    tp,
+		paymentService: payments,
+	}
+}
+
+// resolveTip applies a final progress event for a tip of amt to uid.
+func resolveTip(t *testing.T, b *Bot, seq uint64, uid zkidentity.ShortID, amt dcrutil.Amount, completed bool) {
+	t.Helper()
+	ev := &types.TipProgressEvent{
+		SequenceId:   seq,
+		Uid:          uid[:],
+		AmountMatoms: int64(amt) * 1000,
+		Completed:    completed,
+		Attempt:      1,
+	}
+	if !completed {
+		ev.AttemptErr = "no route"
+	}
+	if _, err := b.tipPayments.progress(ev); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// waitFor waits until cond returns true.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timeout waiting for %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func newTestPaywall(t *testing.T, b *Bot, remainder RemainderPolicy) *Paywall {
+	t.Helper()
+	p, err := NewPaywall(PaywallConfig{
+		Path:      filepath.Join(b.cfg.DataDir, "paywall.json"),
+		Remainder: remainder,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.SetPaywall(p)
+	return p
+}
+
+func TestPaywallHandleTip(t *testing.T) {
+	ctx := context.Background()
+	alice, bob := testUID(1), testUID(2)
+	b := newTestBot(t, t.TempDir(), &fakePayments{})
+	p := newTestPaywall(t, b, RemainderCredit)
+
+	paid := make(chan Invoice, 1)
+	inv, err := p.RequestPayment(ctx, alice, "alice", 100, "test", func(_ context.Context, inv Invoice) {
+		paid <- inv
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name        string
+		tip         *types.ReceivedTip
+		wantHandled bool
+		wantPaid    dcrutil.Amount
+		wantStatus  InvoiceStatus
+	}{
+		{"no invoice", testTip(bob, 1, 100), false, 0, InvoiceOpen},
+		{"partial", testTip(alice, 2, 60), true, 60, InvoiceOpen},
+		{"duplicate", testTip(alice, 2, 60), true, 60, InvoiceOpen},
+		{"overpaid", testTip(alice, 3, 50), true, 110, InvoicePaid},
+		{"closed", testTip(alice, 4, 10), false, 110, InvoicePaid},
+	}
+	for _, tc := range tests {
+		handled, err := p.handleTip(ctx, tc.tip)
+		if err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		got, _ := p.Invoice(inv.ID)
+		if handled != tc.wantHandled || got.PaidMAtoms/1000 != int64(tc.wantPaid) ||
+			got.Status != tc.wantStatus {
+			t.Fatalf("%s: handled %v, invoice %+v", tc.name, handled, got)
+		}
+	}
+	select {
+	case inv := <-paid:
+		if inv.RemainderMAtoms != 10000 {
+			t.Fatalf("unexpected remainder %d", inv.RemainderMAtoms)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("handler not called")
+	}
+	if c := p.Credit(alice); c != 10 {
+		t.Fatalf("got credit %s, want 10 atoms", c)
+	}
+
+	// The credit pays the next invoice first.
+	inv, err = p.RequestPayment(ctx, alice, "alice", 30, "test", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if inv.PaidMAtoms != 10000 || inv.Due() != 20 || p.Credit(alice) != 0 {
+		t.Fatalf("credit not applied: %+v", inv)
+	}
+}
+
+func TestPaywallSaveFailure(t *testing.T) {
+	ctx := context.Background()
+	alice := testUID(1)
+	b := newTestBot(t, t.TempDir(), &fakePayments{})
+	p := newTestPaywall(t, b, RemainderCredit)
+	inv, err := p.RequestPayment(ctx, alice, "alice", 100, "test", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	restore := breakSaves(t, p.cfg.Path)
+	if handled, err := p.handleTip(ctx, testTip(alice, 1, 100)); handled || err == nil {
+		t.Fatalf("handleTip did not fail: %v, %v", handled, err)
+	}
+	if got, _ := p.Invoice(inv.ID); got.Status != InvoiceOpen || got.PaidMAtoms != 0 {
+		t.Fatalf("invoice changed by failed save: %+v", got)
+	}
+	if _, err := p.RequestPayment(ctx, alice, "alice", 10, "test", nil); err == nil {
+		t.Fatal("RequestPayment did not fail")
+	}
+	if err := p.Cancel(ctx, inv.ID); err == nil {
+		t.Fatal("Cancel did not fail")
+	}
+	if n := len(p.OpenInvoices(alice)); n != 1 {
+		t.Fatalf("got %d open invoices, want 1", n)
+	}
+	restore()
+
+	// Delivered again once it can be saved.
+	if handled, err := p.handleTip(ctx, testTip(alice, 1, 100)); !handled || err != nil {
+		t.Fatalf("tip not applied after failure: %v, %v", handled, err)
+	}
+	if got, _ := p.Invoice(inv.ID); got.Status != InvoicePaid {
+		t.Fatalf("invoice not paid: %+v", got)
+	}
+}
+
+func TestPaywallRestart(t *testing.T) {
+	ctx := context.Background()
+	alice := testUID(1)
+	dir := t.TempDir()
+	b := newTestBot(t, dir, &fakePayments{})
+	p := newTestPaywall(t, b, RemainderCredit)
+	gated, err := p.issue(ctx, alice, "alice", 100, "gated", true, func(context.Context, Invoice) {})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := p.handleTip(ctx, testTip(alice, 1, 40)); err != nil {
+		t.Fatal(err)
+	}
+
+	b = newTestBot(t, dir, &fakePayments{})
+	p = newTestPaywall(t, b, RemainderCredit)
+	if handled, err := p.handleTip(ctx, testTip(alice, 1, 40)); !handled || err != nil {
+		t.Fatalf("duplicate tip after restart: %v, %v", handled, err)
+	}
+	if got, _ := p.Invoice(gated.ID); got.PaidMAtoms != 40000 {
+		t.Fatalf("duplicate tip applied after restart: %+v", got)
+	}
+
+	// The command of the gated invoice was lost, so it is credited.
+	if _, err := p.handleTip(ctx, testTip(alice, 2, 60)); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := p.Invoice(gated.ID); got.Status != InvoicePaid {
+		t.Fatalf("invoice not paid: %+v", got)
+	}
+	if c := p.Credit(alice); c != 100 {
+		t.Fatalf("got credit %s, want 100 atoms", c)
+	}
+}
+
+func TestPaywallRefunds(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	alice := testUID(1)
+
+	tests := []struct {
+		name string
+
+		// breakPayments makes recording the refund tip fail, tipErr
+		// makes requesting it fail and completed is the outcome
+		// reported by the progress stream.
+		breakPayments bool
+		tipErr        error
+		completed     bool
+
+		wantTips   int
+		wantCredit dcrutil.Amount
+	}{
+		{name: "completed", completed: true, wantTips: 1},
+		{name: "failed", wantTips: 1, wantCredit: 50},
+		{name: "not recorded", breakPayments: true, wantCredit: 50},
+		{name: "unknown then completed", tipErr: errors.New("conn lost"), completed: true, wantTips: 1},
+		{name: "unknown then failed", tipErr: errors.New("conn lost"), wantTips: 1, wantCredit: 50},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			payments := &fakePayments{err: tc.tipErr}
+			b := newTestBot(t, t.TempDir(), payments)
+			p := newTestPaywall(t, b, RemainderRefund)
+			inv, err := p.RequestPayment(ctx, alice, "alice", 100, "test", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := p.handleTip(ctx, testTip(alice, 1, 50)); err != nil {
+				t.Fatal(err)
+			}
+			if tc.breakPayments {
+				defer breakSaves(t, b.tipPayments.path)()
+			}
+			if err := p.Cancel(ctx, inv.ID); err != nil {
+				t.Fatal(err)
+			}
+			if n := payments.count(); n != tc.wantTips {
+				t.Fatalf("got %d tips, want %d", n, tc.wantTips)
+			}
+			if tc.wantTips > 0 {
+				resolveTip(t, b, 1, alice, 50, tc.completed)
+			}
+			waitFor(t, "refund", func() bool {
+				p.mtx.Lock()
+				defer p.mtx.Unlock()
+				return len(p.state.Refunds) == 0
+			})
+			if c := p.Credit(alice); c != tc.wantCredit {
+				t.Fatalf("got credit %s, want %s", c, tc.wantCredit)
+			}
+		})
+	}
+}
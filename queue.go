@@ -0,0 +1,443 @@
+package bisonbotkit
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/decred/slog"
+	"github.com/vctt94/bisonbotkit/config"
+	"golang.org/x/sync/errgroup"
+	"google.golang.org/protobuf/proto"
+)
+
+const defaultQueueSize = 100
+
+// QueueStats reports the state of the delivery queue of a notification
+// stream.
+type QueueStats struct {
+	Stream   string
+	Overflow string
+	Capacity int
+
+	// Depth is the number of messages held in memory and Spilled the
+	// number of messages waiting in the spill file.
+	Depth   int
+	Spilled int
+
+	// MaxDepth is the highest depth (in memory plus spilled) observed.
+	MaxDepth int
+
+	Enqueued  uint64
+	Delivered uint64
+	Dropped   uint64
+}
+
+// queuedMsg is implemented by the clientrpc stream messages that can be
+// queued (and spilled to disk).
+type queuedMsg[T any] interface {
+	sequencedMsg[T]
+	proto.Message
+}
+
+// SetQueuePolicy overrides the delivery queue policy of a single stream (one
+// of the Stream* constants). It must be called before Run. The drop policies
+// are refused for streams whose messages are acked after being handled (the
+// tip streams and, in manual ack mode, every stream): acks are cumulative, so
+// a dropped message would be acked along with the next handled one.
+func (b *Bot) SetQueuePolicy(stream string, policy config.QueuePolicy) error {
+	switch policy.Overflow {
+	case "", config.OverflowBlock, config.OverflowSpill:
+	case config.OverflowDropOldest, config.OverflowDropNewest:
+		if b.manualAck || stream == StreamTipReceived || stream == StreamTipProgress {
+			return fmt.Errorf("queue overflow policy %q cannot be used "+
+				"for the %s stream, whose messages are acked after "+
+				"being handled", policy.Overflow, stream)
+		}
+	default:
+		return fmt.Errorf("unknown queue overflow policy %q", policy.Overflow)
+	}
+	b.queuesMtx.Lock()
+	b.queuePolicies[stream] = policy
+	b.queuesMtx.Unlock()
+	return nil
+}
+
+// QueueStats returns the state of the delivery queues of the running
+// notification streams.
+func (b *Bot) QueueStats() []QueueStats {
+	b.queuesMtx.Lock()
+	queues := make([]queueStatser, 0, len(b.queues))
+	for _, q := range b.queues {
+		queues = append(queues, q)
+	}
+	b.queuesMtx.Unlock()
+
+	stats := make([]QueueStats, 0, len(queues))
+	for _, q := range queues {
+		stats = append(stats, q.stats())
+	}
+	return stats
+}
+
+// queueStatser is implemented by the stream queues of every message type.
+type queueStatser interface {
+	stats() QueueStats
+}
+
+// queuePolicy returns the queue policy of the given stream.
+func (b *Bot) queuePolicy(stream string) config.QueuePolicy {
+	b.queuesMtx.Lock()
+	defer b.queuesMtx.Unlock()
+	policy, ok := b.queuePolicies[stream]
+	if !ok {
+		policy = b.cfg.Queue
+	}
+	if policy.Size <= 0 {
+		policy.Size = defaultQueueSize
+	}
+	if policy.Overflow == "" {
+		policy.Overflow = config.OverflowBlock
+	}
+	return policy
+}
+
+// streamQueue is a bounded FIFO queue of stream messages, consumed by a
+// single goroutine.
+type streamQueue[T any, PT queuedMsg[T]] struct {
+	name   string
+	policy config.QueuePolicy
+	log    slog.Logger
+
+	// avail is signalled when a message is queued and space when a
+	// message is taken from the queue.
+	avail chan struct{}
+	space chan struct{}
+
+	mtx   sync.Mutex
+	items []PT
+	spill *spillFile
+	st    QueueStats
+}
+
+func newStreamQueue[T any, PT queuedMsg[T]](b *Bot, name string, ackMode StreamAckMode, log slog.Logger) (*streamQueue[T, PT], error) {
+	policy := b.queuePolicy(name)
+	acked := ackMode != AckBeforeHandle
+	if acked && (policy.Overflow == config.OverflowDropOldest ||
+		policy.Overflow == config.OverflowDropNewest) {
+		// A dropped message would be acked along with the next handled
+		// one, losing it for good.
+		log.Infof("Using the %s overflow policy for the %s queue instead "+
+			"of %s", config.OverflowBlock, name, policy.Overflow)
+		policy.Overflow = config.OverflowBlock
+	}
+	q := &streamQueue[T, PT]{
+		name:   name,
+		policy: policy,
+		log:    log,
+		avail:  make(chan struct{}, 1),
+		space:  make(chan struct{}, 1),
+		items:  make([]PT, 0, policy.Size),
+	}
+
+	switch policy.Overflow {
+	case config.OverflowBlock, config.OverflowDropOldest, config.OverflowDropNewest:
+	case config.OverflowSpill:
+		path := filepath.Join(b.cfg.DataDir, "spill", name+".bin")
+		spill, err := openSpillFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("unable to open %s spill file: %w", name, err)
+		}
+		switch {
+		case spill.count > 0 && acked:
+			// The spilled messages were not acked, so brclient
+			// delivers them again.
+			log.Infof("Discarding %d spilled %s msgs that will be "+
+				"received again", spill.count, name)
+			if err := spill.reset(); err != nil {
+				spill.close()
+				return nil, fmt.Errorf("unable to reset %s spill file: %w", name, err)
+			}
+		case spill.count > 0:
+			log.Infof("Resuming delivery of %d spilled %s msgs", spill.count, name)
+			signal(q.avail)
+		}
+		q.spill = spill
+	default:
+		return nil, fmt.Errorf("unknown queue overflow policy %q", policy.Overflow)
+	}
+
+	b.queuesMtx.Lock()
+	b.queues[name] = q
+	b.queuesMtx.Unlock()
+	return q, nil
+}
+
+// signal does a non-blocking send on a signalling channel.
+func signal(c chan struct{}) {
+	select {
+	case c <- struct{}{}:
+	default:
+	}
+}
+
+// depth returns the number of queued messages. It must be called with the
+// mutex held.
+func (q *streamQueue[T, PT]) depth() int {
+	n := len(q.items)
+	if q.spill != nil {
+		n += q.spill.count
+	}
+	return n
+}
+
+// push adds msg to the queue, applying the overflow policy if it is full.
+// It only blocks with OverflowBlock. It fails if the message could not be
+// spilled.
+func (q *streamQueue[T, PT]) push(ctx context.Context, msg PT) error {
+	q.mtx.Lock()
+	for len(q.items) >= q.policy.Size && q.policy.Overflow == config.OverflowBlock {
+		q.mtx.Unlock()
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-q.space:
+		}
+		q.mtx.Lock()
+	}
+	defer q.mtx.Unlock()
+
+	switch {
+	case q.spill != nil && (q.spill.count > 0 || len(q.items) >= q.policy.Size):
+		// Once messages are spilled, every new message goes to the
+		// spill file until it is drained, so that order is kept.
+		if err := q.spill.write(msg); err != nil {
+			q.st.Dropped++
+			return fmt.Errorf("unable to spill %s msg %d: %w",
+				q.name, msg.GetSequenceId(), err)
+		}
+
+	case len(q.items) < q.policy.Size:
+		q.items = append(q.items, msg)
+
+	case q.policy.Overflow == config.OverflowDropOldest:
+		q.st.Dropped++
+		q.log.Warnf("%s queue full, dropping msg %d", q.name,
+			q.items[0].GetSequenceId())
+		q.items[0] = nil
+		q.items = append(q.items[1:], msg)
+
+	default:
+		q.st.Dropped++
+		q.log.Warnf("%s queue full, dropping msg %d", q.name,
+			msg.GetSequenceId())
+		return nil
+	}
+
+	q.st.Enqueued++
+	if d := q.depth(); d > q.st.MaxDepth {
+		q.st.MaxDepth = d
+	}
+	signal(q.avail)
+	return nil
+}
+
+// pop removes the next message from the queue, waiting until one is
+// available or ctx is done.
+func (q *streamQueue[T, PT]) pop(ctx context.Context) (PT, error) {
+	for {
+		q.mtx.Lock()
+		if len(q.items) > 0 {
+			msg := q.items[0]
+			q.items[0] = nil
+			q.items = q.items[1:]
+			q.mtx.Unlock()
+			signal(q.space)
+			return msg, nil
+		}
+		if q.spill != nil && q.spill.count > 0 {
+			msg := PT(new(T))
+			err := q.spill.read(msg)
+			q.mtx.Unlock()
+			if err != nil {
+				q.log.Errorf("Failed to read spilled %s msg: %v", q.name, err)
+				continue
+			}
+			return msg, nil
+		}
+		q.mtx.Unlock()
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-q.avail:
+		}
+	}
+}
+
+// run delivers queued messages until ctx is done.
+func (q *streamQueue[T, PT]) run(ctx context.Context, deliver func(context.Context, PT)) error {
+	for {
+		msg, err := q.pop(ctx)
+		if err != nil {
+			return err
+		}
+		deliver(ctx, msg)
+		q.mtx.Lock()
+		q.st.Delivered++
+		q.mtx.Unlock()
+	}
+}
+
+func (q *streamQueue[T, PT]) stats() QueueStats {
+	q.mtx.Lock()
+	defer q.mtx.Unlock()
+	st := q.st
+	st.Stream = q.name
+	st.Overflow = q.policy.Overflow
+	st.Capacity = q.policy.Size
+	st.Depth = len(q.items)
+	if q.spill != nil {
+		st.Spilled = q.spill.count
+	}
+	return st
+}
+
+// subscribeQueued consumes a stream with Subscribe, placing received
+// messages in the stream's delivery queue. Messages are handed to deliver
+// from a separate goroutine, so a slow consumer does not stall the stream.
+func subscribeQueued[T any, PT queuedMsg[T]](ctx context.Context, b *Bot, sc StreamConfig[T], deliver func(context.Context, PT)) error {
+	q, err := newStreamQueue[T, PT](b, sc.Name, sc.AckMode, sc.Log)
+	if err != nil {
+		return err
+	}
+	if q.spill != nil {
+		defer q.spill.close()
+	}
+	sc.Handle = func(ctx context.Context, msg *T) error {
+		return q.push(ctx, PT(msg))
+	}
+
+	g, gctx := errgroup.WithContext(ctx)
+	g.Go(func() error {
+		return q.run(gctx, deliver)
+	})
+	g.Go(func() error {
+		return Subscribe[T, PT](gctx, b, sc)
+	})
+	return g.Wait()
+}
+
+// spillFile is an append-only file of length-prefixed serialized messages
+// that is read from the start. It is truncated once every message is read.
+// The read offset is not persisted, so messages read before a restart are
+// delivered again if the file was not drained.
+type spillFile struct {
+	f       *os.File
+	readOff int64
+	count   int
+}
+
+func openSpillFile(path string) (*spillFile, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	// Count the messages left by a previous run, discarding any
+	// incomplete trailing record.
+	sf := &spillFile{f: f}
+	var off int64
+	for {
+		n, err := sf.recordLen(off)
+		if err != nil {
+			break
+		}
+		off += 4 + n
+		sf.count++
+	}
+	if err := f.Truncate(off); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return sf, nil
+}
+
+// recordLen returns the length of the record at off.
+func (sf *spillFile) recordLen(off int64) (int64, error) {
+	var hdr [4]byte
+	if _, err := sf.f.ReadAt(hdr[:], off); err != nil {
+		return 0, err
+	}
+	n := int64(binary.BigEndian.Uint32(hdr[:]))
+	st, err := sf.f.Stat()
+	if err != nil {
+		return 0, err
+	}
+	if off+4+n > st.Size() {
+		return 0, io.ErrUnexpectedEOF
+	}
+	return n, nil
+}
+
+func (sf *spillFile) write(msg proto.Message) error {
+	data, err := proto.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	st, err := sf.f.Stat()
+	if err != nil {
+		return err
+	}
+	rec := make([]byte, 4+len(data))
+	binary.BigEndian.PutUint32(rec, uint32(len(data)))
+	copy(rec[4:], data)
+	if _, err := sf.f.WriteAt(rec, st.Size()); err != nil {
+		return err
+	}
+	sf.count++
+	return nil
+}
+
+func (sf *spillFile) read(msg proto.Message) error {
+	if sf.count == 0 {
+		return errors.New("spill file is empty")
+	}
+	n, err := sf.recordLen(sf.readOff)
+	if err != nil {
+		sf.reset()
+		return err
+	}
+	data := make([]byte, n)
+	if _, err := sf.f.ReadAt(data, sf.readOff+4); err != nil {
+		sf.reset()
+		return err
+	}
+	sf.readOff += 4 + n
+	sf.count--
+	if sf.count == 0 {
+		if err := sf.reset(); err != nil {
+			return err
+		}
+	}
+	return proto.Unmarshal(data, msg)
+}
+
+// reset discards every message in the file.
+func (sf *spillFile) reset() error {
+	sf.readOff = 0
+	sf.count = 0
+	return sf.f.Truncate(0)
+}
+
+func (sf *spillFile) close() error {
+	return sf.f.Close()
+}
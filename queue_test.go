@@ -0,0 +1,214 @@
+package bisonbotkit
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/companyzero/bisonrelay/clientrpc/types"
+	"github.com/decred/slog"
+	"github.com/vctt94/bisonbotkit/config"
+)
+
+// newQueueTestBot returns a bot whose stream queues use policy and spill to
+// dir.
+func newQueueTestBot(dir string, policy config.QueuePolicy) *Bot {
+	return &Bot{
+		cfg:           &config.BotConfig{DataDir: dir, Queue: policy},
+		queues:        make(map[string]queueStatser),
+		queuePolicies: make(map[string]config.QueuePolicy),
+	}
+}
+
+// popSeqs pops every queued message, returning their sequence IDs.
+func popSeqs(t *testing.T, q *streamQueue[types.ReceivedPM, *types.ReceivedPM]) []uint64 {
+	t.Helper()
+	var seqs []uint64
+	for {
+		ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+		msg, err := q.pop(ctx)
+		cancel()
+		if errors.Is(err, context.DeadlineExceeded) {
+			return seqs
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		seqs = append(seqs, msg.SequenceId)
+	}
+}
+
+func TestStreamQueueOverflow(t *testing.T) {
+	tests := []struct {
+		overflow string
+		ackMode  StreamAckMode
+
+		// wantSeqs are the messages delivered after pushing messages 1
+		// to 4 in a queue of size 2, and wantBlocked the messages whose
+		// push blocked until its context was done.
+		wantSeqs    []uint64
+		wantDropped uint64
+		wantBlocked []uint64
+	}{{
+		overflow:    config.OverflowBlock,
+		wantSeqs:    []uint64{1, 2},
+		wantBlocked: []uint64{3, 4},
+	}, {
+		overflow:    config.OverflowDropOldest,
+		wantSeqs:    []uint64{3, 4},
+		wantDropped: 2,
+	}, {
+		overflow:    config.OverflowDropNewest,
+		wantSeqs:    []uint64{1, 2},
+		wantDropped: 2,
+	}, {
+		overflow: config.OverflowSpill,
+		wantSeqs: []uint64{1, 2, 3, 4},
+	}, {
+		// Messages acked after being handled are never dropped.
+		overflow:    config.OverflowDropOldest,
+		ackMode:     AckByHandler,
+		wantSeqs:    []uint64{1, 2},
+		wantBlocked: []uint64{3, 4},
+	}, {
+		overflow:    config.OverflowDropNewest,
+		ackMode:     AckAfterHandle,
+		wantSeqs:    []uint64{1, 2},
+		wantBlocked: []uint64{3, 4},
+	}}
+	for _, tc := range tests {
+		b := newQueueTestBot(t.TempDir(), config.QueuePolicy{Size: 2, Overflow: tc.overflow})
+		q, err := newStreamQueue[types.ReceivedPM](b, StreamPM, tc.ackMode, slog.Disabled)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var blocked []uint64
+		for seq := uint64(1); seq <= 4; seq++ {
+			ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+			err := q.push(ctx, &types.ReceivedPM{SequenceId: seq})
+			cancel()
+			switch {
+			case errors.Is(err, context.DeadlineExceeded):
+				blocked = append(blocked, seq)
+			case err != nil:
+				t.Fatalf("%s: %v", tc.overflow, err)
+			}
+		}
+		if !reflect.DeepEqual(blocked, tc.wantBlocked) {
+			t.Fatalf("%s (ack mode %d): blocked %v, want %v", tc.overflow,
+				tc.ackMode, blocked, tc.wantBlocked)
+		}
+		if seqs := popSeqs(t, q); !reflect.DeepEqual(seqs, tc.wantSeqs) {
+			t.Fatalf("%s (ack mode %d): got %v, want %v", tc.overflow,
+				tc.ackMode, seqs, tc.wantSeqs)
+		}
+		if st := q.stats(); st.Dropped != tc.wantDropped || st.Depth != 0 || st.Spilled != 0 {
+			t.Fatalf("%s (ack mode %d): unexpected stats %+v", tc.overflow,
+				tc.ackMode, st)
+		}
+		if q.spill != nil {
+			q.spill.close()
+		}
+	}
+}
+
+func TestStreamQueueSpillOrder(t *testing.T) {
+	b := newQueueTestBot(t.TempDir(), config.QueuePolicy{Size: 2, Overflow: config.OverflowSpill})
+	q, err := newStreamQueue[types.ReceivedPM](b, StreamPM, AckBeforeHandle, slog.Disabled)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.spill.close()
+
+	// Once messages are spilled, later ones are spilled too, even if
+	// there is room in memory, so that they are delivered in order.
+	ctx := context.Background()
+	var got []uint64
+	for seq := uint64(1); seq <= 6; seq++ {
+		if err := q.push(ctx, &types.ReceivedPM{SequenceId: seq}); err != nil {
+			t.Fatal(err)
+		}
+		if seq == 4 {
+			msg, err := q.pop(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got = append(got, msg.SequenceId)
+		}
+	}
+	if st := q.stats(); st.Depth != 1 || st.Spilled != 4 || st.MaxDepth != 5 {
+		t.Fatalf("unexpected stats %+v", st)
+	}
+	got = append(got, popSeqs(t, q)...)
+	if want := []uint64{1, 2, 3, 4, 5, 6}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+}
+
+func TestStreamQueueSpillRestart(t *testing.T) {
+	tests := []struct {
+		ackMode  StreamAckMode
+		wantSeqs []uint64
+	}{
+		// Spilled messages that were acked are only left in the file.
+		{AckBeforeHandle, []uint64{2, 3}},
+
+		// Spilled messages that were not acked are delivered again by
+		// brclient.
+		{AckByHandler, nil},
+	}
+	for _, tc := range tests {
+		dir := t.TempDir()
+		policy := config.QueuePolicy{Size: 1, Overflow: config.OverflowSpill}
+		q, err := newStreamQueue[types.ReceivedPM](newQueueTestBot(dir, policy),
+			StreamPM, tc.ackMode, slog.Disabled)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for seq := uint64(1); seq <= 3; seq++ {
+			if err := q.push(context.Background(), &types.ReceivedPM{SequenceId: seq}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		q.spill.close()
+
+		q, err = newStreamQueue[types.ReceivedPM](newQueueTestBot(dir, policy),
+			StreamPM, tc.ackMode, slog.Disabled)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if seqs := popSeqs(t, q); !reflect.DeepEqual(seqs, tc.wantSeqs) {
+			t.Fatalf("ack mode %d: got %v, want %v", tc.ackMode, seqs, tc.wantSeqs)
+		}
+		q.spill.close()
+	}
+}
+
+func TestSetQueuePolicy(t *testing.T) {
+	tests := []struct {
+		stream    string
+		manualAck bool
+		overflow  string
+		wantErr   bool
+	}{
+		{StreamPM, false, config.OverflowDropOldest, false},
+		{StreamPM, false, config.OverflowSpill, false},
+		{StreamPM, true, config.OverflowBlock, false},
+		{StreamPM, true, config.OverflowDropNewest, true},
+		{StreamTipReceived, false, config.OverflowDropOldest, true},
+		{StreamTipProgress, false, config.OverflowDropNewest, true},
+		{StreamTipProgress, false, config.OverflowSpill, false},
+		{StreamPM, false, "bogus", true},
+	}
+	for _, tc := range tests {
+		b := newQueueTestBot(t.TempDir(), config.QueuePolicy{})
+		b.manualAck = tc.manualAck
+		err := b.SetQueuePolicy(tc.stream, config.QueuePolicy{Overflow: tc.overflow})
+		if (err != nil) != tc.wantErr {
+			t.Errorf("SetQueuePolicy(%s, %s) with manual ack %v: unexpected error %v",
+				tc.stream, tc.overflow, tc.manualAck, err)
+		}
+	}
+}
@@ -0,0 +1,218 @@
+package bisonbotkit
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/vctt94/bisonbotkit/config"
+)
+
+const (
+	defaultReconnectInitialDelay = time.Second
+	defaultReconnectMaxDelay     = time.Minute
+	defaultBreakerCooldown       = 5 * time.Minute
+
+	// streamStableUptime is how long a stream must stay open, without
+	// receiving any message, for its failed attempts to be forgotten.
+	streamStableUptime = time.Minute
+)
+
+// StreamState is the state of a notification stream.
+type StreamState int
+
+const (
+	// StreamDown means the stream failed and is being reopened.
+	StreamDown StreamState = iota
+
+	// StreamUp means the stream is open and receiving messages.
+	StreamUp
+)
+
+func (s StreamState) String() string {
+	if s == StreamUp {
+		return "up"
+	}
+	return "down"
+}
+
+// StreamEvent is sent to the stream state handler whenever a notification
+// stream goes down or is restored.
+type StreamEvent struct {
+	Stream string
+	State  StreamState
+
+	// Err is the error that brought the stream down. It is nil for
+	// StreamUp events.
+	Err error
+
+	// Attempts is the number of consecutive failed attempts to open the
+	// stream.
+	Attempts int
+}
+
+// SetStreamStateHandler sets a function called whenever a notification stream
+// goes down or is restored. The handler is called from the stream goroutines
+// and must not block. It must be called before Run.
+func (b *Bot) SetStreamStateHandler(h func(StreamEvent)) {
+	b.streamStateHandler = h
+}
+
+// circuitBreaker pauses all streams after too many consecutive failures.
+type circuitBreaker struct {
+	mtx       sync.Mutex
+	threshold int
+	cooldown  time.Duration
+	failures  int
+	openUntil time.Time
+}
+
+// failure records a failed attempt, opening the breaker when the threshold
+// is reached.
+func (cb *circuitBreaker) failure() {
+	if cb.threshold <= 0 {
+		return
+	}
+	cb.mtx.Lock()
+	cb.failures++
+	if cb.failures >= cb.threshold {
+		cb.failures = 0
+		cb.openUntil = time.Now().Add(cb.cooldown)
+	}
+	cb.mtx.Unlock()
+}
+
+// success resets the count of consecutive failures.
+func (cb *circuitBreaker) success() {
+	cb.mtx.Lock()
+	cb.failures = 0
+	cb.mtx.Unlock()
+}
+
+// remaining returns how long the breaker stays open.
+func (cb *circuitBreaker) remaining() time.Duration {
+	cb.mtx.Lock()
+	defer cb.mtx.Unlock()
+	return time.Until(cb.openUntil)
+}
+
+func newCircuitBreaker(policy config.ReconnectPolicy) *circuitBreaker {
+	cooldown := policy.BreakerCooldown
+	if cooldown <= 0 {
+		cooldown = defaultBreakerCooldown
+	}
+	return &circuitBreaker{
+		threshold: policy.BreakerThreshold,
+		cooldown:  cooldown,
+	}
+}
+
+// backoff tracks the reconnection attempts of a single stream.
+type backoff struct {
+	policy   config.ReconnectPolicy
+	attempts int
+	up       bool
+
+	// openedAt is when the stream was last opened.
+	openedAt time.Time
+}
+
+// delay returns the time to wait before the next attempt.
+func (bo *backoff) delay() time.Duration {
+	initial, max := bo.policy.InitialDelay, bo.policy.MaxDelay
+	if initial <= 0 {
+		initial = defaultReconnectInitialDelay
+	}
+	if max <= 0 {
+		max = defaultReconnectMaxDelay
+	}
+
+	d := initial
+	for i := 1; i < bo.attempts && d < max; i++ {
+		d *= 2
+	}
+	if d > max {
+		d = max
+	}
+	if j := bo.policy.Jitter; j > 0 {
+		if j > 1 {
+			j = 1
+		}
+		d += time.Duration((rand.Float64()*2 - 1) * j * float64(d))
+	}
+	return d
+}
+
+// streamUp records that the stream was (re)opened. The failed attempts are
+// only forgotten once the stream proves healthy (see streamHealthy), so that a
+// stream that opens but keeps failing to receive still backs off and gives
+// up.
+func (b *Bot) streamUp(bo *backoff, stream string) {
+	bo.openedAt = time.Now()
+	if bo.up {
+		return
+	}
+	bo.up = true
+	if b.streamStateHandler != nil {
+		b.streamStateHandler(StreamEvent{
+			Stream:   stream,
+			State:    StreamUp,
+			Attempts: bo.attempts,
+		})
+	}
+}
+
+// streamHealthy forgets the failed attempts of the stream once it received a
+// message.
+func (b *Bot) streamHealthy(bo *backoff) {
+	if bo.attempts == 0 {
+		return
+	}
+	bo.attempts = 0
+	b.breaker.success()
+}
+
+// streamFailed records a failure to open or read from the stream and waits
+// until the stream may be reopened according to the reconnect policy. It
+// returns an error if the context is done or the stream must give up.
+func (b *Bot) streamFailed(ctx context.Context, bo *backoff, stream string, err error) error {
+	if bo.up && time.Since(bo.openedAt) >= streamStableUptime {
+		// The stream stayed open long enough to count as restored,
+		// even if it did not receive anything.
+		b.streamHealthy(bo)
+	}
+	bo.attempts++
+	b.breaker.failure()
+	if bo.up || bo.attempts == 1 {
+		bo.up = false
+		if b.streamStateHandler != nil {
+			b.streamStateHandler(StreamEvent{
+				Stream:   stream,
+				State:    StreamDown,
+				Err:      err,
+				Attempts: bo.attempts,
+			})
+		}
+	}
+
+	if max := bo.policy.MaxAttempts; max > 0 && bo.attempts >= max {
+		return fmt.Errorf("%s stream: giving up after %d attempts: %w",
+			stream, bo.attempts, err)
+	}
+
+	d := bo.delay()
+	if r := b.breaker.remaining(); r > d {
+		b.streamLog(stream).Warnf("Circuit breaker open, pausing %s stream for %s",
+			stream, r.Truncate(time.Second))
+		d = r
+	}
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-time.After(d):
+		return nil
+	}
+}
@@ -0,0 +1,86 @@
+package bisonbotkit
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/companyzero/bisonrelay/clientrpc/types"
+	"github.com/decred/slog"
+	"github.com/vctt94/bisonbotkit/config"
+)
+
+// fakeStream delivers PMs with the sequence IDs in seqs and then fails.
+type fakeStream struct {
+	seqs []uint64
+}
+
+func (f *fakeStream) Recv(msg *types.ReceivedPM) error {
+	if len(f.seqs) == 0 {
+		return errors.New("stream broken")
+	}
+	msg.SequenceId = f.seqs[0]
+	f.seqs = f.seqs[1:]
+	return nil
+}
+
+func TestSubscribeGivesUp(t *testing.T) {
+	const maxAttempts = 3
+	tests := []struct {
+		name string
+
+		// msgs is the number of messages delivered by each opened
+		// stream before it fails, and wantOpens the number of times the
+		// stream is opened before giving up.
+		msgs      []int
+		wantOpens int
+	}{
+		{"never delivers", nil, maxAttempts},
+		{"delivers once", []int{0, 1}, maxAttempts + 1},
+		{"delivers twice", []int{1, 0, 1}, maxAttempts + 2},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			b := &Bot{
+				cfg: &config.BotConfig{Reconnect: config.ReconnectPolicy{
+					InitialDelay: time.Millisecond,
+					MaxDelay:     time.Millisecond,
+					MaxAttempts:  maxAttempts,
+				}},
+				log:     slog.Disabled,
+				acked:   make(map[string]uint64),
+				streams: make(map[string]streamAcker),
+				breaker: newCircuitBreaker(config.ReconnectPolicy{}),
+			}
+
+			// Streams that open but fail before delivering anything
+			// count as failed attempts.
+			var opens int
+			var seq uint64
+			err := Subscribe(context.Background(), b, StreamConfig[types.ReceivedPM]{
+				Name: StreamPM,
+				Log:  slog.Disabled,
+				Open: func(context.Context, uint64) (StreamClient[types.ReceivedPM], error) {
+					s := &fakeStream{}
+					if opens < len(tc.msgs) {
+						for i := 0; i < tc.msgs[opens]; i++ {
+							seq++
+							s.seqs = append(s.seqs, seq)
+						}
+					}
+					opens++
+					return s, nil
+				},
+				Ack:    func(context.Context, uint64) error { return nil },
+				Handle: func(context.Context, *types.ReceivedPM) error { return nil },
+			})
+			if err == nil {
+				t.Fatal("Subscribe did not give up")
+			}
+			if opens != tc.wantOpens {
+				t.Fatalf("stream opened %d times, want %d", opens, tc.wantOpens)
+			}
+		})
+	}
+}
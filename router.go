@@ -0,0 +1,542 @@
+package bisonbotkit
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/companyzero/bisonrelay/clientrpc/types"
+	"github.com/companyzero/bisonrelay/zkidentity"
+	"github.com/decred/dcrd/dcrutil/v4"
+	"github.com/vctt94/bisonbotkit/args"
+)
+
+// DefaultGCPrefix is the prefix a GC message must start with to be treated
+// as a command by a Router.
+const DefaultGCPrefix = "!"
+
+// CommandScope defines where a command may be invoked from.
+type CommandScope int
+
+const (
+	// ScopeAll commands may be invoked both from PMs and GC messages.
+	ScopeAll CommandScope = iota
+
+	// ScopePM commands may only be invoked from PMs.
+	ScopePM
+
+	// ScopeGC commands may only be invoked from GC messages.
+	ScopeGC
+)
+
+func (s CommandScope) allows(isGC bool) bool {
+	switch s {
+	case ScopePM:
+		return !isGC
+	case ScopeGC:
+		return isGC
+	default:
+		return true
+	}
+}
+
+// ArgType is the type of a command argument. Typed arguments are parsed by
+// the router before calling the handler, replying to the user with the
+// parsing error and the usage of the command when they are invalid.
+type ArgType int
+
+const (
+	// ArgString arguments are not parsed.
+	ArgString ArgType = iota
+
+	// ArgInt arguments are integers, read with MsgContext.Int.
+	ArgInt
+
+	// ArgAmount arguments are positive DCR amounts such as "0.1",
+	// "0.1dcr" or "1000atoms", read with MsgContext.Amount.
+	ArgAmount
+
+	// ArgDuration arguments are durations such as "10m" or "1d", read
+	// with MsgContext.Duration.
+	ArgDuration
+
+	// ArgUser arguments are user IDs or nicks, resolved with
+	// Bot.ResolveUser and read with MsgContext.User.
+	ArgUser
+
+	// ArgEnum arguments must be one of the Options of the argument,
+	// ignoring case. MsgContext.Arg returns the matching option.
+	ArgEnum
+)
+
+// ArgSpec describes a positional argument of a command.
+type ArgSpec struct {
+	Name string
+
+	// Type is the type of the argument. Variadic arguments are always
+	// strings.
+	Type ArgType
+
+	// Options are the accepted values of ArgEnum arguments.
+	Options []string
+
+	// Optional arguments may be omitted. Only trailing arguments may be
+	// optional.
+	Optional bool
+
+	// Variadic marks the last argument as consuming all remaining tokens.
+	Variadic bool
+}
+
+func (a ArgSpec) usage() string {
+	name := a.Name
+	if a.Type == ArgEnum {
+		name = strings.Join(a.Options, "|")
+	}
+	if a.Variadic {
+		name += "..."
+	}
+	if a.Optional {
+		return "[" + name + "]"
+	}
+	return "<" + name + ">"
+}
+
+// HandlerFunc is the signature of command handlers.
+type HandlerFunc func(ctx context.Context, mc *MsgContext) error
+
+// Command is a named command registered in a Router.
+type Command struct {
+	Name    string
+	Aliases []string
+	Args    []ArgSpec
+	Help    string
+	Scope   CommandScope
+	Handler HandlerFunc
+}
+
+// Usage returns the one line usage string of the command.
+func (c *Command) Usage() string {
+	s := c.Name
+	for _, a := range c.Args {
+		s += " " + a.usage()
+	}
+	return s
+}
+
+// minMaxArgs returns the minimum and maximum number of arguments accepted by
+// the command. max is -1 when the command is variadic.
+func (c *Command) minMaxArgs() (min, max int) {
+	for _, a := range c.Args {
+		if !a.Optional {
+			min++
+		}
+		if a.Variadic {
+			return min, -1
+		}
+		max++
+	}
+	return min, max
+}
+
+// MsgContext is the context passed to command handlers. It carries the
+// sender and origin of the message along with helpers to reply to it.
+type MsgContext struct {
+	Bot *Bot
+
+	// UID and Nick identify the sender of the message.
+	UID  zkidentity.ShortID
+	Nick string
+
+	// GC is the alias of the GC the message was sent to. It is empty for
+	// PMs.
+	GC string
+
+	// Msg is the full text of the message.
+	Msg string
+
+	// Cmd is the canonical name of the invoked command and Args its
+	// arguments. When a command has a variadic argument, the remaining
+	// tokens are joined into the last element of Args.
+	Cmd  string
+	Args []string
+
+	// PM or GCM hold the original message, depending on its origin.
+	PM  *types.ReceivedPM
+	GCM *types.GCReceivedMsg
+
+	cmd *Command
+
+	// values holds the parsed values of typed arguments.
+	values map[string]interface{}
+}
+
+// IsGC returns true if the message was received in a GC.
+func (mc *MsgContext) IsGC() bool {
+	return mc.GCM != nil
+}
+
+// Arg returns the value of the named argument or an empty string if it was
+// not provided.
+func (mc *MsgContext) Arg(name string) string {
+	if mc.cmd == nil {
+		return ""
+	}
+	for i, a := range mc.cmd.Args {
+		if a.Name == name && i < len(mc.Args) {
+			return mc.Args[i]
+		}
+	}
+	return ""
+}
+
+// Int returns the value of the named ArgInt argument, or zero if it was not
+// provided.
+func (mc *MsgContext) Int(name string) int64 {
+	v, _ := mc.values[name].(int64)
+	return v
+}
+
+// Amount returns the value of the named ArgAmount argument, or zero if it was
+// not provided.
+func (mc *MsgContext) Amount(name string) dcrutil.Amount {
+	v, _ := mc.values[name].(dcrutil.Amount)
+	return v
+}
+
+// Duration returns the value of the named ArgDuration argument, or zero if it
+// was not provided.
+func (mc *MsgContext) Duration(name string) time.Duration {
+	v, _ := mc.values[name].(time.Duration)
+	return v
+}
+
+// User returns the ID of the user given in the named ArgUser argument, or
+// the zero ID if it was not provided.
+func (mc *MsgContext) User(name string) zkidentity.ShortID {
+	v, _ := mc.values[name].(zkidentity.ShortID)
+	return v
+}
+
+// Reply sends msg back to where the message came from: the GC for GC
+// messages or the sender for PMs.
+func (mc *MsgContext) Reply(ctx context.Context, msg string) error {
+	if mc.IsGC() {
+		return mc.Bot.SendGC(ctx, mc.GC, msg)
+	}
+	return mc.ReplyPM(ctx, msg)
+}
+
+// Replyf is like Reply but formats the message.
+func (mc *MsgContext) Replyf(ctx context.Context, format string, args ...interface{}) error {
+	return mc.Reply(ctx, fmt.Sprintf(format, args...))
+}
+
+// ReplyPM sends msg privately to the sender, even if the message was
+// received in a GC.
+func (mc *MsgContext) ReplyPM(ctx context.Context, msg string) error {
+	return mc.Bot.SendPM(ctx, mc.UID.String(), msg)
+}
+
+// Router dispatches PM and GC messages to registered commands. A "help"
+// command listing the registered commands is provided automatically.
+type Router struct {
+	mtx      sync.Mutex
+	cmds     map[string]*Command
+	aliases  map[string]string
+	gcPrefix string
+	notFound HandlerFunc
+
+	// help is the builtin help command, until it is replaced.
+	help *Command
+
+	middlewares []Middleware
+}
+
+// NewRouter creates an empty Router.
+func NewRouter() *Router {
+	r := &Router{
+		cmds:     make(map[string]*Command),
+		aliases:  make(map[string]string),
+		gcPrefix: DefaultGCPrefix,
+	}
+	r.help = &Command{
+		Name:    "help",
+		Args:    []ArgSpec{{Name: "command", Optional: true}},
+		Help:    "Lists the available commands or shows help for a command",
+		Handler: r.handleHelp,
+	}
+	r.cmds["help"] = r.help
+	return r
+}
+
+// SetGCPrefix sets the prefix GC messages must start with to be handled as
+// commands. PMs may optionally use the same prefix.
+func (r *Router) SetGCPrefix(prefix string) {
+	r.mtx.Lock()
+	r.gcPrefix = prefix
+	r.mtx.Unlock()
+}
+
+// NotFound sets a handler called for PMs that do not match any command. GC
+// messages that do not match a command are ignored. When no handler is set,
+// unmatched messages are left for the bot's channels.
+func (r *Router) NotFound(h HandlerFunc) {
+	r.mtx.Lock()
+	r.notFound = h
+	r.mtx.Unlock()
+}
+
+// Register adds a command to the router. It fails if the name or any of the
+// aliases is already taken. A command named "help" replaces the builtin help
+// command, which may be done only once; "help" cannot be used as an alias.
+func (r *Router) Register(cmd Command) error {
+	if cmd.Name == "" {
+		return errors.New("command name cannot be empty")
+	}
+	if cmd.Handler == nil {
+		return fmt.Errorf("command %q has no handler", cmd.Name)
+	}
+	for i, a := range cmd.Args {
+		last := i == len(cmd.Args)-1
+		if a.Variadic && !last {
+			return fmt.Errorf("command %q: only the last argument may be variadic", cmd.Name)
+		}
+		if !a.Optional && i > 0 && cmd.Args[i-1].Optional {
+			return fmt.Errorf("command %q: required argument %q follows an optional one",
+				cmd.Name, a.Name)
+		}
+		if a.Type == ArgEnum && len(a.Options) == 0 {
+			return fmt.Errorf("command %q: enum argument %q has no options",
+				cmd.Name, a.Name)
+		}
+	}
+
+	cmd.Name = strings.ToLower(cmd.Name)
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+
+	names := append([]string{cmd.Name}, cmd.Aliases...)
+	for i, n := range names {
+		n = strings.ToLower(n)
+		names[i] = n
+		// Only the name of a command may replace the builtin help.
+		if c, ok := r.cmds[n]; ok && !(i == 0 && c == r.help) {
+			return fmt.Errorf("command %q already registered", n)
+		}
+		if _, ok := r.aliases[n]; ok {
+			return fmt.Errorf("alias %q already registered", n)
+		}
+	}
+	cmd.Aliases = names[1:]
+	c := cmd
+	if c.Name == "help" {
+		r.help = nil
+	}
+	r.cmds[c.Name] = &c
+	for _, a := range c.Aliases {
+		r.aliases[a] = c.Name
+	}
+	return nil
+}
+
+// lookup returns the command registered with the given name or alias.
+func (r *Router) lookup(name string) *Command {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	name = strings.ToLower(name)
+	if alias, ok := r.aliases[name]; ok {
+		name = alias
+	}
+	return r.cmds[name]
+}
+
+// isPrefixedCommand returns true if text starts with the router prefix
+// followed by the name of a registered command. Such PMs reach the router even
+// while the user is in a dialog or being onboarded.
+func (r *Router) isPrefixedCommand(text string) bool {
+	r.mtx.Lock()
+	prefix := r.gcPrefix
+	r.mtx.Unlock()
+	text = strings.TrimSpace(text)
+	if prefix == "" || !strings.HasPrefix(text, prefix) {
+		return false
+	}
+	tokens := args.Tokenize(text[len(prefix):])
+	return len(tokens) > 0 && r.lookup(tokens[0].Value) != nil
+}
+
+// Commands returns the registered commands sorted by name.
+func (r *Router) Commands() []Command {
+	r.mtx.Lock()
+	res := make([]Command, 0, len(r.cmds))
+	for _, c := range r.cmds {
+		res = append(res, *c)
+	}
+	r.mtx.Unlock()
+	sort.Slice(res, func(i, j int) bool { return res[i].Name < res[j].Name })
+	return res
+}
+
+// HelpText returns the generated help listing for commands available in PMs
+// or GCs.
+func (r *Router) HelpText(isGC bool) string {
+	r.mtx.Lock()
+	prefix := r.gcPrefix
+	r.mtx.Unlock()
+	if !isGC {
+		prefix = ""
+	}
+
+	var b strings.Builder
+	b.WriteString("Available commands:\n")
+	for _, c := range r.Commands() {
+		if !c.Scope.allows(isGC) {
+			continue
+		}
+		fmt.Fprintf(&b, "  %s%s", prefix, c.Usage())
+		if c.Help != "" {
+			fmt.Fprintf(&b, " - %s", c.Help)
+		}
+		b.WriteString("\n")
+	}
+	return strings.TrimSuffix(b.String(), "\n")
+}
+
+func (r *Router) handleHelp(ctx context.Context, mc *MsgContext) error {
+	name := mc.Arg("command")
+	if name == "" {
+		return mc.Reply(ctx, r.HelpText(mc.IsGC()))
+	}
+	c := r.lookup(name)
+	if c == nil || !c.Scope.allows(mc.IsGC()) {
+		return mc.Replyf(ctx, "Unknown command %q", name)
+	}
+	msg := "Usage: " + c.Usage()
+	if len(c.Aliases) > 0 {
+		msg += "\nAliases: " + strings.Join(c.Aliases, ", ")
+	}
+	if c.Help != "" {
+		msg += "\n" + c.Help
+	}
+	return mc.Reply(ctx, msg)
+}
+
+// dispatch parses the text of mc and calls the matching command. It returns
+// true if the message was handled by the router.
+func (r *Router) dispatch(ctx context.Context, mc *MsgContext) (bool, error) {
+	r.mtx.Lock()
+	prefix, notFound := r.gcPrefix, r.notFound
+	r.mtx.Unlock()
+
+	text := strings.TrimSpace(mc.Msg)
+	if prefix != "" && strings.HasPrefix(text, prefix) {
+		text = text[len(prefix):]
+	} else if mc.IsGC() && prefix != "" {
+		return false, nil
+	}
+
+	tokens := args.Tokenize(text)
+	if len(tokens) == 0 {
+		return false, nil
+	}
+	cmd := r.lookup(tokens[0].Value)
+	if cmd == nil || !cmd.Scope.allows(mc.IsGC()) {
+		if notFound == nil || mc.IsGC() {
+			return false, nil
+		}
+		return true, r.wrap(notFound)(ctx, mc)
+	}
+
+	argTokens := tokens[1:]
+	min, max := cmd.minMaxArgs()
+	if len(argTokens) < min || (max >= 0 && len(argTokens) > max) {
+		return true, mc.Reply(ctx, "Usage: "+cmd.Usage())
+	}
+	cmdArgs := make([]string, len(argTokens))
+	for i, t := range argTokens {
+		cmdArgs[i] = t.Value
+	}
+	if max < 0 && len(argTokens) > len(cmd.Args) {
+		// Join the remaining tokens into the variadic argument,
+		// preserving the original text.
+		n := len(cmd.Args) - 1
+		cmdArgs = append(cmdArgs[:n:n], strings.TrimSpace(text[argTokens[n].Start:]))
+	}
+
+	mc.Cmd = cmd.Name
+	mc.Args = cmdArgs
+	mc.cmd = cmd
+	if err := parseArgs(ctx, mc); err != nil {
+		return true, mc.Reply(ctx, fmt.Sprintf("%v\nUsage: %s", err, cmd.Usage()))
+	}
+	return true, r.wrap(cmd.Handler)(ctx, mc)
+}
+
+// parseArgs parses the typed arguments of mc, storing their values in
+// mc.values.
+func parseArgs(ctx context.Context, mc *MsgContext) error {
+	for i, a := range mc.cmd.Args {
+		if i >= len(mc.Args) || a.Variadic || a.Type == ArgString {
+			continue
+		}
+		var v interface{}
+		var err error
+		switch a.Type {
+		case ArgInt:
+			v, err = args.Int(mc.Args[i])
+		case ArgAmount:
+			v, err = args.Amount(mc.Args[i])
+		case ArgDuration:
+			v, err = args.Duration(mc.Args[i])
+		case ArgUser:
+			v, err = mc.Bot.ResolveUser(ctx, mc.Args[i])
+		case ArgEnum:
+			mc.Args[i], err = args.Enum(mc.Args[i], a.Options)
+			v = mc.Args[i]
+		}
+		if err != nil {
+			return UserErrorf("Invalid %s: %v", a.Name, err)
+		}
+		if mc.values == nil {
+			mc.values = make(map[string]interface{})
+		}
+		mc.values[a.Name] = v
+	}
+	return nil
+}
+
+// HandlePM dispatches a received PM. It returns true if the PM matched a
+// command (or the NotFound handler).
+func (r *Router) HandlePM(ctx context.Context, b *Bot, pm *types.ReceivedPM) (bool, error) {
+	mc := &MsgContext{
+		Bot:  b,
+		Nick: pm.Nick,
+		Msg:  pm.Msg.GetMessage(),
+		PM:   pm,
+	}
+	if err := mc.UID.FromBytes(pm.Uid); err != nil {
+		return false, err
+	}
+	return r.dispatch(ctx, mc)
+}
+
+// HandleGC dispatches a received GC message. It returns true if the message
+// matched a command.
+func (r *Router) HandleGC(ctx context.Context, b *Bot, gcm *types.GCReceivedMsg) (bool, error) {
+	mc := &MsgContext{
+		Bot:  b,
+		Nick: gcm.Nick,
+		GC:   gcm.GcAlias,
+		Msg:  gcm.Msg.GetMessage(),
+		GCM:  gcm,
+	}
+	if err := mc.UID.FromBytes(gcm.Uid); err != nil {
+		return false, err
+	}
+	return r.dispatch(ctx, mc)
+}
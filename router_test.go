@@ -0,0 +1,239 @@
+package bisonbotkit
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/companyzero/bisonrelay/clientrpc/types"
+)
+
+// fakeChat records the PMs and GC messages sent by the bot.
+type fakeChat struct {
+	types.ChatServiceClient
+
+	mtx  sync.Mutex
+	sent []string
+}
+
+func (f *fakeChat) PM(_ context.Context, req *types.PMRequest, _ *types.PMResponse) error {
+	f.mtx.Lock()
+	f.sent = append(f.sent, req.Msg.Message)
+	f.mtx.Unlock()
+	return nil
+}
+
+func (f *fakeChat) GCM(_ context.Context, req *types.GCMRequest, _ *types.GCMResponse) error {
+	f.mtx.Lock()
+	f.sent = append(f.sent, req.Msg)
+	f.mtx.Unlock()
+	return nil
+}
+
+// take returns and forgets the sent messages.
+func (f *fakeChat) take() []string {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	sent := f.sent
+	f.sent = nil
+	return sent
+}
+
+// runChat makes b send its messages to a fakeChat until the test ends.
+func runChat(t *testing.T, b *Bot) *fakeChat {
+	t.Helper()
+	chat := &fakeChat{}
+	b.chatService = chat
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		b.outbound.run(ctx)
+		close(done)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+	waitFor(t, "outbound queue", func() bool {
+		b.outbound.mtx.Lock()
+		defer b.outbound.mtx.Unlock()
+		return !b.outbound.stopped
+	})
+	return chat
+}
+
+func TestRouterRegister(t *testing.T) {
+	h := func(context.Context, *MsgContext) error { return nil }
+	r := NewRouter()
+	tests := []struct {
+		name    string
+		cmd     Command
+		wantErr bool
+	}{
+		{"command", Command{Name: "Bet", Aliases: []string{"b"}, Handler: h}, false},
+		{"no name", Command{Handler: h}, true},
+		{"no handler", Command{Name: "x"}, true},
+		{"name taken", Command{Name: "bet", Handler: h}, true},
+		{"name taken by alias", Command{Name: "B", Handler: h}, true},
+		{"alias taken", Command{Name: "wager", Aliases: []string{"BET"}, Handler: h}, true},
+		{"help alias", Command{Name: "info", Aliases: []string{"help"}, Handler: h}, true},
+		{"variadic not last", Command{Name: "v", Handler: h,
+			Args: []ArgSpec{{Name: "a", Variadic: true}, {Name: "b"}}}, true},
+		{"required after optional", Command{Name: "o", Handler: h,
+			Args: []ArgSpec{{Name: "a", Optional: true}, {Name: "b"}}}, true},
+		{"enum without options", Command{Name: "e", Handler: h,
+			Args: []ArgSpec{{Name: "a", Type: ArgEnum}}}, true},
+		{"replace help", Command{Name: "help", Handler: h}, false},
+		{"replace help again", Command{Name: "HELP", Handler: h}, true},
+	}
+	for _, tc := range tests {
+		if err := r.Register(tc.cmd); (err != nil) != tc.wantErr {
+			t.Errorf("%s: unexpected error %v", tc.name, err)
+		}
+	}
+}
+
+func TestRouterDispatch(t *testing.T) {
+	ctx := context.Background()
+	b := newTestBot(t, t.TempDir(), &fakePayments{})
+	chat := runChat(t, b)
+	alice := testUID(1)
+
+	type call struct {
+		cmd  string
+		args []string
+	}
+	var calls []call
+	record := func(_ context.Context, mc *MsgContext) error {
+		calls = append(calls, call{mc.Cmd, mc.Args})
+		return nil
+	}
+	r := NewRouter()
+	for _, cmd := range []Command{
+		{Name: "bet", Aliases: []string{"b"}, Handler: record,
+			Args: []ArgSpec{{Name: "amount", Type: ArgAmount}, {Name: "side", Type: ArgEnum,
+				Options: []string{"heads", "tails"}}}},
+		{Name: "say", Handler: record, Args: []ArgSpec{{Name: "text", Variadic: true}}},
+		{Name: "pm", Scope: ScopePM, Handler: record},
+		{Name: "gc", Scope: ScopeGC, Handler: record},
+	} {
+		if err := r.Register(cmd); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name string
+		gc   bool
+		msg  string
+
+		wantHandled bool
+		wantCall    *call
+		wantReply   string
+	}{
+		{"command", false, "bet 0.5 heads", true, &call{"bet", []string{"0.5", "heads"}}, ""},
+		{"prefixed PM", false, "!bet 1 tails", true, &call{"bet", []string{"1", "tails"}}, ""},
+		{"alias", false, "B 1 TAILS", true, &call{"bet", []string{"1", "tails"}}, ""},
+		{"quoted variadic", false, `say "a b"  c`, true, &call{"say", []string{`"a b"  c`}}, ""},
+		{"missing args", false, "bet 1", true, nil, "Usage: bet <amount> <heads|tails>"},
+		{"invalid amount", false, "bet x heads", true, nil, "Invalid amount"},
+		{"invalid enum", false, "bet 1 edge", true, nil, "Invalid side"},
+		{"help", false, "help b", true, nil, "Aliases: b"},
+		{"help unknown", false, "help nope", true, nil, `Unknown command "nope"`},
+		{"unknown PM", false, "hello", false, nil, ""},
+		{"gc command", true, "!bet 2 heads", true, &call{"bet", []string{"2", "heads"}}, ""},
+		{"gc without prefix", true, "bet 2 heads", false, nil, ""},
+		{"pm scope in PM", false, "pm", true, &call{"pm", []string{}}, ""},
+		{"pm scope in GC", true, "!pm", false, nil, ""},
+		{"gc scope in GC", true, "!gc", true, &call{"gc", []string{}}, ""},
+		{"gc scope in PM", false, "gc", false, nil, ""},
+		{"empty", false, "   ", false, nil, ""},
+	}
+	for _, tc := range tests {
+		calls = nil
+		var handled bool
+		var err error
+		if tc.gc {
+			handled, err = r.HandleGC(ctx, b, &types.GCReceivedMsg{Uid: alice[:],
+				GcAlias: "gc", Msg: &types.RMGroupMessage{Message: tc.msg}})
+		} else {
+			handled, err = r.HandlePM(ctx, b, &types.ReceivedPM{Uid: alice[:],
+				Msg: &types.RMPrivateMessage{Message: tc.msg}})
+		}
+		if err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		if handled != tc.wantHandled {
+			t.Fatalf("%s: handled %v, want %v", tc.name, handled, tc.wantHandled)
+		}
+		var want []call
+		if tc.wantCall != nil {
+			want = []call{*tc.wantCall}
+		}
+		if !reflect.DeepEqual(calls, want) {
+			t.Fatalf("%s: got calls %v, want %v", tc.name, calls, want)
+		}
+		sent := chat.take()
+		if tc.wantReply == "" && len(sent) != 0 {
+			t.Fatalf("%s: unexpected replies %q", tc.name, sent)
+		}
+		if tc.wantReply != "" && (len(sent) != 1 || !strings.Contains(sent[0], tc.wantReply)) {
+			t.Fatalf("%s: got replies %q, want %q", tc.name, sent, tc.wantReply)
+		}
+	}
+
+	// Unmatched PMs go to the NotFound handler, unmatched GC messages are
+	// still ignored.
+	r.NotFound(record)
+	if handled, _ := r.HandlePM(ctx, b, &types.ReceivedPM{Uid: alice[:],
+		Msg: &types.RMPrivateMessage{Message: "hello"}}); !handled {
+		t.Fatal("unmatched PM not handled by NotFound")
+	}
+	if handled, _ := r.HandleGC(ctx, b, &types.GCReceivedMsg{Uid: alice[:],
+		GcAlias: "gc", Msg: &types.RMGroupMessage{Message: "!hello"}}); handled {
+		t.Fatal("unmatched GC message handled")
+	}
+}
+
+func TestRouterHelpText(t *testing.T) {
+	h := func(context.Context, *MsgContext) error { return nil }
+	r := NewRouter()
+	for _, cmd := range []Command{
+		{Name: "pm", Scope: ScopePM, Help: "PM only", Handler: h},
+		{Name: "gc", Scope: ScopeGC, Help: "GC only", Handler: h},
+		{Name: "all", Args: []ArgSpec{{Name: "x", Optional: true}}, Handler: h},
+	} {
+		if err := r.Register(cmd); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tests := []struct {
+		isGC      bool
+		want      []string
+		wantNotIn string
+	}{
+		{false, []string{"  all [x]", "  help [command]", "  pm - PM only"}, "gc"},
+		{true, []string{"  !all [x]", "  !gc - GC only", "  !help"}, "pm"},
+	}
+	for _, tc := range tests {
+		text := r.HelpText(tc.isGC)
+		for _, w := range tc.want {
+			if !strings.Contains(text, w) {
+				t.Errorf("help for GC %v does not contain %q:\n%s", tc.isGC, w, text)
+			}
+		}
+		if strings.Contains(text, "  "+tc.wantNotIn) || strings.Contains(text, "!"+tc.wantNotIn) {
+			t.Errorf("help for GC %v lists %q:\n%s", tc.isGC, tc.wantNotIn, text)
+		}
+	}
+
+	// isPrefixedCommand only matches registered commands.
+	for text, want := range map[string]bool{"!all": true, " !HELP me": true,
+		"all": false, "!nope": false, "!": false} {
+		if got := r.isPrefixedCommand(text); got != want {
+			t.Errorf("isPrefixedCommand(%q) = %v, want %v", text, got, want)
+		}
+	}
+}
@@ -0,0 +1,142 @@
+package bisonbotkit
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/companyzero/bisonrelay/clientrpc/jsonrpc"
+	"github.com/companyzero/bisonrelay/clientrpc/types"
+	"google.golang.org/protobuf/proto"
+)
+
+// rpcConn is a types.ClientConn that forwards calls to the current websocket
+// client, which may be replaced while the bot runs.
+type rpcConn struct {
+	mtx sync.Mutex
+	wsc *jsonrpc.WSClient
+}
+
+func (c *rpcConn) client() *jsonrpc.WSClient {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	return c.wsc
+}
+
+func (c *rpcConn) setClient(wsc *jsonrpc.WSClient) {
+	c.mtx.Lock()
+	c.wsc = wsc
+	c.mtx.Unlock()
+}
+
+// Request is part of the types.ClientConn interface.
+func (c *rpcConn) Request(ctx context.Context, method string, req, res proto.Message) error {
+	return c.client().Request(ctx, method, req, res)
+}
+
+// Stream is part of the types.ClientConn interface.
+func (c *rpcConn) Stream(ctx context.Context, method string, req proto.Message) (types.ClientStream, error) {
+	return c.client().Stream(ctx, method, req)
+}
+
+// runRPCClient runs the websocket client until ctx is done or the client
+// fails. When RPCRecreateAfter is set, the client is recreated (re-reading the
+// TLS certificates) whenever brclient is unreachable for that long.
+func (b *Bot) runRPCClient(ctx context.Context) error {
+	for {
+		wsc := b.conn.client()
+		runCtx, cancel := context.WithCancel(ctx)
+		runErr := make(chan error, 1)
+		go func() { runErr <- wsc.Run(runCtx) }()
+
+		recreate := make(chan struct{})
+		if timeout := b.cfg.RPCRecreateAfter; timeout > 0 {
+			go b.watchRPCClient(runCtx, timeout, recreate)
+		}
+
+		select {
+		case err := <-runErr:
+			cancel()
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			b.log.Errorf("websocket run ended: %v", err)
+			return fmt.Errorf("websocket run ended: %w", err)
+
+		case <-recreate:
+			cancel()
+			<-runErr
+		}
+
+		b.log.Warnf("brclient unreachable for %s, recreating RPC client",
+			b.cfg.RPCRecreateAfter)
+		if err := b.recreateRPCClient(ctx, wsc); err != nil {
+			return err
+		}
+	}
+}
+
+// recreateRPCClient creates a new websocket client, retrying with the backoff
+// of the reconnect policy until it succeeds or ctx is done, and replaces old
+// with it, closing old.
+func (b *Bot) recreateRPCClient(ctx context.Context, old *jsonrpc.WSClient) error {
+	rpcLog := b.logBackend.Logger("RPC")
+	bo := &backoff{policy: b.cfg.Reconnect}
+	for {
+		newWSC, err := NewJSONRPCClient(b.cfg, rpcLog)
+		if err == nil {
+			b.conn.setClient(newWSC)
+			if err := old.Close(); err != nil {
+				b.log.Debugf("Failed to close replaced RPC client: %v", err)
+			}
+			return nil
+		}
+
+		bo.attempts++
+		d := bo.delay()
+		b.log.Errorf("Failed to recreate RPC client (retrying in %s): %v",
+			d.Truncate(time.Millisecond), err)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(d):
+		}
+	}
+}
+
+// watchRPCClient periodically checks that brclient is reachable and closes
+// recreate once it has been unreachable for longer than timeout.
+func (b *Bot) watchRPCClient(ctx context.Context, timeout time.Duration, recreate chan<- struct{}) {
+	interval := timeout / 4
+	if interval < time.Second {
+		interval = time.Second
+	} else if interval > 30*time.Second {
+		interval = 30 * time.Second
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	lastOK := time.Now()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		reqCtx, cancel := context.WithTimeout(ctx, interval)
+		var res types.VersionResponse
+		err := b.versionService.Version(reqCtx, &types.VersionRequest{}, &res)
+		cancel()
+		switch {
+		case err == nil:
+			lastOK = time.Now()
+		case ctx.Err() != nil:
+			return
+		case time.Since(lastOK) >= timeout:
+			close(recreate)
+			return
+		}
+	}
+}
@@ -0,0 +1,464 @@
+package bisonbotkit
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/companyzero/bisonrelay/zkidentity"
+	"github.com/decred/dcrd/dcrutil/v4"
+	"github.com/decred/slog"
+	"github.com/vctt94/bisonbotkit/utils"
+)
+
+const (
+	// defaultJobTipAttempts is the number of attempts of scheduled tips
+	// when the job does not set one.
+	defaultJobTipAttempts = 3
+
+	// jobRetryDelay is the delay before retrying a failed job, doubled
+	// after each consecutive failure up to jobMaxRetryDelay.
+	jobRetryDelay    = 30 * time.Second
+	jobMaxRetryDelay = time.Hour
+
+	// jobMaxFailures is the number of consecutive failures after which a
+	// one-off job is dropped, or a recurring job skips to its next run.
+	jobMaxFailures = 10
+)
+
+// JobAction is the action performed by a scheduled job.
+type JobAction string
+
+const (
+	// JobSendPM sends Message to the user To with SendPM.
+	JobSendPM JobAction = "pm"
+
+	// JobSendGC sends Message to the GC To with SendGC.
+	JobSendGC JobAction = "gc"
+
+	// JobPayTip tips Amount to the user ID To and waits for the tip to
+	// complete.
+	JobPayTip JobAction = "tip"
+)
+
+// Job is a scheduled action. One-off jobs run once at At and are then
+// removed. Recurring jobs have a Cron schedule and run at every time it
+// matches, starting at At if it is set. Jobs that fail are retried with an
+// increasing delay, and a job is only removed or rescheduled once its run
+// succeeds, so jobs interrupted by a shutdown run again after a restart.
+type Job struct {
+	ID     string    `json:"id"`
+	Action JobAction `json:"action"`
+
+	// To is the nick or user ID for PMs and tips, or the GC name or ID
+	// for GC messages.
+	To      string         `json:"to"`
+	Message string         `json:"message,omitempty"`
+	Amount  dcrutil.Amount `json:"amount,omitempty"`
+
+	// TipAttempts is the maximum number of attempts of tips (default 3).
+	TipAttempts int32 `json:"tipattempts,omitempty"`
+
+	// At is when the job runs next.
+	At time.Time `json:"at"`
+
+	// Cron is a 5 field cron expression (minute, hour, day of month,
+	// month, day of week), a shorthand such as "@daily" or
+	// "@every <duration>". It is empty for one-off jobs.
+	Cron string `json:"cron,omitempty"`
+
+	// Owner is the user that created the job, if any, which allows
+	// listing and cancelling the reminders of a user.
+	Owner string `json:"owner,omitempty"`
+
+	// Failures is the number of consecutive failed runs of the job.
+	Failures int `json:"failures,omitempty"`
+
+	// PaymentID is the tip payment of the current run of a tip job. It is
+	// recorded before the tip is requested, so that a run interrupted by a
+	// restart waits for that tip instead of sending another one.
+	PaymentID uint64 `json:"paymentid,omitempty"`
+
+	Created time.Time `json:"created"`
+}
+
+// scheduler keeps the scheduled jobs, persisted in a JSON file.
+type scheduler struct {
+	path string
+	log  slog.Logger
+
+	// changed is signalled when jobs are added or removed.
+	changed chan struct{}
+
+	mtx  sync.Mutex
+	jobs map[string]*Job
+
+	// running holds the IDs of the jobs being run, and wg tracks their
+	// goroutines.
+	running map[string]bool
+	wg      sync.WaitGroup
+}
+
+func newScheduler(path string, log slog.Logger) (*scheduler, error) {
+	s := &scheduler{
+		path:    path,
+		log:     log,
+		changed: make(chan struct{}, 1),
+		jobs:    make(map[string]*Job),
+		running: make(map[string]bool),
+	}
+	data, err := os.ReadFile(path)
+	switch {
+	case os.IsNotExist(err):
+	case err != nil:
+		return nil, err
+	default:
+		var jobs []*Job
+		if err := json.Unmarshal(data, &jobs); err != nil {
+			return nil, err
+		}
+		for _, j := range jobs {
+			s.jobs[j.ID] = j
+		}
+	}
+	return s, nil
+}
+
+// save writes the jobs to disk. It must be called with the mutex held.
+func (s *scheduler) save() error {
+	jobs := make([]*Job, 0, len(s.jobs))
+	for _, j := range s.jobs {
+		jobs = append(jobs, j)
+	}
+	sort.Slice(jobs, func(i, j int) bool { return jobs[i].ID < jobs[j].ID })
+	data, err := json.MarshalIndent(jobs, "", "  ")
+	if err != nil {
+		return err
+	}
+	return utils.AtomicWriteFile(s.path, data, 0600)
+}
+
+// Schedule adds a job, filling in its ID and, for recurring jobs without a
+// start time, the time of its first run. The job is persisted before
+// returning.
+func (b *Bot) Schedule(job Job) (Job, error) {
+	switch job.Action {
+	case JobSendPM, JobSendGC:
+		if job.Message == "" {
+			return job, errors.New("job has no message")
+		}
+	case JobPayTip:
+		var uid zkidentity.ShortID
+		if err := uid.FromString(job.To); err != nil {
+			return job, fmt.Errorf("tip jobs require a user ID: %w", err)
+		}
+		if job.Amount <= 0 {
+			return job, errors.New("tip amount must be positive")
+		}
+	default:
+		return job, fmt.Errorf("unknown job action %q", job.Action)
+	}
+	if job.To == "" {
+		return job, errors.New("job has no destination")
+	}
+
+	now := time.Now()
+	if job.Cron != "" {
+		cs, err := parseCron(job.Cron)
+		if err != nil {
+			return job, fmt.Errorf("invalid cron schedule: %w", err)
+		}
+		if job.At.IsZero() {
+			job.At = cs.next(now)
+			if job.At.IsZero() {
+				return job, errors.New("cron schedule never runs")
+			}
+		}
+	} else if job.At.IsZero() {
+		return job, errors.New("one-off jobs require a time")
+	}
+
+	id, err := utils.GenerateRandomString(16)
+	if err != nil {
+		return job, err
+	}
+	job.ID = id
+	job.Created = now
+
+	s := b.scheduler
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	j := job
+	s.jobs[id] = &j
+	if err := s.save(); err != nil {
+		delete(s.jobs, id)
+		return job, err
+	}
+	signal(s.changed)
+	return job, nil
+}
+
+// SchedulePM sends msg to nick after the given delay.
+func (b *Bot) SchedulePM(after time.Duration, nick, msg string) (Job, error) {
+	return b.Schedule(Job{
+		Action:  JobSendPM,
+		To:      nick,
+		Message: msg,
+		At:      time.Now().Add(after),
+	})
+}
+
+// ScheduleGC sends msg to the GC every time the cron schedule matches.
+func (b *Bot) ScheduleGC(cron, gc, msg string) (Job, error) {
+	return b.Schedule(Job{
+		Action:  JobSendGC,
+		To:      gc,
+		Message: msg,
+		Cron:    cron,
+	})
+}
+
+// Remind schedules a reminder PM to the user, owned by that user.
+func (b *Bot) Remind(uid zkidentity.ShortID, at time.Time, msg string) (Job, error) {
+	return b.Schedule(Job{
+		Action:  JobSendPM,
+		To:      uid.String(),
+		Message: msg,
+		At:      at,
+		Owner:   uid.String(),
+	})
+}
+
+// CancelJob removes a scheduled job.
+func (b *Bot) CancelJob(id string) error {
+	s := b.scheduler
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	j, ok := s.jobs[id]
+	if !ok {
+		return fmt.Errorf("job %q not found", id)
+	}
+	delete(s.jobs, id)
+	if err := s.save(); err != nil {
+		s.jobs[id] = j
+		return err
+	}
+	signal(s.changed)
+	return nil
+}
+
+// Jobs returns the scheduled jobs sorted by their next run time. If owner is
+// not empty, only the jobs owned by that user are returned.
+func (b *Bot) Jobs(owner string) []Job {
+	s := b.scheduler
+	s.mtx.Lock()
+	res := make([]Job, 0, len(s.jobs))
+	for _, j := range s.jobs {
+		if owner == "" || j.Owner == owner {
+			res = append(res, *j)
+		}
+	}
+	s.mtx.Unlock()
+	sort.Slice(res, func(i, j int) bool { return res[i].At.Before(res[j].At) })
+	return res
+}
+
+// runJob performs the action of a job.
+func (b *Bot) runJob(ctx context.Context, j *Job) error {
+	switch j.Action {
+	case JobSendPM:
+		return b.SendPM(ctx, j.To, j.Message)
+	case JobSendGC:
+		return b.SendGC(ctx, j.To, j.Message)
+	case JobPayTip:
+		var uid zkidentity.ShortID
+		if err := uid.FromString(j.To); err != nil {
+			return err
+		}
+		return b.runTipJob(ctx, j, uid)
+	default:
+		return fmt.Errorf("unknown job action %q", j.Action)
+	}
+}
+
+// runTipJob tips the user of a tip job and waits for the outcome of the tip.
+// The payment is recorded in the job before the tip is requested, so a run
+// interrupted by a restart resumes waiting for it. Only tips that failed are
+// retried.
+func (b *Bot) runTipJob(ctx context.Context, j *Job, uid zkidentity.ShortID) error {
+	s := b.scheduler
+	var payment *TipPayment
+	if j.PaymentID != 0 {
+		var ok bool
+		payment, ok = b.TipPayment(j.PaymentID)
+		if !ok {
+			// The outcome of the tip is no longer known.
+			s.log.Errorf("Tip %d of job %s not found", j.PaymentID, j.ID)
+			return nil
+		}
+	} else {
+		attempts := j.TipAttempts
+		if attempts <= 0 {
+			attempts = defaultJobTipAttempts
+		}
+		var err error
+		payment, err = b.reserveTip(uid, j.Amount, attempts)
+		if err != nil {
+			return err
+		}
+		if err := s.setPayment(j.ID, payment.ID()); err != nil {
+			b.tipFailed(payment.ID(), err)
+			return err
+		}
+		if err := b.sendTip(ctx, payment); err != nil {
+			// The tip may have been sent, so its outcome is
+			// awaited like for any other tip.
+			s.log.Warnf("Tip of job %s has an unknown outcome "+
+				"(payment %d): %v", j.ID, payment.ID(), err)
+		}
+	}
+	return payment.Wait(ctx)
+}
+
+// setPayment records the tip payment of the current run of a job.
+func (s *scheduler) setPayment(id string, paymentID uint64) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	j, ok := s.jobs[id]
+	if !ok {
+		return fmt.Errorf("job %q not found", id)
+	}
+	upd := *j
+	upd.PaymentID = paymentID
+	s.jobs[id] = &upd
+	if err := s.save(); err != nil {
+		s.jobs[id] = j
+		return err
+	}
+	return nil
+}
+
+// dueJobs marks the due jobs as running, returning them and the time of the
+// next job.
+func (s *scheduler) dueJobs(now time.Time) ([]Job, time.Time) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	var due []Job
+	var next time.Time
+	for id, j := range s.jobs {
+		if s.running[id] {
+			continue
+		}
+		if j.At.After(now) {
+			if next.IsZero() || j.At.Before(next) {
+				next = j.At
+			}
+			continue
+		}
+		s.running[id] = true
+		due = append(due, *j)
+	}
+	sort.Slice(due, func(i, j int) bool { return due[i].At.Before(due[j].At) })
+	return due, next
+}
+
+// finished records the result of running a job. Successful one-off jobs are
+// removed and recurring jobs are rescheduled, while failed jobs are retried
+// later. Jobs interrupted because the scheduler stopped are left as they
+// are, to run again after a restart.
+func (s *scheduler) finished(id string, runErr error, stopped bool) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	delete(s.running, id)
+	defer signal(s.changed)
+
+	j, ok := s.jobs[id]
+	if !ok || stopped {
+		// Canceled while it ran, or to run again after a restart.
+		return
+	}
+	// The tip of the run, if any, completed or failed.
+	j.PaymentID = 0
+
+	now := time.Now()
+	done := runErr == nil
+	if runErr != nil {
+		j.Failures++
+		if j.Failures < jobMaxFailures {
+			delay := jobRetryDelay << (j.Failures - 1)
+			if delay > jobMaxRetryDelay {
+				delay = jobMaxRetryDelay
+			}
+			j.At = now.Add(delay)
+			s.log.Errorf("Job %s (%s to %s) failed (retrying in %s): %v",
+				id, j.Action, j.To, delay, runErr)
+		} else {
+			s.log.Errorf("Job %s (%s to %s) failed %d times, giving up: %v",
+				id, j.Action, j.To, j.Failures, runErr)
+			done = true
+		}
+	}
+
+	if done {
+		j.Failures = 0
+		var at time.Time
+		if j.Cron != "" {
+			// Jobs missed while the bot was down ran once and are
+			// rescheduled from now.
+			if cs, err := parseCron(j.Cron); err == nil {
+				at = cs.next(now)
+			}
+			if at.IsZero() {
+				s.log.Errorf("Removing job %s with invalid schedule %q", id, j.Cron)
+			}
+		}
+		if at.IsZero() {
+			delete(s.jobs, id)
+		} else {
+			j.At = at
+		}
+	}
+	if err := s.save(); err != nil {
+		s.log.Errorf("Unable to save scheduled jobs: %v", err)
+	}
+}
+
+// runScheduler runs the scheduled jobs until ctx is done, then waits for the
+// jobs being run. Jobs stored in schedule.json inside the data dir survive
+// restarts.
+func (b *Bot) runScheduler(ctx context.Context) error {
+	s := b.scheduler
+	defer s.wg.Wait()
+	for {
+		due, next := s.dueJobs(time.Now())
+		for i := range due {
+			// Jobs run concurrently so that a slow tip does not
+			// delay other jobs.
+			j := &due[i]
+			s.log.Debugf("Running job %s (%s to %s)", j.ID, j.Action, j.To)
+			s.wg.Add(1)
+			go func() {
+				defer s.wg.Done()
+				err := b.runJob(ctx, j)
+				s.finished(j.ID, err, err != nil && ctx.Err() != nil)
+			}()
+		}
+
+		var timer <-chan time.Time
+		if !next.IsZero() {
+			timer = time.After(time.Until(next))
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-s.changed:
+		case <-timer:
+		}
+	}
+}
@@ -0,0 +1,95 @@
+package bisonbotkit
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/decred/dcrd/dcrutil/v4"
+	"github.com/decred/slog"
+)
+
+// newSchedulerTestBot returns a test bot with the jobs scheduled in dir.
+func newSchedulerTestBot(t *testing.T, dir string, payments *fakePayments) *Bot {
+	t.Helper()
+	b := newTestBot(t, dir, payments)
+	s, err := newScheduler(filepath.Join(dir, "schedule.json"), slog.Disabled)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.scheduler = s
+	return b
+}
+
+// startScheduler runs the scheduler of b until the returned func is called.
+func startScheduler(b *Bot) func() {
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		b.runScheduler(ctx)
+		close(done)
+	}()
+	return func() {
+		cancel()
+		<-done
+	}
+}
+
+// findJob returns the job with the given ID, if it is scheduled.
+func findJob(b *Bot, id string) (Job, bool) {
+	for _, j := range b.Jobs("") {
+		if j.ID == id {
+			return j, true
+		}
+	}
+	return Job{}, false
+}
+
+func TestSchedulerTipRestart(t *testing.T) {
+	dir := t.TempDir()
+	payments := &fakePayments{}
+	b := newSchedulerTestBot(t, dir, payments)
+	uid := testUID(1)
+	amounts := []dcrutil.Amount{1000, 2000}
+	var ids []string
+	for _, amt := range amounts {
+		j, err := b.Schedule(Job{Action: JobPayTip, To: uid.String(),
+			Amount: amt, At: time.Now().Add(-time.Second)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, j.ID)
+	}
+
+	// The payments are recorded in the jobs before the tips are sent.
+	stop := startScheduler(b)
+	waitFor(t, "tips", func() bool { return payments.count() == 2 })
+	for _, id := range ids {
+		if j, _ := findJob(b, id); j.PaymentID == 0 {
+			t.Fatalf("job %s has no payment", id)
+		}
+	}
+	stop()
+
+	// After a restart, the jobs wait for their payments instead of tipping
+	// again. The completed tip removes its job and the failed one is
+	// retried later with a new payment.
+	payments = &fakePayments{}
+	b = newSchedulerTestBot(t, dir, payments)
+	stop = startScheduler(b)
+	defer stop()
+	resolveTip(t, b, 1, uid, amounts[0], true)
+	resolveTip(t, b, 2, uid, amounts[1], false)
+	waitFor(t, "jobs to finish", func() bool {
+		_, ok := findJob(b, ids[0])
+		j := b.Jobs("")
+		return !ok && len(j) == 1 && j[0].Failures == 1
+	})
+	if j, _ := findJob(b, ids[1]); j.PaymentID != 0 || !j.At.After(time.Now()) {
+		t.Fatalf("failed job not rescheduled: %+v", j)
+	}
+	if n := payments.count(); n != 0 {
+		t.Fatalf("sent %d tips after the restart", n)
+	}
+}
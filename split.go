@@ -0,0 +1,69 @@
+package bisonbotkit
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/companyzero/bisonrelay/rpc"
+	"github.com/vctt94/bisonbotkit/utils"
+)
+
+const (
+	defaultSplitMaxLen = 8000
+
+	// sentFilesMaxAge is how long files created to send long messages are
+	// kept.
+	sentFilesMaxAge = 24 * time.Hour
+)
+
+// MaxMessageSize is the maximum size of a message accepted by Bison Relay
+// servers. Messages are split well below this size by default.
+var MaxMessageSize = int(rpc.MaxPayloadSizeForVersion(rpc.MaxMsgSizeV0))
+
+// splitMessage splits msg according to the bot's split policy.
+func (b *Bot) splitMessage(msg string) []string {
+	maxLen := b.cfg.Split.MaxLen
+	if maxLen <= 0 {
+		maxLen = defaultSplitMaxLen
+	}
+	if maxLen > MaxMessageSize {
+		maxLen = MaxMessageSize
+	}
+
+	parts := utils.SplitMessage(msg, maxLen)
+	if len(parts) < 2 || !b.cfg.Split.Number {
+		return parts
+	}
+
+	// Split again leaving room for the part numbers.
+	prefixLen := len(fmt.Sprintf("(%d/%d) ", len(parts), len(parts))) + 2
+	parts = utils.SplitMessage(msg, maxLen-prefixLen)
+	for i := range parts {
+		parts[i] = fmt.Sprintf("(%d/%d) %s", i+1, len(parts), parts[i])
+	}
+	return parts
+}
+
+// sendAsFile writes msg to a text file in the data dir and sends it to nick.
+// Files older than a day are removed.
+func (b *Bot) sendAsFile(ctx context.Context, nick, msg string) error {
+	dir := filepath.Join(b.cfg.DataDir, "sentfiles")
+	if entries, err := os.ReadDir(dir); err == nil {
+		for _, e := range entries {
+			info, err := e.Info()
+			if err == nil && time.Since(info.ModTime()) > sentFilesMaxAge {
+				os.Remove(filepath.Join(dir, e.Name()))
+			}
+		}
+	}
+
+	name := fmt.Sprintf("msg-%s.txt", time.Now().Format("20060102-150405.000000"))
+	path := filepath.Join(dir, name)
+	if err := utils.AtomicWriteFile(path, []byte(msg), 0600); err != nil {
+		return fmt.Errorf("unable to write message file: %w", err)
+	}
+	return b.SendFile(ctx, nick, path)
+}
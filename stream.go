@@ -0,0 +1,454 @@
+package bisonbotkit
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/decred/slog"
+)
+
+// StreamClient is implemented by the clientrpc stream clients (for example,
+// types.ChatService_PMStreamClient).
+type StreamClient[T any] interface {
+	Recv(*T) error
+}
+
+// sequencedMsg is implemented by clientrpc stream messages.
+type sequencedMsg[T any] interface {
+	*T
+	GetSequenceId() uint64
+}
+
+// StreamAckMode defines when a stream consumer acknowledges messages.
+type StreamAckMode int
+
+const (
+	// AckBeforeHandle acknowledges messages as soon as they are received,
+	// before calling the handler.
+	AckBeforeHandle StreamAckMode = iota
+
+	// AckAfterHandle acknowledges messages once the handler returns
+	// without error. A message whose handler fails is not acknowledged,
+	// and neither are later messages, until it is received again after the
+	// stream is reopened and handled.
+	AckAfterHandle
+
+	// AckByHandler never acknowledges messages automatically. The
+	// application must call Bot.AckStream (or Envelope.Ack, or one of the
+	// stream specific Ack methods) once the message is processed, or
+	// Bot.NackStream (or Envelope.Nack) if processing it failed.
+	AckByHandler
+)
+
+// StreamConfig describes a clientrpc notification stream consumed with
+// Subscribe.
+type StreamConfig[T any] struct {
+	// Name identifies the stream in logs, stream events and the cursor
+	// store. It must be unique per bot.
+	Name string
+
+	// Log is the logger for the stream. Defaults to a logger for the
+	// "STRM" subsystem.
+	Log slog.Logger
+
+	// Open opens the stream, requesting the messages after unackedFrom.
+	Open func(ctx context.Context, unackedFrom uint64) (StreamClient[T], error)
+
+	// Ack acknowledges all messages up to seq. It may only be nil when
+	// AckMode is AckByHandler and the application acks messages itself
+	// through some other means.
+	Ack func(ctx context.Context, seq uint64) error
+
+	AckMode StreamAckMode
+
+	// Handle is called for each received message, in order. Unless
+	// AckMode is AckBeforeHandle, messages received again after the stream
+	// is reopened are only handled again if they were not handled yet.
+	Handle func(ctx context.Context, msg *T) error
+}
+
+// streamAcker is a registered stream that can be acked through Bot.ack.
+type streamAcker struct {
+	ack     func(ctx context.Context, seq uint64) error
+	log     slog.Logger
+	tracker *ackTracker
+}
+
+// registerStream records how to ack the given stream and returns its ack
+// tracker. A nil ack keeps any previously registered ack function.
+func (b *Bot) registerStream(name string, ack func(context.Context, uint64) error, log slog.Logger) *ackTracker {
+	b.streamsMtx.Lock()
+	defer b.streamsMtx.Unlock()
+	old := b.streams[name]
+	if ack == nil {
+		ack = old.ack
+	}
+	tracker := old.tracker
+	if tracker == nil {
+		tracker = &ackTracker{states: make(map[uint64]ackState)}
+	}
+	b.streams[name] = streamAcker{ack: ack, log: log, tracker: tracker}
+	return tracker
+}
+
+// streamLog returns the logger used for the given stream.
+func (b *Bot) streamLog(stream string) slog.Logger {
+	b.streamsMtx.Lock()
+	defer b.streamsMtx.Unlock()
+	if s, ok := b.streams[stream]; ok && s.log != nil {
+		return s.log
+	}
+	return b.log
+}
+
+// ack records that the message seq of the stream was handled and
+// acknowledges the messages up to the highest sequence ID below which every
+// tracked message is handled, advancing the stream cursor.
+func (b *Bot) ack(ctx context.Context, stream string, seq uint64) error {
+	b.streamsMtx.Lock()
+	s, ok := b.streams[stream]
+	b.streamsMtx.Unlock()
+	if !ok || s.ack == nil {
+		return fmt.Errorf("stream %q cannot be acked", stream)
+	}
+	if !s.tracker.handled(seq) {
+		// Earlier messages are still being handled.
+		return nil
+	}
+	return s.tracker.flush(func(upTo uint64) error {
+		if err := s.ack(ctx, upTo); err != nil {
+			return err
+		}
+		b.setStreamCursor(stream, upTo, b.streamLog(stream))
+		return nil
+	})
+}
+
+// nack records that handling the message seq of the stream failed, so that
+// neither it nor any later message is acknowledged until it is delivered
+// again and handled.
+func (b *Bot) nack(stream string, seq uint64) {
+	b.streamsMtx.Lock()
+	s, ok := b.streams[stream]
+	b.streamsMtx.Unlock()
+	if ok {
+		s.tracker.failed(seq)
+	}
+}
+
+// AckStream records that the message seq of a stream consumed with Subscribe
+// was handled. Acks sent to brclient are cumulative, so the message is only
+// acknowledged once every earlier message received from the stream is acked
+// too.
+func (b *Bot) AckStream(ctx context.Context, stream string, seq uint64) error {
+	return b.ack(ctx, stream, seq)
+}
+
+// NackStream records that handling the message seq of a stream consumed with
+// Subscribe failed. Neither it nor any later message is acknowledged until
+// it is handled, which happens when it is delivered again after the stream is
+// reopened (for example, after a reconnection or a restart).
+func (b *Bot) NackStream(stream string, seq uint64) {
+	b.nack(stream, seq)
+}
+
+// Envelope is the acknowledgement handle of a message received from a stream
+// whose messages are acked by the application: every stream in manual ack
+// mode and the tip streams. Either Ack or Nack must be called once the
+// message is handled.
+type Envelope struct {
+	b      *Bot
+	stream string
+	seq    uint64
+}
+
+// Envelope returns the acknowledgement handle of the message seq of the
+// stream (one of the Stream* constants or the name of a stream consumed with
+// Subscribe).
+func (b *Bot) Envelope(stream string, seq uint64) *Envelope {
+	return &Envelope{b: b, stream: stream, seq: seq}
+}
+
+// Ack records that the message was handled. See AckStream.
+func (e *Envelope) Ack(ctx context.Context) error {
+	return e.b.ack(ctx, e.stream, e.seq)
+}
+
+// Nack records that handling the message failed. See NackStream.
+func (e *Envelope) Nack() {
+	e.b.nack(e.stream, e.seq)
+}
+
+// ackState is the state of a message tracked by an ackTracker.
+type ackState int
+
+const (
+	ackInflight ackState = iota
+	ackHandled
+	ackFailed
+)
+
+// ackTracker tracks the messages of a stream that are not acked yet, so that
+// the cumulative acks sent to brclient never cover a message that was not
+// handled.
+type ackTracker struct {
+	mtx sync.Mutex
+
+	// pending holds the sequence IDs of the received messages that are
+	// not acked yet, in order, and states their state.
+	pending []uint64
+	states  map[uint64]ackState
+
+	// last is the highest sequence ID received or acked.
+	last uint64
+
+	// flushMtx serializes the acks sent to brclient, and acked is the
+	// last sequence ID acked.
+	flushMtx sync.Mutex
+	acked    uint64
+}
+
+// reset forgets the tracked messages, which are delivered again when the
+// stream is opened.
+func (t *ackTracker) reset() {
+	t.flushMtx.Lock()
+	defer t.flushMtx.Unlock()
+	t.mtx.Lock()
+	t.pending = nil
+	t.states = make(map[uint64]ackState)
+	t.last = t.acked
+	t.mtx.Unlock()
+}
+
+// received tracks a message received from the stream. It returns false if
+// the message must not be handled because it is already being handled, or was
+// handled, since it was first received.
+func (t *ackTracker) received(seq uint64) bool {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	if st, ok := t.states[seq]; ok {
+		if st != ackFailed {
+			return false
+		}
+		t.states[seq] = ackInflight
+		return true
+	}
+	if seq <= t.last {
+		return false
+	}
+	t.pending = append(t.pending, seq)
+	t.states[seq] = ackInflight
+	t.last = seq
+	return true
+}
+
+// handled records that the message was handled. It returns true if the ack
+// may advance. Messages that were not tracked (for example, in streams that
+// ack before handling) advance it as long as no message is pending.
+func (t *ackTracker) handled(seq uint64) bool {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	if _, ok := t.states[seq]; ok {
+		t.states[seq] = ackHandled
+		return t.states[t.pending[0]] == ackHandled
+	}
+	if len(t.pending) > 0 || seq <= t.last {
+		return false
+	}
+	t.last = seq
+	return true
+}
+
+// failed records that handling the message failed.
+func (t *ackTracker) failed(seq uint64) {
+	t.mtx.Lock()
+	if _, ok := t.states[seq]; ok {
+		t.states[seq] = ackFailed
+	}
+	t.mtx.Unlock()
+}
+
+// flush calls ack with the highest sequence ID up to which every message is
+// handled, if it advanced, and forgets the acked messages once ack succeeds.
+func (t *ackTracker) flush(ack func(upTo uint64) error) error {
+	t.flushMtx.Lock()
+	defer t.flushMtx.Unlock()
+
+	t.mtx.Lock()
+	upTo := t.last
+	if len(t.pending) > 0 {
+		upTo = 0
+		for _, seq := range t.pending {
+			if t.states[seq] != ackHandled {
+				break
+			}
+			upTo = seq
+		}
+	}
+	t.mtx.Unlock()
+	if upTo <= t.acked {
+		return nil
+	}
+
+	if err := ack(upTo); err != nil {
+		return err
+	}
+	t.acked = upTo
+
+	t.mtx.Lock()
+	n := 0
+	for n < len(t.pending) && t.pending[n] <= upTo {
+		delete(t.states, t.pending[n])
+		n++
+	}
+	t.pending = t.pending[n:]
+	t.mtx.Unlock()
+	return nil
+}
+
+// maxAppliedSeqs is the number of sequence IDs kept by an appliedSeqs.
+const maxAppliedSeqs = 1000
+
+// appliedSeqs is the set of sequence IDs of the stream messages applied to a
+// persisted state, used to skip the messages delivered again after a restart.
+// A nacked message is only delivered again once its stream is reopened, after
+// later messages may have been applied, so the IDs are recorded one by one
+// rather than as a high-water mark. Only the highest maxAppliedSeqs IDs are
+// kept and Floor covers the older ones.
+type appliedSeqs struct {
+	Floor uint64   `json:"floor,omitempty"`
+	IDs   []uint64 `json:"ids,omitempty"`
+}
+
+// has returns true if the message seq was applied. Messages without a
+// sequence ID are never considered applied.
+func (s appliedSeqs) has(seq uint64) bool {
+	if seq == 0 {
+		return false
+	}
+	if seq <= s.Floor {
+		return true
+	}
+	i := sort.Search(len(s.IDs), func(i int) bool { return s.IDs[i] >= seq })
+	return i < len(s.IDs) && s.IDs[i] == seq
+}
+
+// add returns the set with seq added. The IDs of s are not modified, so
+// states that are copied before being saved can share them.
+func (s appliedSeqs) add(seq uint64) appliedSeqs {
+	if seq == 0 || s.has(seq) {
+		return s
+	}
+	i := sort.Search(len(s.IDs), func(i int) bool { return s.IDs[i] > seq })
+	ids := make([]uint64, 0, len(s.IDs)+1)
+	ids = append(ids, s.IDs[:i]...)
+	ids = append(ids, seq)
+	ids = append(ids, s.IDs[i:]...)
+	if n := len(ids) - maxAppliedSeqs; n > 0 {
+		s.Floor = ids[n-1]
+		ids = ids[n:]
+	}
+	s.IDs = ids
+	return s
+}
+
+// Subscribe consumes a clientrpc notification stream until ctx is done. It
+// reopens the stream according to the bot's reconnect policy, resumes it from
+// the stream cursor, acks messages according to the ack mode and calls the
+// handler for every received message. It may be used to consume streams not
+// covered by the bot itself.
+func Subscribe[T any, PT sequencedMsg[T]](ctx context.Context, b *Bot, sc StreamConfig[T]) error {
+	if sc.Name == "" || sc.Open == nil || sc.Handle == nil {
+		return errors.New("stream config requires name, open and handle")
+	}
+	if sc.Ack == nil && sc.AckMode != AckByHandler {
+		return fmt.Errorf("stream %q requires an ack function", sc.Name)
+	}
+	log := sc.Log
+	if log == nil {
+		log = b.logBackend.Logger("STRM")
+	}
+	tracker := b.registerStream(sc.Name, sc.Ack, log)
+
+	// Unless messages are acked before being handled, track them so that
+	// acks only cover handled messages.
+	tracked := sc.AckMode != AckBeforeHandle
+	if tracked {
+		tracker.reset()
+	}
+
+	bo := &backoff{policy: b.cfg.Reconnect}
+	for {
+		// Keep requesting a new stream if the connection breaks. Also
+		// request any messages received since the last one we acked.
+		stream, err := sc.Open(ctx, b.streamCursor(sc.Name, log))
+		if errors.Is(err, context.Canceled) {
+			// Program is done.
+			return err
+		}
+		if err != nil {
+			log.Errorf("Failed to open %s stream: %v", sc.Name, err)
+			if err := b.streamFailed(ctx, bo, sc.Name, err); err != nil {
+				return err
+			}
+			continue
+		}
+		b.streamUp(bo, sc.Name)
+
+		log.Infof("Listening for %s stream msgs...", sc.Name)
+		for {
+			var msg T
+			err := stream.Recv(&msg)
+			if errors.Is(err, context.Canceled) {
+				// Program is done.
+				return err
+			}
+			if err != nil {
+				log.Errorf("Failed to receive from %s stream: %v", sc.Name, err)
+				if err := b.streamFailed(ctx, bo, sc.Name, err); err != nil {
+					return err
+				}
+				break
+			}
+
+			seq := PT(&msg).GetSequenceId()
+			if tracked && !tracker.received(seq) {
+				log.Debugf("Skipping %s msg %d received again", sc.Name, seq)
+				continue
+			}
+			if sc.AckMode == AckBeforeHandle {
+				if err := b.ack(ctx, sc.Name, seq); err != nil {
+					log.Errorf("Failed to acknowledge %s msg: %v", sc.Name, err)
+					if err := b.streamFailed(ctx, bo, sc.Name, err); err != nil {
+						return err
+					}
+					break
+				}
+			}
+
+			// The stream delivers messages again, so its failed
+			// attempts are forgotten.
+			b.streamHealthy(bo)
+			if err := sc.Handle(ctx, &msg); err != nil {
+				log.Errorf("Failed to handle %s msg %d: %v", sc.Name, seq, err)
+				if tracked {
+					b.nack(sc.Name, seq)
+				}
+				continue
+			}
+
+			if sc.AckMode == AckAfterHandle {
+				if err := b.ack(ctx, sc.Name, seq); err != nil {
+					log.Errorf("Failed to acknowledge %s msg: %v", sc.Name, err)
+					if err := b.streamFailed(ctx, bo, sc.Name, err); err != nil {
+						return err
+					}
+					break
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,204 @@
+package bisonbotkit
+
+import (
+	"context"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+
+	"github.com/decred/slog"
+	"github.com/vctt94/bisonbotkit/config"
+)
+
+// fakeAcks records the acks sent to brclient for a stream.
+type fakeAcks struct {
+	mtx  sync.Mutex
+	seqs []uint64
+}
+
+func (f *fakeAcks) ack(_ context.Context, seq uint64) error {
+	f.mtx.Lock()
+	f.seqs = append(f.seqs, seq)
+	f.mtx.Unlock()
+	return nil
+}
+
+// last returns the last acked sequence ID.
+func (f *fakeAcks) last() uint64 {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	if len(f.seqs) == 0 {
+		return 0
+	}
+	return f.seqs[len(f.seqs)-1]
+}
+
+// newAckTestBot returns a bot in manual ack mode whose acks of stream are
+// recorded in the returned fakeAcks.
+func newAckTestBot(t *testing.T, stream string) (*Bot, *fakeAcks) {
+	t.Helper()
+	dir := t.TempDir()
+	dialogs, err := newDialogs(filepath.Join(dir, "dialogs.json"), slog.Disabled)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := &Bot{
+		cfg:       &config.BotConfig{DataDir: dir},
+		log:       slog.Disabled,
+		pmLog:     slog.Disabled,
+		gcLog:     slog.Disabled,
+		manualAck: true,
+		acked:     make(map[string]uint64),
+		streams:   make(map[string]streamAcker),
+		dialogs:   dialogs,
+	}
+	acks := &fakeAcks{}
+	b.registerStream(stream, acks.ack, slog.Disabled)
+	return b, acks
+}
+
+func TestAckTracker(t *testing.T) {
+	const (
+		recv = iota
+		handle
+		fail
+		reopen
+	)
+	tests := []struct {
+		name string
+		op   int
+		seq  uint64
+
+		// wantRecv is the result of received for recv ops, and
+		// wantAcked the last sequence ID acked after the op.
+		wantRecv  bool
+		wantAcked uint64
+	}{
+		{"receive 1", recv, 1, true, 0},
+		{"receive 2", recv, 2, true, 0},
+		{"receive 3", recv, 3, true, 0},
+		{"handle 2 before 1", handle, 2, false, 0},
+		{"handle 1 flushes 2", handle, 1, false, 2},
+		{"duplicate 2", recv, 2, false, 2},
+		{"nack 3", fail, 3, false, 2},
+		{"receive 4", recv, 4, true, 2},
+		{"handle 4 held back by 3", handle, 4, false, 2},
+		{"4 again not handled twice", recv, 4, false, 2},
+		{"3 delivered again", recv, 3, true, 2},
+		{"3 again while in flight", recv, 3, false, 2},
+		{"handle 3 flushes 4", handle, 3, false, 4},
+		{"reopen", reopen, 0, false, 4},
+		{"4 after reopen", recv, 4, false, 4},
+		{"receive 6", recv, 6, true, 4},
+		{"nack 6", fail, 6, false, 4},
+		{"reopen forgets 6", reopen, 0, false, 4},
+		{"6 after reopen", recv, 6, true, 4},
+		{"handle 6", handle, 6, false, 6},
+	}
+
+	ctx := context.Background()
+	b, acks := newAckTestBot(t, StreamPM)
+	tracker := b.streams[StreamPM].tracker
+	for _, tc := range tests {
+		switch tc.op {
+		case recv:
+			if got := tracker.received(tc.seq); got != tc.wantRecv {
+				t.Fatalf("%s: received returned %v", tc.name, got)
+			}
+		case handle:
+			if err := b.ack(ctx, StreamPM, tc.seq); err != nil {
+				t.Fatalf("%s: %v", tc.name, err)
+			}
+		case fail:
+			b.nack(StreamPM, tc.seq)
+		case reopen:
+			tracker.reset()
+		}
+		if got := acks.last(); got != tc.wantAcked {
+			t.Fatalf("%s: acked up to %d, want %d", tc.name, got, tc.wantAcked)
+		}
+	}
+	if cursor := b.streamCursor(StreamPM, slog.Disabled); cursor != 6 {
+		t.Fatalf("got cursor %d, want 6", cursor)
+	}
+}
+
+func TestAckTrackerConcurrent(t *testing.T) {
+	const n = 200
+	ctx := context.Background()
+	b, _ := newAckTestBot(t, StreamPM)
+
+	// Acks sent while handlers finish in any order never cover a message
+	// that was not handled yet, and never move back.
+	var mtx sync.Mutex
+	handled := make(map[uint64]bool)
+	var last uint64
+	b.registerStream(StreamPM, func(_ context.Context, upTo uint64) error {
+		mtx.Lock()
+		defer mtx.Unlock()
+		if upTo <= last {
+			t.Errorf("ack moved back from %d to %d", last, upTo)
+		}
+		for seq := last + 1; seq <= upTo; seq++ {
+			if !handled[seq] {
+				t.Errorf("ack up to %d covers unhandled msg %d", upTo, seq)
+			}
+		}
+		last = upTo
+		return nil
+	}, slog.Disabled)
+	tracker := b.streams[StreamPM].tracker
+	for seq := uint64(1); seq <= n; seq++ {
+		tracker.received(seq)
+	}
+
+	var wg sync.WaitGroup
+	for seq := uint64(n); seq > 0; seq-- {
+		wg.Add(1)
+		go func(seq uint64) {
+			defer wg.Done()
+			mtx.Lock()
+			handled[seq] = true
+			mtx.Unlock()
+			if err := b.ack(ctx, StreamPM, seq); err != nil {
+				t.Error(err)
+			}
+		}(seq)
+	}
+	wg.Wait()
+	if last != n {
+		t.Fatalf("acked up to %d, want %d", last, n)
+	}
+}
+
+func TestAppliedSeqs(t *testing.T) {
+	var s appliedSeqs
+	for _, seq := range []uint64{6, 0, 4, 6, 5} {
+		s = s.add(seq)
+	}
+	if want := []uint64{4, 5, 6}; s.Floor != 0 || !reflect.DeepEqual(s.IDs, want) {
+		t.Fatalf("got %+v, want IDs %v", s, want)
+	}
+	for seq, want := range map[uint64]bool{0: false, 3: false, 4: true, 5: true, 7: false} {
+		if got := s.has(seq); got != want {
+			t.Errorf("has(%d) = %v, want %v", seq, got, want)
+		}
+	}
+
+	// Adding does not modify the IDs of the original set.
+	added := s.add(1)
+	if !reflect.DeepEqual(s.IDs, []uint64{4, 5, 6}) || !added.has(1) {
+		t.Fatalf("add modified the original set: %+v, %+v", s, added)
+	}
+
+	// Only the highest IDs are kept, and the older ones are covered by
+	// Floor.
+	s = appliedSeqs{}
+	for seq := uint64(maxAppliedSeqs + 10); seq > 0; seq-- {
+		s = s.add(seq)
+	}
+	if len(s.IDs) != maxAppliedSeqs || s.Floor != 10 || !s.has(1) || s.has(maxAppliedSeqs+11) {
+		t.Fatalf("unexpected pruned set: floor %d, %d IDs", s.Floor, len(s.IDs))
+	}
+}
@@ -0,0 +1,372 @@
+package bisonbotkit
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/companyzero/bisonrelay/clientrpc/types"
+	"github.com/companyzero/bisonrelay/zkidentity"
+	"github.com/decred/dcrd/dcrutil/v4"
+	"github.com/vctt94/bisonbotkit/utils"
+)
+
+// tipPaymentRetention is how long completed and failed tip payments are kept
+// in the payments table.
+const tipPaymentRetention = 7 * 24 * time.Hour
+
+// TipPaymentRecord is the state of a tip sent with PayTip.
+type TipPaymentRecord struct {
+	ID   uint64 `json:"id"`
+	UID  string `json:"uid"`
+	Nick string `json:"nick,omitempty"`
+
+	// MAtoms is the amount of the tip in milli-atoms.
+	MAtoms      int64     `json:"matoms"`
+	MaxAttempts int32     `json:"maxattempts,omitempty"`
+	Status      TipStatus `json:"status"`
+
+	// Attempts is the number of payment attempts reported so far and
+	// Error the error of the last failed attempt.
+	Attempts int32  `json:"attempts,omitempty"`
+	Error    string `json:"error,omitempty"`
+
+	// LedgerID is the ID of the ledger entry of the tip, if a ledger is
+	// attached.
+	LedgerID uint64 `json:"ledgerid,omitempty"`
+
+	Created time.Time `json:"created"`
+	Updated time.Time `json:"updated"`
+}
+
+// Amount returns the amount of the tip, truncated to atoms.
+func (r TipPaymentRecord) Amount() dcrutil.Amount {
+	return dcrutil.Amount(r.MAtoms / 1000)
+}
+
+// final returns true if the payment completed or failed.
+func (r *TipPaymentRecord) final() bool {
+	return r.Status == TipCompleted || r.Status == TipFailed
+}
+
+// TipFailedError is the error of a tip payment that failed.
+type TipFailedError struct {
+	Attempts int32
+	Err      string
+}
+
+func (e *TipFailedError) Error() string {
+	if e.Err == "" {
+		return fmt.Sprintf("tip failed after %d attempts", e.Attempts)
+	}
+	return fmt.Sprintf("tip failed after %d attempts: %s", e.Attempts, e.Err)
+}
+
+// TipPayment tracks a tip sent with PayTip until it completes or fails.
+type TipPayment struct {
+	id   uint64
+	done chan struct{}
+
+	mtx sync.Mutex
+	rec TipPaymentRecord
+}
+
+// ID returns the ID of the payment, which can be used with Bot.TipPayment.
+func (p *TipPayment) ID() uint64 {
+	return p.id
+}
+
+// Done returns a channel closed once the tip completes or fails.
+func (p *TipPayment) Done() <-chan struct{} {
+	return p.done
+}
+
+// Status returns the current state of the payment.
+func (p *TipPayment) Status() TipPaymentRecord {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	return p.rec
+}
+
+// Err returns a *TipFailedError if the tip failed. It returns nil until Done
+// is closed.
+func (p *TipPayment) Err() error {
+	select {
+	case <-p.done:
+	default:
+		return nil
+	}
+	rec := p.Status()
+	if rec.Status != TipFailed {
+		return nil
+	}
+	return &TipFailedError{Attempts: rec.Attempts, Err: rec.Error}
+}
+
+// Wait blocks until the tip completes or fails and returns its error, or
+// until ctx is done.
+func (p *TipPayment) Wait(ctx context.Context) error {
+	select {
+	case <-p.done:
+		return p.Err()
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// update sets the state of the payment, closing Done when it is final.
+func (p *TipPayment) update(rec TipPaymentRecord) {
+	p.mtx.Lock()
+	p.rec = rec
+	p.mtx.Unlock()
+	if rec.final() {
+		select {
+		case <-p.done:
+		default:
+			close(p.done)
+		}
+	}
+}
+
+// tipPaymentsData is the persisted table of tip payments.
+type tipPaymentsData struct {
+	NextID   uint64              `json:"nextid"`
+	Payments []*TipPaymentRecord `json:"payments"`
+
+	// ProgressSeqs are the sequence IDs of the progress events applied,
+	// used to skip events delivered again after a restart.
+	ProgressSeqs appliedSeqs `json:"progressseqs"`
+}
+
+// tipPayments is the persisted table of the tips sent by the bot, updated by
+// the tip progress stream.
+type tipPayments struct {
+	path string
+
+	mtx     sync.Mutex
+	data    tipPaymentsData
+	handles map[uint64]*TipPayment
+}
+
+func newTipPayments(path string) (*tipPayments, error) {
+	t := &tipPayments{
+		path:    path,
+		data:    tipPaymentsData{NextID: 1},
+		handles: make(map[uint64]*TipPayment),
+	}
+	data, err := os.ReadFile(path)
+	switch {
+	case os.IsNotExist(err):
+	case err != nil:
+		return nil, err
+	default:
+		if err := json.Unmarshal(data, &t.data); err != nil {
+			return nil, err
+		}
+	}
+	return t, nil
+}
+
+// save writes d to disk, dropping old completed and failed payments, and then
+// makes it the table of payments, so changes that could not be persisted are
+// discarded. Records are shared with the current table, so they must be
+// replaced by copies before being changed. It must be called with the mutex
+// held.
+func (t *tipPayments) save(d tipPaymentsData) error {
+	limit := time.Now().Add(-tipPaymentRetention)
+	payments := make([]*TipPaymentRecord, 0, len(d.Payments))
+	var dropped []uint64
+	for _, rec := range d.Payments {
+		if rec.final() && rec.Updated.Before(limit) {
+			dropped = append(dropped, rec.ID)
+			continue
+		}
+		payments = append(payments, rec)
+	}
+	d.Payments = payments
+
+	data, err := json.MarshalIndent(&d, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := utils.AtomicWriteFile(t.path, data, 0600); err != nil {
+		return err
+	}
+	t.data = d
+	for _, id := range dropped {
+		delete(t.handles, id)
+	}
+	return nil
+}
+
+// set saves the table with rec replacing the record with the same ID.
+func (t *tipPayments) set(rec TipPaymentRecord) error {
+	d := t.data
+	d.Payments = append([]*TipPaymentRecord(nil), d.Payments...)
+	for i, r := range d.Payments {
+		if r.ID == rec.ID {
+			d.Payments[i] = &rec
+			break
+		}
+	}
+	return t.save(d)
+}
+
+// handle returns the handle of the payment, creating it if needed. It must be
+// called with the mutex held.
+func (t *tipPayments) handle(rec *TipPaymentRecord) *TipPayment {
+	h, ok := t.handles[rec.ID]
+	if !ok {
+		h = &TipPayment{id: rec.ID, done: make(chan struct{})}
+		t.handles[rec.ID] = h
+	}
+	h.update(*rec)
+	return h
+}
+
+// add records a new pending payment.
+func (t *tipPayments) add(uid zkidentity.ShortID, amt dcrutil.Amount, maxAttempts int32,
+	ledgerID uint64) (*TipPayment, error) {
+
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	now := time.Now()
+	d := t.data
+	rec := &TipPaymentRecord{
+		ID:          d.NextID,
+		UID:         uid.String(),
+		MAtoms:      int64(amt) * 1000,
+		MaxAttempts: maxAttempts,
+		Status:      TipPending,
+		LedgerID:    ledgerID,
+		Created:     now,
+		Updated:     now,
+	}
+	d.NextID++
+	d.Payments = append(d.Payments, rec)
+	if err := t.save(d); err != nil {
+		return nil, err
+	}
+	return t.handle(rec), nil
+}
+
+// get returns the payment with the given ID.
+func (t *tipPayments) get(id uint64) *TipPaymentRecord {
+	for _, rec := range t.data.Payments {
+		if rec.ID == id {
+			return rec
+		}
+	}
+	return nil
+}
+
+// setStatus sets the status and error of a payment whose request did not
+// go through: TipFailed if the tip was certainly not sent, TipUnknown if it
+// might have been. Payments already updated by a progress event are left
+// as they are.
+func (t *tipPayments) setStatus(id uint64, status TipStatus, err error) (TipPaymentRecord, error) {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	old := t.get(id)
+	if old == nil {
+		return TipPaymentRecord{}, fmt.Errorf("unknown tip payment %d", id)
+	}
+	if old.Status != TipPending {
+		return *old, nil
+	}
+	rec := *old
+	rec.Status = status
+	rec.Error = err.Error()
+	rec.Updated = time.Now()
+	if err := t.set(rec); err != nil {
+		return rec, err
+	}
+	t.handle(&rec)
+	return rec, nil
+}
+
+// progress applies a progress event to the payment it refers to. The
+// clientrpc events do not identify the tip request, so the event is matched
+// to the oldest open payment (including those in TipUnknown) to the same user
+// with the same amount. It returns nil if the event was already applied or
+// matched no payment.
+func (t *tipPayments) progress(ev *types.TipProgressEvent) (*TipPaymentRecord, error) {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	if t.data.ProgressSeqs.has(ev.SequenceId) {
+		return nil, nil
+	}
+	d := t.data
+	d.ProgressSeqs = d.ProgressSeqs.add(ev.SequenceId)
+
+	uid := hex.EncodeToString(ev.Uid)
+	idx := -1
+	for i, rec := range d.Payments {
+		if !rec.final() && rec.UID == uid && rec.MAtoms == ev.AmountMatoms {
+			idx = i
+			break
+		}
+	}
+	if idx < 0 {
+		// Events of other tips are not worth a write of the file and
+		// are only recorded with the next change.
+		t.data.ProgressSeqs = d.ProgressSeqs
+		return nil, nil
+	}
+
+	match := *d.Payments[idx]
+	if ev.Nick != "" {
+		match.Nick = ev.Nick
+	}
+	match.Attempts = ev.Attempt
+	match.Error = ev.AttemptErr
+	switch {
+	case ev.Completed:
+		match.Status = TipCompleted
+	case ev.WillRetry:
+		match.Status = TipRetrying
+	default:
+		match.Status = TipFailed
+	}
+	match.Updated = time.Now()
+	d.Payments = append([]*TipPaymentRecord(nil), d.Payments...)
+	d.Payments[idx] = &match
+	if err := t.save(d); err != nil {
+		return nil, err
+	}
+	t.handle(&match)
+	return &match, nil
+}
+
+// TipPayment returns the handle of a tip sent with PayTip, including tips
+// sent before the bot restarted. Completed and failed tips are kept for a
+// week.
+func (b *Bot) TipPayment(id uint64) (*TipPayment, bool) {
+	t := b.tipPayments
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	rec := t.get(id)
+	if rec == nil {
+		return nil, false
+	}
+	return t.handle(rec), true
+}
+
+// PendingTipPayments returns the tips sent with PayTip that have not
+// completed or failed yet, oldest first.
+func (b *Bot) PendingTipPayments() []TipPaymentRecord {
+	t := b.tipPayments
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	var res []TipPaymentRecord
+	for _, rec := range t.data.Payments {
+		if !rec.final() {
+			res = append(res, *rec)
+		}
+	}
+	return res
+}
@@ -0,0 +1,117 @@
+package bisonbotkit
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"testing"
+
+	"github.com/companyzero/bisonrelay/clientrpc/types"
+)
+
+func TestPayTipUnknown(t *testing.T) {
+	ctx := context.Background()
+	alice := testUID(1)
+	payments := &fakePayments{err: errors.New("conn lost")}
+	b := newTestBot(t, t.TempDir(), payments)
+
+	payment, err := b.PayTip(ctx, alice, 10, 3)
+	if err == nil || payment == nil {
+		t.Fatalf("got payment %v and error %v", payment, err)
+	}
+	if st := payment.Status().Status; st != TipUnknown {
+		t.Fatalf("got status %s, want %s", st, TipUnknown)
+	}
+	if n := len(b.PendingTipPayments()); n != 1 {
+		t.Fatalf("got %d pending payments, want 1", n)
+	}
+
+	// A progress event resolves it.
+	resolveTip(t, b, 1, alice, 10, true)
+	select {
+	case <-payment.Done():
+	default:
+		t.Fatal("payment not resolved")
+	}
+	if err := payment.Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Request errors do not override the outcome of progress events.
+	if _, err := b.tipPayments.setStatus(payment.ID(), TipUnknown, errors.New("late")); err != nil {
+		t.Fatal(err)
+	}
+	if st := payment.Status().Status; st != TipCompleted {
+		t.Fatalf("got status %s, want %s", st, TipCompleted)
+	}
+}
+
+func TestTipProgress(t *testing.T) {
+	ctx := context.Background()
+	alice, bob := testUID(1), testUID(2)
+	dir := t.TempDir()
+	b := newTestBot(t, dir, &fakePayments{})
+	first, err := b.PayTip(ctx, alice, 10, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := b.PayTip(ctx, alice, 10, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	third, err := b.PayTip(ctx, bob, 20, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The oldest matching payment is resolved first.
+	resolveTip(t, b, 5, alice, 10, true)
+	if first.Status().Status != TipCompleted || second.Status().Status != TipPending {
+		t.Fatalf("got %s and %s", first.Status().Status, second.Status().Status)
+	}
+
+	// Events of other tips, and events already applied, are ignored.
+	// Events of other tips do not rewrite the file.
+	before, err := os.ReadFile(b.tipPayments.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resolveTip(t, b, 6, bob, 10, true)
+	resolveTip(t, b, 5, alice, 10, false)
+	if st := second.Status().Status; st != TipPending {
+		t.Fatalf("got status %s, want %s", st, TipPending)
+	}
+	if after, _ := os.ReadFile(b.tipPayments.path); !bytes.Equal(after, before) {
+		t.Fatal("unmatched event rewrote the payments file")
+	}
+
+	// Events that cannot be saved are not applied.
+	restore := breakSaves(t, b.tipPayments.path)
+	ev := &types.TipProgressEvent{SequenceId: 7, Uid: alice[:], AmountMatoms: 10000, Completed: true}
+	if _, err := b.tipPayments.progress(ev); err == nil {
+		t.Fatal("progress did not fail")
+	}
+	if st := second.Status().Status; st != TipPending || b.tipPayments.data.ProgressSeqs.has(7) {
+		t.Fatalf("failed event applied: %s", st)
+	}
+	restore()
+
+	// The event is applied once delivered again, after a later event and
+	// a restart.
+	resolveTip(t, b, 8, bob, 20, true)
+	if st := third.Status().Status; st != TipCompleted {
+		t.Fatalf("got status %s, want %s", st, TipCompleted)
+	}
+	b = newTestBot(t, dir, &fakePayments{})
+	rec, err := b.tipPayments.progress(ev)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rec == nil || rec.ID != second.ID() || rec.Status != TipCompleted {
+		t.Fatalf("unexpected record %+v", rec)
+	}
+	if n := len(b.PendingTipPayments()); n != 0 {
+		t.Fatalf("got %d pending payments, want 0", n)
+	}
+}
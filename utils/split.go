@@ -0,0 +1,208 @@
+package utils
+
+import (
+	"strings"
+	"unicode/utf8"
+)
+
+const codeFence = "```"
+
+// splitBlock is a paragraph or a fenced code block of a message.
+type splitBlock struct {
+	text string
+	code bool
+}
+
+// messageBlocks splits msg into paragraphs (separated by blank lines) and
+// fenced code blocks, which are kept whole.
+func messageBlocks(msg string) []splitBlock {
+	var blocks []splitBlock
+	var cur []string
+	inCode := false
+	flush := func(code bool) {
+		if len(cur) > 0 {
+			blocks = append(blocks, splitBlock{text: strings.Join(cur, "\n"), code: code})
+			cur = nil
+		}
+	}
+	for _, line := range strings.Split(msg, "\n") {
+		isFence := strings.HasPrefix(strings.TrimSpace(line), codeFence)
+		switch {
+		case inCode:
+			cur = append(cur, line)
+			if isFence {
+				flush(true)
+				inCode = false
+			}
+		case isFence:
+			flush(false)
+			cur = append(cur, line)
+			inCode = true
+		case strings.TrimSpace(line) == "":
+			flush(false)
+		default:
+			cur = append(cur, line)
+		}
+	}
+	flush(inCode)
+	return blocks
+}
+
+// runeCut returns the length of the longest prefix of s, of at most maxLen
+// bytes, that does not break an UTF-8 sequence. s must be longer than maxLen.
+func runeCut(s string, maxLen int) int {
+	i := maxLen
+	for i > 0 && !utf8.RuneStart(s[i]) {
+		i--
+	}
+	if i == 0 {
+		i = maxLen
+	}
+	return i
+}
+
+// hardSplit splits s into chunks of at most maxLen bytes without breaking
+// UTF-8 sequences.
+func hardSplit(s string, maxLen int) []string {
+	var res []string
+	for len(s) > maxLen {
+		i := runeCut(s, maxLen)
+		res = append(res, s[:i])
+		s = s[i:]
+	}
+	return append(res, s)
+}
+
+// splitLine splits a line into chunks of at most maxLen bytes, breaking each
+// one after its last space or tab, or inside a word when it has none. Unlike
+// splitting on fields, the indentation and runs of spaces are kept.
+func splitLine(s string, maxLen int) []string {
+	var res []string
+	for len(s) > maxLen {
+		i := strings.LastIndexAny(s[:maxLen], " \t") + 1
+		if i == 0 {
+			i = runeCut(s, maxLen)
+		}
+		res = append(res, s[:i])
+		s = s[i:]
+	}
+	return append(res, s)
+}
+
+// pack greedily joins pieces with sep into chunks of at most maxLen bytes.
+// Pieces longer than maxLen are split with splitPiece.
+func pack(pieces []string, sep string, maxLen int, splitPiece func(string) []string) []string {
+	var res []string
+	var cur string
+	for _, p := range pieces {
+		if len(p) > maxLen {
+			if cur != "" {
+				res = append(res, cur)
+				cur = ""
+			}
+			sub := splitPiece(p)
+			if len(sub) == 0 {
+				continue
+			}
+			res = append(res, sub[:len(sub)-1]...)
+			cur = sub[len(sub)-1]
+			continue
+		}
+		switch {
+		case cur == "":
+			cur = p
+		case len(cur)+len(sep)+len(p) <= maxLen:
+			cur += sep + p
+		default:
+			res = append(res, cur)
+			cur = p
+		}
+	}
+	if cur != "" {
+		res = append(res, cur)
+	}
+	return res
+}
+
+// splitText splits plain text on line boundaries, then on word boundaries.
+func splitText(s string, maxLen int) []string {
+	return pack(strings.Split(s, "\n"), "\n", maxLen, func(line string) []string {
+		return splitLine(line, maxLen)
+	})
+}
+
+// splitCode splits a fenced code block that does not fit in maxLen on line
+// boundaries, closing and reopening the fence in every chunk.
+func splitCode(s string, maxLen int) []string {
+	lines := strings.Split(s, "\n")
+	open := lines[0]
+	lines = lines[1:]
+	if len(lines) > 0 && strings.HasPrefix(strings.TrimSpace(lines[len(lines)-1]), codeFence) {
+		lines = lines[:len(lines)-1]
+	}
+
+	inner := maxLen - len(open) - len(codeFence) - 2
+	if inner <= 0 {
+		return splitText(s, maxLen)
+	}
+	chunks := pack(lines, "\n", inner, func(line string) []string {
+		return hardSplit(line, inner)
+	})
+	for i, c := range chunks {
+		chunks[i] = open + "\n" + c + "\n" + codeFence
+	}
+	return chunks
+}
+
+// SplitMessage splits msg into parts of at most maxLen bytes. It splits on
+// paragraph boundaries when possible, then on line and word boundaries.
+// Fenced code blocks are kept intact unless a single block does not fit in a
+// part, in which case it is split by lines and every part is fenced.
+func SplitMessage(msg string, maxLen int) []string {
+	if maxLen <= 0 || len(msg) <= maxLen {
+		return []string{msg}
+	}
+
+	// Pieces of the same paragraph are joined back with a newline, and
+	// different paragraphs with a blank line.
+	type piece struct {
+		text, sep string
+	}
+	var pieces []piece
+	for _, b := range messageBlocks(msg) {
+		var sub []string
+		switch {
+		case len(b.text) <= maxLen:
+			sub = []string{b.text}
+		case b.code:
+			sub = splitCode(b.text, maxLen)
+		default:
+			sub = splitText(b.text, maxLen)
+		}
+		for i, text := range sub {
+			sep := "\n\n"
+			if i > 0 {
+				sep = "\n"
+			}
+			pieces = append(pieces, piece{text: text, sep: sep})
+		}
+	}
+
+	var res []string
+	var cur string
+	for _, p := range pieces {
+		switch {
+		case cur == "":
+			cur = p.text
+		case len(cur)+len(p.sep)+len(p.text) <= maxLen:
+			cur += p.sep + p.text
+		default:
+			res = append(res, cur)
+			cur = p.text
+		}
+	}
+	if cur != "" {
+		res = append(res, cur)
+	}
+	return res
+}
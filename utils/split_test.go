@@ -0,0 +1,115 @@
+package utils
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestSplitMessage(t *testing.T) {
+	tests := []struct {
+		name   string
+		msg    string
+		maxLen int
+		want   []string
+	}{{
+		name:   "fits",
+		msg:    "hello\n\nworld",
+		maxLen: 20,
+		want:   []string{"hello\n\nworld"},
+	}, {
+		name:   "no limit",
+		msg:    strings.Repeat("a", 100),
+		maxLen: 0,
+		want:   []string{strings.Repeat("a", 100)},
+	}, {
+		name:   "paragraphs",
+		msg:    "first one\n\nsecond one\n\nthird",
+		maxLen: 22,
+		want:   []string{"first one\n\nsecond one", "third"},
+	}, {
+		name:   "lines then words",
+		msg:    "aaa bbb\nccc ddd eee",
+		maxLen: 8,
+		want:   []string{"aaa bbb", "ccc ddd ", "eee"},
+	}, {
+		name:   "spaces kept",
+		msg:    "    a  b  c  d",
+		maxLen: 8,
+		want:   []string{"    a  ", "b  c  d"},
+	}, {
+		name:   "word after spaces",
+		msg:    "ab\tcdefghij",
+		maxLen: 4,
+		want:   []string{"ab\t", "cdef", "ghij"},
+	}, {
+		name:   "long word",
+		msg:    "abcdefghij",
+		maxLen: 4,
+		want:   []string{"abcd", "efgh", "ij"},
+	}, {
+		name:   "code block kept whole",
+		msg:    "intro\n\n```\na\n\nb\n```\n\noutro",
+		maxLen: 16,
+		want:   []string{"intro", "```\na\n\nb\n```", "outro"},
+	}, {
+		name:   "code block split and refenced",
+		msg:    "```go\nline1\nline2\nline3\n```",
+		maxLen: 24,
+		want:   []string{"```go\nline1\nline2\n```", "```go\nline3\n```"},
+	}, {
+		name:   "unclosed code block",
+		msg:    "text\n\n```\ncode",
+		maxLen: 8,
+		want:   []string{"text", "```\ncode"},
+	}}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			got := SplitMessage(tc.msg, tc.maxLen)
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Fatalf("got %q, want %q", got, tc.want)
+			}
+			for _, part := range got {
+				if tc.maxLen > 0 && len(part) > tc.maxLen {
+					t.Fatalf("part %q longer than %d", part, tc.maxLen)
+				}
+			}
+		})
+	}
+}
+
+func TestSplitMessageUTF8(t *testing.T) {
+	msg := strings.Repeat("é", 10)
+	for _, part := range SplitMessage(msg, 5) {
+		if len(part) > 5 || !utf8.ValidString(part) {
+			t.Fatalf("invalid part %q", part)
+		}
+	}
+}
+
+func TestSplitMessageCodeFences(t *testing.T) {
+	var b strings.Builder
+	b.WriteString("```\n")
+	for i := 0; i < 50; i++ {
+		b.WriteString("fmt.Println(i)\n")
+	}
+	b.WriteString("```")
+	parts := SplitMessage(b.String(), 100)
+	if len(parts) < 2 {
+		t.Fatalf("code block was not split: %q", parts)
+	}
+	lines := 0
+	for _, part := range parts {
+		if len(part) > 100 {
+			t.Fatalf("part longer than 100: %q", part)
+		}
+		if !strings.HasPrefix(part, "```\n") || !strings.HasSuffix(part, "\n```") {
+			t.Fatalf("part is not fenced: %q", part)
+		}
+		lines += strings.Count(part, "fmt.Println(i)")
+	}
+	if lines != 50 {
+		t.Fatalf("got %d code lines, want 50", lines)
+	}
+}
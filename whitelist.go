@@ -0,0 +1,170 @@
+package bisonbotkit
+
+import (
+	"context"
+	"encoding/json"
+	"sort"
+	"time"
+
+	"github.com/companyzero/bisonrelay/zkidentity"
+	"github.com/decred/slog"
+	"github.com/vctt94/bisonbotkit/config"
+	"github.com/vctt94/bisonbotkit/utils"
+)
+
+// The whitelist is stored in whitelist.json inside the data dir as a JSON
+// object that maps user IDs to the unix timestamp (in seconds) at which the
+// user stops being whitelisted. A value of zero means the entry never
+// expires.
+
+// whitelistReplyInterval is the minimum time between two replies to the same
+// non-whitelisted user in WhitelistModeReply.
+const whitelistReplyInterval = time.Hour
+
+// WhitelistEntry is a user in the bot's whitelist.
+type WhitelistEntry struct {
+	UID zkidentity.ShortID
+
+	// Expires is the time after which the user is no longer whitelisted.
+	// It is the zero time for entries that never expire.
+	Expires time.Time
+}
+
+// IsWhitelisted returns true if the user is in the whitelist and the entry
+// has not expired.
+func (b *Bot) IsWhitelisted(uid zkidentity.ShortID) bool {
+	b.wlMtx.Lock()
+	defer b.wlMtx.Unlock()
+
+	expires, ok := b.wl[uid.String()]
+	if !ok {
+		return false
+	}
+	return expires == 0 || time.Now().Unix() < expires
+}
+
+// Whitelist returns the entries of the whitelist, including expired ones.
+func (b *Bot) Whitelist() []WhitelistEntry {
+	b.wlMtx.Lock()
+	res := make([]WhitelistEntry, 0, len(b.wl))
+	for id, expires := range b.wl {
+		var e WhitelistEntry
+		if err := e.UID.FromString(id); err != nil {
+			continue
+		}
+		if expires != 0 {
+			e.Expires = time.Unix(expires, 0)
+		}
+		res = append(res, e)
+	}
+	b.wlMtx.Unlock()
+
+	sort.Slice(res, func(i, j int) bool { return res[i].UID.Less(&res[j].UID) })
+	return res
+}
+
+// AddToWhitelist adds the user to the whitelist, or updates its expiry time
+// if it is already there. A zero expires time means the entry never expires.
+// The whitelist is persisted before returning.
+func (b *Bot) AddToWhitelist(uid zkidentity.ShortID, expires time.Time) error {
+	var v int64
+	if !expires.IsZero() {
+		v = expires.Unix()
+	}
+
+	b.wlMtx.Lock()
+	defer b.wlMtx.Unlock()
+
+	id := uid.String()
+	old, hadOld := b.wl[id]
+	b.wl[id] = v
+	if err := b.saveWhitelist(); err != nil {
+		if hadOld {
+			b.wl[id] = old
+		} else {
+			delete(b.wl, id)
+		}
+		return err
+	}
+	return nil
+}
+
+// RemoveFromWhitelist removes the user from the whitelist. The whitelist is
+// persisted before returning.
+func (b *Bot) RemoveFromWhitelist(uid zkidentity.ShortID) error {
+	b.wlMtx.Lock()
+	defer b.wlMtx.Unlock()
+
+	id := uid.String()
+	old, ok := b.wl[id]
+	if !ok {
+		return nil
+	}
+	delete(b.wl, id)
+	if err := b.saveWhitelist(); err != nil {
+		b.wl[id] = old
+		return err
+	}
+	return nil
+}
+
+// saveWhitelist writes the whitelist to disk. It must be called with wlMtx
+// held.
+func (b *Bot) saveWhitelist() error {
+	data, err := json.MarshalIndent(b.wl, "", "  ")
+	if err != nil {
+		return err
+	}
+	return utils.AtomicWriteFile(b.wlFile, data, 0600)
+}
+
+// senderAllowed returns whether a message from the given user should be
+// delivered according to the configured whitelist mode. When the mode
+// requires it, users that are not allowed are sent the configured reply, at
+// most once per whitelistReplyInterval and only for PMs, so that GC members
+// are not spammed.
+func (b *Bot) senderAllowed(ctx context.Context, rawUID []byte, isPM bool, log slog.Logger) bool {
+	mode := b.cfg.WhitelistMode
+	if mode != config.WhitelistModeDrop && mode != config.WhitelistModeReply {
+		return true
+	}
+
+	var uid zkidentity.ShortID
+	if err := uid.FromBytes(rawUID); err != nil {
+		log.Warnf("Dropping msg with invalid sender id: %v", err)
+		return false
+	}
+	if b.IsWhitelisted(uid) {
+		return true
+	}
+
+	log.Debugf("Dropping msg from non-whitelisted user %s", uid)
+	if mode == config.WhitelistModeReply && b.cfg.WhitelistReply != "" &&
+		isPM && b.shouldReplyNotWhitelisted(uid) {
+		// The reply is queued so that it does not stall the stream.
+		b.QueuePM(ctx, uid.String(), b.cfg.WhitelistReply, OnFailure(func(err error) {
+			log.Warnf("Failed to reply to non-whitelisted user %s: %v", uid, err)
+		}))
+	}
+	return false
+}
+
+// shouldReplyNotWhitelisted returns true if the user was not replied to in
+// the last whitelistReplyInterval, recording the reply.
+func (b *Bot) shouldReplyNotWhitelisted(uid zkidentity.ShortID) bool {
+	b.wlMtx.Lock()
+	defer b.wlMtx.Unlock()
+
+	now := time.Now()
+	id := uid.String()
+	if last, ok := b.wlReplied[id]; ok && now.Sub(last) < whitelistReplyInterval {
+		return false
+	}
+	for other, last := range b.wlReplied {
+		if now.Sub(last) >= whitelistReplyInterval {
+			delete(b.wlReplied, other)
+		}
+	}
+	b.wlReplied[id] = now
+	return true
+}